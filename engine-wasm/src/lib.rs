@@ -1,7 +1,9 @@
 use engine::{Rng, Scene};
 use rand::SeedableRng;
 use serde::{Deserialize, Serialize};
+use std::fmt;
 use std::str::FromStr;
+use std::sync::atomic::AtomicBool;
 use strum::IntoEnumIterator;
 use wasm_bindgen::prelude::*;
 use wasm_bindgen::JsCast;
@@ -104,7 +106,9 @@ pub fn get_all_scenes() -> RenderParamsArray {
     let params: Vec<RenderParams> = ALL_SUPPORTED_SCENES
         .iter()
         .map(|scene| {
-            let (params, _, _) = scene.load(&mut Rng::seed_from_u64(BASE_SEED));
+            let (params, _, _) = scene
+                .load(&mut Rng::seed_from_u64(BASE_SEED))
+                .expect("built-in scene failed to load");
             RenderParams {
                 scene_name: scene.to_string(),
                 width: params.width,
@@ -119,30 +123,47 @@ pub fn get_all_scenes() -> RenderParamsArray {
         .unchecked_into::<RenderParamsArray>()
 }
 
+// Errors are thrown as exceptions in JavaScript.
 #[wasm_bindgen]
-pub fn render(params: RenderParams) -> RenderResult {
-    let scene = Scene::from_str(&params.scene_name).expect("no such scene");
-    let (_, camera, world) = scene.load(&mut Rng::seed_from_u64(BASE_SEED));
+pub fn render(params: RenderParams) -> Result<RenderResult, JsValue> {
+    let scene = Scene::from_str(&params.scene_name)
+        .map_err(|_| JsValue::from_str(&format!("Unknown scene: {}", params.scene_name)))?;
+    let (scene_params, camera, world) = scene
+        .load(&mut Rng::seed_from_u64(BASE_SEED))
+        .map_err(error_to_js)?;
 
     let params = engine::RenderParams {
         width: params.width,
         height: params.height,
         samples_per_pixel: params.samples_per_pixel,
         importance_sampling: params.importance_sampling,
+        ..scene_params
     };
 
     let mut buf: Vec<u8> = vec![];
-    let mut rngs: Vec<Rng> = (0..params.samples_per_pixel)
-        .map(|i| Rng::seed_from_u64(BASE_SEED + i as u64))
-        .collect();
-
-    engine::render(&mut buf, &camera, &world, &params, &mut rngs).expect("render failed");
+    let mut frame = engine::Frame::new(params.width, params.height);
+    engine::render(
+        &camera,
+        &world,
+        &params,
+        &mut frame,
+        &AtomicBool::new(false),
+        &mut |_| {},
+    )
+    .map_err(error_to_js)?;
+    frame
+        .write_rgb(&engine::DisplayParams::DEFAULT, &mut buf)
+        .map_err(error_to_js)?;
 
-    RenderResult {
+    Ok(RenderResult {
         width: params.width,
         height: params.height,
         buf,
-    }
+    })
+}
+
+fn error_to_js(err: impl fmt::Display) -> JsValue {
+    JsValue::from_str(&format!("{:#}", err))
 }
 
 #[wasm_bindgen]
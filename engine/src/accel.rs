@@ -0,0 +1,149 @@
+use crate::binary::{read_u8, write_u8};
+use crate::bvh::Bvh;
+use crate::geom::{Box3, Vec3};
+use crate::kdtree::KdTree;
+use crate::ray::{Ray, RayBatch};
+use crate::sampler::Sampler;
+use crate::shape::{Hit, Shape};
+use crate::time::TimeRange;
+use serde::{Deserialize, Serialize};
+use std::io::{self, Read, Write};
+use strum_macros::{Display, EnumIter, EnumString};
+
+// Acceleration structures to find shapes hit by rays. Which one is faster
+// depends on scenes.
+#[derive(Copy, Clone, Debug, Deserialize, Display, EnumIter, EnumString, PartialEq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AcceleratorKind {
+    #[strum(serialize = "bvh")]
+    Bvh,
+    #[strum(serialize = "kd_tree")]
+    KdTree,
+}
+
+impl Default for AcceleratorKind {
+    fn default() -> Self {
+        AcceleratorKind::Bvh
+    }
+}
+
+#[derive(Clone, Debug)]
+pub enum Accelerator<S: Shape> {
+    Bvh(Bvh<S>),
+    KdTree(KdTree<S>),
+}
+
+impl<S: Shape> Shape for Accelerator<S> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.hit(ray, t_min, t_max),
+            Accelerator::KdTree(kdtree) => kdtree.hit(ray, t_min, t_max),
+        }
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.bounding_box(time),
+            Accelerator::KdTree(kdtree) => kdtree.bounding_box(time),
+        }
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.sampler(from, time),
+            Accelerator::KdTree(kdtree) => kdtree.sampler(from, time),
+        }
+    }
+
+    fn is_empty(&self) -> bool {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.is_empty(),
+            Accelerator::KdTree(kdtree) => kdtree.is_empty(),
+        }
+    }
+}
+
+impl<S: Shape> Accelerator<S> {
+    pub fn new(
+        kind: AcceleratorKind,
+        shapes: impl IntoIterator<Item = S>,
+        time: TimeRange,
+    ) -> Self {
+        match kind {
+            AcceleratorKind::Bvh => Accelerator::Bvh(Bvh::new(shapes, time)),
+            AcceleratorKind::KdTree => Accelerator::KdTree(KdTree::new(shapes, time)),
+        }
+    }
+
+    pub fn kind(&self) -> AcceleratorKind {
+        match self {
+            Accelerator::Bvh(_) => AcceleratorKind::Bvh,
+            Accelerator::KdTree(_) => AcceleratorKind::KdTree,
+        }
+    }
+
+    // Writes the structure preceded by its kind.
+    pub fn save(&self, writer: &mut impl Write, shape_index: impl Fn(&S) -> u64) -> io::Result<()> {
+        match self {
+            Accelerator::Bvh(bvh) => {
+                write_u8(writer, 0)?;
+                bvh.save(writer, shape_index)
+            }
+            Accelerator::KdTree(kdtree) => {
+                write_u8(writer, 1)?;
+                kdtree.save(writer, shape_index)
+            }
+        }
+    }
+
+    pub fn load(reader: &mut impl Read, shape: impl Fn(u64) -> Option<S>) -> io::Result<Self> {
+        match read_u8(reader)? {
+            0 => Ok(Accelerator::Bvh(Bvh::load(reader, shape)?)),
+            1 => Ok(Accelerator::KdTree(KdTree::load(reader, shape)?)),
+            _ => Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                "Unknown acceleration structure",
+            )),
+        }
+    }
+
+    pub fn hit_shape(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<(Hit, &S)> {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.hit_shape(ray, t_min, t_max),
+            Accelerator::KdTree(kdtree) => kdtree.hit_shape(ray, t_min, t_max),
+        }
+    }
+
+    pub fn hit_shape_with(
+        &self,
+        ray: &Ray,
+        t_min: f64,
+        t_max: f64,
+        hit: impl Fn(&S, &Ray, f64, f64) -> Option<Hit>,
+    ) -> Option<(Hit, &S)> {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.hit_shape_with(ray, t_min, t_max, hit),
+            Accelerator::KdTree(kdtree) => kdtree.hit_shape_with(ray, t_min, t_max, hit),
+        }
+    }
+
+    pub fn hit_batch(&self, batch: &RayBatch, t_min: f64, t_max: &[f64]) -> Vec<Option<(Hit, &S)>> {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.hit_batch(batch, t_min, t_max),
+            Accelerator::KdTree(kdtree) => kdtree.hit_batch(batch, t_min, t_max),
+        }
+    }
+
+    pub fn hit_batch_with(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: &[f64],
+        hit: impl Fn(&S, &Ray, f64, f64) -> Option<Hit>,
+    ) -> Vec<Option<(Hit, &S)>> {
+        match self {
+            Accelerator::Bvh(bvh) => bvh.hit_batch_with(batch, t_min, t_max, hit),
+            Accelerator::KdTree(kdtree) => kdtree.hit_batch_with(batch, t_min, t_max, hit),
+        }
+    }
+}
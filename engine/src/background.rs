@@ -1,20 +1,241 @@
 use crate::color::Color;
+use crate::environment::{EnvironmentLight, EnvironmentMap};
+use crate::geom::{IntoVec3, Vec3, Vec3Unit};
 use crate::ray::Ray;
+use crate::shape::{Shape, EMPTY_SHAPE};
+use crate::sky::SkyModel;
+use anyhow::{bail, Context, Result};
+use std::sync::Arc;
 
+// Light from directions rays leave the world to.
+pub trait Background: Sync + Send {
+    fn color(&self, ray: &Ray) -> Color;
+
+    // Returns the shape to sample as a light, which is empty unless the
+    // background has bright spots worth sampling.
+    fn important_shape(&self) -> Box<dyn Shape> {
+        Box::new(EMPTY_SHAPE)
+    }
+
+    // Calls the method of the visitor for the background with its parameters,
+    // or none if the background cannot be described.
+    fn describe(&self, _visitor: &mut dyn BackgroundVisitor) {}
+}
+
+// Visits backgrounds by their parameters, like ShapeVisitor.
+pub trait BackgroundVisitor {
+    fn sky(&mut self);
+    fn solid(&mut self, color: Color);
+    fn gradient(&mut self, bottom: Color, top: Color);
+    fn daylight(&mut self, sun: Vec3Unit);
+    fn physical(&mut self, sky: &SkyModel);
+    fn environment(&mut self, map: &EnvironmentMap);
+}
+
+impl Background for Arc<dyn Background> {
+    fn color(&self, ray: &Ray) -> Color {
+        self.as_ref().color(ray)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        self.as_ref().important_shape()
+    }
+
+    fn describe(&self, visitor: &mut dyn BackgroundVisitor) {
+        self.as_ref().describe(visitor)
+    }
+}
+
+// Blends white to light blue from bottom to top, as in the books.
+#[derive(Clone, Copy, Debug)]
+pub struct Sky;
+
+impl Background for Sky {
+    fn color(&self, ray: &Ray) -> Color {
+        let t = 0.5 * (ray.dir.y + 1.0);
+        (1.0 - t) * Color::WHITE + t * Color::new(0.5, 0.7, 1.0)
+    }
+
+    fn describe(&self, visitor: &mut dyn BackgroundVisitor) {
+        visitor.sky();
+    }
+}
+
+// The same color in all directions.
+#[derive(Clone, Copy, Debug)]
+pub struct Solid(pub Color);
+
+impl Solid {
+    pub const BLACK: Solid = Solid(Color::BLACK);
+}
+
+impl Background for Solid {
+    fn color(&self, _ray: &Ray) -> Color {
+        self.0
+    }
+
+    fn describe(&self, visitor: &mut dyn BackgroundVisitor) {
+        visitor.solid(self.0);
+    }
+}
+
+// Blends from bottom to top by the height of the direction, as Sky does.
+#[derive(Clone, Copy, Debug)]
+pub struct Gradient {
+    pub bottom: Color,
+    pub top: Color,
+}
+
+impl Background for Gradient {
+    fn color(&self, ray: &Ray) -> Color {
+        let t = 0.5 * (ray.dir.y + 1.0);
+        (1.0 - t) * self.bottom + t * self.top
+    }
+
+    fn describe(&self, visitor: &mut dyn BackgroundVisitor) {
+        visitor.gradient(self.bottom, self.top);
+    }
+}
+
+// Blue sky with the sun in the direction, over a gray ground.
 #[derive(Clone, Copy, Debug)]
-pub enum Background {
-    SKY,
-    BLACK,
+pub struct Daylight {
+    pub sun: Vec3Unit,
+}
+
+impl Background for Daylight {
+    fn color(&self, ray: &Ray) -> Color {
+        // The sun is drawn larger and dimmer than the real one so that it
+        // converges without being sampled directly.
+        const SUN_COS: f64 = 0.9994;
+        if ray.dir.dot(self.sun) > SUN_COS {
+            return Color::new(1.0, 0.95, 0.85) * 50.0;
+        }
+        let y = ray.dir.y;
+        if y < 0.0 {
+            return Color::new(0.3, 0.3, 0.3);
+        }
+        // Whiter near the horizon and around the sun.
+        let haze = (1.0 - y).powi(4);
+        let glow = ray.dir.dot(self.sun).max(0.0).powi(64);
+        (1.0 - haze) * Color::new(0.3, 0.5, 0.9)
+            + haze * Color::new(0.8, 0.85, 0.9)
+            + glow * Color::new(1.0, 0.9, 0.7)
+    }
+
+    fn describe(&self, visitor: &mut dyn BackgroundVisitor) {
+        visitor.daylight(self.sun);
+    }
+}
+
+// Preetham analytic sky.
+impl Background for SkyModel {
+    fn color(&self, ray: &Ray) -> Color {
+        SkyModel::color(self, ray.dir)
+    }
+
+    fn describe(&self, visitor: &mut dyn BackgroundVisitor) {
+        visitor.physical(self);
+    }
+}
+
+// Equirectangular HDR image around the scene, sampled as a light.
+#[derive(Clone, Debug)]
+pub struct Environment(pub Arc<EnvironmentMap>);
+
+impl Background for Environment {
+    fn color(&self, ray: &Ray) -> Color {
+        self.0.color(ray.dir)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        Box::new(EnvironmentLight::new(Arc::clone(&self.0)))
+    }
+
+    fn describe(&self, visitor: &mut dyn BackgroundVisitor) {
+        visitor.environment(&self.0);
+    }
 }
 
-impl Background {
-    pub fn color(self, ray: &Ray) -> Color {
-        match self {
-            Background::SKY => {
-                let t = 0.5 * (ray.dir.y + 1.0);
-                (1.0 - t) * Color::WHITE + t * Color::new(0.5, 0.7, 1.0)
+// Parses "sky", "black", "daylight", "daylight:x,y,z" (sun direction),
+// "r,g,b", "gradient:r,g,b:r,g,b" (bottom and top),
+// "physical:elevation,azimuth,turbidity" (degrees) and "hdri:path" (loads the
+// file).
+pub fn parse_background(s: &str) -> Result<Arc<dyn Background>> {
+    fn triple(s: &str) -> Result<[f64; 3]> {
+        let values = s
+            .split(',')
+            .map(|s| s.trim().parse::<f64>())
+            .collect::<Result<Vec<_>, _>>()
+            .with_context(|| format!("Invalid triple: {}", s))?;
+        if values.len() != 3 {
+            bail!("Invalid triple: {}", s);
+        }
+        Ok([values[0], values[1], values[2]])
+    }
+    fn color(s: &str) -> Result<Color> {
+        let [r, g, b] = triple(s)?;
+        if !(r >= 0.0 && g >= 0.0 && b >= 0.0) {
+            bail!("Invalid color: {}", s);
+        }
+        Ok(Color::new(r, g, b))
+    }
+
+    if let Some(path) = s.strip_prefix("hdri:") {
+        let map = EnvironmentMap::load(path).with_context(|| format!("Failed to load {}", path))?;
+        return Ok(Arc::new(Environment(Arc::new(map))));
+    }
+    let mut parts = s.split(':');
+    let kind = parts.next().unwrap_or_default();
+    let args: Vec<&str> = parts.collect();
+    Ok(match (kind, args.as_slice()) {
+        ("sky", []) => Arc::new(Sky),
+        ("black", []) => Arc::new(Solid::BLACK),
+        ("daylight", []) => Arc::new(Daylight {
+            sun: Vec3::new(1.0, 1.0, 1.0).unit(),
+        }),
+        ("daylight", [sun]) => {
+            let [x, y, z] = triple(sun)?;
+            let sun = Vec3::new(x, y, z);
+            if !(sun.norm() > 0.0) {
+                bail!("Invalid sun direction: {}", s);
             }
-            Background::BLACK => Color::BLACK,
+            Arc::new(Daylight { sun: sun.unit() })
         }
+        ("physical", [args]) => {
+            let [elevation, azimuth, turbidity] = triple(args)?;
+            Arc::new(SkyModel::new(elevation, azimuth, turbidity)?)
+        }
+        ("gradient", [bottom, top]) => Arc::new(Gradient {
+            bottom: color(bottom)?,
+            top: color(top)?,
+        }),
+        (_, []) if kind.contains(',') => Arc::new(Solid(color(kind)?)),
+        _ => bail!("Unknown background: {}", s),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_background() {
+        let up = Ray::new(Vec3::ZERO, Vec3Unit::Y, 0.0);
+        let down = Ray::new(Vec3::ZERO, -Vec3Unit::Y, 0.0);
+        let bg = parse_background("0.5,0.25,0").unwrap();
+        assert_eq!(bg.color(&up).r, 0.5);
+        let bg = parse_background("gradient:1,1,1:0,0,1").unwrap();
+        assert_eq!(bg.color(&up).r, 0.0);
+        assert_eq!(bg.color(&down).r, 1.0);
+        let bg = parse_background("daylight:0,1,0").unwrap();
+        assert!(bg.color(&up).g > 10.0);
+        assert!(parse_background("sky").is_ok());
+        assert!(parse_background("physical:30,90,3").is_ok());
+        assert!(parse_background("physical:30,90,20").is_err());
+        assert!(parse_background("gradient:1,1,1").is_err());
+        assert!(parse_background("1,1").is_err());
+        assert!(parse_background("daylight:0,0,0").is_err());
+        assert!(parse_background("white").is_err());
     }
 }
@@ -0,0 +1,170 @@
+// Benchmarks of the hot path, so that optimizations can be measured and
+// regressions caught. They are ignored by default, and should be run in
+// release builds:
+//
+//   cargo test --release -p engine bench_ -- --ignored --nocapture --test-threads=1
+
+use crate::bvh::Bvh;
+use crate::color::Color;
+use crate::frame::Frame;
+use crate::geom::{IntoVec3, Vec3, Vec3Unit};
+use crate::material::{Dielectric, Lambertian, Material, Metal};
+use crate::ray::Ray;
+use crate::renderer::{render, RenderParams};
+use crate::rng::{Generator, Rng, Xoshiro256PlusPlus};
+use crate::sampler::Sampler;
+use crate::scene::SceneRegistry;
+use crate::shape::{Hit, Shape, Sphere};
+use crate::texture::SolidColor;
+use crate::time::TimeRange;
+use itertools::Itertools;
+use rand::{Rng as _, SeedableRng};
+use std::sync::atomic::AtomicBool;
+use std::time::{Duration, Instant};
+
+// Runs the function repeatedly for about a second and prints the time per
+// iteration. The function returns a number derived from its results, which is
+// printed too so that the work is not optimized away.
+fn bench(name: &str, mut f: impl FnMut() -> f64) {
+    let mut checksum = f();
+    let mut iterations = 0;
+    let start = Instant::now();
+    while start.elapsed() < Duration::from_secs(1) {
+        checksum += f();
+        iterations += 1;
+    }
+    eprintln!(
+        "{}: {:?}/iter ({} iterations, checksum {})",
+        name,
+        start.elapsed() / iterations,
+        iterations,
+        checksum
+    );
+}
+
+// Rays from around the origin toward the unit cube.
+fn random_rays(n: usize, rng: &mut Rng) -> Vec<Ray> {
+    (0..n)
+        .map(|_| {
+            let origin = Vec3::new(0.5, 0.5, -3.0) + Vec3::random_in_unit_sphere(rng);
+            let target = Vec3::new(rng.gen(), rng.gen(), rng.gen());
+            Ray::new(origin, (target - origin).unit(), 0.0)
+        })
+        .collect()
+}
+
+fn hit_distances(shape: &dyn Shape, rays: &[Ray]) -> f64 {
+    rays.iter()
+        .filter_map(|ray| shape.hit(ray, 1e-8, f64::INFINITY))
+        .map(|hit| hit.t)
+        .sum()
+}
+
+#[test]
+#[ignore]
+fn bench_rng() {
+    fn bench_generator<G: Generator>(name: &str) {
+        let mut rng = G::for_pixel(28, 0, 0);
+        bench(&format!("{}::next_u64 x1000", name), || {
+            (0..1000).map(|_| rng.next_u64() >> 54).sum::<u64>() as f64
+        });
+        bench(&format!("{}::for_pixel x1000", name), || {
+            (0..1000)
+                .map(|x| G::for_pixel(28, x, 0).next_u64() >> 54)
+                .sum::<u64>() as f64
+        });
+    }
+    bench_generator::<rand_pcg::Pcg64Mcg>("Pcg64Mcg");
+    bench_generator::<Xoshiro256PlusPlus>("Xoshiro256PlusPlus");
+}
+
+#[test]
+#[ignore]
+fn bench_sphere_hit() {
+    let mut rng = Rng::seed_from_u64(28);
+    let sphere = Sphere::new(Vec3::new(0.5, 0.5, 0.5), 0.5);
+    let rays = random_rays(1000, &mut rng);
+    bench("Sphere::hit x1000", || hit_distances(&sphere, &rays));
+}
+
+#[test]
+#[ignore]
+fn bench_bvh_hit() {
+    let mut rng = Rng::seed_from_u64(28);
+    let spheres = (0..10000)
+        .map(|_| {
+            let center = Vec3::new(rng.gen(), rng.gen(), rng.gen());
+            Sphere::new(center, rng.gen_range(0.001..0.02))
+        })
+        .collect_vec();
+    let bvh = Bvh::new(spheres, TimeRange::ZERO);
+    let rays = random_rays(1000, &mut rng);
+    bench("Bvh::hit of 10000 spheres x1000", || {
+        hit_distances(&bvh, &rays)
+    });
+}
+
+#[test]
+#[ignore]
+fn bench_material_scatter() {
+    let mut rng = Rng::seed_from_u64(28);
+    let ray = Ray::new(
+        Vec3::new(0.0, 1.0, -1.0),
+        Vec3::new(0.0, -1.0, 1.0).unit(),
+        0.0,
+    );
+    let hit = Hit {
+        point: Vec3::ZERO,
+        normal: Vec3Unit::Y,
+        tangent: Vec3Unit::X,
+        t: 2.0f64.sqrt(),
+        u: 0.5,
+        v: 0.5,
+    };
+    let materials: Vec<(&str, Box<dyn Material>)> = vec![
+        (
+            "Lambertian",
+            Box::new(Lambertian::new(SolidColor::new(Color::new(0.5, 0.5, 0.5)))),
+        ),
+        (
+            "Metal",
+            Box::new(Metal::new(SolidColor::new(Color::new(0.5, 0.5, 0.5)), 0.1)),
+        ),
+        ("Dielectric", Box::new(Dielectric::new(1.5))),
+    ];
+    for (name, material) in materials.iter() {
+        bench(&format!("{}::scatter x1000", name), || {
+            (0..1000)
+                .map(|_| {
+                    let scatter = material.scatter(&ray, &hit, 0, &mut rng);
+                    match scatter.sampler {
+                        Some(sampler) => sampler.sample(&mut rng).dot(Vec3Unit::Y),
+                        None => 0.0,
+                    }
+                })
+                .sum()
+        });
+    }
+}
+
+#[test]
+#[ignore]
+fn bench_render_tile() {
+    let mut rng = Rng::seed_from_u64(28);
+    let (params, camera, world) = SceneRegistry::with_builtins()
+        .load("book1/final", &mut rng)
+        .unwrap();
+    let params = RenderParams {
+        width: 32,
+        height: 32,
+        samples_per_pixel: 4,
+        tile_size: 32,
+        ..params
+    };
+    let cancel = AtomicBool::new(false);
+    bench("book1/final 32x32 tile at 4 samples", || {
+        let mut frame = Frame::new(params.width, params.height);
+        render(&camera, &world, &params, &mut frame, &cancel, &mut |_| {}).unwrap();
+        frame.pixels().iter().map(|c| c.r).sum()
+    });
+}
@@ -0,0 +1,33 @@
+// Little-endian encoding of numbers in binary files such as checkpoints.
+
+use std::io::{Read, Result, Write};
+
+pub fn write_u64(writer: &mut impl Write, x: u64) -> Result<()> {
+    writer.write_all(&x.to_le_bytes())
+}
+
+pub fn write_u8(writer: &mut impl Write, x: u8) -> Result<()> {
+    writer.write_all(&[x])
+}
+
+pub fn write_f64(writer: &mut impl Write, x: f64) -> Result<()> {
+    writer.write_all(&x.to_le_bytes())
+}
+
+pub fn read_u64(reader: &mut impl Read) -> Result<u64> {
+    let mut buf = [0; 8];
+    reader.read_exact(&mut buf)?;
+    Ok(u64::from_le_bytes(buf))
+}
+
+pub fn read_u8(reader: &mut impl Read) -> Result<u8> {
+    let mut buf = [0; 1];
+    reader.read_exact(&mut buf)?;
+    Ok(buf[0])
+}
+
+pub fn read_f64(reader: &mut impl Read) -> Result<f64> {
+    let mut buf = [0; 8];
+    reader.read_exact(&mut buf)?;
+    Ok(f64::from_le_bytes(buf))
+}
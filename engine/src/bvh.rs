@@ -0,0 +1,462 @@
+use crate::binary::{read_f64, read_u64, read_u8, write_f64, write_u64, write_u8};
+use crate::geom::{Box3, Box3x4, IntoVec3, Vec3};
+use crate::ray::{Ray, RayBatch};
+use crate::sampler::{MixedSampler, Sampler};
+use crate::shape::{Hit, Shape};
+use crate::stats;
+use crate::time::TimeRange;
+use itertools::Itertools;
+use std::io::{self, Read, Write};
+
+const MAX_LEAF_SIZE: usize = 4;
+// Trees are balanced, so this allows more shapes than memory does.
+const MAX_DEPTH: usize = 32;
+// Number of children of a node, whose boxes are tested at once.
+const WIDTH: usize = 4;
+
+#[derive(Clone, Debug)]
+struct Node {
+    count: usize,
+    boxes: Box3x4,
+    // For a leaf child, shapes[start..start + len] belong to it. For an inner
+    // child, len is zero and start is the index of its node, which comes after
+    // the parent.
+    start: [usize; WIDTH],
+    len: [usize; WIDTH],
+}
+
+#[derive(Clone, Debug)]
+pub struct Bvh<S: Shape> {
+    bb: Box3,
+    nodes: Vec<Node>,
+    shapes: Vec<S>,
+}
+
+impl<S: Shape> Shape for Bvh<S> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        self.hit_shape(ray, t_min, t_max).map(|(hit, _)| hit)
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        self.bb
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        let samplers = self
+            .shapes
+            .iter()
+            .filter_map(|shape| shape.sampler(from, time))
+            .collect_vec();
+        if samplers.is_empty() {
+            None
+        } else {
+            Some(Box::new(MixedSampler::new(samplers)))
+        }
+    }
+
+    fn is_empty(&self) -> bool {
+        self.shapes.is_empty()
+    }
+}
+
+impl<S: Shape> Bvh<S> {
+    pub fn new(shapes: impl IntoIterator<Item = S>, time: TimeRange) -> Self {
+        let mut entries = shapes
+            .into_iter()
+            .filter(|shape| !shape.is_empty())
+            .map(|shape| {
+                let bb = shape.bounding_box(time);
+                (shape, bb)
+            })
+            .collect_vec();
+        let bb = union(&entries);
+        let mut nodes = Vec::new();
+        if !entries.is_empty() {
+            build(&mut nodes, &mut entries, 0, 0);
+        }
+        Bvh {
+            bb,
+            nodes,
+            shapes: entries.into_iter().map(|(shape, _)| shape).collect(),
+        }
+    }
+
+    // Writes the tree with shapes told by their indices, so that it can be
+    // loaded later without building it again.
+    pub fn save(&self, writer: &mut impl Write, shape_index: impl Fn(&S) -> u64) -> io::Result<()> {
+        write_u64(writer, self.nodes.len() as u64)?;
+        for node in self.nodes.iter() {
+            write_u8(writer, node.count as u8)?;
+            for lane in 0..node.count {
+                let bb = node.boxes.get(lane);
+                for p in [bb.min, bb.max].iter() {
+                    write_f64(writer, p.x)?;
+                    write_f64(writer, p.y)?;
+                    write_f64(writer, p.z)?;
+                }
+                write_u64(writer, node.start[lane] as u64)?;
+                write_u64(writer, node.len[lane] as u64)?;
+            }
+        }
+        write_u64(writer, self.shapes.len() as u64)?;
+        for shape in self.shapes.iter() {
+            write_u64(writer, shape_index(shape))?;
+        }
+        Ok(())
+    }
+
+    // Reads a tree written by save, getting shapes from their indices.
+    pub fn load(reader: &mut impl Read, shape: impl Fn(u64) -> Option<S>) -> io::Result<Self> {
+        let corrupted = || io::Error::new(io::ErrorKind::InvalidData, "Corrupted BVH");
+        let mut nodes = Vec::new();
+        let mut bb = Box3::EMPTY;
+        for _ in 0..read_u64(reader)? {
+            let count = read_u8(reader)? as usize;
+            if count == 0 || count > WIDTH {
+                return Err(corrupted());
+            }
+            let mut node = Node {
+                count,
+                boxes: Box3x4::EMPTY,
+                start: [0; WIDTH],
+                len: [0; WIDTH],
+            };
+            for lane in 0..count {
+                let mut coords = [0.0; 6];
+                for c in coords.iter_mut() {
+                    *c = read_f64(reader)?;
+                }
+                let lane_bb = Box3::new(
+                    Vec3::new(coords[0], coords[1], coords[2]),
+                    Vec3::new(coords[3], coords[4], coords[5]),
+                );
+                if nodes.is_empty() {
+                    bb = bb.union(lane_bb);
+                }
+                node.boxes.set(lane, lane_bb);
+                node.start[lane] = read_u64(reader)? as usize;
+                node.len[lane] = read_u64(reader)? as usize;
+            }
+            nodes.push(node);
+        }
+        let mut shapes = Vec::new();
+        for _ in 0..read_u64(reader)? {
+            shapes.push(shape(read_u64(reader)?).ok_or_else(corrupted)?);
+        }
+        if !nodes.is_empty() && !is_valid(&nodes, shapes.len(), 0, 0) {
+            return Err(corrupted());
+        }
+        Ok(Bvh { bb, nodes, shapes })
+    }
+
+    // Finds the closest hit along with the shape hit.
+    pub fn hit_shape(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<(Hit, &S)> {
+        self.hit_shape_with(ray, t_min, t_max, |shape, ray, t_min, t_max| {
+            shape.hit(ray, t_min, t_max)
+        })
+    }
+
+    // Same as hit_shape, but intersects shapes by the function instead of
+    // their own hit, e.g. to skip some of them.
+    pub fn hit_shape_with(
+        &self,
+        ray: &Ray,
+        t_min: f64,
+        t_max: f64,
+        hit: impl Fn(&S, &Ray, f64, f64) -> Option<Hit>,
+    ) -> Option<(Hit, &S)> {
+        if self.nodes.is_empty() {
+            return None;
+        }
+        let dir = ray.dir.into_vec3();
+        let inv_dir = Vec3::new(1.0 / dir.x, 1.0 / dir.y, 1.0 / dir.z);
+        let mut best: Option<(Hit, &S)> = None;
+        let (mut nodes, mut shapes) = (0, 0);
+        // Children entered by the ray are pushed with where they are entered,
+        // as (t, start, len) in the same way as nodes refer to them.
+        let mut stack = [(t_min, 0, 0); (WIDTH - 1) * MAX_DEPTH + 1];
+        let mut sp = 1;
+        while sp > 0 {
+            sp -= 1;
+            let (t, start, len) = stack[sp];
+            let t_best = best.as_ref().map_or(t_max, |(h, _)| h.t);
+            if t > t_best {
+                continue;
+            }
+            if len > 0 {
+                shapes += len;
+                for shape in self.shapes[start..start + len].iter() {
+                    let t_best = best.as_ref().map_or(t_max, |(h, _)| h.t);
+                    if let Some(hit) = hit(shape, ray, t_min, t_best) {
+                        best = Some((hit, shape));
+                    }
+                }
+                continue;
+            }
+            let node = &self.nodes[start];
+            nodes += 1;
+            let ts = node.boxes.enter(ray.origin, inv_dir, t_min, t_best);
+            // Farther children are pushed first, so that the nearer ones are
+            // visited first and likely cull them with closer hits.
+            let bottom = sp;
+            for lane in 0..node.count {
+                if ts[lane] == f64::INFINITY {
+                    continue;
+                }
+                let entry = (ts[lane], node.start[lane], node.len[lane]);
+                let mut i = sp;
+                while i > bottom && stack[i - 1].0 < entry.0 {
+                    stack[i] = stack[i - 1];
+                    i -= 1;
+                }
+                stack[i] = entry;
+                sp += 1;
+            }
+        }
+        stats::record(nodes, shapes as u64);
+        best
+    }
+
+    // Same as hit_shape for the rays in the batch, each before its own t_max.
+    pub fn hit_batch(&self, batch: &RayBatch, t_min: f64, t_max: &[f64]) -> Vec<Option<(Hit, &S)>> {
+        self.hit_batch_with(batch, t_min, t_max, |shape, ray, t_min, t_max| {
+            shape.hit(ray, t_min, t_max)
+        })
+    }
+
+    // Same as hit_shape_with for the rays in the batch. Rays are tested against
+    // the children of each node together, and only the ones entering a child
+    // go down, so that coherent rays load nodes and shapes once.
+    pub fn hit_batch_with(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: &[f64],
+        hit: impl Fn(&S, &Ray, f64, f64) -> Option<Hit>,
+    ) -> Vec<Option<(Hit, &S)>> {
+        let mut best: Vec<Option<(Hit, &S)>> = (0..batch.len()).map(|_| None).collect();
+        if self.nodes.is_empty() || batch.is_empty() {
+            return best;
+        }
+        let mut t_best = t_max.to_vec();
+        let (mut nodes, mut shapes) = (0, 0);
+        // Indices of rays reaching children on the stack are kept in one list.
+        // Ranges of pending children never follow the one popped, so the list
+        // is truncated to its end before adding the rays entering its
+        // children.
+        let mut active: Vec<usize> = (0..batch.len()).collect();
+        let mut entered: Vec<[f64; WIDTH]> = Vec::new();
+        let mut stack = vec![(0, 0, 0, batch.len())];
+        while let Some((start, len, first, last)) = stack.pop() {
+            active.truncate(last);
+            if len > 0 {
+                shapes += len * (last - first);
+                for shape in self.shapes[start..start + len].iter() {
+                    for &i in active[first..last].iter() {
+                        if let Some(h) = hit(shape, &batch.rays()[i], t_min, t_best[i]) {
+                            t_best[i] = h.t;
+                            best[i] = Some((h, shape));
+                        }
+                    }
+                }
+                continue;
+            }
+            let node = &self.nodes[start];
+            nodes += last - first;
+            entered.clear();
+            for &i in active[first..last].iter() {
+                entered.push(batch.enter(i, &node.boxes, t_min, t_best[i]));
+            }
+            // Children are ordered by where the first ray enters them, and
+            // the nearest one goes last to the list and to the stack.
+            let mut lanes = [0, 1, 2, 3];
+            lanes[..node.count].sort_by(|&a, &b| entered[0][b].total_cmp(&entered[0][a]));
+            for &lane in lanes[..node.count].iter() {
+                let child_first = active.len();
+                for k in first..last {
+                    if entered[k - first][lane] < f64::INFINITY {
+                        active.push(active[k]);
+                    }
+                }
+                if active.len() > child_first {
+                    stack.push((node.start[lane], node.len[lane], child_first, active.len()));
+                }
+            }
+        }
+        stats::record(nodes as u64, shapes as u64);
+        best
+    }
+}
+
+// Tells if nodes under the index form a tree that hit can traverse within the
+// stack, with leaves referring to existing shapes.
+fn is_valid(nodes: &[Node], shapes: usize, index: usize, depth: usize) -> bool {
+    let node = &nodes[index];
+    (0..node.count).all(|lane| {
+        let (start, len) = (node.start[lane], node.len[lane]);
+        if len > 0 {
+            start <= shapes && len <= shapes - start
+        } else {
+            depth + 1 < MAX_DEPTH
+                && index < start
+                && start < nodes.len()
+                && is_valid(nodes, shapes, start, depth + 1)
+        }
+    })
+}
+
+fn union<S>(entries: &[(S, Box3)]) -> Box3 {
+    entries
+        .iter()
+        .map(|(_, bb)| *bb)
+        .fold(Box3::EMPTY, Box3::union)
+}
+
+// Builds the node for the entries and ones under it, and returns its index.
+// Entries are split into WIDTH children by halving the one of the largest
+// surface area in turn, at the median along the longest axis of centers.
+fn build<S>(nodes: &mut Vec<Node>, entries: &mut [(S, Box3)], start: usize, depth: usize) -> usize {
+    // Ranges of entries for children, with their boxes.
+    let mut children = vec![(0, entries.len(), union(entries))];
+    while children.len() < WIDTH {
+        let largest = children
+            .iter()
+            .enumerate()
+            .filter(|(_, (_, len, _))| *len > MAX_LEAF_SIZE)
+            .max_by(|(_, (_, _, a)), (_, (_, _, b))| a.surface_area().total_cmp(&b.surface_area()))
+            .map(|(k, _)| k);
+        let k = match largest {
+            Some(k) => k,
+            None => break,
+        };
+        let (first, len, _) = children[k];
+        let group = &mut entries[first..first + len];
+        let axis = group
+            .iter()
+            .map(|(_, bb)| {
+                let c = bb.center();
+                Box3::new(c, c)
+            })
+            .fold(Box3::EMPTY, Box3::union)
+            .longest_axis();
+        let mid = len / 2;
+        group.select_nth_unstable_by(mid, |(_, a), (_, b)| {
+            a.center().get(axis).total_cmp(&b.center().get(axis))
+        });
+        let (left, right) = group.split_at(mid);
+        children[k] = (first, mid, union(left));
+        children.insert(k + 1, (first + mid, len - mid, union(right)));
+    }
+
+    let index = nodes.len();
+    nodes.push(Node {
+        count: children.len(),
+        boxes: Box3x4::EMPTY,
+        start: [0; WIDTH],
+        len: [0; WIDTH],
+    });
+    for (lane, &(first, len, bb)) in children.iter().enumerate() {
+        nodes[index].boxes.set(lane, bb);
+        // The traversal stack holds at most WIDTH - 1 pending children per
+        // level.
+        if len <= MAX_LEAF_SIZE || depth + 1 >= MAX_DEPTH {
+            nodes[index].start[lane] = start + first;
+            nodes[index].len[lane] = len;
+        } else {
+            let child = build(
+                nodes,
+                &mut entries[first..first + len],
+                start + first,
+                depth + 1,
+            );
+            nodes[index].start[lane] = child;
+        }
+    }
+    index
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::geom::Vec3Unit;
+    use crate::rng::Rng;
+    use crate::shape::{Plane, Sphere};
+    use rand::{Rng as _, SeedableRng};
+
+    #[test]
+    fn test_hit_batch() {
+        let mut rng = Rng::seed_from_u64(28);
+        let spheres = (0..100)
+            .map(|_| {
+                let center = Vec3::new(
+                    rng.gen_range(-5.0..5.0),
+                    rng.gen_range(-5.0..5.0),
+                    rng.gen_range(-5.0..5.0),
+                );
+                Sphere::new(center, rng.gen_range(0.1..1.0))
+            })
+            .collect_vec();
+        let bvh = Bvh::new(spheres.clone(), TimeRange::ZERO);
+        let mut rays = (0..200)
+            .map(|_| {
+                let origin = Vec3::new(0.0, 0.0, -10.0);
+                let target = Vec3::new(rng.gen_range(-5.0..5.0), rng.gen_range(-5.0..5.0), 0.0);
+                Ray::new(origin, (target - origin).unit(), 0.0)
+            })
+            .collect_vec();
+        for _ in 0..10 {
+            rays.push(Ray::new(
+                Vec3::ZERO,
+                Vec3Unit::random_on_unit_sphere(&mut rng),
+                0.0,
+            ));
+        }
+        let t_max = rays.iter().map(|_| 15.0).collect_vec();
+        let batch = RayBatch::new(rays);
+        let hits = bvh.hit_batch(&batch, 1e-8, &t_max);
+        for (ray, hit) in batch.rays().iter().zip(hits) {
+            let closest = spheres
+                .iter()
+                .filter_map(|sphere| sphere.hit(ray, 1e-8, 15.0))
+                .map(|h| h.t)
+                .fold(None, |best: Option<f64>, t| {
+                    Some(best.map_or(t, |b| b.min(t)))
+                });
+            assert_eq!(bvh.hit(ray, 1e-8, 15.0).map(|h| h.t), closest);
+            assert_eq!(hit.map(|(h, _)| h.t), closest);
+        }
+    }
+
+    #[test]
+    fn test_unbounded() {
+        // Tilted planes have boxes with infinite and NaN coordinates.
+        let mut shapes: Vec<Box<dyn Shape>> = (0..20)
+            .map(|i| -> Box<dyn Shape> {
+                Box::new(Sphere::new(Vec3::new(i as f64 * 3.0, 0.0, 0.0), 1.0))
+            })
+            .collect();
+        shapes.push(Box::new(Plane::new(
+            Vec3::new(0.0, -2.0, 0.0),
+            Vec3::new(0.0, 1.0, 0.1),
+        )));
+        shapes.push(Box::new(Plane::new(
+            Vec3::new(0.0, 0.0, 50.0),
+            Vec3::new(1.0, 1.0, 1.0),
+        )));
+        let bvh = Bvh::new(shapes, TimeRange::ZERO);
+        let ray = Ray::new(
+            Vec3::new(1.5, 10.0, 0.0),
+            Vec3::new(0.0, -1.0, 0.0).unit(),
+            0.0,
+        );
+        let hit = bvh.hit(&ray, 1e-8, f64::INFINITY).expect("hit");
+        assert!((hit.point.y + 2.0).abs() < 1e-9, "{:?}", hit.point);
+        let ray = Ray::new(
+            Vec3::new(9.0, 10.0, 0.0),
+            Vec3::new(0.0, -1.0, 0.0).unit(),
+            0.0,
+        );
+        let hit = bvh.hit(&ray, 1e-8, f64::INFINITY).expect("hit");
+        assert!((hit.t - 9.0).abs() < 1e-9, "{}", hit.t);
+    }
+}
@@ -1,19 +1,20 @@
 use crate::geom::{IntoVec3, Vec3, Vec3Unit};
 use crate::ray::Ray;
 use crate::rng::Rng;
+use crate::scene_file::{vec3, CameraDesc};
 use crate::time::TimeRange;
 use rand::Rng as _;
 
 #[derive(Debug)]
 pub struct Camera {
-    origin: Vec3,
-    horizontal: Vec3,
-    vertical: Vec3,
-    lower_left_corner: Vec3,
+    pub(crate) origin: Vec3,
+    pub(crate) horizontal: Vec3,
+    pub(crate) vertical: Vec3,
+    pub(crate) lower_left_corner: Vec3,
     u: Vec3Unit,
     v: Vec3Unit,
-    lens_radius: f64,
-    time: TimeRange,
+    pub(crate) lens_radius: f64,
+    pub(crate) time: TimeRange,
 }
 
 impl Camera {
@@ -49,6 +50,21 @@ impl Camera {
         }
     }
 
+    pub fn from_desc(desc: &CameraDesc, aspect_ratio: f64) -> Camera {
+        let look_from = vec3(desc.look_from);
+        let look_at = vec3(desc.look_at);
+        Camera::new(
+            look_from,
+            look_at,
+            desc.vfov.to_radians(),
+            aspect_ratio,
+            desc.aperture,
+            desc.focus_dist
+                .unwrap_or_else(|| (look_at - look_from).abs()),
+            TimeRange::new(desc.time[0], desc.time[1]),
+        )
+    }
+
     pub fn ray(&self, u: f64, v: f64, rng: &mut Rng) -> Ray {
         let lens = Vec3::random_in_unit_disc(rng) * self.lens_radius;
         let blur = self.u * lens.x + self.v * lens.y;
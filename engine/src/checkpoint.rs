@@ -0,0 +1,179 @@
+use crate::binary::{read_f64, read_u64, read_u8, write_f64, write_u64, write_u8};
+use crate::color::Color;
+use crate::frame::Frame;
+use crate::integrator::IntegratorKind;
+use crate::renderer::RenderParams;
+use crate::rng::fnv1a;
+use std::io::{Error, ErrorKind, Read, Result, Write};
+use strum::IntoEnumIterator;
+
+const MAGIC: &[u8; 8] = b"RTCKPT04";
+
+fn write_color(writer: &mut impl Write, color: Color) -> Result<()> {
+    write_f64(writer, color.r)?;
+    write_f64(writer, color.g)?;
+    write_f64(writer, color.b)
+}
+
+fn read_color(reader: &mut impl Read) -> Result<Color> {
+    let r = read_f64(reader)?;
+    let g = read_f64(reader)?;
+    let b = read_f64(reader)?;
+    Ok(Color::new(r, g, b))
+}
+
+// Identifies the scene of a checkpoint by a hash of data describing it.
+pub fn scene_hash(data: &[u8]) -> u64 {
+    fnv1a(data.iter().copied())
+}
+
+fn params_header(params: &RenderParams) -> [u64; 10] {
+    [
+        params.width as u64,
+        params.height as u64,
+        params.tile_size as u64,
+        params.pixel_sampling as u64,
+        params.integrator as u64,
+        params.ao_distance.map_or(u64::MAX, f64::to_bits),
+        params.samples_per_pixel as u64,
+        params.max_depth as u64,
+        params.importance_sampling as u64,
+        params.seed,
+    ]
+}
+
+pub fn save_checkpoint(
+    writer: &mut impl Write,
+    params: &RenderParams,
+    scene: u64,
+    frame: &Frame,
+) -> Result<()> {
+    writer.write_all(MAGIC)?;
+    write_u64(writer, scene)?;
+    for x in params_header(params).iter() {
+        write_u64(writer, *x)?;
+    }
+    write_u64(writer, frame.aovs().len() as u64)?;
+    for aov in frame.aovs() {
+        let index = IntegratorKind::iter()
+            .position(|kind| kind == *aov)
+            .unwrap();
+        write_u64(writer, index as u64)?;
+    }
+    for y in 0..frame.height() {
+        for x in 0..frame.width() {
+            if !frame.is_rendered(x, y) {
+                write_u8(writer, 0)?;
+                continue;
+            }
+            let index = (y * frame.width() + x) as usize;
+            write_u8(writer, 1)?;
+            write_color(writer, frame.pixels()[index])?;
+            for aov in 0..frame.aovs().len() {
+                write_color(writer, frame.aov_pixels(aov)[index])?;
+            }
+        }
+    }
+    Ok(())
+}
+
+// Loads a checkpoint saved for the scene, identified by scene_hash, with the
+// parameters.
+pub fn load_checkpoint(reader: &mut impl Read, params: &RenderParams, scene: u64) -> Result<Frame> {
+    let mut magic = [0; 8];
+    reader.read_exact(&mut magic)?;
+    if &magic != MAGIC {
+        return Err(Error::new(ErrorKind::InvalidData, "Not a checkpoint file"));
+    }
+    if read_u64(reader)? != scene {
+        return Err(Error::new(
+            ErrorKind::InvalidData,
+            "Checkpoint was saved for a different scene",
+        ));
+    }
+    for x in params_header(params).iter() {
+        if read_u64(reader)? != *x {
+            return Err(Error::new(
+                ErrorKind::InvalidData,
+                "Checkpoint was saved with different render parameters",
+            ));
+        }
+    }
+    let aov_count = read_u64(reader)?;
+    let mut aovs = Vec::new();
+    for _ in 0..aov_count {
+        let index = read_u64(reader)? as usize;
+        match IntegratorKind::iter().nth(index) {
+            Some(aov) => aovs.push(aov),
+            None => return Err(Error::new(ErrorKind::InvalidData, "Corrupted checkpoint")),
+        }
+    }
+    let mut frame = Frame::with_aovs(params.width, params.height, aovs);
+    for y in 0..params.height {
+        for x in 0..params.width {
+            match read_u8(reader)? {
+                0 => {}
+                1 => {
+                    let color = read_color(reader)?;
+                    for aov in 0..aov_count as usize {
+                        frame.set_aov(aov, x, y, read_color(reader)?);
+                    }
+                    frame.set(x, y, color);
+                }
+                _ => return Err(Error::new(ErrorKind::InvalidData, "Corrupted checkpoint")),
+            }
+        }
+    }
+    Ok(frame)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_round_trip() {
+        let params = RenderParams {
+            width: 3,
+            height: 2,
+            ..RenderParams::DEFAULT
+        };
+        let mut frame = Frame::with_aovs(
+            params.width,
+            params.height,
+            vec![IntegratorKind::Normal, IntegratorKind::Albedo],
+        );
+        frame.set_aov(1, 0, 0, Color::new(0.5, 0.5, 0.5));
+        frame.set(0, 0, Color::new(1.0, 0.5, 0.25));
+        frame.set(2, 1, Color::new(3.0, 0.0, 1e-9));
+
+        let mut buf = vec![];
+        let scene = scene_hash(b"book1/image12");
+        save_checkpoint(&mut buf, &params, scene, &frame).unwrap();
+        let loaded = load_checkpoint(&mut buf.as_slice(), &params, scene).unwrap();
+
+        assert_eq!(loaded.rendered_pixels(), 2);
+        for y in 0..params.height {
+            for x in 0..params.width {
+                assert_eq!(loaded.is_rendered(x, y), frame.is_rendered(x, y));
+            }
+        }
+        for (a, b) in loaded.pixels().iter().zip(frame.pixels()) {
+            assert_eq!((a.r, a.g, a.b), (b.r, b.g, b.b));
+        }
+        assert_eq!(loaded.aovs(), frame.aovs());
+        for aov in 0..frame.aovs().len() {
+            for (a, b) in loaded.aov_pixels(aov).iter().zip(frame.aov_pixels(aov)) {
+                assert_eq!((a.r, a.g, a.b), (b.r, b.g, b.b));
+            }
+        }
+
+        let other = RenderParams {
+            seed: params.seed + 1,
+            ..params.clone()
+        };
+        assert!(load_checkpoint(&mut buf.as_slice(), &other, scene).is_err());
+        let other_scene = scene_hash(b"book1/image14");
+        assert!(load_checkpoint(&mut buf.as_slice(), &params, other_scene).is_err());
+    }
+}
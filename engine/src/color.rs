@@ -11,6 +11,14 @@ pub fn clamp(x: f64, lo: f64, hi: f64) -> f64 {
     }
 }
 
+fn quantize(x: f64, max: f64) -> f64 {
+    if x.is_nan() {
+        0.0
+    } else {
+        clamp(x * max, 0.0, max)
+    }
+}
+
 #[derive(Clone, Copy, Debug)]
 pub struct Color {
     pub r: f64,
@@ -86,6 +94,19 @@ impl std::iter::Sum for Color {
     }
 }
 
+// Formats as (r, g, b), passing the precision to the components.
+impl std::fmt::Display for Color {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("(")?;
+        std::fmt::Display::fmt(&self.r, f)?;
+        f.write_str(", ")?;
+        std::fmt::Display::fmt(&self.g, f)?;
+        f.write_str(", ")?;
+        std::fmt::Display::fmt(&self.b, f)?;
+        f.write_str(")")
+    }
+}
+
 impl Color {
     pub const BLACK: Color = Color {
         r: 0.0,
@@ -118,15 +139,155 @@ impl Color {
         )
     }
 
-    pub fn gamma2(self) -> Self {
-        Color::new(self.r.sqrt(), self.g.sqrt(), self.b.sqrt())
+    // Relative luminance of linear sRGB.
+    pub fn luminance(self) -> f64 {
+        0.2126 * self.r + 0.7152 * self.g + 0.0722 * self.b
+    }
+
+    // Applies a power curve of 1 / gamma to encode linear colors.
+    pub fn gamma(self, gamma: f64) -> Self {
+        let f = |x: f64| x.max(0.0).powf(1.0 / gamma);
+        Color::new(f(self.r), f(self.g), f(self.b))
+    }
+
+    // Applies the sRGB transfer function to encode linear colors.
+    pub fn srgb(self) -> Self {
+        let f = |x: f64| {
+            if x <= 0.0031308 {
+                12.92 * x.max(0.0)
+            } else {
+                1.055 * x.powf(1.0 / 2.4) - 0.055
+            }
+        };
+        Color::new(f(self.r), f(self.g), f(self.b))
     }
 
+    pub fn is_nan(self) -> bool {
+        self.r.is_nan() || self.g.is_nan() || self.b.is_nan()
+    }
+
+    pub fn is_black(self) -> bool {
+        self.r == 0.0 && self.g == 0.0 && self.b == 0.0
+    }
+
+    // Channels are clamped to [0, 1], and NaN channels are encoded as 0.
     pub fn encode(self) -> [u8; 3] {
         [
-            clamp(self.r * 255.999, 0.0, 255.999) as u8,
-            clamp(self.g * 255.999, 0.0, 255.999) as u8,
-            clamp(self.b * 255.999, 0.0, 255.999) as u8,
+            quantize(self.r, 255.999) as u8,
+            quantize(self.g, 255.999) as u8,
+            quantize(self.b, 255.999) as u8,
+        ]
+    }
+
+    // Encodes to 16-bit big-endian channels.
+    pub fn encode16(self) -> [u8; 6] {
+        let r = quantize(self.r, 65535.999) as u16;
+        let g = quantize(self.g, 65535.999) as u16;
+        let b = quantize(self.b, 65535.999) as u16;
+        let [r0, r1] = r.to_be_bytes();
+        let [g0, g1] = g.to_be_bytes();
+        let [b0, b1] = b.to_be_bytes();
+        [r0, r1, g0, g1, b0, b1]
+    }
+
+    // Encodes to the shared exponent format of Radiance HDR files.
+    pub fn encode_rgbe(self) -> [u8; 4] {
+        let c = self.clamp(0.0, f64::MAX);
+        let v = c.r.max(c.g).max(c.b);
+        if !(v >= 1e-32) {
+            return [0, 0, 0, 0];
+        }
+        // Find e such that v = m * 2^e where m is in [0.5, 1).
+        let mut e = v.log2().floor() as i32 + 1;
+        if v / 2f64.powi(e) >= 1.0 {
+            e += 1;
+        }
+        let e = e.max(-128).min(127);
+        let scale = 256.0 / 2f64.powi(e);
+        [
+            (c.r * scale).min(255.0) as u8,
+            (c.g * scale).min(255.0) as u8,
+            (c.b * scale).min(255.0) as u8,
+            (e + 128) as u8,
         ]
     }
+
+    // Decodes from the shared exponent format of Radiance HDR files.
+    pub fn decode_rgbe(rgbe: [u8; 4]) -> Self {
+        if rgbe[3] == 0 {
+            return Color::BLACK;
+        }
+        let scale = 2f64.powi(rgbe[3] as i32 - 128 - 8);
+        Color::new(
+            (rgbe[0] as f64 + 0.5) * scale,
+            (rgbe[1] as f64 + 0.5) * scale,
+            (rgbe[2] as f64 + 0.5) * scale,
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_encode() {
+        assert_eq!(Color::BLACK.encode(), [0, 0, 0]);
+        assert_eq!(Color::WHITE.encode(), [255, 255, 255]);
+        assert_eq!(Color::new(0.5, 1.5, -0.5).encode(), [127, 255, 0]);
+        assert_eq!(
+            Color::new(f64::INFINITY, f64::NAN, 1e300).encode(),
+            [255, 0, 255]
+        );
+        assert_eq!(
+            Color::new(f64::NAN, 0.0, 0.0).encode16(),
+            [0, 0, 0, 0, 0, 0]
+        );
+    }
+
+    #[test]
+    fn test_srgb() {
+        let c = Color::new(0.0, 0.5, 1.0).srgb();
+        assert_eq!(c.r, 0.0);
+        assert!((c.g - 0.7354).abs() < 1e-4);
+        assert!((c.b - 1.0).abs() < 1e-12);
+        // Linear near black.
+        assert!((Color::new(0.001, 0.0, 0.0).srgb().r - 0.01292).abs() < 1e-12);
+    }
+
+    #[test]
+    fn test_encode16() {
+        assert_eq!(Color::BLACK.encode16(), [0, 0, 0, 0, 0, 0]);
+        assert_eq!(Color::WHITE.encode16(), [255, 255, 255, 255, 255, 255]);
+        assert_eq!(
+            Color::new(0.5, 2.0, -1.0).encode16(),
+            [127, 255, 255, 255, 0, 0]
+        );
+    }
+
+    #[test]
+    fn test_encode_rgbe() {
+        assert_eq!(Color::BLACK.encode_rgbe(), [0, 0, 0, 0]);
+        assert_eq!(Color::WHITE.encode_rgbe(), [128, 128, 128, 129]);
+        assert_eq!(Color::new(0.5, 0.25, 0.0).encode_rgbe(), [128, 64, 0, 128]);
+        assert_eq!(Color::new(10.0, 1.0, 0.0).encode_rgbe(), [160, 16, 0, 132]);
+    }
+
+    #[test]
+    fn test_decode_rgbe() {
+        for &c in [
+            Color::WHITE,
+            Color::new(10.0, 1.0, 0.02),
+            Color::new(0.3, 0.0, 1e-3),
+        ]
+        .iter()
+        {
+            let d = Color::decode_rgbe(c.encode_rgbe());
+            let max = c.r.max(c.g).max(c.b);
+            assert!((d.r - c.r).abs() <= max / 128.0);
+            assert!((d.g - c.g).abs() <= max / 128.0);
+            assert!((d.b - c.b).abs() <= max / 128.0);
+        }
+        assert_eq!(Color::decode_rgbe([0, 0, 0, 0]).r, 0.0);
+    }
 }
@@ -0,0 +1,251 @@
+// Differences between two images, e.g. a render and a reference, to evaluate
+// samplers and denoisers or check renders against golden images.
+//
+// PNG and JPEG images are compared in the values they store, between 0 and 1
+// as they are displayed, and HDR images in linear colors.
+
+use crate::color::Color;
+use crate::environment::parse_hdr;
+use crate::texture::Image;
+use anyhow::{bail, Result};
+use std::fs;
+use std::path::Path;
+
+pub struct ImageData {
+    pub width: u32,
+    pub height: u32,
+    // Pixels in scanline order starting from the top-left corner.
+    pub pixels: Vec<Color>,
+    pub hdr: bool,
+}
+
+impl ImageData {
+    // Loads a PNG, JPEG or Radiance HDR image, chosen by the extension.
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        let is_hdr = path
+            .extension()
+            .map_or(false, |ext| ext.eq_ignore_ascii_case("hdr"));
+        if is_hdr {
+            let (width, height, pixels) = parse_hdr(&fs::read(path)?)?;
+            return Ok(ImageData {
+                width: width as u32,
+                height: height as u32,
+                pixels,
+                hdr: true,
+            });
+        }
+        let image = Image::load(path)?;
+        let mut pixels = Vec::with_capacity(image.width() * image.height());
+        for y in 0..image.height() {
+            for x in 0..image.width() {
+                pixels.push(image.pixel(x, y));
+            }
+        }
+        Ok(ImageData {
+            width: image.width() as u32,
+            height: image.height() as u32,
+            pixels,
+            hdr: false,
+        })
+    }
+}
+
+#[derive(Clone, Copy, Debug)]
+pub struct Comparison {
+    // Root mean square error over the channels of all pixels.
+    pub rmse: f64,
+    // Peak signal-to-noise ratio in dB for the peak of 1, which is infinite for
+    // identical images.
+    pub psnr: f64,
+    // Mean structural similarity of luminance clamped to [0, 1], which is 1
+    // for identical images.
+    pub ssim: f64,
+}
+
+pub fn compare_images(reference: &ImageData, image: &ImageData) -> Result<Comparison> {
+    if (reference.width, reference.height) != (image.width, image.height) {
+        bail!(
+            "Image sizes differ: {}x{} and {}x{}",
+            reference.width,
+            reference.height,
+            image.width,
+            image.height
+        );
+    }
+    if reference.hdr != image.hdr {
+        bail!("HDR images can only be compared with HDR images");
+    }
+    let sum: f64 = reference
+        .pixels
+        .iter()
+        .zip(&image.pixels)
+        .map(|(r, i)| {
+            let d = *r - *i;
+            d.r * d.r + d.g * d.g + d.b * d.b
+        })
+        .sum();
+    let rmse = (sum / (reference.pixels.len() * 3) as f64).sqrt();
+    Ok(Comparison {
+        rmse,
+        psnr: -20.0 * rmse.log10(),
+        ssim: ssim(reference, image),
+    })
+}
+
+// Returns the differences of pixels, as distances between their colors.
+pub fn pixel_differences(reference: &ImageData, image: &ImageData) -> Vec<f64> {
+    reference
+        .pixels
+        .iter()
+        .zip(&image.pixels)
+        .map(|(r, i)| {
+            let d = *r - *i;
+            (d.r * d.r + d.g * d.g + d.b * d.b).sqrt()
+        })
+        .collect()
+}
+
+// Maps 0..=1 to colors from black through purple, red and yellow to white, so
+// that differences stand out by brightness as well as by hue.
+pub fn false_color(t: f64) -> [u8; 3] {
+    const STOPS: [[f64; 3]; 5] = [
+        [0.0, 0.0, 4.0],
+        [87.0, 16.0, 110.0],
+        [188.0, 55.0, 84.0],
+        [249.0, 142.0, 9.0],
+        [252.0, 255.0, 164.0],
+    ];
+    let t = if t.is_nan() { 1.0 } else { t.max(0.0).min(1.0) };
+    let pos = t * (STOPS.len() - 1) as f64;
+    let i = (pos as usize).min(STOPS.len() - 2);
+    let f = pos - i as f64;
+    let mut color = [0; 3];
+    for (c, (a, b)) in color.iter_mut().zip(STOPS[i].iter().zip(&STOPS[i + 1])) {
+        *c = (a + (b - a) * f).round() as u8;
+    }
+    color
+}
+
+// Window and constants of Wang et al., "Image quality assessment: from error
+// visibility to structural similarity", 2004.
+const SSIM_RADIUS: usize = 5;
+const SSIM_SIGMA: f64 = 1.5;
+const SSIM_C1: f64 = 0.01 * 0.01;
+const SSIM_C2: f64 = 0.03 * 0.03;
+
+fn ssim(reference: &ImageData, image: &ImageData) -> f64 {
+    let (width, height) = (reference.width as usize, reference.height as usize);
+    let luminance = |image: &ImageData| -> Vec<f64> {
+        image
+            .pixels
+            .iter()
+            .map(|c| c.luminance().max(0.0).min(1.0))
+            .collect()
+    };
+    let x = luminance(reference);
+    let y = luminance(image);
+    let product =
+        |a: &[f64], b: &[f64]| -> Vec<f64> { a.iter().zip(b).map(|(a, b)| a * b).collect() };
+    let blur = |values: &[f64]| gaussian_blur(values, width, height);
+    let (mx, my) = (blur(&x), blur(&y));
+    let (mxx, myy, mxy) = (
+        blur(&product(&x, &x)),
+        blur(&product(&y, &y)),
+        blur(&product(&x, &y)),
+    );
+    let sum: f64 = (0..x.len())
+        .map(|i| {
+            let (vx, vy) = (mxx[i] - mx[i] * mx[i], myy[i] - my[i] * my[i]);
+            let cov = mxy[i] - mx[i] * my[i];
+            ((2.0 * mx[i] * my[i] + SSIM_C1) * (2.0 * cov + SSIM_C2))
+                / ((mx[i] * mx[i] + my[i] * my[i] + SSIM_C1) * (vx + vy + SSIM_C2))
+        })
+        .sum();
+    sum / x.len() as f64
+}
+
+// Blurs rows and then columns. Weights are normalized at the borders, so that
+// images smaller than the window can be compared.
+fn gaussian_blur(values: &[f64], width: usize, height: usize) -> Vec<f64> {
+    let kernel: Vec<f64> = (0..=2 * SSIM_RADIUS)
+        .map(|i| {
+            let d = i as f64 - SSIM_RADIUS as f64;
+            (-d * d / (2.0 * SSIM_SIGMA * SSIM_SIGMA)).exp()
+        })
+        .collect();
+    let blur_1d = |get: &dyn Fn(usize) -> f64, len: usize, i: usize| {
+        let lo = i.saturating_sub(SSIM_RADIUS);
+        let hi = (i + SSIM_RADIUS).min(len - 1);
+        let (mut sum, mut weight) = (0.0, 0.0);
+        for j in lo..=hi {
+            let w = kernel[j + SSIM_RADIUS - i];
+            sum += get(j) * w;
+            weight += w;
+        }
+        sum / weight
+    };
+    let mut rows = vec![0.0; values.len()];
+    for y in 0..height {
+        for x in 0..width {
+            rows[y * width + x] = blur_1d(&|j| values[y * width + j], width, x);
+        }
+    }
+    let mut out = vec![0.0; values.len()];
+    for y in 0..height {
+        for x in 0..width {
+            out[y * width + x] = blur_1d(&|j| rows[j * width + x], height, y);
+        }
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn image(width: u32, height: u32, f: impl Fn(u32, u32) -> f64) -> ImageData {
+        let mut pixels = Vec::new();
+        for y in 0..height {
+            for x in 0..width {
+                let v = f(x, y);
+                pixels.push(Color::new(v, v, v));
+            }
+        }
+        ImageData {
+            width,
+            height,
+            pixels,
+            hdr: false,
+        }
+    }
+
+    #[test]
+    fn test_compare_images() {
+        let reference = image(16, 8, |x, y| ((x + y) % 4) as f64 / 4.0);
+        let same = compare_images(&reference, &reference).unwrap();
+        assert_eq!(same.rmse, 0.0);
+        assert_eq!(same.psnr, f64::INFINITY);
+        assert!((same.ssim - 1.0).abs() < 1e-9);
+
+        let brighter = image(16, 8, |x, y| ((x + y) % 4) as f64 / 4.0 + 0.1);
+        let c = compare_images(&reference, &brighter).unwrap();
+        assert!((c.rmse - 0.1).abs() < 1e-9);
+        assert!((c.psnr - 20.0).abs() < 1e-9);
+        assert!(c.ssim < 1.0 && c.ssim > 0.9, "{}", c.ssim);
+
+        // Structure lost matters more than brightness.
+        let flat = image(16, 8, |_, _| 0.375);
+        assert!(compare_images(&reference, &flat).unwrap().ssim < 0.5);
+
+        assert!(compare_images(&reference, &image(8, 16, |_, _| 0.0)).is_err());
+    }
+
+    #[test]
+    fn test_false_color() {
+        assert_eq!(false_color(0.0), [0, 0, 4]);
+        assert_eq!(false_color(0.5), [188, 55, 84]);
+        assert_eq!(false_color(1.0), [252, 255, 164]);
+        assert_eq!(false_color(2.0), [252, 255, 164]);
+    }
+}
@@ -0,0 +1,113 @@
+use crate::color::Color;
+use crate::frame::Frame;
+use crate::integrator::IntegratorKind;
+
+const RADIUS: i64 = 5;
+const SIGMA_SPATIAL: f64 = 3.0;
+const SIGMA_COLOR: f64 = 0.3;
+const SIGMA_ALBEDO: f64 = 0.1;
+const SIGMA_NORMAL: f64 = 0.1;
+
+fn distance2(a: Color, b: Color) -> f64 {
+    let d = a - b;
+    d.r * d.r + d.g * d.g + d.b * d.b
+}
+
+// Compresses colors to [0, 1) so that fireflies do not dominate color
+// distances.
+fn compress(c: Color) -> Color {
+    Color::new(c.r / (1.0 + c.r), c.g / (1.0 + c.g), c.b / (1.0 + c.b))
+}
+
+// Smooths noise in the rendered pixels of frame with a joint bilateral filter.
+// If frame has albedo and normal AOVs, they guide the filter to keep texture
+// and geometry edges sharp.
+pub fn denoise(frame: &mut Frame) {
+    let width = frame.width() as i64;
+    let height = frame.height() as i64;
+    let guide = |kind: IntegratorKind| {
+        frame
+            .aovs()
+            .iter()
+            .position(|aov| *aov == kind)
+            .map(|aov| frame.aov_pixels(aov))
+    };
+    let albedo = guide(IntegratorKind::Albedo);
+    let normal = guide(IntegratorKind::Normal);
+    let pixels = frame.pixels();
+    let compressed: Vec<Color> = pixels.iter().map(|c| compress(*c)).collect();
+
+    let mut denoised = Vec::with_capacity(pixels.len());
+    for y in 0..height {
+        for x in 0..width {
+            let index = (y * width + x) as usize;
+            if !frame.is_rendered(x as u32, y as u32) || pixels[index].is_nan() {
+                denoised.push(pixels[index]);
+                continue;
+            }
+            let mut sum = Color::BLACK;
+            let mut total_weight = 0.0;
+            for ny in (y - RADIUS).max(0)..(y + RADIUS + 1).min(height) {
+                for nx in (x - RADIUS).max(0)..(x + RADIUS + 1).min(width) {
+                    let neighbor = (ny * width + nx) as usize;
+                    if !frame.is_rendered(nx as u32, ny as u32) || pixels[neighbor].is_nan() {
+                        continue;
+                    }
+                    let spatial2 = ((nx - x) * (nx - x) + (ny - y) * (ny - y)) as f64;
+                    let mut exponent = spatial2 / (2.0 * SIGMA_SPATIAL * SIGMA_SPATIAL)
+                        + distance2(compressed[index], compressed[neighbor])
+                            / (2.0 * SIGMA_COLOR * SIGMA_COLOR);
+                    if let Some(albedo) = albedo {
+                        exponent += distance2(albedo[index], albedo[neighbor])
+                            / (2.0 * SIGMA_ALBEDO * SIGMA_ALBEDO);
+                    }
+                    if let Some(normal) = normal {
+                        exponent += distance2(normal[index], normal[neighbor])
+                            / (2.0 * SIGMA_NORMAL * SIGMA_NORMAL);
+                    }
+                    let weight = (-exponent).exp();
+                    sum = sum + pixels[neighbor] * weight;
+                    total_weight += weight;
+                }
+            }
+            denoised.push(sum / total_weight);
+        }
+    }
+
+    for y in 0..frame.height() {
+        for x in 0..frame.width() {
+            if frame.is_rendered(x, y) {
+                frame.set(x, y, denoised[(y * frame.width() + x) as usize]);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_keeps_edges() {
+        // Left half is black and right half is white in both the image and the
+        // albedo.
+        let mut frame = Frame::with_aovs(16, 16, vec![IntegratorKind::Albedo]);
+        for y in 0..16 {
+            for x in 0..16 {
+                let base = if x < 8 { 0.0 } else { 1.0 };
+                let noise = if (x + y) % 2 == 0 { 0.1 } else { -0.1 };
+                let albedo = Color::new(base, base, base);
+                frame.set_aov(0, x, y, albedo);
+                frame.set(x, y, albedo + Color::new(noise, noise, noise) * base);
+            }
+        }
+        denoise(&mut frame);
+        for y in 0..16 {
+            for x in 0..16 {
+                let c = frame.pixels()[(y * 16 + x) as usize];
+                let expected = if x < 8 { 0.0 } else { 1.0 };
+                assert!((c.r - expected).abs() < 0.05, "({}, {}): {:?}", x, y, c);
+            }
+        }
+    }
+}
@@ -0,0 +1,146 @@
+use crate::color::Color;
+use strum_macros::{Display, EnumIter, EnumString};
+
+// Maps linear radiance to [0, 1] for display.
+#[derive(Copy, Clone, Debug, Display, EnumIter, EnumString, PartialEq)]
+pub enum ToneMapping {
+    // Clips values above 1.
+    #[strum(serialize = "clamp")]
+    Clamp,
+    // L / (1 + L) on luminance, keeping hues.
+    #[strum(serialize = "reinhard")]
+    Reinhard,
+    // Narkowicz's fit of the ACES filmic curve.
+    #[strum(serialize = "aces")]
+    Aces,
+    // 1 - exp(-x), as if the film was exposed to the light.
+    #[strum(serialize = "exponential")]
+    Exponential,
+}
+
+impl ToneMapping {
+    pub fn apply(self, c: Color) -> Color {
+        match self {
+            ToneMapping::Clamp => c,
+            ToneMapping::Reinhard => {
+                let l = c.luminance();
+                if l <= 0.0 {
+                    return c;
+                }
+                c * (1.0 / (1.0 + l))
+            }
+            ToneMapping::Aces => {
+                let f = |x: f64| (x * (2.51 * x + 0.03)) / (x * (2.43 * x + 0.59) + 0.14);
+                Color::new(f(c.r), f(c.g), f(c.b))
+            }
+            ToneMapping::Exponential => {
+                Color::new(1.0 - (-c.r).exp(), 1.0 - (-c.g).exp(), 1.0 - (-c.b).exp())
+            }
+        }
+        .clamp(0.0, 1.0)
+    }
+}
+
+// Post-processing applied when rendered images are encoded for display. They
+// can be changed without rendering again.
+#[derive(Clone, Debug)]
+pub struct DisplayParams {
+    // Scales radiance by 2^exposure before tone mapping.
+    pub exposure: f64,
+    // Per-channel multipliers applied with the exposure.
+    pub white_balance: Color,
+    pub tone_mapping: ToneMapping,
+    // Gamma of a simple power curve, or None for the sRGB transfer function.
+    pub gamma: Option<f64>,
+    // Shows NaN pixels in magenta instead of black.
+    pub mark_nan: bool,
+}
+
+impl DisplayParams {
+    pub const DEFAULT: DisplayParams = DisplayParams {
+        exposure: 0.0,
+        white_balance: Color::WHITE,
+        tone_mapping: ToneMapping::Clamp,
+        gamma: None,
+        mark_nan: false,
+    };
+
+    // Returns the color to be quantized, in [0, 1].
+    fn map(&self, c: Color) -> Color {
+        if c.is_nan() {
+            return if self.mark_nan {
+                Color::new(1.0, 0.0, 1.0)
+            } else {
+                Color::BLACK
+            };
+        }
+        let c = c * self.white_balance * 2f64.powf(self.exposure);
+        let c = self.tone_mapping.apply(c.clamp(0.0, f64::MAX));
+        match self.gamma {
+            Some(gamma) => c.gamma(gamma),
+            None => c.srgb(),
+        }
+    }
+
+    pub fn encode(&self, c: Color) -> [u8; 3] {
+        self.map(c).encode()
+    }
+
+    pub fn encode16(&self, c: Color) -> [u8; 6] {
+        self.map(c).encode16()
+    }
+}
+
+impl Default for DisplayParams {
+    fn default() -> Self {
+        DisplayParams::DEFAULT
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use strum::IntoEnumIterator;
+
+    #[test]
+    fn test_encode_nan() {
+        let nan = Color::new(0.5, f64::NAN, 0.5);
+        assert_eq!(DisplayParams::DEFAULT.encode(nan), [0, 0, 0]);
+        let display = DisplayParams {
+            mark_nan: true,
+            ..DisplayParams::DEFAULT
+        };
+        assert_eq!(display.encode(nan), [255, 0, 255]);
+        assert_eq!(display.encode(Color::new(0.0, 2.0, 1e300)), [0, 255, 255]);
+    }
+
+    #[test]
+    fn test_exposure() {
+        let display = DisplayParams {
+            exposure: 1.0,
+            white_balance: Color::new(1.0, 0.5, 0.25),
+            gamma: Some(1.0),
+            ..DisplayParams::DEFAULT
+        };
+        assert_eq!(display.encode(Color::new(0.25, 0.5, 1.0)), [127, 127, 127]);
+    }
+
+    #[test]
+    fn test_tone_mapping_range() {
+        for tone_mapping in ToneMapping::iter() {
+            let mut last = 0.0;
+            for i in 0..100 {
+                let x = 1.1f64.powi(i) - 1.0;
+                let y = tone_mapping.apply(Color::new(x, x, x));
+                assert!(
+                    y.r >= last && y.r <= 1.0,
+                    "{}: {} -> {}",
+                    tone_mapping,
+                    x,
+                    y.r
+                );
+                last = y.r;
+            }
+        }
+    }
+}
@@ -0,0 +1,367 @@
+// Equirectangular environment maps loaded from Radiance HDR files.
+//
+// Directions map to image coordinates as sphere surfaces map to textures: the
+// top row is +Y, and the horizontal center is +X.
+//
+// Maps can be sampled as lights: pixels are chosen in proportion to the
+// luminance they contribute, so that a small bright sun is found by next event
+// estimation instead of only by chance.
+
+use crate::color::Color;
+use crate::geom::{Box3, Vec3, Vec3Unit};
+use crate::ray::Ray;
+use crate::rng::Rng;
+use crate::sampler::Sampler;
+use crate::shape::{Hit, Shape};
+use crate::time::TimeRange;
+use anyhow::{bail, Context, Result};
+use rand::Rng as _;
+use std::f64::consts::PI;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::{fmt, fs};
+
+pub struct EnvironmentMap {
+    path: PathBuf,
+    width: usize,
+    height: usize,
+    // Pixels in scanline order starting from the top-left corner.
+    pixels: Vec<Color>,
+    // Cumulative sampling weights of rows, and of pixels in each row. Weights
+    // are scaled by the solid angles of pixels, which shrink toward the poles.
+    row_cdf: Vec<f64>,
+    pixel_cdfs: Vec<Vec<f64>>,
+}
+
+impl fmt::Debug for EnvironmentMap {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("EnvironmentMap")
+            .field("path", &self.path)
+            .field("width", &self.width)
+            .field("height", &self.height)
+            .finish()
+    }
+}
+
+impl EnvironmentMap {
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        let data = fs::read(path)?;
+        let (width, height, pixels) = parse_hdr(&data)?;
+        Ok(Self::new(path, width, height, pixels))
+    }
+
+    fn new(path: &Path, width: usize, height: usize, pixels: Vec<Color>) -> Self {
+        let pixel_cdfs: Vec<Vec<f64>> = pixels
+            .chunks_exact(width)
+            .enumerate()
+            .map(|(y, row)| {
+                let sin = ((y as f64 + 0.5) / height as f64 * PI).sin();
+                cumulative(row.iter().map(|c| c.luminance().max(0.0) * sin))
+            })
+            .collect();
+        let row_cdf = cumulative(pixel_cdfs.iter().map(|cdf| cdf[width]));
+        EnvironmentMap {
+            path: path.to_owned(),
+            width,
+            height,
+            pixels,
+            row_cdf,
+            pixel_cdfs,
+        }
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    pub fn width(&self) -> usize {
+        self.width
+    }
+
+    pub fn height(&self) -> usize {
+        self.height
+    }
+
+    pub fn pixel(&self, x: usize, y: usize) -> Color {
+        self.pixels[y * self.width + x]
+    }
+
+    // Returns the pixel position of the direction in [0, 1]^2.
+    pub fn uv(dir: Vec3Unit) -> (f64, f64) {
+        let theta = (-dir.y).max(-1.0).min(1.0).acos();
+        let phi = f64::atan2(-dir.z, dir.x) + PI;
+        (phi / (2.0 * PI), 1.0 - theta / PI)
+    }
+
+    pub fn color(&self, dir: Vec3Unit) -> Color {
+        let (u, v) = Self::uv(dir);
+        let x = ((u * self.width as f64) as usize).min(self.width - 1);
+        let y = ((v * self.height as f64) as usize).min(self.height - 1);
+        self.pixel(x, y)
+    }
+
+    // Returns the probability density of sampling the direction, with respect
+    // to the solid angle.
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        let total = self.row_cdf[self.height];
+        let sin = (1.0 - dir.y * dir.y).max(0.0).sqrt();
+        if !(total > 0.0) || sin == 0.0 {
+            return 0.0;
+        }
+        let (u, v) = Self::uv(dir);
+        let x = ((u * self.width as f64) as usize).min(self.width - 1);
+        let y = ((v * self.height as f64) as usize).min(self.height - 1);
+        let cdf = &self.pixel_cdfs[y];
+        let p = (cdf[x + 1] - cdf[x]) / total;
+        // Pixels are uniform in (u, v), which spans 2 pi^2 sin(theta) of solid
+        // angle per unit area.
+        p * (self.width * self.height) as f64 / (2.0 * PI * PI * sin)
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        let y = sample_cdf(&self.row_cdf, rng);
+        let x = sample_cdf(&self.pixel_cdfs[y], rng);
+        let u = (x as f64 + rng.gen::<f64>()) / self.width as f64;
+        let v = (y as f64 + rng.gen::<f64>()) / self.height as f64;
+        let phi = 2.0 * PI * u - PI;
+        let theta = (1.0 - v) * PI;
+        Vec3::new(
+            theta.sin() * phi.cos(),
+            -theta.cos(),
+            -theta.sin() * phi.sin(),
+        )
+        .unit()
+    }
+}
+
+fn cumulative(weights: impl Iterator<Item = f64>) -> Vec<f64> {
+    let mut cdf = vec![0.0];
+    let mut sum = 0.0;
+    for w in weights {
+        sum += w;
+        cdf.push(sum);
+    }
+    cdf
+}
+
+// Returns i with probability (cdf[i + 1] - cdf[i]) / cdf[n].
+fn sample_cdf(cdf: &[f64], rng: &mut Rng) -> usize {
+    let target = rng.gen::<f64>() * cdf[cdf.len() - 1];
+    // The first bin ending after target, which is never empty.
+    cdf.partition_point(|&c| c <= target)
+        .max(1)
+        .min(cdf.len() - 1)
+        - 1
+}
+
+// Environment map sampled as a light infinitely far away. It never hits rays;
+// the background is seen by rays escaping the scene.
+#[derive(Clone, Debug)]
+pub struct EnvironmentLight {
+    map: Arc<EnvironmentMap>,
+}
+
+impl Shape for EnvironmentLight {
+    fn hit(&self, _ray: &Ray, _t_min: f64, _t_max: f64) -> Option<Hit> {
+        None
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        Box3::EMPTY
+    }
+
+    fn sampler(&self, _from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        Some(Box::new(self.clone()))
+    }
+
+    fn is_empty(&self) -> bool {
+        !(self.map.row_cdf[self.map.height] > 0.0)
+    }
+}
+
+impl Sampler for EnvironmentLight {
+    fn constant(&self) -> Option<Vec3Unit> {
+        None
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        self.map.sample(rng)
+    }
+
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        self.map.probability(dir)
+    }
+}
+
+impl EnvironmentLight {
+    pub fn new(map: Arc<EnvironmentMap>) -> Self {
+        EnvironmentLight { map }
+    }
+}
+
+pub(crate) fn parse_hdr(data: &[u8]) -> Result<(usize, usize, Vec<Color>)> {
+    let mut pos = 0;
+    let mut next_line = || -> Result<&str> {
+        let len = match data[pos..].iter().position(|&b| b == b'\n') {
+            Some(len) => len,
+            None => bail!("Truncated HDR header"),
+        };
+        let line = std::str::from_utf8(&data[pos..pos + len]).context("Invalid HDR header")?;
+        pos += len + 1;
+        Ok(line)
+    };
+
+    let magic = next_line()?;
+    if !magic.starts_with("#?") {
+        bail!("Not a Radiance HDR file");
+    }
+    loop {
+        let line = next_line()?;
+        if line.is_empty() {
+            break;
+        }
+        if let Some(format) = line.strip_prefix("FORMAT=") {
+            if format != "32-bit_rle_rgbe" {
+                bail!("Unsupported HDR format: {}", format);
+            }
+        }
+    }
+    let resolution = next_line()?;
+    let fields: Vec<&str> = resolution.split_whitespace().collect();
+    let (height, width) = match fields.as_slice() {
+        ["-Y", height, "+X", width] => (
+            height.parse::<usize>().context("Invalid HDR height")?,
+            width.parse::<usize>().context("Invalid HDR width")?,
+        ),
+        _ => bail!("Unsupported HDR orientation: {}", resolution),
+    };
+    if width == 0 || height == 0 {
+        bail!("Empty HDR image");
+    }
+
+    let mut rest = &data[pos..];
+    let mut pixels = Vec::with_capacity(width * height);
+    let mut scanline = vec![0u8; width * 4];
+    for _ in 0..height {
+        let rle = (8..0x8000).contains(&width)
+            && rest.len() >= 4
+            && rest[0] == 2
+            && rest[1] == 2
+            && ((rest[2] as usize) << 8 | rest[3] as usize) == width;
+        if rle {
+            rest = &rest[4..];
+            // Channels are stored one after another, each run-length encoded.
+            for channel in 0..4 {
+                let mut x = 0;
+                while x < width {
+                    let (&count, tail) = match rest.split_first() {
+                        Some(split) => split,
+                        None => bail!("Truncated HDR data"),
+                    };
+                    rest = tail;
+                    if count > 128 {
+                        let count = count as usize - 128;
+                        if x + count > width || rest.is_empty() {
+                            bail!("Corrupted HDR data");
+                        }
+                        for i in x..x + count {
+                            scanline[i * 4 + channel] = rest[0];
+                        }
+                        rest = &rest[1..];
+                        x += count;
+                    } else {
+                        let count = count as usize;
+                        if count == 0 || x + count > width || rest.len() < count {
+                            bail!("Corrupted HDR data");
+                        }
+                        for (i, &b) in rest[..count].iter().enumerate() {
+                            scanline[(x + i) * 4 + channel] = b;
+                        }
+                        rest = &rest[count..];
+                        x += count;
+                    }
+                }
+            }
+        } else {
+            if rest.len() < width * 4 {
+                bail!("Truncated HDR data");
+            }
+            scanline.copy_from_slice(&rest[..width * 4]);
+            rest = &rest[width * 4..];
+        }
+        pixels.extend(
+            scanline
+                .chunks_exact(4)
+                .map(|p| Color::decode_rgbe([p[0], p[1], p[2], p[3]])),
+        );
+    }
+    Ok((width, height, pixels))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use rand::SeedableRng;
+
+    #[test]
+    fn test_parse_hdr() {
+        // Flat scanlines as written by Frame::write_hdr.
+        let mut data = b"#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y 2 +X 1\n".to_vec();
+        data.extend_from_slice(&[128, 128, 128, 129, 128, 64, 0, 128]);
+        let (width, height, pixels) = parse_hdr(&data).unwrap();
+        assert_eq!((width, height), (1, 2));
+        assert!((pixels[0].r - 1.0).abs() < 0.01);
+        assert!((pixels[1].g - 0.25).abs() < 0.01);
+
+        // A run-length encoded scanline of 8 pixels.
+        let mut data = b"#?RADIANCE\n\n-Y 1 +X 8\n".to_vec();
+        data.extend_from_slice(&[2, 2, 0, 8]);
+        data.extend_from_slice(&[136, 128]);
+        data.extend_from_slice(&[4, 0, 64, 128, 255, 132, 32]);
+        data.extend_from_slice(&[136, 0]);
+        data.extend_from_slice(&[136, 129]);
+        let (width, _, pixels) = parse_hdr(&data).unwrap();
+        assert_eq!(width, 8);
+        assert!((pixels[2].r - 1.0).abs() < 0.01);
+        assert!((pixels[1].g - 0.5).abs() < 0.01);
+        assert!((pixels[7].g - 0.25).abs() < 0.01);
+
+        assert!(parse_hdr(b"#?RADIANCE\n\n+Y 1 +X 1\n\0\0\0\0").is_err());
+        assert!(parse_hdr(b"#?RADIANCE\n\n-Y 1 +X 2\n\0\0\0\0").is_err());
+    }
+
+    #[test]
+    fn test_sampling() {
+        // A dim sky with a bright spot, which should take most samples.
+        let (width, height) = (16, 8);
+        let mut pixels = vec![Color::new(0.1, 0.1, 0.1); width * height];
+        pixels[2 * width + 5] = Color::new(100.0, 100.0, 100.0);
+        let map = EnvironmentMap::new(Path::new("test.hdr"), width, height, pixels);
+        let mut rng = Rng::seed_from_u64(28);
+
+        let n = 10000;
+        let mut bright = 0;
+        let mut sum = 0.0;
+        for _ in 0..n {
+            let dir = map.sample(&mut rng);
+            let (u, v) = EnvironmentMap::uv(dir);
+            if (u * width as f64) as usize == 5 && (v * height as f64) as usize == 2 {
+                bright += 1;
+            }
+            sum += 1.0 / map.probability(dir);
+        }
+        assert!(bright > n * 9 / 10);
+        // The estimate of the sphere area is 4 pi.
+        let area = sum / n as f64;
+        assert!((area - 4.0 * PI).abs() < 0.5, "area = {}", area);
+    }
+
+    #[test]
+    fn test_uv() {
+        let (_, v) = EnvironmentMap::uv(Vec3::new(0.0, 1.0, 0.0).unit());
+        assert!(v.abs() < 1e-9);
+        let (u, v) = EnvironmentMap::uv(Vec3::new(1.0, 0.0, 0.0).unit());
+        assert!((u - 0.5).abs() < 1e-9 && (v - 0.5).abs() < 1e-9);
+    }
+}
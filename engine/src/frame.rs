@@ -0,0 +1,180 @@
+use crate::color::Color;
+use crate::display::{DisplayParams, ToneMapping};
+use crate::integrator::IntegratorKind;
+use crate::renderer::Tile;
+use std::io::{Result, Write};
+
+// Rendered image, optionally with AOVs (arbitrary output variables) which are
+// extra images rendered in the same pass by other integrators, e.g. albedo and
+// normals.
+#[derive(Clone, Debug)]
+pub struct Frame {
+    width: u32,
+    height: u32,
+    pixels: Vec<Color>,
+    aovs: Vec<IntegratorKind>,
+    aov_pixels: Vec<Vec<Color>>,
+    rendered: Vec<bool>,
+    rendered_count: usize,
+}
+
+fn write_rgb(pixels: &[Color], display: &DisplayParams, writer: &mut impl Write) -> Result<()> {
+    for color in pixels.iter() {
+        writer.write_all(&display.encode(*color))?;
+    }
+    Ok(())
+}
+
+fn write_rgb16(pixels: &[Color], display: &DisplayParams, writer: &mut impl Write) -> Result<()> {
+    for color in pixels.iter() {
+        writer.write_all(&display.encode16(*color))?;
+    }
+    Ok(())
+}
+
+fn aov_display(display: &DisplayParams) -> DisplayParams {
+    DisplayParams {
+        exposure: 0.0,
+        white_balance: Color::WHITE,
+        tone_mapping: ToneMapping::Clamp,
+        ..display.clone()
+    }
+}
+
+// Writes a Radiance HDR image with linear colors.
+fn write_hdr(width: u32, height: u32, pixels: &[Color], writer: &mut impl Write) -> Result<()> {
+    write!(
+        writer,
+        "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y {} +X {}\n",
+        height, width
+    )?;
+    for color in pixels.iter() {
+        writer.write_all(&color.encode_rgbe())?;
+    }
+    Ok(())
+}
+
+impl Frame {
+    pub fn new(width: u32, height: u32) -> Self {
+        Self::with_aovs(width, height, Vec::new())
+    }
+
+    pub fn with_aovs(width: u32, height: u32, aovs: Vec<IntegratorKind>) -> Self {
+        let size = (width * height) as usize;
+        Frame {
+            width,
+            height,
+            pixels: vec![Color::BLACK; size],
+            aov_pixels: vec![vec![Color::BLACK; size]; aovs.len()],
+            aovs,
+            rendered: vec![false; size],
+            rendered_count: 0,
+        }
+    }
+
+    pub fn width(&self) -> u32 {
+        self.width
+    }
+
+    pub fn height(&self) -> u32 {
+        self.height
+    }
+
+    // Pixels are stored in scanline order starting from the top-left corner.
+    pub fn pixels(&self) -> &[Color] {
+        &self.pixels
+    }
+
+    pub fn aovs(&self) -> &[IntegratorKind] {
+        &self.aovs
+    }
+
+    pub fn aov_pixels(&self, aov: usize) -> &[Color] {
+        &self.aov_pixels[aov]
+    }
+
+    pub fn is_rendered(&self, x: u32, y: u32) -> bool {
+        self.rendered[self.index(x, y)]
+    }
+
+    pub fn rendered_pixels(&self) -> usize {
+        self.rendered_count
+    }
+
+    pub fn is_complete(&self) -> bool {
+        self.rendered_count == self.pixels.len()
+    }
+
+    // AOVs of a pixel should be set before the pixel itself, which marks the
+    // pixel rendered.
+    pub(crate) fn set_aov(&mut self, aov: usize, x: u32, y: u32, color: Color) {
+        let index = self.index(x, y);
+        self.aov_pixels[aov][index] = color;
+    }
+
+    pub(crate) fn set(&mut self, x: u32, y: u32, color: Color) {
+        let index = self.index(x, y);
+        self.pixels[index] = color;
+        if !self.rendered[index] {
+            self.rendered[index] = true;
+            self.rendered_count += 1;
+        }
+    }
+
+    // Sets pixels of a tile rendered elsewhere, e.g. by render_single_tile on
+    // another machine. Each pixel has its color followed by its AOVs.
+    pub fn set_tile(&mut self, tile: &Tile, colors: &[Color]) {
+        let stride = 1 + self.aovs.len();
+        assert_eq!(colors.len(), (tile.width * tile.height) as usize * stride);
+        for (k, pixel) in colors.chunks(stride).enumerate() {
+            let k = k as u32;
+            let (x, y) = (tile.x + k % tile.width, tile.y + k / tile.width);
+            for (aov, color) in pixel[1..].iter().enumerate() {
+                self.set_aov(aov, x, y, *color);
+            }
+            self.set(x, y, pixel[0]);
+        }
+    }
+
+    fn index(&self, x: u32, y: u32) -> usize {
+        assert!(x < self.width && y < self.height);
+        (y * self.width + x) as usize
+    }
+
+    // Writes 8-bit RGB triplets. Pixels not rendered yet are written as black.
+    pub fn write_rgb(&self, display: &DisplayParams, writer: &mut impl Write) -> Result<()> {
+        write_rgb(&self.pixels, display, writer)
+    }
+
+    // AOVs are not exposed nor tone-mapped since they are not radiance.
+    pub fn write_aov_rgb(
+        &self,
+        aov: usize,
+        display: &DisplayParams,
+        writer: &mut impl Write,
+    ) -> Result<()> {
+        write_rgb(&self.aov_pixels[aov], &aov_display(display), writer)
+    }
+
+    // Writes 16-bit RGB triplets in big-endian.
+    pub fn write_rgb16(&self, display: &DisplayParams, writer: &mut impl Write) -> Result<()> {
+        write_rgb16(&self.pixels, display, writer)
+    }
+
+    pub fn write_aov_rgb16(
+        &self,
+        aov: usize,
+        display: &DisplayParams,
+        writer: &mut impl Write,
+    ) -> Result<()> {
+        write_rgb16(&self.aov_pixels[aov], &aov_display(display), writer)
+    }
+
+    pub fn write_hdr(&self, writer: &mut impl Write) -> Result<()> {
+        write_hdr(self.width, self.height, &self.pixels, writer)
+    }
+
+    pub fn write_aov_hdr(&self, aov: usize, writer: &mut impl Write) -> Result<()> {
+        write_hdr(self.width, self.height, &self.aov_pixels[aov], writer)
+    }
+}
@@ -126,6 +126,19 @@ impl std::ops::Neg for Vec3 {
     }
 }
 
+// Formats as (x, y, z), passing the precision to the components.
+impl std::fmt::Display for Vec3 {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("(")?;
+        std::fmt::Display::fmt(&self.x, f)?;
+        f.write_str(", ")?;
+        std::fmt::Display::fmt(&self.y, f)?;
+        f.write_str(", ")?;
+        std::fmt::Display::fmt(&self.z, f)?;
+        f.write_str(")")
+    }
+}
+
 impl Vec3 {
     pub const ZERO: Vec3 = Vec3 {
         x: 0.0,
@@ -272,6 +285,18 @@ impl std::ops::Neg for Vec3Unit {
     }
 }
 
+impl std::fmt::Display for Vec3Unit {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("(")?;
+        std::fmt::Display::fmt(&self.x, f)?;
+        f.write_str(", ")?;
+        std::fmt::Display::fmt(&self.y, f)?;
+        f.write_str(", ")?;
+        std::fmt::Display::fmt(&self.z, f)?;
+        f.write_str(")")
+    }
+}
+
 impl Vec3Unit {
     pub const X: Vec3Unit = Vec3Unit {
         x: 1.0,
@@ -304,15 +329,7 @@ impl Vec3Unit {
             y: r.y,
             z: r.z.abs(),
         };
-        let u = n
-            .cross(if n.x.abs() > 0.9 {
-                Vec3Unit::Y
-            } else {
-                Vec3Unit::X
-            })
-            .unit();
-        let v = n.cross(u).unit();
-        (u * r.x + v * r.y + n * r.z).unit()
+        Onb::from_normal(n).to_world(r).unit()
     }
 
     pub fn rotate_axes(self, mut from: Axis, mut to: Axis) -> Self {
@@ -338,6 +355,58 @@ impl Vec3Unit {
     }
 }
 
+// Orthonormal basis whose w is a surface normal, for working with directions
+// in coordinates local to the surface.
+#[derive(Clone, Copy, Debug)]
+pub struct Onb {
+    pub u: Vec3Unit,
+    pub v: Vec3Unit,
+    pub w: Vec3Unit,
+}
+
+impl Onb {
+    // u is chosen arbitrarily.
+    pub fn from_normal(w: Vec3Unit) -> Self {
+        let u = w
+            .cross(if w.x.abs() > 0.9 {
+                Vec3Unit::Y
+            } else {
+                Vec3Unit::X
+            })
+            .unit();
+        Onb {
+            u,
+            v: w.cross(u).unit(),
+            w,
+        }
+    }
+
+    // u is the tangent made perpendicular to w, or chosen arbitrarily if the
+    // tangent is parallel to w.
+    pub fn from_normal_tangent(w: Vec3Unit, tangent: Vec3Unit) -> Self {
+        let t = tangent - w * tangent.dot(w);
+        if t.norm() < 1e-16 {
+            return Onb::from_normal(w);
+        }
+        let u = t.unit();
+        Onb {
+            u,
+            v: w.cross(u).unit(),
+            w,
+        }
+    }
+
+    pub fn to_world<T: IntoVec3>(&self, a: T) -> Vec3 {
+        let a = a.into_vec3();
+        self.u * a.x + self.v * a.y + self.w * a.z
+    }
+
+    pub fn to_local<T: IntoVec3>(&self, a: T) -> Vec3 {
+        let a = a.into_vec3();
+        Vec3::new(self.u.dot(a), self.v.dot(a), self.w.dot(a))
+    }
+}
+
 #[derive(Clone, Copy, Debug)]
 pub struct Box3 {
     pub min: Vec3,
@@ -385,6 +454,30 @@ impl Box3 {
         Box3::new(self.min + offset, self.max + offset)
     }
 
+    pub fn scale(self, factor: f64) -> Self {
+        Box3::new(self.min * factor, self.max * factor)
+    }
+
+    pub fn center(self) -> Vec3 {
+        (self.min + self.max) / 2.0
+    }
+
+    pub fn surface_area(self) -> f64 {
+        let d = self.max - self.min;
+        2.0 * (d.x * d.y + d.y * d.z + d.z * d.x)
+    }
+
+    pub fn longest_axis(self) -> Axis {
+        let size = self.max - self.min;
+        if size.x >= size.y && size.x >= size.z {
+            Axis::X
+        } else if size.y >= size.z {
+            Axis::Y
+        } else {
+            Axis::Z
+        }
+    }
+
     pub fn iter_vertex(&self) -> Box3VertexIter {
         Box3VertexIter { bb: self, i: 0 }
     }
@@ -410,3 +503,603 @@ impl<'a> Iterator for Box3VertexIter<'a> {
         Some(Vec3::new(x, y, z))
     }
 }
+
+// Precision of coordinates stored in bulk, such as mesh vertices and boxes of
+// BVH nodes. The f32 feature halves their memory footprint and bandwidth,
+// which matters more than accuracy for large scenes and previews.
+#[cfg(not(feature = "f32"))]
+pub type Coord = f64;
+#[cfg(feature = "f32")]
+pub type Coord = f32;
+
+// Rounds toward negative infinity, so that the result never exceeds x.
+#[cfg_attr(not(feature = "f32"), allow(dead_code))]
+fn f32_down(x: f64) -> f32 {
+    let c = x as f32;
+    if (c as f64) <= x || c.is_nan() {
+        c
+    } else if c == 0.0 {
+        -f32::from_bits(1)
+    } else if c > 0.0 {
+        f32::from_bits(c.to_bits() - 1)
+    } else {
+        f32::from_bits(c.to_bits() + 1)
+    }
+}
+
+// Rounds toward positive infinity, so that the result is never below x.
+#[cfg_attr(not(feature = "f32"), allow(dead_code))]
+fn f32_up(x: f64) -> f32 {
+    -f32_down(-x)
+}
+
+#[cfg(not(feature = "f32"))]
+fn coord_down(x: f64) -> Coord {
+    x
+}
+
+#[cfg(not(feature = "f32"))]
+fn coord_up(x: f64) -> Coord {
+    x
+}
+
+#[cfg(feature = "f32")]
+fn coord_down(x: f64) -> Coord {
+    f32_down(x)
+}
+
+#[cfg(feature = "f32")]
+fn coord_up(x: f64) -> Coord {
+    f32_up(x)
+}
+
+// Vec3 stored in the precision of Coord.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct PackedVec3([Coord; 3]);
+
+impl From<Vec3> for PackedVec3 {
+    fn from(v: Vec3) -> Self {
+        PackedVec3([v.x as Coord, v.y as Coord, v.z as Coord])
+    }
+}
+
+impl From<PackedVec3> for Vec3 {
+    fn from(v: PackedVec3) -> Self {
+        Vec3::new(v.0[0] as f64, v.0[1] as f64, v.0[2] as f64)
+    }
+}
+
+// Four boxes stored in the precision of Coord, rounded outward. Bounds are laid
+// out lane by lane, and lanes are computed independently in the same way, so
+// that the compiler tests a ray against all of them with SIMD instructions.
+#[derive(Clone, Copy, Debug)]
+pub struct Box3x4 {
+    min: [[Coord; 4]; 3],
+    max: [[Coord; 4]; 3],
+}
+
+impl Box3x4 {
+    pub const EMPTY: Box3x4 = Box3x4 {
+        min: [[Coord::INFINITY; 4]; 3],
+        max: [[-Coord::INFINITY; 4]; 3],
+    };
+
+    pub fn get(&self, lane: usize) -> Box3 {
+        Box3::new(
+            Vec3::new(
+                self.min[0][lane] as f64,
+                self.min[1][lane] as f64,
+                self.min[2][lane] as f64,
+            ),
+            Vec3::new(
+                self.max[0][lane] as f64,
+                self.max[1][lane] as f64,
+                self.max[2][lane] as f64,
+            ),
+        )
+    }
+
+    pub fn set(&mut self, lane: usize, bb: Box3) {
+        for (k, &axis) in Axis::ALL.iter().enumerate() {
+            self.min[k][lane] = coord_down(bb.min.get(axis));
+            self.max[k][lane] = coord_up(bb.max.get(axis));
+        }
+    }
+
+    // Returns where the ray from the origin with the reciprocal of the
+    // direction enters each box within the range, or infinity for boxes it
+    // misses.
+    pub fn enter(&self, origin: Vec3, inv_dir: Vec3, t_min: f64, t_max: f64) -> [f64; 4] {
+        let origin = [origin.x, origin.y, origin.z];
+        let inv_dir = [inv_dir.x, inv_dir.y, inv_dir.z];
+        let mut t0 = [t_min; 4];
+        let mut t1 = [t_max; 4];
+        for k in 0..3 {
+            for lane in 0..4 {
+                let a = (self.min[k][lane] as f64 - origin[k]) * inv_dir[k];
+                let b = (self.max[k][lane] as f64 - origin[k]) * inv_dir[k];
+                let (near, far) = if a < b { (a, b) } else { (b, a) };
+                t0[lane] = if near > t0[lane] { near } else { t0[lane] };
+                t1[lane] = if far < t1[lane] { far } else { t1[lane] };
+            }
+        }
+        let mut t = [f64::INFINITY; 4];
+        for lane in 0..4 {
+            if t0[lane] <= t1[lane] {
+                t[lane] = t0[lane];
+            }
+        }
+        t
+    }
+}
+
+// Affine or projective transform of homogeneous coordinates, in row-major
+// order. Vectors are columns, so a * b applies b first.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct Mat4 {
+    pub m: [[f64; 4]; 4],
+}
+
+impl Mat4 {
+    pub const IDENTITY: Mat4 = Mat4 {
+        m: [
+            [1.0, 0.0, 0.0, 0.0],
+            [0.0, 1.0, 0.0, 0.0],
+            [0.0, 0.0, 1.0, 0.0],
+            [0.0, 0.0, 0.0, 1.0],
+        ],
+    };
+
+    pub fn new(m: [[f64; 4]; 4]) -> Self {
+        Mat4 { m }
+    }
+
+    pub fn translation(offset: Vec3) -> Self {
+        Mat4::new([
+            [1.0, 0.0, 0.0, offset.x],
+            [0.0, 1.0, 0.0, offset.y],
+            [0.0, 0.0, 1.0, offset.z],
+            [0.0, 0.0, 0.0, 1.0],
+        ])
+    }
+
+    pub fn scaling(factor: Vec3) -> Self {
+        Mat4::new([
+            [factor.x, 0.0, 0.0, 0.0],
+            [0.0, factor.y, 0.0, 0.0],
+            [0.0, 0.0, factor.z, 0.0],
+            [0.0, 0.0, 0.0, 1.0],
+        ])
+    }
+
+    // Same as Vec3::rotate_around.
+    pub fn rotation(axis: Axis, theta: f64) -> Self {
+        let x = Vec3Unit::X.rotate_around(axis, theta);
+        let y = Vec3Unit::Y.rotate_around(axis, theta);
+        let z = Vec3Unit::Z.rotate_around(axis, theta);
+        Mat4::new([
+            [x.x, y.x, z.x, 0.0],
+            [x.y, y.y, z.y, 0.0],
+            [x.z, y.z, z.z, 0.0],
+            [0.0, 0.0, 0.0, 1.0],
+        ])
+    }
+
+    pub fn transpose(&self) -> Self {
+        let mut t = Mat4::IDENTITY;
+        for i in 0..4 {
+            for j in 0..4 {
+                t.m[i][j] = self.m[j][i];
+            }
+        }
+        t
+    }
+
+    // Determinant of the upper-left 3x3 part, i.e. the volume scale of an
+    // affine transform.
+    pub fn linear_determinant(&self) -> f64 {
+        let m = &self.m;
+        m[0][0] * (m[1][1] * m[2][2] - m[1][2] * m[2][1])
+            - m[0][1] * (m[1][0] * m[2][2] - m[1][2] * m[2][0])
+            + m[0][2] * (m[1][0] * m[2][1] - m[1][1] * m[2][0])
+    }
+
+    // Returns None if the matrix is singular or not finite.
+    pub fn inverse(&self) -> Option<Self> {
+        if !self.m.iter().flatten().all(|x| x.is_finite()) {
+            return None;
+        }
+        // Gauss-Jordan elimination with partial pivoting.
+        let mut a = self.m;
+        let mut inv = Mat4::IDENTITY.m;
+        for col in 0..4 {
+            let pivot = (col..4)
+                .max_by(|&i, &j| a[i][col].abs().total_cmp(&a[j][col].abs()))
+                .unwrap();
+            if a[pivot][col].abs() < 1e-12 {
+                return None;
+            }
+            a.swap(col, pivot);
+            inv.swap(col, pivot);
+            let d = a[col][col];
+            for j in 0..4 {
+                a[col][j] /= d;
+                inv[col][j] /= d;
+            }
+            for i in 0..4 {
+                if i == col {
+                    continue;
+                }
+                let f = a[i][col];
+                for j in 0..4 {
+                    a[i][j] -= f * a[col][j];
+                    inv[i][j] -= f * inv[col][j];
+                }
+            }
+        }
+        Some(Mat4::new(inv))
+    }
+
+    pub fn transform_point(&self, p: Vec3) -> Vec3 {
+        let m = &self.m;
+        let x = m[0][0] * p.x + m[0][1] * p.y + m[0][2] * p.z + m[0][3];
+        let y = m[1][0] * p.x + m[1][1] * p.y + m[1][2] * p.z + m[1][3];
+        let z = m[2][0] * p.x + m[2][1] * p.y + m[2][2] * p.z + m[2][3];
+        let w = m[3][0] * p.x + m[3][1] * p.y + m[3][2] * p.z + m[3][3];
+        if w == 1.0 {
+            Vec3::new(x, y, z)
+        } else {
+            Vec3::new(x, y, z) / w
+        }
+    }
+
+    // Ignores the translation. Directions are not normalized.
+    pub fn transform_dir(&self, d: impl IntoVec3) -> Vec3 {
+        let d = d.into_vec3();
+        let m = &self.m;
+        Vec3::new(
+            m[0][0] * d.x + m[0][1] * d.y + m[0][2] * d.z,
+            m[1][0] * d.x + m[1][1] * d.y + m[1][2] * d.z,
+            m[2][0] * d.x + m[2][1] * d.y + m[2][2] * d.z,
+        )
+    }
+
+    // Normals are transformed by the inverse transpose, which should be
+    // computed once by the caller: m.inverse()?.transpose().
+    pub fn transform_normal(inv_transpose: &Mat4, n: Vec3Unit) -> Vec3Unit {
+        inv_transpose.transform_dir(n).unit()
+    }
+
+    pub fn transform_box(&self, bb: Box3) -> Box3 {
+        bb.iter_vertex()
+            .map(|p| self.transform_point(p))
+            .map(|p| Box3::new(p, p))
+            .fold(Box3::EMPTY, Box3::union)
+    }
+}
+
+impl Default for Mat4 {
+    fn default() -> Self {
+        Mat4::IDENTITY
+    }
+}
+
+impl std::ops::Mul<Mat4> for Mat4 {
+    type Output = Mat4;
+
+    fn mul(self, rhs: Mat4) -> Self::Output {
+        let mut m = [[0.0; 4]; 4];
+        for i in 0..4 {
+            for j in 0..4 {
+                m[i][j] = (0..4).map(|k| self.m[i][k] * rhs.m[k][j]).sum();
+            }
+        }
+        Mat4::new(m)
+    }
+}
+
+impl From<Quat> for Mat4 {
+    fn from(q: Quat) -> Self {
+        let Quat { w, x, y, z } = q;
+        Mat4::new([
+            [
+                1.0 - 2.0 * (y * y + z * z),
+                2.0 * (x * y - w * z),
+                2.0 * (x * z + w * y),
+                0.0,
+            ],
+            [
+                2.0 * (x * y + w * z),
+                1.0 - 2.0 * (x * x + z * z),
+                2.0 * (y * z - w * x),
+                0.0,
+            ],
+            [
+                2.0 * (x * z - w * y),
+                2.0 * (y * z + w * x),
+                1.0 - 2.0 * (x * x + y * y),
+                0.0,
+            ],
+            [0.0, 0.0, 0.0, 1.0],
+        ])
+    }
+}
+
+// Rotation represented by a unit quaternion w + xi + yj + zk. Like Mat4, a * b
+// applies b first.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct Quat {
+    pub w: f64,
+    pub x: f64,
+    pub y: f64,
+    pub z: f64,
+}
+
+impl Quat {
+    pub const IDENTITY: Quat = Quat {
+        w: 1.0,
+        x: 0.0,
+        y: 0.0,
+        z: 0.0,
+    };
+
+    pub fn new(w: f64, x: f64, y: f64, z: f64) -> Self {
+        Quat { w, x, y, z }
+    }
+
+    // Rotates counterclockwise by theta radians looking from the tip of axis.
+    pub fn from_axis_angle(axis: Vec3Unit, theta: f64) -> Self {
+        let (s, c) = (theta / 2.0).sin_cos();
+        Quat::new(c, axis.x * s, axis.y * s, axis.z * s)
+    }
+
+    pub fn dot(self, rhs: Quat) -> f64 {
+        self.w * rhs.w + self.x * rhs.x + self.y * rhs.y + self.z * rhs.z
+    }
+
+    pub fn normalize(self) -> Self {
+        let n = self.dot(self).sqrt();
+        Quat::new(self.w / n, self.x / n, self.y / n, self.z / n)
+    }
+
+    // Inverse of a unit quaternion.
+    pub fn conjugate(self) -> Self {
+        Quat::new(self.w, -self.x, -self.y, -self.z)
+    }
+
+    pub fn rotate(self, v: impl IntoVec3) -> Vec3 {
+        // v' = v + 2w(q x v) + 2q x (q x v) where q is the vector part.
+        let v = v.into_vec3();
+        let q = Vec3::new(self.x, self.y, self.z);
+        let t = q.cross(v) * 2.0;
+        v + t * self.w + q.cross(t)
+    }
+
+    // Spherical linear interpolation along the shorter arc.
+    pub fn slerp(self, other: Quat, t: f64) -> Self {
+        let mut cos = self.dot(other);
+        let other = if cos < 0.0 {
+            cos = -cos;
+            Quat::new(-other.w, -other.x, -other.y, -other.z)
+        } else {
+            other
+        };
+        let (a, b) = if cos > 0.9995 {
+            // Nearly parallel; fall back to linear interpolation.
+            (1.0 - t, t)
+        } else {
+            let theta = cos.acos();
+            let sin = theta.sin();
+            (((1.0 - t) * theta).sin() / sin, (t * theta).sin() / sin)
+        };
+        Quat::new(
+            a * self.w + b * other.w,
+            a * self.x + b * other.x,
+            a * self.y + b * other.y,
+            a * self.z + b * other.z,
+        )
+        .normalize()
+    }
+}
+
+impl Default for Quat {
+    fn default() -> Self {
+        Quat::IDENTITY
+    }
+}
+
+impl std::ops::Mul<Quat> for Quat {
+    type Output = Quat;
+
+    fn mul(self, rhs: Quat) -> Self::Output {
+        Quat::new(
+            self.w * rhs.w - self.x * rhs.x - self.y * rhs.y - self.z * rhs.z,
+            self.w * rhs.x + self.x * rhs.w + self.y * rhs.z - self.z * rhs.y,
+            self.w * rhs.y - self.x * rhs.z + self.y * rhs.w + self.z * rhs.x,
+            self.w * rhs.z + self.x * rhs.y - self.y * rhs.x + self.z * rhs.w,
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use rand::SeedableRng;
+
+    fn assert_near(a: Vec3, b: Vec3) {
+        assert!((a - b).abs() < 1e-9, "{:?} != {:?}", a, b);
+    }
+
+    #[test]
+    fn test_onb() {
+        let w = Vec3::new(1.0, 2.0, 3.0).unit();
+        for onb in [
+            Onb::from_normal(w),
+            Onb::from_normal(Vec3Unit::X),
+            Onb::from_normal_tangent(w, Vec3Unit::Y),
+            Onb::from_normal_tangent(Vec3Unit::Y, Vec3Unit::Y),
+        ]
+        .iter()
+        {
+            assert!(onb.u.dot(onb.v).abs() < 1e-9);
+            assert!(onb.v.dot(onb.w).abs() < 1e-9);
+            assert!(onb.w.dot(onb.u).abs() < 1e-9);
+            assert_near(onb.u.cross(onb.v).into_vec3(), onb.w.into_vec3());
+            let a = Vec3::new(0.5, -1.0, 2.0);
+            assert_near(onb.to_local(onb.to_world(a)), a);
+        }
+        let onb = Onb::from_normal_tangent(Vec3Unit::Z, Vec3::new(1.0, 0.0, 1.0).unit());
+        assert_near(onb.u.into_vec3(), Vec3Unit::X.into_vec3());
+    }
+
+    #[test]
+    fn test_mat4_compose_and_invert() {
+        let m = Mat4::translation(Vec3::new(1.0, 2.0, 3.0))
+            * Mat4::rotation(Axis::Y, 0.7)
+            * Mat4::scaling(Vec3::new(2.0, 3.0, 4.0));
+        let p = Vec3::new(0.5, -1.0, 2.0);
+        let expected =
+            (Vec3::new(1.0, -3.0, 8.0).rotate_around(Axis::Y, 0.7)) + Vec3::new(1.0, 2.0, 3.0);
+        assert_near(m.transform_point(p), expected);
+        assert_near(
+            m.transform_dir(p),
+            Vec3::new(1.0, -3.0, 8.0).rotate_around(Axis::Y, 0.7),
+        );
+
+        let inv = m.inverse().unwrap();
+        assert_near(inv.transform_point(m.transform_point(p)), p);
+        let id = m * inv;
+        for i in 0..4 {
+            for j in 0..4 {
+                assert!((id.m[i][j] - Mat4::IDENTITY.m[i][j]).abs() < 1e-9);
+            }
+        }
+        assert!(Mat4::scaling(Vec3::new(1.0, 0.0, 1.0)).inverse().is_none());
+        assert!(Mat4::scaling(Vec3::new(1.0, f64::NAN, 1.0))
+            .inverse()
+            .is_none());
+        assert!(Mat4::translation(Vec3::new(f64::INFINITY, 0.0, 0.0))
+            .inverse()
+            .is_none());
+    }
+
+    #[test]
+    fn test_mat4_normal() {
+        // Normals stay perpendicular to surfaces under non-uniform scaling.
+        let m = Mat4::scaling(Vec3::new(1.0, 4.0, 1.0));
+        let tangent = m.transform_dir(Vec3::new(1.0, -1.0, 0.0));
+        let n = Mat4::transform_normal(
+            &m.inverse().unwrap().transpose(),
+            Vec3::new(1.0, 1.0, 0.0).unit(),
+        );
+        assert!(n.dot(tangent).abs() < 1e-9);
+    }
+
+    #[test]
+    fn test_quat() {
+        let axis = Vec3::new(1.0, 2.0, -0.5).unit();
+        let v = Vec3::new(0.3, -1.0, 2.0);
+        for &theta in [0.0, 0.5, 2.0, -3.0].iter() {
+            let q = Quat::from_axis_angle(axis, theta);
+            assert_near(Mat4::from(q).transform_point(v), q.rotate(v));
+            assert_near(q.conjugate().rotate(q.rotate(v)), v);
+        }
+        let q = Quat::from_axis_angle(Vec3Unit::Y, 0.7);
+        assert_near(q.rotate(v), v.rotate_around(Axis::Y, 0.7));
+        assert_near(
+            Mat4::from(q).transform_point(v),
+            Mat4::rotation(Axis::Y, 0.7).transform_point(v),
+        );
+
+        let a = Quat::from_axis_angle(Vec3Unit::Z, 0.2);
+        let b = Quat::from_axis_angle(Vec3Unit::X, 1.1);
+        assert_near((a * b).rotate(v), a.rotate(b.rotate(v)));
+
+        let c = Quat::from_axis_angle(Vec3Unit::Z, 1.0);
+        assert_near(
+            a.slerp(c, 0.5).rotate(v),
+            Quat::from_axis_angle(Vec3Unit::Z, 0.6).rotate(v),
+        );
+        assert_near(a.slerp(c, 0.0).rotate(v), a.rotate(v));
+        assert_near(a.slerp(c, 1.0).rotate(v), c.rotate(v));
+    }
+
+    #[test]
+    fn test_f32_rounding() {
+        // Tested in any precision of Coord.
+        let values = [
+            0.1, -0.1, 1e-50, -1e-50, 0.0, 3.3, -7.7e10, 1e300, -1e300, 1.0,
+        ];
+        for &x in values.iter() {
+            let (down, up) = (f32_down(x), f32_up(x));
+            assert!(
+                (down as f64) <= x && x <= (up as f64),
+                "{}: {} {}",
+                x,
+                down,
+                up
+            );
+            if x as f32 as f64 == x {
+                assert_eq!((down, up), (x as f32, x as f32));
+            }
+        }
+        // The nearest ones are taken on both sides.
+        assert_eq!(f32_up(0.1), 0.1f32);
+        assert_eq!(f32_down(0.1), f32::from_bits(0.1f32.to_bits() - 1));
+        assert_eq!(f32_down(-1e-50), -f32::from_bits(1));
+        assert_eq!(f32_up(-1e-50), 0.0);
+        assert_eq!(f32_down(1e300), f32::MAX);
+        assert_eq!(f32_up(1e300), f32::INFINITY);
+        assert!(f32_down(f64::NAN).is_nan());
+    }
+
+    #[test]
+    fn test_box3x4() {
+        let values = [0.1, -0.1, 1e-50, -1e-50, 0.0, 3.3, -7.7e10, 1e300, -1e300];
+        let mut boxes = Box3x4::EMPTY;
+        for &min in values.iter() {
+            for &max in values.iter() {
+                let bb = Box3::new(Vec3::new(min, min, 0.0), Vec3::new(max, 1.0, max));
+                boxes.set(1, bb);
+                let packed = boxes.get(1);
+                assert!(packed.min.x <= bb.min.x && packed.min.y <= bb.min.y);
+                assert!(packed.max.x >= bb.max.x && packed.max.z >= bb.max.z);
+            }
+        }
+
+        let unit = Box3::new(Vec3::ZERO, Vec3::new(1.0, 1.0, 1.0));
+        for lane in 0..4 {
+            boxes.set(lane, unit.translate(Vec3::new(0.0, 0.0, lane as f64 * 2.0)));
+        }
+        let origin = Vec3::new(0.5, 0.5, -1.0);
+        let t = boxes.enter(
+            origin,
+            Vec3::new(f64::INFINITY, f64::INFINITY, 1.0),
+            0.0,
+            6.0,
+        );
+        assert_eq!(t, [1.0, 3.0, 5.0, f64::INFINITY]);
+        let origin = Vec3::new(-0.5, 0.5, -1.0);
+        let t = boxes.enter(origin, Vec3::new(1.0, f64::INFINITY, 1.0), 0.0, 6.0);
+        assert_eq!(t, [1.0, f64::INFINITY, f64::INFINITY, f64::INFINITY]);
+    }
+
+    #[test]
+    fn test_unit() {
+        let mut rng = Rng::seed_from_u64(28);
+        for _ in 0..10000 {
+            let scale = 10f64.powf(rng.gen_range(-100.0..100.0));
+            let v = Vec3::random_in_unit_sphere(&mut rng) * scale;
+            let u = v.unit();
+            assert!(
+                (u.into_vec3().abs() - 1.0).abs() < 1e-12,
+                "{:?} -> {:?}",
+                v,
+                u
+            );
+            assert!(u.dot(v) > 0.0, "{:?} -> {:?}", v, u);
+        }
+        let u = Vec3::new(0.0, -1e-100, 0.0).unit();
+        assert_eq!((u.x, u.y, u.z), (0.0, -1.0, 0.0));
+    }
+}
@@ -0,0 +1,582 @@
+// Importer of glTF 2.0 files, in either the JSON form with buffers in separate
+// files or data URIs, or the binary GLB form. Triangle meshes of the default
+// scene are converted to objects with transforms of their nodes applied, and
+// metallic-roughness materials to PBR materials. Cameras, lights, animations
+// and sparse accessors are ignored.
+
+use crate::accel::AcceleratorKind;
+use crate::color::Color;
+use crate::geom::{IntoVec3, Mat4, Quat, Vec3};
+use crate::material::{DiffuseLight, Material, Pbr};
+use crate::mesh::{vertex_normals, Mesh};
+use crate::object::{ObjectPtr, SolidObject};
+use crate::texture::{Image, SolidColor, Texture, Tinted};
+use anyhow::{bail, Context, Result};
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::Arc;
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Document {
+    scene: Option<usize>,
+    #[serde(default)]
+    scenes: Vec<SceneDef>,
+    #[serde(default)]
+    nodes: Vec<NodeDef>,
+    #[serde(default)]
+    meshes: Vec<MeshDef>,
+    #[serde(default)]
+    accessors: Vec<AccessorDef>,
+    #[serde(default)]
+    buffer_views: Vec<BufferViewDef>,
+    #[serde(default)]
+    buffers: Vec<BufferDef>,
+    #[serde(default)]
+    materials: Vec<MaterialDef>,
+    #[serde(default)]
+    textures: Vec<TextureDef>,
+    #[serde(default)]
+    images: Vec<ImageDef>,
+}
+
+#[derive(Deserialize)]
+struct SceneDef {
+    #[serde(default)]
+    nodes: Vec<usize>,
+}
+
+#[derive(Deserialize)]
+struct NodeDef {
+    #[serde(default)]
+    children: Vec<usize>,
+    mesh: Option<usize>,
+    // Column-major.
+    matrix: Option<[f64; 16]>,
+    translation: Option<[f64; 3]>,
+    // Quaternion in x, y, z, w.
+    rotation: Option<[f64; 4]>,
+    scale: Option<[f64; 3]>,
+}
+
+#[derive(Deserialize)]
+struct MeshDef {
+    primitives: Vec<PrimitiveDef>,
+}
+
+#[derive(Deserialize)]
+struct PrimitiveDef {
+    attributes: HashMap<String, usize>,
+    indices: Option<usize>,
+    material: Option<usize>,
+    #[serde(default = "default_mode")]
+    mode: u32,
+}
+
+fn default_mode() -> u32 {
+    TRIANGLES
+}
+
+const TRIANGLES: u32 = 4;
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct AccessorDef {
+    buffer_view: Option<usize>,
+    #[serde(default)]
+    byte_offset: usize,
+    component_type: u32,
+    #[serde(default)]
+    normalized: bool,
+    count: usize,
+    #[serde(rename = "type")]
+    kind: String,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct BufferViewDef {
+    buffer: usize,
+    #[serde(default)]
+    byte_offset: usize,
+    byte_length: usize,
+    byte_stride: Option<usize>,
+}
+
+#[derive(Deserialize)]
+struct BufferDef {
+    uri: Option<String>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct MaterialDef {
+    pbr_metallic_roughness: Option<PbrDef>,
+    #[serde(default)]
+    emissive_factor: [f64; 3],
+}
+
+#[derive(Clone, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct PbrDef {
+    #[serde(default = "default_base_color")]
+    base_color_factor: [f64; 4],
+    base_color_texture: Option<TextureInfoDef>,
+    #[serde(default = "default_factor")]
+    metallic_factor: f64,
+    #[serde(default = "default_factor")]
+    roughness_factor: f64,
+}
+
+impl Default for PbrDef {
+    fn default() -> Self {
+        PbrDef {
+            base_color_factor: default_base_color(),
+            base_color_texture: None,
+            metallic_factor: default_factor(),
+            roughness_factor: default_factor(),
+        }
+    }
+}
+
+fn default_base_color() -> [f64; 4] {
+    [1.0, 1.0, 1.0, 1.0]
+}
+
+fn default_factor() -> f64 {
+    1.0
+}
+
+#[derive(Clone, Deserialize)]
+struct TextureInfoDef {
+    index: usize,
+}
+
+#[derive(Deserialize)]
+struct TextureDef {
+    source: Option<usize>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct ImageDef {
+    uri: Option<String>,
+    buffer_view: Option<usize>,
+    mime_type: Option<String>,
+}
+
+struct Importer<'a> {
+    doc: Document,
+    dir: &'a Path,
+    buffers: Vec<Vec<u8>>,
+    materials: HashMap<Option<usize>, Arc<dyn Material>>,
+    images: HashMap<usize, Arc<dyn Texture>>,
+    smooth: bool,
+    accelerator: AcceleratorKind,
+}
+
+// Loads objects in the file, transformed by the matrix. If smooth, normals are
+// computed for meshes lacking them. Meshes are built with the acceleration
+// structure of the kind.
+pub fn load_gltf(
+    path: &Path,
+    transform: Mat4,
+    smooth: bool,
+    accelerator: AcceleratorKind,
+) -> Result<Vec<ObjectPtr>> {
+    let data = std::fs::read(path)?;
+    let (json, bin) = if data.starts_with(b"glTF") {
+        parse_glb(&data)?
+    } else {
+        (&data[..], None)
+    };
+    // JSON is a subset of YAML.
+    let doc: Document = serde_yaml::from_str(std::str::from_utf8(json)?)?;
+    let dir = path.parent().unwrap_or_else(|| Path::new(""));
+
+    let mut buffers = Vec::new();
+    for (i, buffer) in doc.buffers.iter().enumerate() {
+        buffers.push(match (&buffer.uri, bin) {
+            (Some(uri), _) => read_uri(uri, dir)?,
+            // Only the first buffer may refer to the binary chunk of GLB.
+            (None, Some(bin)) if i == 0 => bin.to_vec(),
+            (None, _) => bail!("Buffer {} has no data", i),
+        });
+    }
+
+    let mut importer = Importer {
+        doc,
+        dir,
+        buffers,
+        materials: HashMap::new(),
+        images: HashMap::new(),
+        smooth,
+        accelerator,
+    };
+    // Files without scenes have nothing to show.
+    let roots = match (importer.doc.scene, importer.doc.scenes.first()) {
+        (Some(scene), _) => importer
+            .doc
+            .scenes
+            .get(scene)
+            .context("Missing scene")?
+            .nodes
+            .clone(),
+        (None, Some(scene)) => scene.nodes.clone(),
+        (None, None) => Vec::new(),
+    };
+    let mut objects = Vec::new();
+    for root in roots {
+        importer.node(root, transform, &mut objects, 0)?;
+    }
+    Ok(objects)
+}
+
+// Splits GLB into the JSON chunk and the optional binary chunk.
+fn parse_glb(data: &[u8]) -> Result<(&[u8], Option<&[u8]>)> {
+    let u32_at = |offset: usize| -> Result<usize> {
+        let b = data.get(offset..offset + 4).context("Truncated GLB")?;
+        Ok(u32::from_le_bytes([b[0], b[1], b[2], b[3]]) as usize)
+    };
+    if u32_at(4)? != 2 {
+        bail!("Unsupported GLB version: {}", u32_at(4)?);
+    }
+    let mut json = None;
+    let mut bin = None;
+    let mut offset = 12;
+    while offset + 8 <= data.len() {
+        let len = u32_at(offset)?;
+        let kind = u32_at(offset + 4)?;
+        let chunk = data
+            .get(offset + 8..offset + 8 + len)
+            .context("Truncated GLB")?;
+        match kind {
+            0x4e4f534a => json = Some(chunk),
+            0x004e4942 => bin = Some(chunk),
+            _ => {}
+        }
+        offset += 8 + len;
+    }
+    Ok((json.context("GLB has no JSON chunk")?, bin))
+}
+
+// Reads a file relative to dir, or the data of a data URI.
+fn read_uri(uri: &str, dir: &Path) -> Result<Vec<u8>> {
+    if uri.starts_with("data:") {
+        let (_, data) = uri.split_at(uri.find(',').context("Malformed data URI")? + 1);
+        return decode_base64(data);
+    }
+    let path = dir.join(percent_decode(uri));
+    std::fs::read(&path).with_context(|| format!("Failed to read {}", path.display()))
+}
+
+fn decode_base64(text: &str) -> Result<Vec<u8>> {
+    let mut data = Vec::with_capacity(text.len() * 3 / 4);
+    let mut bits = 0u32;
+    let mut len = 0;
+    for c in text.bytes().take_while(|c| *c != b'=') {
+        let value = match c {
+            b'A'..=b'Z' => c - b'A',
+            b'a'..=b'z' => c - b'a' + 26,
+            b'0'..=b'9' => c - b'0' + 52,
+            b'+' => 62,
+            b'/' => 63,
+            _ => bail!("Invalid base64 character: {:?}", c as char),
+        };
+        bits = bits << 6 | value as u32;
+        len += 6;
+        if len >= 8 {
+            len -= 8;
+            data.push((bits >> len) as u8);
+        }
+    }
+    Ok(data)
+}
+
+fn percent_decode(text: &str) -> String {
+    let bytes = text.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let hex = bytes
+            .get(i + 1..i + 3)
+            .and_then(|h| std::str::from_utf8(h).ok())
+            .and_then(|h| u8::from_str_radix(h, 16).ok());
+        match (bytes[i], hex) {
+            (b'%', Some(b)) => {
+                decoded.push(b);
+                i += 3;
+            }
+            (b, _) => {
+                decoded.push(b);
+                i += 1;
+            }
+        }
+    }
+    String::from_utf8_lossy(&decoded).into_owned()
+}
+
+impl<'a> Importer<'a> {
+    fn node(
+        &mut self,
+        index: usize,
+        parent: Mat4,
+        objects: &mut Vec<ObjectPtr>,
+        depth: usize,
+    ) -> Result<()> {
+        if depth > 64 {
+            bail!("Node hierarchy is too deep");
+        }
+        let node = self.doc.nodes.get(index).context("Missing node")?;
+        let local = match node.matrix {
+            Some(m) => {
+                let mut rows = [[0.0; 4]; 4];
+                for (i, value) in m.iter().enumerate() {
+                    rows[i % 4][i / 4] = *value;
+                }
+                Mat4::new(rows)
+            }
+            None => {
+                let t = node.translation.unwrap_or([0.0; 3]);
+                let [x, y, z, w] = node.rotation.unwrap_or([0.0, 0.0, 0.0, 1.0]);
+                let s = node.scale.unwrap_or([1.0; 3]);
+                Mat4::translation(Vec3::new(t[0], t[1], t[2]))
+                    * Mat4::from(Quat::new(w, x, y, z).normalize())
+                    * Mat4::scaling(Vec3::new(s[0], s[1], s[2]))
+            }
+        };
+        let transform = parent * local;
+        let children = node.children.clone();
+        if let Some(mesh) = node.mesh {
+            self.mesh(mesh, transform, objects)?;
+        }
+        for child in children {
+            self.node(child, transform, objects, depth + 1)?;
+        }
+        Ok(())
+    }
+
+    fn mesh(&mut self, index: usize, transform: Mat4, objects: &mut Vec<ObjectPtr>) -> Result<()> {
+        let count = self
+            .doc
+            .meshes
+            .get(index)
+            .context("Missing mesh")?
+            .primitives
+            .len();
+        for i in 0..count {
+            let primitive = &self.doc.meshes[index].primitives[i];
+            if primitive.mode != TRIANGLES {
+                continue;
+            }
+            let position = *primitive
+                .attributes
+                .get("POSITION")
+                .context("Primitive has no positions")?;
+            let texcoord = primitive.attributes.get("TEXCOORD_0").copied();
+            let normal = primitive.attributes.get("NORMAL").copied();
+            let (indices, material) = (primitive.indices, primitive.material);
+
+            let vertices: Vec<Vec3> = self
+                .accessor(position, 3)?
+                .chunks_exact(3)
+                .map(|p| transform.transform_point(Vec3::new(p[0], p[1], p[2])))
+                .collect();
+            let corners: Vec<usize> = match indices {
+                Some(indices) => self
+                    .accessor(indices, 1)?
+                    .into_iter()
+                    .map(|i| i as usize)
+                    .collect(),
+                None => (0..vertices.len()).collect(),
+            };
+            if let Some(i) = corners.iter().find(|i| **i >= vertices.len()) {
+                bail!("Vertex index out of range: {}", i);
+            }
+            let faces: Vec<[usize; 3]> = corners
+                .chunks_exact(3)
+                .map(|c| [c[0], c[1], c[2]])
+                .collect();
+            // The origin of texture coordinates is at the top left of images.
+            let uvs = match texcoord {
+                Some(texcoord) => self
+                    .accessor(texcoord, 2)?
+                    .chunks_exact(2)
+                    .map(|uv| [uv[0], 1.0 - uv[1]])
+                    .collect(),
+                None => Vec::new(),
+            };
+            if !uvs.is_empty() && uvs.len() != vertices.len() {
+                bail!("Texture coordinates do not match vertices");
+            }
+            // Degenerate transforms flatten meshes, which have no normals.
+            let normals = match (normal, transform.inverse()) {
+                (Some(normal), Some(inverse)) => {
+                    let inv_transpose = inverse.transpose();
+                    self.accessor(normal, 3)?
+                        .chunks_exact(3)
+                        .map(|n| {
+                            let n = Vec3::new(n[0], n[1], n[2]);
+                            if n.norm() > 0.0 {
+                                Mat4::transform_normal(&inv_transpose, n.unit()).into_vec3()
+                            } else {
+                                n
+                            }
+                        })
+                        .collect()
+                }
+                _ if self.smooth => vertex_normals(&vertices, &faces),
+                _ => Vec::new(),
+            };
+            if !normals.is_empty() && normals.len() != vertices.len() {
+                bail!("Normals do not match vertices");
+            }
+
+            let material = self.material(material)?;
+            objects.push(SolidObject::new_rc(
+                Mesh::with_attributes(vertices, faces, uvs, normals)
+                    .with_accelerator(self.accelerator),
+                material,
+            ));
+        }
+        Ok(())
+    }
+
+    // Reads elements of the accessor, which must have the number of
+    // components, as a flat list.
+    fn accessor(&self, index: usize, components: usize) -> Result<Vec<f64>> {
+        let accessor = self.doc.accessors.get(index).context("Missing accessor")?;
+        let expected = match components {
+            1 => "SCALAR",
+            2 => "VEC2",
+            _ => "VEC3",
+        };
+        if accessor.kind != expected {
+            bail!("Accessor type {} is not {}", accessor.kind, expected);
+        }
+        let view = match accessor.buffer_view {
+            Some(view) => self
+                .doc
+                .buffer_views
+                .get(view)
+                .context("Missing buffer view")?,
+            None => return Ok(vec![0.0; accessor.count * components]),
+        };
+        let size = match accessor.component_type {
+            5120 | 5121 => 1,
+            5122 | 5123 => 2,
+            5125 | 5126 => 4,
+            t => bail!("Unknown component type: {}", t),
+        };
+        let stride = view.byte_stride.unwrap_or(size * components);
+        let buffer = self.buffers.get(view.buffer).context("Missing buffer")?;
+        let data = buffer
+            .get(view.byte_offset..view.byte_offset + view.byte_length)
+            .context("Buffer view out of range")?;
+
+        let mut values = Vec::with_capacity(accessor.count * components);
+        for i in 0..accessor.count {
+            for c in 0..components {
+                let offset = accessor.byte_offset + i * stride + c * size;
+                let b = data
+                    .get(offset..offset + size)
+                    .context("Accessor out of range")?;
+                let (value, max) = match accessor.component_type {
+                    5120 => (b[0] as i8 as f64, 127.0),
+                    5121 => (b[0] as f64, 255.0),
+                    5122 => (i16::from_le_bytes([b[0], b[1]]) as f64, 32767.0),
+                    5123 => (u16::from_le_bytes([b[0], b[1]]) as f64, 65535.0),
+                    5125 => (u32::from_le_bytes([b[0], b[1], b[2], b[3]]) as f64, 1.0),
+                    _ => (f32::from_le_bytes([b[0], b[1], b[2], b[3]]) as f64, 1.0),
+                };
+                values.push(if accessor.normalized {
+                    (value / max).max(-1.0)
+                } else {
+                    value
+                });
+            }
+        }
+        Ok(values)
+    }
+
+    fn material(&mut self, index: Option<usize>) -> Result<Arc<dyn Material>> {
+        if let Some(material) = self.materials.get(&index) {
+            return Ok(material.clone());
+        }
+        let (pbr, emissive) = match index {
+            Some(i) => {
+                let def = self.doc.materials.get(i).context("Missing material")?;
+                let pbr = def.pbr_metallic_roughness.clone().unwrap_or_default();
+                (pbr, def.emissive_factor)
+            }
+            None => (PbrDef::default(), [0.0; 3]),
+        };
+
+        let material: Arc<dyn Material> = if emissive.iter().any(|e| *e > 0.0) {
+            let emissive = Color::new(emissive[0], emissive[1], emissive[2]);
+            Arc::new(DiffuseLight::new(SolidColor::new(emissive)))
+        } else {
+            let [r, g, b, _] = pbr.base_color_factor;
+            let factor = Color::new(r, g, b);
+            let texture: Arc<dyn Texture> = match &pbr.base_color_texture {
+                Some(info) => Arc::new(Tinted::new(self.texture(info.index)?, factor)),
+                None => Arc::new(SolidColor::new(factor)),
+            };
+            Arc::new(Pbr::new(texture, pbr.roughness_factor, pbr.metallic_factor))
+        };
+        self.materials.insert(index, material.clone());
+        Ok(material)
+    }
+
+    fn texture(&mut self, index: usize) -> Result<Arc<dyn Texture>> {
+        let source = self
+            .doc
+            .textures
+            .get(index)
+            .context("Missing texture")?
+            .source
+            .context("Texture has no image")?;
+        if let Some(image) = self.images.get(&source) {
+            return Ok(image.clone());
+        }
+        let def = self.doc.images.get(source).context("Missing image")?;
+        let image = match (&def.uri, def.buffer_view) {
+            (Some(uri), _) if !uri.starts_with("data:") => {
+                Image::load(self.dir.join(percent_decode(uri)))?
+            }
+            (Some(uri), _) => {
+                Image::decode(&read_uri(uri, self.dir)?, uri.starts_with("data:image/png"))?
+            }
+            (None, Some(view)) => {
+                let view = self
+                    .doc
+                    .buffer_views
+                    .get(view)
+                    .context("Missing buffer view")?;
+                let data = self
+                    .buffers
+                    .get(view.buffer)
+                    .and_then(|b| b.get(view.byte_offset..view.byte_offset + view.byte_length))
+                    .context("Buffer view out of range")?;
+                Image::decode(data, def.mime_type.as_deref() == Some("image/png"))?
+            }
+            (None, None) => bail!("Image {} has no data", source),
+        };
+        let image: Arc<dyn Texture> = Arc::new(image);
+        self.images.insert(source, image.clone());
+        Ok(image)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_decode_base64() {
+        assert_eq!(decode_base64("aGVsbG8=").unwrap(), b"hello");
+        assert_eq!(decode_base64("AAEC/w==").unwrap(), vec![0, 1, 2, 255]);
+        assert!(decode_base64("a*b").is_err());
+    }
+}
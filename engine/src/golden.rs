@@ -0,0 +1,156 @@
+// Golden-image regression tests. Tiny images of built-in scenes are rendered
+// with fixed seeds and compared against references in testdata/golden, so that
+// refactoring integrators or materials can't change the output unnoticed.
+//
+// After an intended change, write the references again with
+//
+//   UPDATE_GOLDEN=1 cargo test --release -p engine golden
+//
+// and look at the new images before committing them.
+
+use crate::color::Color;
+use crate::display::DisplayParams;
+use crate::environment::parse_hdr;
+use crate::frame::Frame;
+use crate::renderer::{render, RenderParams};
+use crate::rng::Rng;
+use crate::scene::SceneRegistry;
+use rand::SeedableRng;
+use std::fs::{self, File};
+use std::io::BufWriter;
+use std::path::PathBuf;
+use std::sync::atomic::AtomicBool;
+
+const WIDTH: u32 = 64;
+const SAMPLES_PER_PIXEL: usize = 8;
+
+// Differences are measured on 8-bit sRGB values as the images are displayed.
+// Small ones are allowed everywhere since references are stored in RGBE, and
+// large ones only in a few pixels since a changed rounding can send a path
+// elsewhere.
+const MAX_MEAN_DIFF: f64 = 1.0;
+const LARGE_DIFF: u8 = 16;
+const MAX_LARGE_DIFF_RATIO: f64 = 0.01;
+
+fn golden_path(name: &str) -> PathBuf {
+    PathBuf::from(env!("CARGO_MANIFEST_DIR"))
+        .join("testdata/golden")
+        .join(format!("{}.hdr", name.replace('/', "_")))
+}
+
+fn render_scene(name: &str) -> Frame {
+    let mut rng = Rng::seed_from_u64(28);
+    let (params, camera, world) = SceneRegistry::with_builtins().load(name, &mut rng).unwrap();
+    // Keep the aspect ratio of the scene as the camera is set up for it.
+    let params = RenderParams {
+        width: WIDTH,
+        height: (WIDTH * params.height + params.width / 2) / params.width,
+        samples_per_pixel: SAMPLES_PER_PIXEL,
+        ..params
+    };
+    let mut frame = Frame::new(params.width, params.height);
+    let cancel = AtomicBool::new(false);
+    render(&camera, &world, &params, &mut frame, &cancel, &mut |_| {}).unwrap();
+    frame
+}
+
+// Returns a description of the difference if it is noticeable.
+fn compare(actual: &[Color], expected: &[Color]) -> Option<String> {
+    let display = DisplayParams::DEFAULT;
+    let mut total = 0.0;
+    let mut large = 0;
+    for (a, e) in actual.iter().zip(expected.iter()) {
+        let diffs = display
+            .encode(*a)
+            .iter()
+            .zip(display.encode(*e).iter())
+            .map(|(a, e)| (*a as i32 - *e as i32).abs() as u8)
+            .collect::<Vec<_>>();
+        total += diffs.iter().map(|d| *d as f64).sum::<f64>();
+        if diffs.iter().any(|d| *d > LARGE_DIFF) {
+            large += 1;
+        }
+    }
+    let mean = total / (actual.len() * 3) as f64;
+    let ratio = large as f64 / actual.len() as f64;
+    if mean > MAX_MEAN_DIFF || ratio > MAX_LARGE_DIFF_RATIO {
+        Some(format!(
+            "mean difference {:.2}, {:.1}% pixels differ by more than {}",
+            mean,
+            ratio * 100.0,
+            LARGE_DIFF
+        ))
+    } else {
+        None
+    }
+}
+
+fn check_golden(name: &str) {
+    let frame = render_scene(name);
+    let path = golden_path(name);
+    if std::env::var_os("UPDATE_GOLDEN").is_some() {
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        let mut writer = BufWriter::new(File::create(&path).unwrap());
+        frame.write_hdr(&mut writer).unwrap();
+        return;
+    }
+
+    let data = fs::read(&path).unwrap_or_else(|err| {
+        panic!(
+            "{}: {}; run with UPDATE_GOLDEN=1 to create it",
+            path.display(),
+            err
+        )
+    });
+    let (width, height, pixels) = parse_hdr(&data).unwrap();
+    assert_eq!(
+        (width as u32, height as u32),
+        (frame.width(), frame.height()),
+        "{}: size mismatch",
+        name
+    );
+    if let Some(diff) = compare(frame.pixels(), &pixels) {
+        panic!("{}: differs from {}: {}", name, path.display(), diff);
+    }
+}
+
+#[test]
+fn test_golden_materials() {
+    check_golden("book1/image16");
+}
+
+#[test]
+fn test_golden_noise_texture() {
+    check_golden("book2/image13");
+}
+
+#[test]
+fn test_golden_cornell_box() {
+    check_golden("book3/image12");
+}
+
+#[test]
+fn test_golden_pbr() {
+    check_golden("debug/pbr");
+}
+
+#[test]
+fn test_golden_lights() {
+    check_golden("debug/lights");
+}
+
+#[test]
+fn test_compare() {
+    let gray = vec![Color::new(0.5, 0.5, 0.5); 200];
+    assert_eq!(compare(&gray, &gray), None);
+
+    let mut noisy = gray.clone();
+    noisy[0] = Color::WHITE;
+    assert_eq!(compare(&noisy, &gray), None);
+    noisy[1] = Color::WHITE;
+    noisy[2] = Color::WHITE;
+    assert!(compare(&noisy, &gray).is_some());
+
+    let darker = vec![Color::new(0.45, 0.45, 0.45); 200];
+    assert!(compare(&darker, &gray).is_some());
+}
@@ -0,0 +1,195 @@
+// Density values sampled on a regular 3D grid, used for heterogeneous volumes.
+//
+// Grids can be loaded from NRRD files with raw encoding and uchar or float
+// samples, where the first axis varies fastest. uchar samples are mapped to
+// [0, 1].
+
+use crate::geom::Vec3;
+use anyhow::{bail, Context, Result};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+#[derive(Clone, Debug)]
+pub struct DensityGrid {
+    path: Option<PathBuf>,
+    size: [usize; 3],
+    values: Vec<f32>,
+    max: f64,
+}
+
+impl DensityGrid {
+    pub fn new(size: [usize; 3], values: Vec<f32>) -> Result<Self> {
+        if size.iter().any(|&n| n == 0) {
+            bail!("Empty density grid: {:?}", size);
+        }
+        if values.len() != size[0] * size[1] * size[2] {
+            bail!(
+                "Density grid of size {:?} needs {} values, got {}",
+                size,
+                size[0] * size[1] * size[2],
+                values.len()
+            );
+        }
+        if let Some(v) = values.iter().find(|v| !(**v >= 0.0 && v.is_finite())) {
+            bail!("Invalid density in grid: {}", v);
+        }
+        let max = values.iter().fold(0.0f32, |a, &b| a.max(b)) as f64;
+        Ok(DensityGrid {
+            path: None,
+            size,
+            values,
+            max,
+        })
+    }
+
+    pub fn load(path: impl AsRef<Path>) -> Result<Self> {
+        let path = path.as_ref();
+        let data = fs::read(path)?;
+        let mut grid = Self::parse_nrrd(&data)?;
+        grid.path = Some(path.to_owned());
+        Ok(grid)
+    }
+
+    fn parse_nrrd(data: &[u8]) -> Result<Self> {
+        let header_len = match data.windows(2).position(|w| w == b"\n\n") {
+            Some(pos) => pos + 2,
+            None => bail!("NRRD header is not terminated"),
+        };
+        let header = std::str::from_utf8(&data[..header_len]).context("Invalid NRRD header")?;
+        let mut lines = header.lines();
+        if !lines
+            .next()
+            .map_or(false, |magic| magic.starts_with("NRRD"))
+        {
+            bail!("Not a NRRD file");
+        }
+
+        let mut kind = None;
+        let mut size = None;
+        let mut little_endian = true;
+        for line in lines {
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let (key, value) = match line.find(": ") {
+                Some(pos) => (&line[..pos], line[pos + 2..].trim()),
+                // Key/value pairs (":=") carry no format information.
+                None => continue,
+            };
+            match key {
+                "type" => kind = Some(value.to_owned()),
+                "dimension" => {
+                    if value != "3" {
+                        bail!("Unsupported NRRD dimension: {}", value);
+                    }
+                }
+                "sizes" => {
+                    let sizes = value
+                        .split_whitespace()
+                        .map(|s| s.parse::<usize>())
+                        .collect::<Result<Vec<_>, _>>()
+                        .context("Invalid NRRD sizes")?;
+                    if sizes.len() != 3 {
+                        bail!("Unsupported NRRD sizes: {}", value);
+                    }
+                    size = Some([sizes[0], sizes[1], sizes[2]]);
+                }
+                "encoding" => {
+                    if value != "raw" {
+                        bail!("Unsupported NRRD encoding: {}", value);
+                    }
+                }
+                "endian" => little_endian = value == "little",
+                _ => {}
+            }
+        }
+        let size = match size {
+            Some(size) => size,
+            None => bail!("NRRD sizes are missing"),
+        };
+
+        let body = &data[header_len..];
+        let values: Vec<f32> = match kind.as_deref() {
+            Some("uchar") | Some("unsigned char") | Some("uint8") | Some("uint8_t") => {
+                body.iter().map(|&b| b as f32 / 255.0).collect()
+            }
+            Some("float") => body
+                .chunks_exact(4)
+                .map(|c| {
+                    let bytes = [c[0], c[1], c[2], c[3]];
+                    if little_endian {
+                        f32::from_le_bytes(bytes)
+                    } else {
+                        f32::from_be_bytes(bytes)
+                    }
+                })
+                .collect(),
+            Some(kind) => bail!("Unsupported NRRD type: {}", kind),
+            None => bail!("NRRD type is missing"),
+        };
+        Self::new(size, values)
+    }
+
+    pub fn path(&self) -> Option<&Path> {
+        self.path.as_deref()
+    }
+
+    pub fn max(&self) -> f64 {
+        self.max
+    }
+
+    // Returns the density at p in [0, 1]^3, trilinearly interpolated between
+    // samples at cell centers.
+    pub fn density(&self, p: Vec3) -> f64 {
+        let split = |x: f64, n: usize| {
+            let x = (x * n as f64 - 0.5).max(0.0).min((n - 1) as f64);
+            let i = (x as usize).min(n.saturating_sub(2));
+            (i, (i + 1).min(n - 1), x - i as f64)
+        };
+        let (i0, i1, u) = split(p.x, self.size[0]);
+        let (j0, j1, v) = split(p.y, self.size[1]);
+        let (k0, k1, w) = split(p.z, self.size[2]);
+        let at = |i: usize, j: usize, k: usize| {
+            self.values[(k * self.size[1] + j) * self.size[0] + i] as f64
+        };
+        let lerp = |a: f64, b: f64, t: f64| a + (b - a) * t;
+        lerp(
+            lerp(
+                lerp(at(i0, j0, k0), at(i1, j0, k0), u),
+                lerp(at(i0, j1, k0), at(i1, j1, k0), u),
+                v,
+            ),
+            lerp(
+                lerp(at(i0, j0, k1), at(i1, j0, k1), u),
+                lerp(at(i0, j1, k1), at(i1, j1, k1), u),
+                v,
+            ),
+            w,
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_nrrd() {
+        let mut data =
+            b"NRRD0004\n# test\ntype: uchar\ndimension: 3\nsizes: 2 1 2\nencoding: raw\n\n"
+                .to_vec();
+        data.extend_from_slice(&[0, 255, 51, 102]);
+        let grid = DensityGrid::parse_nrrd(&data).unwrap();
+        assert_eq!(grid.max(), 1.0);
+        assert!((grid.density(Vec3::new(0.0, 0.5, 0.0)) - 0.0).abs() < 1e-6);
+        assert!((grid.density(Vec3::new(1.0, 0.5, 0.0)) - 1.0).abs() < 1e-6);
+        assert!((grid.density(Vec3::new(0.5, 0.5, 0.0)) - 0.5).abs() < 1e-6);
+        assert!((grid.density(Vec3::new(0.0, 0.5, 1.0)) - 0.2).abs() < 1e-6);
+        assert!((grid.density(Vec3::new(0.5, 0.5, 0.5)) - 0.4).abs() < 1e-6);
+
+        let mut data =
+            b"NRRD0004\ntype: float\ndimension: 3\nsizes: 1 1 2\nencoding: gzip\n\n".to_vec();
+        data.extend_from_slice(&[0; 8]);
+        assert!(DensityGrid::parse_nrrd(&data).is_err());
+    }
+}
@@ -0,0 +1,245 @@
+// Terrain given by heights on a regular grid, like one from a grayscale image.
+// Each grid cell is split into two triangles, and rays walk through cells
+// along their projection on the ground with a 2D DDA, so the cost grows with
+// the side of the grid rather than its area.
+
+use crate::geom::{Box3, Vec3, Vec3Unit};
+use crate::ray::Ray;
+use crate::sampler::Sampler;
+use crate::shape::{Hit, Shape, ShapeVisitor, Triangle};
+use crate::texture::Image;
+use crate::time::TimeRange;
+use anyhow::{bail, Result};
+use std::path::{Path, PathBuf};
+
+#[derive(Clone, Debug)]
+pub struct Heightfield {
+    path: PathBuf,
+    // Heights in [0, 1] of columns * rows samples, row by row from the lowest
+    // z.
+    heights: Vec<f64>,
+    columns: usize,
+    rows: usize,
+    min: Vec3,
+    size: Vec3,
+    bb: Box3,
+}
+
+impl Shape for Heightfield {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let (t0, t1) = ray.clip(&self.bb, t_min, t_max)?;
+        let cell_x = self.size.x / (self.columns - 1) as f64;
+        let cell_z = self.size.z / (self.rows - 1) as f64;
+        let start = ray.at(t0) - self.min;
+        let mut i = ((start.x / cell_x).floor().max(0.0) as usize).min(self.columns - 2);
+        let mut k = ((start.z / cell_z).floor().max(0.0) as usize).min(self.rows - 2);
+
+        // Values of t where the ray crosses the next cell boundaries.
+        let next = |index: usize, origin: f64, dir: f64, cell: f64| {
+            if dir > 0.0 {
+                ((index + 1) as f64 * cell - origin) / dir
+            } else if dir < 0.0 {
+                (index as f64 * cell - origin) / dir
+            } else {
+                f64::INFINITY
+            }
+        };
+        let origin = ray.origin - self.min;
+        let mut next_x = next(i, origin.x, ray.dir.x, cell_x);
+        let mut next_z = next(k, origin.z, ray.dir.z, cell_z);
+        let delta_x = cell_x / ray.dir.x.abs();
+        let delta_z = cell_z / ray.dir.z.abs();
+
+        let mut t_enter = t0;
+        loop {
+            let t_exit = next_x.min(next_z).min(t1);
+            if let Some(hit) = self.hit_cell(i, k, ray, t_min, t_max, t_enter, t_exit) {
+                return Some(hit);
+            }
+            if t_exit >= t1 {
+                return None;
+            }
+            if next_x < next_z {
+                if ray.dir.x > 0.0 {
+                    i += 1;
+                } else {
+                    i = i.checked_sub(1)?;
+                }
+                if i > self.columns - 2 {
+                    return None;
+                }
+                next_x += delta_x;
+            } else {
+                if ray.dir.z > 0.0 {
+                    k += 1;
+                } else {
+                    k = k.checked_sub(1)?;
+                }
+                if k > self.rows - 2 {
+                    return None;
+                }
+                next_z += delta_z;
+            }
+            t_enter = t_exit;
+        }
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        self.bb
+    }
+
+    fn sampler(&self, _from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        None
+    }
+
+    fn is_empty(&self) -> bool {
+        false
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.heightfield(&self.path, self.min, self.size);
+    }
+}
+
+impl Heightfield {
+    // Loads heights from the luminance of the image, which spans the box of
+    // the size from min. The top of the image is toward +z.
+    pub fn load(path: impl AsRef<Path>, min: Vec3, size: Vec3) -> Result<Self> {
+        let path = path.as_ref();
+        let image = Image::load(path)?;
+        let (columns, rows) = (image.width(), image.height());
+        if columns < 2 || rows < 2 {
+            bail!(
+                "Heightfield image must be at least 2x2: {}x{}",
+                columns,
+                rows
+            );
+        }
+        let heights = (0..rows)
+            .flat_map(|k| (0..columns).map(move |i| (i, rows - 1 - k)))
+            .map(|(x, y)| image.pixel(x, y).luminance())
+            .collect();
+        Ok(Self::new(
+            path.to_owned(),
+            heights,
+            columns,
+            rows,
+            min,
+            size,
+        ))
+    }
+
+    fn new(
+        path: PathBuf,
+        heights: Vec<f64>,
+        columns: usize,
+        rows: usize,
+        min: Vec3,
+        size: Vec3,
+    ) -> Self {
+        let low = heights.iter().copied().fold(f64::INFINITY, f64::min);
+        let high = heights.iter().copied().fold(-f64::INFINITY, f64::max);
+        // Padded so that flat terrain has a box of some thickness.
+        let bb = Box3::new(
+            Vec3::new(min.x, min.y + low * size.y - 1e-6, min.z),
+            Vec3::new(min.x + size.x, min.y + high * size.y + 1e-6, min.z + size.z),
+        );
+        Heightfield {
+            path,
+            heights,
+            columns,
+            rows,
+            min,
+            size,
+            bb,
+        }
+    }
+
+    fn point(&self, i: usize, k: usize) -> Vec3 {
+        Vec3::new(
+            self.min.x + self.size.x * i as f64 / (self.columns - 1) as f64,
+            self.min.y + self.size.y * self.heights[k * self.columns + i],
+            self.min.z + self.size.z * k as f64 / (self.rows - 1) as f64,
+        )
+    }
+
+    // Intersects the two triangles of the cell, which the ray passes over
+    // between t_enter and t_exit.
+    fn hit_cell(
+        &self,
+        i: usize,
+        k: usize,
+        ray: &Ray,
+        t_min: f64,
+        t_max: f64,
+        t_enter: f64,
+        t_exit: f64,
+    ) -> Option<Hit> {
+        let p00 = self.point(i, k);
+        let p10 = self.point(i + 1, k);
+        let p01 = self.point(i, k + 1);
+        let p11 = self.point(i + 1, k + 1);
+
+        // Skip cells the ray passes entirely above or below.
+        let (y0, y1) = (ray.at(t_enter).y, ray.at(t_exit).y);
+        if y0.min(y1) > p00.y.max(p10.y).max(p01.y).max(p11.y)
+            || y0.max(y1) < p00.y.min(p10.y).min(p01.y).min(p11.y)
+        {
+            return None;
+        }
+
+        // Vertices are ordered so that normals face +y.
+        let first = Triangle::new(p00, p01, p10).hit(ray, t_min, t_max);
+        let t_best = first.as_ref().map_or(t_max, |h| h.t);
+        let hit = Triangle::new(p11, p10, p01)
+            .hit(ray, t_min, t_best)
+            .or(first)?;
+        Some(Hit {
+            tangent: Vec3Unit::X,
+            u: (hit.point.x - self.min.x) / self.size.x,
+            v: (hit.point.z - self.min.z) / self.size.z,
+            ..hit
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::geom::IntoVec3;
+
+    #[test]
+    fn test_hit() {
+        // A ridge along z at x = 1, rising to height 1.
+        let heights = vec![0.0, 1.0, 0.0, 0.0, 1.0, 0.0];
+        let field = Heightfield::new(
+            PathBuf::new(),
+            heights,
+            3,
+            2,
+            Vec3::ZERO,
+            Vec3::new(2.0, 1.0, 1.0),
+        );
+
+        let ray = Ray::new(Vec3::new(0.5, 5.0, 0.5), -Vec3Unit::Y, 0.0);
+        let hit = field.hit(&ray, 1e-8, f64::INFINITY).unwrap();
+        assert!((hit.t - 4.5).abs() < 1e-9);
+        assert!(
+            (hit.normal.into_vec3() - Vec3::new(-1.0, 1.0, 0.0).unit().into_vec3()).abs() < 1e-9
+        );
+        assert!((hit.u - 0.25).abs() < 1e-9 && (hit.v - 0.5).abs() < 1e-9);
+
+        // Horizontal rays cross cells until they hit the ridge.
+        let ray = Ray::new(Vec3::new(-1.0, 0.5, 0.5), Vec3Unit::X, 0.0);
+        let hit = field.hit(&ray, 1e-8, f64::INFINITY).unwrap();
+        assert!((hit.point.x - 0.5).abs() < 1e-9);
+        let ray = Ray::new(Vec3::new(3.0, 0.5, 0.5), -Vec3Unit::X, 0.0);
+        let hit = field.hit(&ray, 1e-8, f64::INFINITY).unwrap();
+        assert!((hit.point.x - 1.5).abs() < 1e-9);
+
+        let ray = Ray::new(Vec3::new(-1.0, 1.5, 0.5), Vec3Unit::X, 0.0);
+        assert!(field.hit(&ray, 1e-8, f64::INFINITY).is_none());
+        let ray = Ray::new(Vec3::new(0.25, 0.5, -1.0), Vec3Unit::Z, 0.0);
+        assert!(field.hit(&ray, 1e-8, f64::INFINITY).is_none());
+    }
+}
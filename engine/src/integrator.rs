@@ -0,0 +1,614 @@
+use crate::color::Color;
+use crate::geom::{Box3, IntoVec3, Vec3};
+use crate::object::ObjectHit;
+use crate::ray::{Ray, RayBatch};
+use crate::renderer::RenderParams;
+use crate::rng::Rng;
+use crate::sampler::{LambertianSampler, Sampler};
+use crate::shape::Shape;
+use crate::stats;
+use crate::time::TimeRange;
+use crate::world::World;
+use std::fmt;
+use strum_macros::{Display, EnumIter, EnumString};
+
+// Estimates radiance arriving at the ray origin from the ray direction.
+pub trait Integrator: Sync + Send {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color;
+
+    // Estimates radiance for the rays in the batch. Integrators may override
+    // it to find the first hits of the rays together.
+    fn radiance_batch(&self, batch: &RayBatch, rng: &mut Rng) -> Vec<Color> {
+        batch
+            .rays()
+            .iter()
+            .map(|ray| self.radiance(ray, rng))
+            .collect()
+    }
+
+    // Same as radiance_batch, but also describes what happens to the rays
+    // through log, for debugging a pixel.
+    fn radiance_batch_logged(
+        &self,
+        batch: &RayBatch,
+        rng: &mut Rng,
+        log: &mut dyn FnMut(fmt::Arguments),
+    ) -> Vec<Color> {
+        let colors = self.radiance_batch(batch, rng);
+        for (index, color) in colors.iter().enumerate() {
+            log(format_args!("sample {}: radiance {:.4}", index, color));
+        }
+        colors
+    }
+}
+
+#[derive(Copy, Clone, Debug, Display, EnumIter, EnumString, PartialEq)]
+pub enum IntegratorKind {
+    #[strum(serialize = "path")]
+    Path,
+    #[strum(serialize = "whitted")]
+    Whitted,
+    #[strum(serialize = "ao")]
+    AmbientOcclusion,
+    #[strum(serialize = "direct")]
+    Direct,
+    #[strum(serialize = "normal")]
+    Normal,
+    #[strum(serialize = "depth")]
+    Depth,
+    #[strum(serialize = "albedo")]
+    Albedo,
+    #[strum(serialize = "id")]
+    Id,
+    #[strum(serialize = "traversal")]
+    Traversal,
+}
+
+impl IntegratorKind {
+    // important is the shape sampled as light sources.
+    pub fn new_integrator<'a>(
+        self,
+        world: &'a World,
+        important: &'a dyn Shape,
+        params: &RenderParams,
+    ) -> Box<dyn Integrator + 'a> {
+        let max_depth = params.max_depth;
+        match self {
+            IntegratorKind::Path => Box::new(PathTracer {
+                world,
+                important,
+                max_depth,
+            }),
+            IntegratorKind::Whitted => Box::new(WhittedTracer {
+                world,
+                important,
+                max_depth,
+            }),
+            IntegratorKind::AmbientOcclusion => {
+                Box::new(AmbientOcclusion::new(world, params.ao_distance))
+            }
+            IntegratorKind::Direct => Box::new(DirectLighting { world, important }),
+            IntegratorKind::Normal => Box::new(NormalIntegrator { world }),
+            IntegratorKind::Depth => Box::new(DepthIntegrator::new(world)),
+            IntegratorKind::Albedo => Box::new(AlbedoIntegrator { world }),
+            IntegratorKind::Id => Box::new(IdIntegrator { world }),
+            IntegratorKind::Traversal => Box::new(TraversalIntegrator { world }),
+        }
+    }
+}
+
+// Radiance emitted toward the ray origin by the first surface the ray hits.
+fn emitted(ray: &Ray, world: &World, rng: &mut Rng) -> Color {
+    match world.hit(ray, 1e-8, f64::INFINITY, rng) {
+        Some(hit) => hit.scatter.emit,
+        None => world.background.color(ray),
+    }
+}
+
+fn power_heuristic(pdf: f64, other_pdf: f64) -> f64 {
+    pdf * pdf / (pdf * pdf + other_pdf * other_pdf)
+}
+
+// Samples a direction toward lights and returns the light reflected toward the
+// scatter point, weighted for combining with scatter sampling.
+fn sample_light(
+    ray: &Ray,
+    point: Vec3,
+    albedo: Color,
+    scatter_sampler: &dyn Sampler,
+    light_sampler: &dyn Sampler,
+    world: &World,
+    rng: &mut Rng,
+) -> Color {
+    let light_dir = light_sampler.sample(rng);
+    let light_pdf = light_sampler.probability(light_dir);
+    let scatter_pdf = scatter_sampler.probability(light_dir);
+    if light_pdf == 0.0 || scatter_pdf == 0.0 {
+        return Color::BLACK;
+    }
+    let radiance = emitted(&Ray::new(point, light_dir, ray.time), world, rng);
+    albedo
+        * scatter_sampler.weight(light_dir)
+        * radiance
+        * (scatter_pdf / light_pdf)
+        * power_heuristic(light_pdf, scatter_pdf)
+}
+
+// Returns light from delta lights reflected toward the scatter point. Each
+// light is checked for occlusion with a shadow ray.
+fn delta_lights(
+    point: Vec3,
+    albedo: Color,
+    scatter_sampler: &dyn Sampler,
+    world: &World,
+    time: f64,
+    rng: &mut Rng,
+) -> Color {
+    let mut color = Color::BLACK;
+    for light in world.lights.iter() {
+        let ill = match light.illuminate(point) {
+            Some(ill) => ill,
+            None => continue,
+        };
+        let scatter_pdf = scatter_sampler.probability(ill.dir);
+        if scatter_pdf == 0.0 {
+            continue;
+        }
+        let shadow_ray = Ray::new(point, ill.dir, time);
+        if world.hit(&shadow_ray, 1e-8, ill.distance, rng).is_some() {
+            continue;
+        }
+        color = color + albedo * scatter_sampler.weight(ill.dir) * ill.irradiance * scatter_pdf;
+    }
+    color
+}
+
+// Path tracing with next event estimation. At each diffuse bounce, lights are
+// sampled directly in addition to the scatter direction, and the two are
+// combined with multiple importance sampling.
+pub struct PathTracer<'a> {
+    world: &'a World,
+    important: &'a dyn Shape,
+    max_depth: usize,
+}
+
+impl Integrator for PathTracer<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        let hit = self.world.hit(ray, 1e-8, f64::INFINITY, rng);
+        self.trace(ray, hit, rng, |_| {})
+    }
+
+    fn radiance_batch(&self, batch: &RayBatch, rng: &mut Rng) -> Vec<Color> {
+        let mut hits: Vec<Option<ObjectHit>> = batch.rays().iter().map(|_| None).collect();
+        self.world
+            .hit_batch(batch, 1e-8, f64::INFINITY, rng, &mut hits);
+        batch
+            .rays()
+            .iter()
+            .zip(hits)
+            .map(|(ray, hit)| self.trace(ray, hit, rng, |_| {}))
+            .collect()
+    }
+
+    fn radiance_batch_logged(
+        &self,
+        batch: &RayBatch,
+        rng: &mut Rng,
+        log: &mut dyn FnMut(fmt::Arguments),
+    ) -> Vec<Color> {
+        let mut hits: Vec<Option<ObjectHit>> = batch.rays().iter().map(|_| None).collect();
+        self.world
+            .hit_batch(batch, 1e-8, f64::INFINITY, rng, &mut hits);
+        batch
+            .rays()
+            .iter()
+            .zip(hits)
+            .enumerate()
+            .map(|(index, (ray, hit))| {
+                log(format_args!(
+                    "sample {}: ray from {:.4} toward {:.4}",
+                    index, ray.origin, ray.dir
+                ));
+                let color = self.trace(ray, hit, rng, |args| log(args));
+                log(format_args!("sample {}: radiance {:.4}", index, color));
+                color
+            })
+            .collect()
+    }
+}
+
+impl PathTracer<'_> {
+    // Follows the path of the ray, whose first hit is given. Every bounce is
+    // described through log, which is a no-op when rendering images.
+    fn trace(
+        &self,
+        ray: &Ray,
+        first_hit: Option<ObjectHit>,
+        rng: &mut Rng,
+        mut log: impl FnMut(fmt::Arguments),
+    ) -> Color {
+        let world = self.world;
+        let mut first_hit = Some(first_hit);
+        let mut ray = ray.clone();
+        let mut color = Color::BLACK;
+        let mut throughput = Color::WHITE;
+        // Probabilities of the last scatter direction under the scatter and
+        // light distributions, if the direction was also sampled by lights.
+        let mut last_pdfs: Option<(f64, f64)> = None;
+        for depth in 0..self.max_depth {
+            let mis_weight = last_pdfs.map_or(1.0, |(scatter_pdf, light_pdf)| {
+                power_heuristic(scatter_pdf, light_pdf)
+            });
+            let hit = first_hit
+                .take()
+                .unwrap_or_else(|| world.hit(&ray, 1e-8, f64::INFINITY, rng));
+            let mut hit = match hit {
+                Some(hit) => hit,
+                None => {
+                    let background = world.background.color(&ray);
+                    log(format_args!(
+                        "  depth {}: missed; background {:.4}, MIS weight {:.4}",
+                        depth, background, mis_weight
+                    ));
+                    return color + throughput * background * mis_weight;
+                }
+            };
+            stats::record_bounce();
+            log(format_args!(
+                "  depth {}: hit object {} at t={:.6}, point {:.4}, normal {}",
+                depth,
+                hit.id.map_or("-".to_owned(), |id| format!("{:016x}", id)),
+                hit.t,
+                hit.scatter.point,
+                hit.normal
+                    .map_or("- (volume)".to_owned(), |normal| format!("{:.4}", normal))
+            ));
+            if !hit.scatter.emit.is_black() {
+                log(format_args!(
+                    "    emitted {:.4}, MIS weight {:.4}",
+                    hit.scatter.emit, mis_weight
+                ));
+            }
+            color = color + throughput * hit.scatter.emit * mis_weight;
+            let scatter_sampler = match hit.scatter.sampler.take() {
+                Some(scatter_sampler) => scatter_sampler,
+                None => {
+                    log(format_args!("    absorbed"));
+                    return color;
+                }
+            };
+            let point = hit.scatter.point;
+            let albedo = hit.scatter.albedo;
+            let media = scatter_sampler.media().unwrap_or_else(|| ray.media.clone());
+            if let Some(new_dir) = scatter_sampler.constant() {
+                throughput = throughput * albedo;
+                log(format_args!(
+                    "    specular toward {:.4}, albedo {:.4}, throughput {:.4}",
+                    new_dir, albedo, throughput
+                ));
+                ray = Ray::new(point, new_dir, ray.time).with_media(media);
+                last_pdfs = None;
+                continue;
+            }
+
+            let delta = delta_lights(point, albedo, &scatter_sampler, world, ray.time, rng);
+            color = color + throughput * delta;
+            let light_sampler = self.important.sampler(point, ray.time);
+            let mut sampled = Color::BLACK;
+            if let Some(light_sampler) = &light_sampler {
+                if depth + 1 < self.max_depth {
+                    sampled = sample_light(
+                        &ray,
+                        point,
+                        albedo,
+                        &scatter_sampler,
+                        light_sampler.as_ref(),
+                        world,
+                        rng,
+                    );
+                    color = color + throughput * sampled;
+                }
+            }
+            log(format_args!(
+                "    direct light {:.4} from delta lights, {:.4} from light sampling",
+                delta, sampled
+            ));
+
+            let new_dir = scatter_sampler.sample(rng);
+            let scatter_pdf = scatter_sampler.probability(new_dir);
+            if scatter_pdf == 0.0 {
+                log(format_args!(
+                    "    sampled {:.4} of zero probability; path ends",
+                    new_dir
+                ));
+                return color;
+            }
+            last_pdfs = light_sampler
+                .as_ref()
+                .map(|light_sampler| (scatter_pdf, light_sampler.probability(new_dir)));
+            throughput = throughput * albedo * scatter_sampler.weight(new_dir);
+            log(format_args!(
+                "    scattered toward {:.4}, pdf {:.4}, albedo {:.4}, throughput {:.4}",
+                new_dir, scatter_pdf, albedo, throughput
+            ));
+            ray = Ray::new(point, new_dir, ray.time).with_media(media);
+        }
+        log(format_args!("  max depth reached"));
+        color
+    }
+}
+
+// Returns light reaching the ray origin after at most one non-specular
+// reflection. If the ray hits a specular surface, its attenuation and the
+// reflected or refracted ray are also returned.
+fn direct_lighting(
+    ray: &Ray,
+    world: &World,
+    important: &dyn Shape,
+    rng: &mut Rng,
+) -> (Color, Option<(Color, Ray)>) {
+    let mut hit = match world.hit(ray, 1e-8, f64::INFINITY, rng) {
+        Some(hit) => hit,
+        None => return (world.background.color(ray), None),
+    };
+    let emit = hit.scatter.emit;
+    let scatter_sampler = match hit.scatter.sampler.take() {
+        Some(scatter_sampler) => scatter_sampler,
+        None => return (emit, None),
+    };
+    let point = hit.scatter.point;
+    let albedo = hit.scatter.albedo;
+    if let Some(new_dir) = scatter_sampler.constant() {
+        let media = scatter_sampler.media().unwrap_or_else(|| ray.media.clone());
+        let new_ray = Ray::new(point, new_dir, ray.time).with_media(media);
+        return (emit, Some((albedo, new_ray)));
+    }
+    let mut color = emit + delta_lights(point, albedo, &scatter_sampler, world, ray.time, rng);
+    let light_sampler = important.sampler(point, ray.time);
+    if let Some(light_sampler) = &light_sampler {
+        color = color
+            + sample_light(
+                ray,
+                point,
+                albedo,
+                &scatter_sampler,
+                light_sampler.as_ref(),
+                world,
+                rng,
+            );
+    }
+    let new_dir = scatter_sampler.sample(rng);
+    let scatter_pdf = scatter_sampler.probability(new_dir);
+    if scatter_pdf > 0.0 {
+        let mis_weight = light_sampler.map_or(1.0, |light_sampler| {
+            power_heuristic(scatter_pdf, light_sampler.probability(new_dir))
+        });
+        let radiance = emitted(&Ray::new(point, new_dir, ray.time), world, rng);
+        color = color + albedo * scatter_sampler.weight(new_dir) * radiance * mis_weight;
+    }
+    (color, None)
+}
+
+// Classic recursive ray tracing: specular reflection and refraction are
+// followed, while diffuse surfaces only receive direct lighting.
+pub struct WhittedTracer<'a> {
+    world: &'a World,
+    important: &'a dyn Shape,
+    max_depth: usize,
+}
+
+impl Integrator for WhittedTracer<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        let mut ray = ray.clone();
+        let mut color = Color::BLACK;
+        let mut throughput = Color::WHITE;
+        for _ in 0..self.max_depth {
+            let (direct, specular) = direct_lighting(&ray, self.world, self.important, rng);
+            color = color + throughput * direct;
+            match specular {
+                Some((albedo, next_ray)) => {
+                    throughput = throughput * albedo;
+                    ray = next_ray;
+                }
+                None => break,
+            }
+        }
+        color
+    }
+}
+
+// Direct lighting at the first surface only, for quick previews. Specular
+// surfaces show what is directly visible in the reflected direction.
+pub struct DirectLighting<'a> {
+    world: &'a World,
+    important: &'a dyn Shape,
+}
+
+impl Integrator for DirectLighting<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        let (direct, specular) = direct_lighting(ray, self.world, self.important, rng);
+        match specular {
+            Some((albedo, next_ray)) => direct + albedo * emitted(&next_ray, self.world, rng),
+            None => direct,
+        }
+    }
+}
+
+// Fraction of the hemisphere above the first surface that is not occluded
+// within a distance, shown in gray scale. Occluders are looked up with cosine
+// weighted sampling.
+pub struct AmbientOcclusion<'a> {
+    world: &'a World,
+    distance: f64,
+}
+
+impl<'a> AmbientOcclusion<'a> {
+    // The distance defaults to a tenth of the scene size.
+    pub fn new(world: &'a World, distance: Option<f64>) -> Self {
+        let distance = distance
+            .or_else(|| scene_size(world).map(|size| size / 10.0))
+            .unwrap_or(f64::INFINITY);
+        AmbientOcclusion { world, distance }
+    }
+}
+
+fn scene_size(world: &World) -> Option<f64> {
+    let bb = world.object.bounding_box(TimeRange::ZERO);
+    Some((bb.max - bb.min).abs()).filter(|size| size.is_finite())
+}
+
+impl Integrator for AmbientOcclusion<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        let hit = match self.world.hit(ray, 1e-8, f64::INFINITY, rng) {
+            Some(hit) => hit,
+            None => return Color::WHITE,
+        };
+        let normal = match hit.normal {
+            Some(normal) if normal.dot(ray.dir) > 0.0 => -normal,
+            Some(normal) => normal,
+            None => return Color::WHITE,
+        };
+        let dir = LambertianSampler::new(normal).sample(rng);
+        let occlusion_ray = Ray::new(hit.scatter.point, dir, ray.time);
+        match self.world.hit(&occlusion_ray, 1e-8, self.distance, rng) {
+            Some(_) => Color::BLACK,
+            None => Color::WHITE,
+        }
+    }
+}
+
+// Outward normals at the first hit, mapped from [-1, 1] to [0, 1]. Volumes and
+// the background are black.
+pub struct NormalIntegrator<'a> {
+    world: &'a World,
+}
+
+impl Integrator for NormalIntegrator<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        match self
+            .world
+            .hit(ray, 1e-8, f64::INFINITY, rng)
+            .and_then(|hit| hit.normal)
+        {
+            Some(n) => Color::new(n.x + 1.0, n.y + 1.0, n.z + 1.0) / 2.0,
+            None => Color::BLACK,
+        }
+    }
+}
+
+// Distance to the first hit in gray scale. If the scene is bounded, distances
+// are mapped from the nearest and farthest points of the scene bounding box to
+// [0, 1]. The background is white.
+pub struct DepthIntegrator<'a> {
+    world: &'a World,
+    bb: Option<Box3>,
+}
+
+impl<'a> DepthIntegrator<'a> {
+    pub fn new(world: &'a World) -> Self {
+        DepthIntegrator {
+            world,
+            bb: scene_size(world).map(|_| world.object.bounding_box(TimeRange::ZERO)),
+        }
+    }
+}
+
+impl Integrator for DepthIntegrator<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        let hit = match self.world.hit(ray, 1e-8, f64::INFINITY, rng) {
+            Some(hit) => hit,
+            None => return Color::WHITE,
+        };
+        let depth = match &self.bb {
+            Some(bb) => {
+                let o = ray.origin;
+                let closest = Vec3::new(
+                    o.x.max(bb.min.x).min(bb.max.x),
+                    o.y.max(bb.min.y).min(bb.max.y),
+                    o.z.max(bb.min.z).min(bb.max.z),
+                );
+                let near = (closest - o).abs();
+                let far = bb.iter_vertex().map(|p| (p - o).abs()).fold(0.0, f64::max);
+                (hit.t - near) / (far - near)
+            }
+            None => hit.t / (1.0 + hit.t),
+        };
+        Color::new(depth, depth, depth)
+    }
+}
+
+// Reflectance at the first hit. Lights show their emission and the
+// background shows itself.
+pub struct AlbedoIntegrator<'a> {
+    world: &'a World,
+}
+
+impl Integrator for AlbedoIntegrator<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        match self.world.hit(ray, 1e-8, f64::INFINITY, rng) {
+            Some(hit) if hit.scatter.sampler.is_some() => hit.scatter.albedo,
+            Some(hit) => hit.scatter.emit.clamp(0.0, 1.0),
+            None => self.world.background.color(ray),
+        }
+    }
+}
+
+// A color unique to each named object at the first hit. Unnamed objects and the
+// background are black.
+pub struct IdIntegrator<'a> {
+    world: &'a World,
+}
+
+// Maps an object ID to a bright color. The ID is mixed first so that similar
+// names get distinct colors.
+fn id_color(id: u64) -> Color {
+    let mut x = id;
+    x = (x ^ (x >> 30)).wrapping_mul(0xbf58476d1ce4e5b9);
+    x = (x ^ (x >> 27)).wrapping_mul(0x94d049bb133111eb);
+    x ^= x >> 31;
+    let channel = |shift: u64| 0.1 + 0.9 * ((x >> shift) & 0xff) as f64 / 255.0;
+    Color::new(channel(0), channel(8), channel(16))
+}
+
+impl Integrator for IdIntegrator<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        match self
+            .world
+            .hit(ray, 1e-8, f64::INFINITY, rng)
+            .and_then(|hit| hit.id)
+        {
+            Some(id) => id_color(id),
+            None => Color::BLACK,
+        }
+    }
+}
+
+// Heat map of the cost to find the first hit, counted as the tests made by
+// acceleration structures. Colors go from black through blue, green and
+// yellow to red on a log scale, where red is 1024 tests or more.
+pub struct TraversalIntegrator<'a> {
+    world: &'a World,
+}
+
+fn heat_color(tests: u64) -> Color {
+    let stops = [
+        Color::BLACK,
+        Color::new(0.0, 0.0, 1.0),
+        Color::new(0.0, 1.0, 0.0),
+        Color::new(1.0, 1.0, 0.0),
+        Color::new(1.0, 0.0, 0.0),
+    ];
+    let x = ((tests + 1) as f64).log2() / 10.0 * (stops.len() - 1) as f64;
+    let i = (x as usize).min(stops.len() - 2);
+    let f = (x - i as f64).min(1.0);
+    stops[i] * (1.0 - f) + stops[i + 1] * f
+}
+
+impl Integrator for TraversalIntegrator<'_> {
+    fn radiance(&self, ray: &Ray, rng: &mut Rng) -> Color {
+        let before = stats::get();
+        self.world.hit(ray, 1e-8, f64::INFINITY, rng);
+        let stats = stats::get() - before;
+        heat_color(stats.nodes + stats.shapes)
+    }
+}
@@ -0,0 +1,480 @@
+use crate::binary::{read_f64, read_u64, read_u8, write_f64, write_u64, write_u8};
+use crate::geom::{Axis, Box3, IntoVec3, Vec3};
+use crate::ray::{Ray, RayBatch};
+use crate::sampler::{MixedSampler, Sampler};
+use crate::shape::{Hit, Shape};
+use crate::stats;
+use crate::time::TimeRange;
+use itertools::Itertools;
+use std::io::{self, Read, Write};
+
+// Costs of the surface area heuristic relative to each other, where
+// intersecting shapes is much more expensive than stepping through nodes.
+const TRAVERSAL_COST: f64 = 1.0;
+const INTERSECTION_COST: f64 = 80.0;
+// Discount of splits cutting off empty space.
+const EMPTY_BONUS: f64 = 0.5;
+// Splits costing more than leaves allowed along a path, as they may still
+// enable cheaper ones below.
+const MAX_BAD_REFINES: usize = 3;
+const MAX_DEPTH: usize = 64;
+
+#[derive(Clone, Debug)]
+enum Node {
+    // The child below the split immediately follows the node, and above is
+    // the index of the other.
+    Inner {
+        axis: Axis,
+        split: f64,
+        above: usize,
+    },
+    // Shapes of indices[start..start + len] belong to the leaf. Shapes
+    // straddling splits belong to leaves on both sides.
+    Leaf {
+        start: usize,
+        len: usize,
+    },
+}
+
+// A kd-tree, which splits space by axis-aligned planes chosen by the surface
+// area heuristic. It often traverses faster than a BVH as nodes never
+// overlap, at the cost of a slower build and more memory.
+#[derive(Clone, Debug)]
+pub struct KdTree<S: Shape> {
+    bb: Box3,
+    nodes: Vec<Node>,
+    indices: Vec<usize>,
+    shapes: Vec<S>,
+}
+
+impl<S: Shape> Shape for KdTree<S> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        self.hit_shape(ray, t_min, t_max).map(|(hit, _)| hit)
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        self.bb
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        let samplers = self
+            .shapes
+            .iter()
+            .filter_map(|shape| shape.sampler(from, time))
+            .collect_vec();
+        if samplers.is_empty() {
+            None
+        } else {
+            Some(Box::new(MixedSampler::new(samplers)))
+        }
+    }
+
+    fn is_empty(&self) -> bool {
+        self.shapes.is_empty()
+    }
+}
+
+impl<S: Shape> KdTree<S> {
+    pub fn new(shapes: impl IntoIterator<Item = S>, time: TimeRange) -> Self {
+        let shapes = shapes
+            .into_iter()
+            .filter(|shape| !shape.is_empty())
+            .collect_vec();
+        let boxes = shapes
+            .iter()
+            .map(|shape| shape.bounding_box(time))
+            .collect_vec();
+        let bb = boxes.iter().copied().fold(Box3::EMPTY, Box3::union);
+        let mut builder = Builder {
+            boxes: &boxes,
+            nodes: Vec::new(),
+            indices: Vec::new(),
+        };
+        if !shapes.is_empty() {
+            let max_depth = (8.0 + 1.3 * (shapes.len() as f64).log2()).round() as usize;
+            builder.build(
+                (0..shapes.len()).collect(),
+                bb,
+                max_depth.min(MAX_DEPTH - 2),
+                0,
+            );
+        }
+        KdTree {
+            bb,
+            nodes: builder.nodes,
+            indices: builder.indices,
+            shapes,
+        }
+    }
+
+    // Writes the tree with shapes told by their indices, so that it can be
+    // loaded later without building it again.
+    pub fn save(&self, writer: &mut impl Write, shape_index: impl Fn(&S) -> u64) -> io::Result<()> {
+        for p in [self.bb.min, self.bb.max].iter() {
+            write_f64(writer, p.x)?;
+            write_f64(writer, p.y)?;
+            write_f64(writer, p.z)?;
+        }
+        write_u64(writer, self.nodes.len() as u64)?;
+        for node in self.nodes.iter() {
+            match *node {
+                Node::Inner { axis, split, above } => {
+                    let axis = Axis::ALL.iter().position(|a| *a == axis).unwrap();
+                    write_u8(writer, axis as u8)?;
+                    write_f64(writer, split)?;
+                    write_u64(writer, above as u64)?;
+                }
+                Node::Leaf { start, len } => {
+                    write_u8(writer, Axis::ALL.len() as u8)?;
+                    write_u64(writer, start as u64)?;
+                    write_u64(writer, len as u64)?;
+                }
+            }
+        }
+        write_u64(writer, self.indices.len() as u64)?;
+        for index in self.indices.iter() {
+            write_u64(writer, *index as u64)?;
+        }
+        write_u64(writer, self.shapes.len() as u64)?;
+        for shape in self.shapes.iter() {
+            write_u64(writer, shape_index(shape))?;
+        }
+        Ok(())
+    }
+
+    // Reads a tree written by save, getting shapes from their indices.
+    pub fn load(reader: &mut impl Read, shape: impl Fn(u64) -> Option<S>) -> io::Result<Self> {
+        let corrupted = || io::Error::new(io::ErrorKind::InvalidData, "Corrupted kd-tree");
+        let mut coords = [0.0; 6];
+        for c in coords.iter_mut() {
+            *c = read_f64(reader)?;
+        }
+        let bb = Box3::new(
+            Vec3::new(coords[0], coords[1], coords[2]),
+            Vec3::new(coords[3], coords[4], coords[5]),
+        );
+        let mut nodes = Vec::new();
+        for _ in 0..read_u64(reader)? {
+            let tag = read_u8(reader)? as usize;
+            nodes.push(match Axis::ALL.get(tag) {
+                Some(&axis) => Node::Inner {
+                    axis,
+                    split: read_f64(reader)?,
+                    above: read_u64(reader)? as usize,
+                },
+                None if tag == Axis::ALL.len() => Node::Leaf {
+                    start: read_u64(reader)? as usize,
+                    len: read_u64(reader)? as usize,
+                },
+                None => return Err(corrupted()),
+            });
+        }
+        let mut indices = Vec::new();
+        for _ in 0..read_u64(reader)? {
+            indices.push(read_u64(reader)? as usize);
+        }
+        let mut shapes = Vec::new();
+        for _ in 0..read_u64(reader)? {
+            shapes.push(shape(read_u64(reader)?).ok_or_else(corrupted)?);
+        }
+        if indices.iter().any(|i| *i >= shapes.len())
+            || !nodes.is_empty() && !is_valid(&nodes, indices.len(), 0, 0)
+        {
+            return Err(corrupted());
+        }
+        Ok(KdTree {
+            bb,
+            nodes,
+            indices,
+            shapes,
+        })
+    }
+
+    // Finds the closest hit along with the shape hit.
+    pub fn hit_shape(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<(Hit, &S)> {
+        self.hit_shape_with(ray, t_min, t_max, |shape, ray, t_min, t_max| {
+            shape.hit(ray, t_min, t_max)
+        })
+    }
+
+    // Same as hit_shape, but intersects shapes by the function instead of
+    // their own hit, e.g. to skip some of them.
+    pub fn hit_shape_with(
+        &self,
+        ray: &Ray,
+        t_min: f64,
+        t_max: f64,
+        hit: impl Fn(&S, &Ray, f64, f64) -> Option<Hit>,
+    ) -> Option<(Hit, &S)> {
+        if self.nodes.is_empty() {
+            return None;
+        }
+        let (mut t_near, mut t_far) = ray.clip(&self.bb, t_min, t_max)?;
+        let mut best: Option<(Hit, &S)> = None;
+        let (mut nodes, mut shapes) = (0, 0);
+        // Nodes are visited front to back, so the traversal stops once the
+        // closest hit is before the next node.
+        let mut stack = [(0, 0.0, 0.0); MAX_DEPTH];
+        let mut sp = 0;
+        let mut index = 0;
+        loop {
+            if best.as_ref().map_or(false, |(h, _)| h.t < t_near) {
+                break;
+            }
+            nodes += 1;
+            match self.nodes[index] {
+                Node::Inner { axis, split, above } => {
+                    let origin = ray.origin.get(axis);
+                    let dir = ray.dir.get(axis);
+                    let t_split = (split - origin) / dir;
+                    let (first, second) = if origin < split || (origin == split && dir <= 0.0) {
+                        (index + 1, above)
+                    } else {
+                        (above, index + 1)
+                    };
+                    // The ray crosses the plane only within the range of the
+                    // node if it visits both children.
+                    if !(t_split > 0.0) || t_split > t_far {
+                        index = first;
+                    } else if t_split < t_near {
+                        index = second;
+                    } else {
+                        stack[sp] = (second, t_split, t_far);
+                        sp += 1;
+                        index = first;
+                        t_far = t_split;
+                    }
+                }
+                Node::Leaf { start, len } => {
+                    shapes += len;
+                    for &i in self.indices[start..start + len].iter() {
+                        let shape = &self.shapes[i];
+                        let t_best = best.as_ref().map_or(t_max, |(h, _)| h.t);
+                        if let Some(hit) = hit(shape, ray, t_min, t_best) {
+                            best = Some((hit, shape));
+                        }
+                    }
+                    if sp == 0 {
+                        break;
+                    }
+                    sp -= 1;
+                    let (next, near, far) = stack[sp];
+                    index = next;
+                    t_near = near;
+                    t_far = far;
+                }
+            }
+        }
+        stats::record(nodes, shapes as u64);
+        best
+    }
+
+    // Same as hit_shape for the rays in the batch, each before its own t_max.
+    pub fn hit_batch(&self, batch: &RayBatch, t_min: f64, t_max: &[f64]) -> Vec<Option<(Hit, &S)>> {
+        self.hit_batch_with(batch, t_min, t_max, |shape, ray, t_min, t_max| {
+            shape.hit(ray, t_min, t_max)
+        })
+    }
+
+    // Same as hit_shape_with for the rays in the batch. Rays are traced one by
+    // one, as they take different paths through the tree.
+    pub fn hit_batch_with(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: &[f64],
+        hit: impl Fn(&S, &Ray, f64, f64) -> Option<Hit>,
+    ) -> Vec<Option<(Hit, &S)>> {
+        batch
+            .rays()
+            .iter()
+            .zip(t_max.iter())
+            .map(|(ray, t_max)| self.hit_shape_with(ray, t_min, *t_max, &hit))
+            .collect()
+    }
+}
+
+// Tells if nodes under the index form a tree that hit can traverse within the
+// stack, with leaves referring to existing indices.
+fn is_valid(nodes: &[Node], indices: usize, index: usize, depth: usize) -> bool {
+    match nodes[index] {
+        Node::Leaf { start, len } => start <= indices && len <= indices - start,
+        Node::Inner { above, .. } => {
+            depth + 1 < MAX_DEPTH
+                && index + 1 < above
+                && above < nodes.len()
+                && is_valid(nodes, indices, index + 1, depth + 1)
+                && is_valid(nodes, indices, above, depth + 1)
+        }
+    }
+}
+
+fn with_coord(v: Vec3, axis: Axis, value: f64) -> Vec3 {
+    match axis {
+        Axis::X => Vec3::new(value, v.y, v.z),
+        Axis::Y => Vec3::new(v.x, value, v.z),
+        Axis::Z => Vec3::new(v.x, v.y, value),
+    }
+}
+
+struct Builder<'a> {
+    boxes: &'a [Box3],
+    nodes: Vec<Node>,
+    indices: Vec<usize>,
+}
+
+impl Builder<'_> {
+    fn build(&mut self, shapes: Vec<usize>, bb: Box3, depth: usize, bad_refines: usize) {
+        match self.find_split(&shapes, bb, bad_refines) {
+            Some((axis, split, bad_refines)) if depth > 0 => {
+                let (mut below, mut above) = (Vec::new(), Vec::new());
+                for &i in shapes.iter() {
+                    let b = self.boxes[i];
+                    // Shapes lying on the plane go below.
+                    if b.min.get(axis) < split || b.max.get(axis) <= split {
+                        below.push(i);
+                    }
+                    if b.max.get(axis) > split {
+                        above.push(i);
+                    }
+                }
+                drop(shapes);
+                let index = self.nodes.len();
+                self.nodes.push(Node::Inner {
+                    axis,
+                    split,
+                    above: 0,
+                });
+                let below_bb = Box3::new(bb.min, with_coord(bb.max, axis, split));
+                let above_bb = Box3::new(with_coord(bb.min, axis, split), bb.max);
+                self.build(below, below_bb, depth - 1, bad_refines);
+                let second = self.nodes.len();
+                if let Node::Inner { above, .. } = &mut self.nodes[index] {
+                    *above = second;
+                }
+                self.build(above, above_bb, depth - 1, bad_refines);
+            }
+            _ => {
+                self.nodes.push(Node::Leaf {
+                    start: self.indices.len(),
+                    len: shapes.len(),
+                });
+                self.indices.extend(shapes);
+            }
+        }
+    }
+
+    // Returns the axis and the position of the cheapest split, with the count
+    // of bad refines updated, or None if a leaf is better.
+    fn find_split(
+        &self,
+        shapes: &[usize],
+        bb: Box3,
+        bad_refines: usize,
+    ) -> Option<(Axis, f64, usize)> {
+        if shapes.len() <= 1 {
+            return None;
+        }
+        let leaf_cost = INTERSECTION_COST * shapes.len() as f64;
+        let inv_area = 1.0 / bb.surface_area();
+        let d = bb.max - bb.min;
+        let mut best: Option<(f64, Axis, f64)> = None;
+        // Splits along the longest axis are usually the best, so others are
+        // tried only if it has none.
+        let mut axis = bb.longest_axis();
+        for _ in 0..Axis::ALL.len() {
+            // Edges of boxes sorted by their positions, with starts before ends
+            // at the same position.
+            let mut edges = Vec::with_capacity(shapes.len() * 2);
+            for &i in shapes.iter() {
+                let b = self.boxes[i];
+                edges.push((b.min.get(axis), false));
+                edges.push((b.max.get(axis), true));
+            }
+            edges.sort_unstable_by(|a, b| a.partial_cmp(b).expect("NaN in coordinates"));
+            let (axis_min, axis_max) = (bb.min.get(axis), bb.max.get(axis));
+            let (other1, other2) = (d.get(axis.next()), d.get(axis.next().next()));
+            let (mut below, mut above) = (0, shapes.len());
+            for &(t, is_end) in edges.iter() {
+                if is_end {
+                    above -= 1;
+                }
+                if axis_min < t && t < axis_max {
+                    let p_below = 2.0 * (other1 * other2 + (t - axis_min) * (other1 + other2));
+                    let p_above = 2.0 * (other1 * other2 + (axis_max - t) * (other1 + other2));
+                    let bonus = if below == 0 || above == 0 {
+                        EMPTY_BONUS
+                    } else {
+                        0.0
+                    };
+                    let cost = TRAVERSAL_COST
+                        + INTERSECTION_COST
+                            * (1.0 - bonus)
+                            * (p_below * below as f64 + p_above * above as f64)
+                            * inv_area;
+                    if best.map_or(true, |(c, _, _)| cost < c) {
+                        best = Some((cost, axis, t));
+                    }
+                }
+                if !is_end {
+                    below += 1;
+                }
+            }
+            if best.is_some() {
+                break;
+            }
+            axis = axis.next();
+        }
+
+        let (cost, axis, split) = best?;
+        let bad_refines = if cost > leaf_cost {
+            bad_refines + 1
+        } else {
+            bad_refines
+        };
+        if (cost > 4.0 * leaf_cost && shapes.len() < 16) || bad_refines >= MAX_BAD_REFINES {
+            return None;
+        }
+        Some((axis, split, bad_refines))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::bvh::Bvh;
+    use crate::geom::Vec3Unit;
+    use crate::rng::Rng;
+    use crate::shape::Sphere;
+    use rand::{Rng as _, SeedableRng};
+
+    #[test]
+    fn test_hit_matches_bvh() {
+        let mut rng = Rng::seed_from_u64(28);
+        let spheres = (0..200)
+            .map(|_| {
+                let center = Vec3::new(
+                    rng.gen_range(-10.0..10.0),
+                    rng.gen_range(-10.0..10.0),
+                    rng.gen_range(-10.0..10.0),
+                );
+                Sphere::new(center, rng.gen_range(0.1..1.0))
+            })
+            .collect_vec();
+        let kdtree = KdTree::new(spheres.clone(), TimeRange::ZERO);
+        let bvh = Bvh::new(spheres, TimeRange::ZERO);
+
+        for _ in 0..1000 {
+            let origin = Vec3::new(
+                rng.gen_range(-15.0..15.0),
+                rng.gen_range(-15.0..15.0),
+                rng.gen_range(-15.0..15.0),
+            );
+            let ray = Ray::new(origin, Vec3Unit::random_on_unit_sphere(&mut rng), 0.0);
+            assert_eq!(
+                kdtree.hit(&ray, 1e-8, f64::INFINITY).map(|h| h.t),
+                bvh.hit(&ray, 1e-8, f64::INFINITY).map(|h| h.t)
+            );
+        }
+    }
+}
@@ -1,21 +1,74 @@
+mod accel;
 mod background;
+#[cfg(test)]
+mod bench;
+mod binary;
+mod bvh;
 mod camera;
+mod checkpoint;
 mod color;
+mod compare;
+mod denoise;
+mod display;
+mod environment;
+mod frame;
 mod geom;
+mod gltf;
+// References are rendered with the default random number generator.
+#[cfg(all(test, not(feature = "xoshiro")))]
+mod golden;
+mod grid;
+mod heightfield;
+mod integrator;
+mod kdtree;
+mod light;
 mod material;
+mod mesh;
+mod mesh_file;
+mod obj;
 mod object;
 mod parallel;
 mod physics;
+mod pixel_sampler;
 mod ray;
 mod renderer;
 mod rng;
 mod sampler;
 mod scene;
+mod scene_file;
+mod scene_graph;
+mod scene_validate;
+mod sdf;
 mod shape;
+mod sky;
+mod stats;
 mod texture;
 mod time;
 mod world;
 
-pub use renderer::{render, RenderParams};
-pub use rng::Rng;
-pub use scene::Scene;
+pub use accel::AcceleratorKind;
+pub use background::{
+    parse_background, Background, BackgroundVisitor, Daylight, Environment, Gradient, Sky, Solid,
+};
+pub use camera::Camera;
+pub use checkpoint::{load_checkpoint, save_checkpoint, scene_hash};
+pub use color::Color;
+pub use compare::{compare_images, false_color, pixel_differences, Comparison, ImageData};
+pub use denoise::denoise;
+pub use display::{DisplayParams, ToneMapping};
+pub use frame::Frame;
+pub use geom::{Axis, Box3, Mat4, Quat, Vec3, Vec3Unit};
+pub use integrator::IntegratorKind;
+pub use light::Light;
+pub use pixel_sampler::PixelSampling;
+pub use renderer::{
+    make_tiles, render, render_progressive, render_single_tile, trace_pixel, Progress,
+    RenderParams, Tile, TileSpan,
+};
+pub use rng::{Generator, Rng, Xoshiro256PlusPlus};
+pub use scene::{Scene, SceneBuilder, SceneRegistry};
+pub use scene_file::{load_scene_file, CameraDesc, SceneFile};
+pub use scene_graph::SceneNode;
+pub use scene_validate::Problem;
+pub use stats::RenderStats;
+pub use world::World;
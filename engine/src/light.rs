@@ -0,0 +1,167 @@
+// Lights of no size, which illuminate from a single point or direction. They
+// cannot be hit by rays, so integrators look them up with shadow rays instead.
+
+use crate::color::Color;
+use crate::geom::{IntoVec3, Vec3, Vec3Unit};
+
+#[derive(Clone, Copy, Debug)]
+pub enum Light {
+    // Shines in all directions. Intensity falls off with squared distance.
+    Point {
+        position: Vec3,
+        intensity: Color,
+    },
+    // Shines from infinitely far away toward the direction, like the sun.
+    Directional {
+        direction: Vec3Unit,
+        irradiance: Color,
+    },
+    // Point light limited to a cone around the direction. Intensity is full
+    // within the inner angle and fades out to the outer angle, both of which
+    // are half angles stored as cosines.
+    Spot {
+        position: Vec3,
+        direction: Vec3Unit,
+        intensity: Color,
+        cos_inner: f64,
+        cos_outer: f64,
+    },
+}
+
+pub struct Illumination {
+    // Direction from the point toward the light.
+    pub dir: Vec3Unit,
+    pub distance: f64,
+    // Irradiance on a surface facing the light.
+    pub irradiance: Color,
+}
+
+impl Light {
+    pub fn point(position: Vec3, intensity: Color) -> Self {
+        Light::Point {
+            position,
+            intensity,
+        }
+    }
+
+    pub fn directional(direction: Vec3, irradiance: Color) -> Self {
+        Light::Directional {
+            direction: direction.unit(),
+            irradiance,
+        }
+    }
+
+    // Angles are in radians.
+    pub fn spot(
+        position: Vec3,
+        direction: Vec3,
+        intensity: Color,
+        inner_angle: f64,
+        outer_angle: f64,
+    ) -> Self {
+        assert!(
+            0.0 <= inner_angle && inner_angle <= outer_angle,
+            "Invalid spot angles: {}, {}",
+            inner_angle,
+            outer_angle
+        );
+        Light::Spot {
+            position,
+            direction: direction.unit(),
+            intensity,
+            cos_inner: inner_angle.cos(),
+            cos_outer: outer_angle.cos(),
+        }
+    }
+
+    // Returns how the light reaches the point, or None if it does not.
+    pub fn illuminate(&self, point: Vec3) -> Option<Illumination> {
+        match *self {
+            Light::Point {
+                position,
+                intensity,
+            } => {
+                let offset = position - point;
+                let distance = offset.abs();
+                if distance == 0.0 {
+                    return None;
+                }
+                Some(Illumination {
+                    dir: offset.unit(),
+                    distance,
+                    irradiance: intensity / offset.norm(),
+                })
+            }
+            Light::Directional {
+                direction,
+                irradiance,
+            } => Some(Illumination {
+                dir: -direction,
+                distance: f64::INFINITY,
+                irradiance,
+            }),
+            Light::Spot {
+                position,
+                direction,
+                intensity,
+                cos_inner,
+                cos_outer,
+            } => {
+                let offset = position - point;
+                let distance = offset.abs();
+                if distance == 0.0 {
+                    return None;
+                }
+                let dir = offset.unit();
+                let cos = -dir.dot(direction);
+                if cos <= cos_outer {
+                    return None;
+                }
+                let falloff = if cos >= cos_inner {
+                    1.0
+                } else {
+                    // Smoothstep between the cone edges.
+                    let t = (cos - cos_outer) / (cos_inner - cos_outer);
+                    t * t * (3.0 - 2.0 * t)
+                };
+                Some(Illumination {
+                    dir,
+                    distance,
+                    irradiance: intensity * (falloff / offset.norm()),
+                })
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::f64::consts::PI;
+
+    #[test]
+    fn test_illuminate() {
+        let light = Light::point(Vec3::new(0.0, 2.0, 0.0), Color::WHITE);
+        let ill = light.illuminate(Vec3::ZERO).unwrap();
+        assert!((ill.dir.y - 1.0).abs() < 1e-9);
+        assert!((ill.distance - 2.0).abs() < 1e-9);
+        assert!((ill.irradiance.r - 0.25).abs() < 1e-9);
+
+        let light = Light::directional(Vec3::new(0.0, -1.0, 0.0), Color::WHITE);
+        let ill = light.illuminate(Vec3::ZERO).unwrap();
+        assert!((ill.dir.y - 1.0).abs() < 1e-9);
+        assert_eq!(ill.distance, f64::INFINITY);
+
+        let light = Light::spot(
+            Vec3::new(0.0, 1.0, 0.0),
+            Vec3::new(0.0, -1.0, 0.0),
+            Color::WHITE,
+            PI / 8.0,
+            PI / 4.0,
+        );
+        assert!((light.illuminate(Vec3::ZERO).unwrap().irradiance.r - 1.0).abs() < 1e-9);
+        let edge = light.illuminate(Vec3::new(0.6, 0.0, 0.0)).unwrap();
+        assert!(edge.irradiance.r > 0.0 && edge.irradiance.r < 1.0 / 1.36);
+        assert!(light.illuminate(Vec3::new(1.1, 0.0, 0.0)).is_none());
+    }
+}
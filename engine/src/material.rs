@@ -1,28 +1,69 @@
 use crate::color::Color;
-use crate::geom::{IntoVec3, Vec3};
+use crate::geom::{IntoVec3, Onb, Vec3};
 use crate::physics::{reflect, reflectance, refract};
-use crate::ray::Ray;
+use crate::ray::{Medium, Ray};
 use crate::rng::Rng;
-use crate::sampler::{ConstantSampler, LambertianSampler, Sampler, SphereSampler};
+use crate::sampler::{
+    ConstantSampler, GgxSampler, LambertianSampler, ScatterSampler, SphereSampler,
+};
 use crate::shape::Hit;
 use crate::texture::Texture;
 use rand::Rng as _;
+use std::sync::Arc;
 
 #[derive(Debug)]
 pub struct Scatter {
     pub point: Vec3,
     pub albedo: Color,
     pub emit: Color,
-    pub sampler: Option<Box<dyn Sampler>>,
+    pub sampler: Option<ScatterSampler>,
 }
 
 pub trait Material: Sync + Send {
-    fn scatter(&self, ray: &Ray, hit: &Hit, rng: &mut Rng) -> Scatter;
+    // The instance identifies the object hit, so that objects sharing the
+    // material are told apart.
+    fn scatter(&self, ray: &Ray, hit: &Hit, instance: u64, rng: &mut Rng) -> Scatter;
     fn important(&self) -> bool;
+
+    // Calls the method of the visitor for the material with its parameters,
+    // or none if the material cannot be described.
+    fn describe(&self, _visitor: &mut dyn MaterialVisitor) {}
+}
+
+// Visits materials by their parameters, like ShapeVisitor.
+pub trait MaterialVisitor {
+    fn lambertian(&mut self, texture: &dyn Texture);
+    fn metal(&mut self, texture: &dyn Texture, fuzz: f64);
+    fn pbr(&mut self, texture: &dyn Texture, roughness: f64, metallic: f64, anisotropy: f64);
+    fn coated(&mut self, base: &dyn Material, index: f64);
+    fn mix(&mut self, a: &dyn Material, b: &dyn Material, mask: &dyn Texture);
+    fn bump(&mut self, base: &dyn Material, height: &dyn Texture, scale: f64);
+    fn dielectric(&mut self, index: f64, priority: u32, absorption: Option<(Color, f64)>);
+    fn diffuse_light(&mut self, texture: &dyn Texture);
+}
+
+impl Material for Arc<dyn Material> {
+    fn scatter(&self, ray: &Ray, hit: &Hit, instance: u64, rng: &mut Rng) -> Scatter {
+        self.as_ref().scatter(ray, hit, instance, rng)
+    }
+
+    fn important(&self) -> bool {
+        self.as_ref().important()
+    }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        self.as_ref().describe(visitor)
+    }
 }
 
 pub trait VolumeMaterial: Sync + Send {
     fn scatter(&self, ray: &Ray, point: Vec3, rng: &mut Rng) -> Scatter;
+
+    fn describe(&self, _visitor: &mut dyn VolumeVisitor) {}
+}
+
+pub trait VolumeVisitor {
+    fn fog(&mut self, color: Color);
 }
 
 #[derive(Clone)]
@@ -31,7 +72,7 @@ pub struct Lambertian<T: Texture> {
 }
 
 impl<T: Texture> Material for Lambertian<T> {
-    fn scatter(&self, ray: &Ray, hit: &Hit, _rng: &mut Rng) -> Scatter {
+    fn scatter(&self, ray: &Ray, hit: &Hit, _instance: u64, _rng: &mut Rng) -> Scatter {
         let out_normal = if ray.dir.dot(hit.normal) < 0.0 {
             hit.normal
         } else {
@@ -41,14 +82,18 @@ impl<T: Texture> Material for Lambertian<T> {
             point: hit.point,
             albedo: self.texture.color(hit.u, hit.v, hit.point),
             emit: Color::BLACK,
-            sampler: Some(Box::new(LambertianSampler::new(out_normal))),
-            // sampler: Some(Box::new(SphereSampler::new(out_normal.into_vec3(), 1.0))),
+            sampler: Some(LambertianSampler::new(out_normal).into()),
+            // sampler: Some(SphereSampler::new(out_normal.into_vec3(), 1.0).into()),
         }
     }
 
     fn important(&self) -> bool {
         false
     }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.lambertian(&self.texture);
+    }
 }
 
 impl<T: Texture> Lambertian<T> {
@@ -64,21 +109,24 @@ pub struct Metal<T: Texture> {
 }
 
 impl<T: Texture> Material for Metal<T> {
-    fn scatter(&self, ray: &Ray, hit: &Hit, _rng: &mut Rng) -> Scatter {
+    fn scatter(&self, ray: &Ray, hit: &Hit, _instance: u64, _rng: &mut Rng) -> Scatter {
         Scatter {
             point: hit.point,
             albedo: self.texture.color(hit.u, hit.v, hit.point),
             emit: Color::BLACK,
-            sampler: Some(Box::new(SphereSampler::new(
-                reflect(ray.dir, hit.normal).into_vec3(),
-                self.fuzz,
-            ))),
+            sampler: Some(
+                SphereSampler::new(reflect(ray.dir, hit.normal).into_vec3(), self.fuzz).into(),
+            ),
         }
     }
 
     fn important(&self) -> bool {
         true
     }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.metal(&self.texture, self.fuzz);
+    }
 }
 
 impl<T: Texture> Metal<T> {
@@ -87,43 +135,329 @@ impl<T: Texture> Metal<T> {
     }
 }
 
+// Metallic-roughness material of PBR pipelines: diffuse reflection under
+// glossy GGX reflection. Each scatter picks one of them by their weights
+// after Fresnel reflectance at the viewing angle. Anisotropic roughness
+// stretches highlights across the tangent, as on brushed metal.
+#[derive(Clone)]
+pub struct Pbr<T: Texture> {
+    texture: T,
+    roughness: f64,
+    metallic: f64,
+    anisotropy: f64,
+}
+
+impl<T: Texture> Material for Pbr<T> {
+    fn scatter(&self, ray: &Ray, hit: &Hit, _instance: u64, rng: &mut Rng) -> Scatter {
+        let normal = if ray.dir.dot(hit.normal) < 0.0 {
+            hit.normal
+        } else {
+            -hit.normal
+        };
+        let base = self.texture.color(hit.u, hit.v, hit.point);
+        let cos = (-ray.dir.dot(normal)).max(0.0).min(1.0);
+        let f0 = (1.0 - self.metallic) * Color::new(0.04, 0.04, 0.04) + self.metallic * base;
+        let specular = f0 + (1.0 - cos).powi(5) * (Color::WHITE - f0);
+        let diffuse = (1.0 - self.metallic) * base * (Color::WHITE - specular);
+        let weight = specular.luminance() + diffuse.luminance();
+        let p = if weight > 0.0 {
+            specular.luminance() / weight
+        } else {
+            1.0
+        };
+        let (albedo, sampler): (Color, ScatterSampler) = if rng.gen::<f64>() < p {
+            // Rough surfaces reflect by the Fresnel reflectance at microfacet
+            // normals, which GgxSampler weights directions by.
+            let alpha = self.roughness * self.roughness;
+            if alpha < 1e-4 {
+                let sampler = ConstantSampler::new(reflect(ray.dir, normal));
+                (specular / p, sampler.into())
+            } else if self.anisotropy > 0.0 {
+                let aspect = (1.0 - 0.9 * self.anisotropy).sqrt();
+                let sampler = GgxSampler::anisotropic(
+                    normal,
+                    hit.tangent,
+                    ray.dir,
+                    alpha / aspect,
+                    alpha * aspect,
+                    f0,
+                );
+                (Color::WHITE / p, sampler.into())
+            } else {
+                let sampler = GgxSampler::new(normal, ray.dir, alpha, f0);
+                (Color::WHITE / p, sampler.into())
+            }
+        } else {
+            (diffuse / (1.0 - p), LambertianSampler::new(normal).into())
+        };
+        Scatter {
+            point: hit.point,
+            albedo,
+            emit: Color::BLACK,
+            sampler: Some(sampler),
+        }
+    }
+
+    fn important(&self) -> bool {
+        false
+    }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.pbr(
+            &self.texture,
+            self.roughness,
+            self.metallic,
+            self.anisotropy,
+        );
+    }
+}
+
+impl<T: Texture> Pbr<T> {
+    // roughness and metallic are in [0, 1].
+    pub fn new(texture: T, roughness: f64, metallic: f64) -> Self {
+        Pbr {
+            texture,
+            roughness: roughness.max(0.0).min(1.0),
+            metallic: metallic.max(0.0).min(1.0),
+            anisotropy: 0.0,
+        }
+    }
+
+    // Anisotropy in [0, 1] makes the surface rougher along the tangent, the
+    // direction of increasing u, than across it.
+    pub fn with_anisotropy(self, anisotropy: f64) -> Self {
+        Pbr {
+            anisotropy: anisotropy.max(0.0).min(1.0),
+            ..self
+        }
+    }
+}
+
+// A thin smooth dielectric layer over another material, as clear coats on car
+// paint and polished wood. Light is reflected by the coat by its Fresnel
+// reflectance and reaches the base otherwise. The coat is one-sided, on the
+// side the normal faces, and light from behind reaches the base directly.
+#[derive(Clone)]
+pub struct Coated<M: Material> {
+    base: M,
+    index: f64,
+}
+
+impl<M: Material> Material for Coated<M> {
+    fn scatter(&self, ray: &Ray, hit: &Hit, instance: u64, rng: &mut Rng) -> Scatter {
+        let front = ray.dir.dot(hit.normal) < 0.0;
+        if front && rng.gen::<f64>() < reflectance(ray.dir, hit.normal, 1.0 / self.index) {
+            return Scatter {
+                point: hit.point,
+                albedo: Color::WHITE,
+                emit: Color::BLACK,
+                sampler: Some(ConstantSampler::new(reflect(ray.dir, hit.normal)).into()),
+            };
+        }
+        self.base.scatter(ray, hit, instance, rng)
+    }
+
+    fn important(&self) -> bool {
+        true
+    }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.coated(&self.base, self.index);
+    }
+}
+
+impl<M: Material> Coated<M> {
+    pub fn new(base: M, index: f64) -> Self {
+        Coated { base, index }
+    }
+}
+
+// Blends two materials, e.g. rust over metal, by scattering with b in the
+// fraction of the luminance of the mask, clamped to [0, 1], and with a
+// otherwise.
+#[derive(Clone)]
+pub struct Mix<A: Material, B: Material, T: Texture> {
+    a: A,
+    b: B,
+    mask: T,
+}
+
+impl<A: Material, B: Material, T: Texture> Material for Mix<A, B, T> {
+    fn scatter(&self, ray: &Ray, hit: &Hit, instance: u64, rng: &mut Rng) -> Scatter {
+        let weight = self.mask.color(hit.u, hit.v, hit.point).luminance();
+        if rng.gen::<f64>() < weight.max(0.0).min(1.0) {
+            self.b.scatter(ray, hit, instance, rng)
+        } else {
+            self.a.scatter(ray, hit, instance, rng)
+        }
+    }
+
+    fn important(&self) -> bool {
+        self.a.important() || self.b.important()
+    }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.mix(&self.a, &self.b, &self.mask);
+    }
+}
+
+impl<A: Material, B: Material, T: Texture> Mix<A, B, T> {
+    pub fn new(a: A, b: B, mask: T) -> Self {
+        Mix { a, b, mask }
+    }
+}
+
+// Tilts normals seen by the base material by the slope of a height map, the
+// luminance of the texture times scale, for fine detail like hammered metal
+// without adding geometry. The slope is taken by moving both the texture
+// coordinates and the point, so that image and solid textures both work.
+#[derive(Clone)]
+pub struct Bump<M: Material, T: Texture> {
+    base: M,
+    height: T,
+    scale: f64,
+}
+
+impl<M: Material, T: Texture> Material for Bump<M, T> {
+    fn scatter(&self, ray: &Ray, hit: &Hit, instance: u64, rng: &mut Rng) -> Scatter {
+        const EPS: f64 = 1e-3;
+        let height = |u: f64, v: f64, p: Vec3| self.height.color(u, v, p).luminance() * self.scale;
+        let basis = Onb::from_normal_tangent(hit.normal, hit.tangent);
+        let h = height(hit.u, hit.v, hit.point);
+        let du = (height(hit.u + EPS, hit.v, hit.point + basis.u * EPS) - h) / EPS;
+        let dv = (height(hit.u, hit.v + EPS, hit.point + basis.v * EPS) - h) / EPS;
+        let hit = Hit {
+            normal: basis.to_world(Vec3::new(-du, -dv, 1.0)).unit(),
+            ..hit.clone()
+        };
+        self.base.scatter(ray, &hit, instance, rng)
+    }
+
+    fn important(&self) -> bool {
+        self.base.important()
+    }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.bump(&self.base, &self.height, self.scale);
+    }
+}
+
+impl<M: Material, T: Texture> Bump<M, T> {
+    pub fn new(base: M, height: T, scale: f64) -> Self {
+        Bump {
+            base,
+            height,
+            scale,
+        }
+    }
+}
+
+// Transparent material like glass and water. Where dielectrics overlap, e.g.
+// water filling a glass, the one of the highest priority takes effect, and
+// surfaces inside it are ignored. The inside of each object is a medium of its
+// own, even if objects share the material.
 #[derive(Clone)]
 pub struct Dielectric {
     index: f64,
+    priority: u32,
+    // Light traveling 1 / density inside is tinted by the color.
+    absorption: Option<(Color, f64)>,
 }
 
 impl Material for Dielectric {
-    fn scatter(&self, ray: &Ray, hit: &Hit, rng: &mut Rng) -> Scatter {
-        let new_dir = {
-            let ratio = if ray.dir.dot(hit.normal) > 0.0 {
-                self.index
-            } else {
-                1.0 / self.index
-            };
-            if rng.gen::<f64>() < reflectance(ray.dir, hit.normal, ratio) {
-                reflect(ray.dir, hit.normal)
-            } else if let Some(new_dir) = refract(ray.dir, hit.normal, ratio) {
-                new_dir
-            } else {
-                reflect(ray.dir, hit.normal)
+    fn scatter(&self, ray: &Ray, hit: &Hit, instance: u64, rng: &mut Rng) -> Scatter {
+        let inside = ray.dir.dot(hit.normal) > 0.0;
+        let mut media = ray.media.clone();
+        // The ray may have started inside, e.g. from a camera under water.
+        if inside {
+            media.push(self.medium(instance));
+        }
+        // Light is absorbed in the medium it has traveled hit.t through.
+        let albedo = match media.top().and_then(|m| m.absorption) {
+            Some((color, density)) => {
+                let d = density * hit.t;
+                Color::new(color.r.powf(d), color.g.powf(d), color.b.powf(d))
             }
+            None => Color::WHITE,
+        };
+        let mut crossed = media.clone();
+        if inside {
+            crossed.remove(instance);
+        } else {
+            crossed.push(self.medium(instance));
+        }
+        // The surface is ignored if the medium on the other side overrides it.
+        let outer = if inside { crossed.top() } else { media.top() };
+        if let Some(outer) = outer {
+            if outer.priority > self.priority {
+                return Scatter {
+                    point: hit.point,
+                    albedo,
+                    emit: Color::BLACK,
+                    sampler: Some(ConstantSampler::new(ray.dir).with_media(crossed).into()),
+                };
+            }
+        }
+
+        let outer_index = outer.map_or(1.0, |m| m.index);
+        let ratio = if inside {
+            self.index / outer_index
+        } else {
+            outer_index / self.index
+        };
+        let (new_dir, media) = if rng.gen::<f64>() < reflectance(ray.dir, hit.normal, ratio) {
+            (reflect(ray.dir, hit.normal), media)
+        } else if let Some(new_dir) = refract(ray.dir, hit.normal, ratio) {
+            (new_dir, crossed)
+        } else {
+            (reflect(ray.dir, hit.normal), media)
         };
         Scatter {
             point: hit.point,
-            albedo: Color::WHITE,
+            albedo,
             emit: Color::BLACK,
-            sampler: Some(Box::new(ConstantSampler::new(new_dir))),
+            sampler: Some(ConstantSampler::new(new_dir).with_media(media).into()),
         }
     }
 
     fn important(&self) -> bool {
         true
     }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.dielectric(self.index, self.priority, self.absorption);
+    }
 }
 
 impl Dielectric {
     pub fn new(index: f64) -> Self {
-        Dielectric { index }
+        Dielectric {
+            index,
+            priority: 0,
+            absorption: None,
+        }
+    }
+
+    // Makes light inside tinted by the color per 1 / density of distance, as
+    // in colored glass and liquids.
+    pub fn with_absorption(self, color: Color, density: f64) -> Self {
+        Dielectric {
+            absorption: Some((color.clamp(0.0, 1.0), density)),
+            ..self
+        }
+    }
+
+    pub fn with_priority(self, priority: u32) -> Self {
+        Dielectric { priority, ..self }
+    }
+
+    fn medium(&self, instance: u64) -> Medium {
+        Medium {
+            id: instance,
+            priority: self.priority,
+            index: self.index,
+            absorption: self.absorption,
+        }
     }
 }
 
@@ -133,7 +467,7 @@ pub struct DiffuseLight<T: Texture> {
 }
 
 impl<T: Texture> Material for DiffuseLight<T> {
-    fn scatter(&self, _ray: &Ray, hit: &Hit, _rng: &mut Rng) -> Scatter {
+    fn scatter(&self, _ray: &Ray, hit: &Hit, _instance: u64, _rng: &mut Rng) -> Scatter {
         Scatter {
             point: hit.point,
             albedo: Color::BLACK,
@@ -145,6 +479,10 @@ impl<T: Texture> Material for DiffuseLight<T> {
     fn important(&self) -> bool {
         true
     }
+
+    fn describe(&self, visitor: &mut dyn MaterialVisitor) {
+        visitor.diffuse_light(&self.texture);
+    }
 }
 
 impl<T: Texture> DiffuseLight<T> {
@@ -164,9 +502,13 @@ impl VolumeMaterial for Fog {
             point,
             albedo: self.color,
             emit: Color::BLACK,
-            sampler: Some(Box::new(SphereSampler::new(Vec3::ZERO, 1.0))),
+            sampler: Some(SphereSampler::new(Vec3::ZERO, 1.0).into()),
         }
     }
+
+    fn describe(&self, visitor: &mut dyn VolumeVisitor) {
+        visitor.fog(self.color);
+    }
 }
 
 impl Fog {
@@ -174,3 +516,271 @@ impl Fog {
         Fog { color }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::geom::Vec3Unit;
+    use crate::ray::Media;
+    use crate::sampler::Sampler;
+    use crate::texture::SolidColor;
+    use rand::SeedableRng;
+
+    // Returns a ray hitting the plane y = 0 at the origin, at the angle of cos
+    // to its normal.
+    fn incoming(cos: f64) -> (Ray, Hit) {
+        let dir = Vec3::new((1.0 - cos * cos).sqrt(), -cos, 0.0).unit();
+        let ray = Ray::new(Vec3::new(0.0, 1.0, 0.0), dir, 0.0);
+        let hit = Hit {
+            point: Vec3::new(0.0, 0.0, 0.0),
+            normal: Vec3Unit::Y,
+            tangent: Vec3Unit::X,
+            t: 1.0,
+            u: 0.5,
+            v: 0.5,
+        };
+        (ray, hit)
+    }
+
+    // Returns the fraction of light reflected off the material lit evenly
+    // from every direction, toward the direction at the angle of cos.
+    fn furnace(material: &dyn Material, cos: f64, rng: &mut Rng) -> f64 {
+        let n = 200000;
+        let (ray, hit) = incoming(cos);
+        let mut sum = 0.0;
+        for _ in 0..n {
+            let scatter = material.scatter(&ray, &hit, 0, rng);
+            let sampler = scatter.sampler.unwrap();
+            let out = sampler.sample(rng);
+            if sampler.constant().is_some() {
+                sum += scatter.albedo.luminance();
+            } else if sampler.probability(out) > 0.0 {
+                sum += (scatter.albedo * sampler.weight(out)).luminance();
+            }
+        }
+        sum / n as f64
+    }
+
+    #[test]
+    fn test_pbr_white_furnace() {
+        let mut rng = Rng::seed_from_u64(28);
+        let white = || SolidColor::new(Color::WHITE);
+        for &roughness in [0.1, 0.5, 1.0].iter() {
+            for &cos in [1.0, 0.5, 0.1].iter() {
+                // White metals reflect everything but what is lost to masking,
+                // which grows with roughness.
+                let metal = furnace(&Pbr::new(white(), roughness, 1.0), cos, &mut rng);
+                let dielectric = furnace(&Pbr::new(white(), roughness, 0.0), cos, &mut rng);
+                for &energy in [metal, dielectric].iter() {
+                    assert!(
+                        energy <= 1.01,
+                        "roughness={} cos={}: {}",
+                        roughness,
+                        cos,
+                        energy
+                    );
+                }
+                if roughness == 0.1 {
+                    assert!(
+                        metal >= 0.99,
+                        "roughness={} cos={}: {}",
+                        roughness,
+                        cos,
+                        metal
+                    );
+                }
+            }
+        }
+        // The GGX BRDF integrated over the hemisphere gives these.
+        for &(roughness, cos, want) in
+            [(0.5, 1.0, 0.917), (0.5, 0.5, 0.857), (1.0, 1.0, 0.307)].iter()
+        {
+            let got = furnace(&Pbr::new(white(), roughness, 1.0), cos, &mut rng);
+            assert!(
+                (got - want).abs() < 0.01,
+                "roughness={} cos={}: got {}, want {}",
+                roughness,
+                cos,
+                got,
+                want
+            );
+        }
+        let anisotropic = Pbr::new(white(), 0.5, 1.0).with_anisotropy(1.0);
+        assert!(furnace(&anisotropic, 0.1, &mut rng) <= 1.01);
+    }
+
+    #[test]
+    fn test_mix() {
+        let mut rng = Rng::seed_from_u64(28);
+        let (ray, hit) = incoming(1.0);
+        let a = DiffuseLight::new(SolidColor::new(Color::new(1.0, 0.0, 0.0)));
+        let b = DiffuseLight::new(SolidColor::new(Color::new(0.0, 0.0, 1.0)));
+        let n = 100000;
+        for &(mask, want) in [
+            (0.25, 0.25),
+            (-1.0, 0.0),
+            (0.0, 0.0),
+            (1.0, 1.0),
+            (3.0, 1.0),
+        ]
+        .iter()
+        {
+            let mix = Mix::new(
+                a.clone(),
+                b.clone(),
+                SolidColor::new(Color::new(mask, mask, mask)),
+            );
+            let picked_b = (0..n)
+                .filter(|_| mix.scatter(&ray, &hit, 0, &mut rng).emit.b > 0.0)
+                .count();
+            let got = picked_b as f64 / n as f64;
+            assert!(
+                (got - want).abs() < 0.01,
+                "mask={}: got {}, want {}",
+                mask,
+                got,
+                want
+            );
+        }
+    }
+
+    #[test]
+    fn test_coated() {
+        let mut rng = Rng::seed_from_u64(28);
+        let coated = Coated::new(DiffuseLight::new(SolidColor::new(Color::WHITE)), 1.5);
+        let n = 100000;
+        let r0 = 0.04;
+        // Schlick's approximation at normal and grazing incidence.
+        for &(cos, want) in [(1.0, r0), (0.01, r0 + (1.0 - r0) * 0.99f64.powi(5))].iter() {
+            let (ray, hit) = incoming(cos);
+            let mut coat = 0;
+            for _ in 0..n {
+                let scatter = coated.scatter(&ray, &hit, 0, &mut rng);
+                if scatter.sampler.is_some() {
+                    assert_eq!(scatter.emit.luminance(), 0.0);
+                    let dir = scatter.sampler.unwrap().sample(&mut rng);
+                    assert!((dir - reflect(ray.dir, hit.normal)).abs() < 1e-9);
+                    coat += 1;
+                } else {
+                    // The base, which is a light.
+                    assert!(scatter.emit.luminance() > 0.0);
+                }
+            }
+            let got = coat as f64 / n as f64;
+            assert!(
+                (got - want).abs() < 0.01,
+                "cos={}: got {}, want {}",
+                cos,
+                got,
+                want
+            );
+        }
+
+        // Light from behind always reaches the base.
+        let (ray, hit) = incoming(1.0);
+        let hit = Hit {
+            normal: -hit.normal,
+            ..hit
+        };
+        for _ in 0..1000 {
+            assert!(coated.scatter(&ray, &hit, 0, &mut rng).sampler.is_none());
+        }
+    }
+
+    // Follows a ray going down through the plane y = 0, which it enters if the
+    // normal faces up and leaves otherwise, and returns the media after it.
+    fn pass(
+        material: &Dielectric,
+        instance: u64,
+        enter: bool,
+        media: &Media,
+        rng: &mut Rng,
+    ) -> Media {
+        let ray = Ray::new(Vec3::new(0.0, 1.0, 0.0), -Vec3Unit::Y, 0.0).with_media(media.clone());
+        let (_, hit) = incoming(1.0);
+        let hit = Hit {
+            normal: if enter { Vec3Unit::Y } else { -Vec3Unit::Y },
+            ..hit
+        };
+        loop {
+            let sampler = material.scatter(&ray, &hit, instance, rng).sampler.unwrap();
+            if sampler.sample(rng).dot(Vec3Unit::Y) < 0.0 {
+                return sampler.media().unwrap();
+            }
+        }
+    }
+
+    #[test]
+    fn test_dielectric_media() {
+        let mut rng = Rng::seed_from_u64(28);
+        let top = |media: &Media| media.top().map(|m| m.id);
+
+        // Overlapping objects sharing the material are media of their own.
+        let glass = Dielectric::new(1.5);
+        let media = pass(&glass, 1, true, &Media::default(), &mut rng);
+        let media = pass(&glass, 2, true, &media, &mut rng);
+        assert!(media.contains(1) && media.contains(2));
+        let media = pass(&glass, 1, false, &media, &mut rng);
+        assert_eq!(top(&media), Some(2));
+        let media = pass(&glass, 2, false, &media, &mut rng);
+        assert_eq!(top(&media), None);
+
+        // Water filling a glass of a higher priority, overlapping its wall.
+        let glass = Dielectric::new(1.5).with_priority(2);
+        let water = Dielectric::new(1.33).with_priority(1);
+        let media = pass(&glass, 3, true, &Media::default(), &mut rng);
+        let ray = Ray::new(Vec3::new(0.0, 1.0, 0.0), -Vec3Unit::Y, 0.0).with_media(media.clone());
+        let (_, hit) = incoming(1.0);
+        for _ in 0..100 {
+            // The surface of the water inside the glass is ignored.
+            let sampler = water.scatter(&ray, &hit, 4, &mut rng).sampler.unwrap();
+            assert!((sampler.sample(&mut rng) - ray.dir).abs() < 1e-9);
+        }
+        let media = pass(&water, 4, true, &media, &mut rng);
+        assert_eq!(top(&media), Some(3));
+        let media = pass(&glass, 3, false, &media, &mut rng);
+        assert_eq!(top(&media), Some(4));
+        let media = pass(&water, 4, false, &media, &mut rng);
+        assert_eq!(top(&media), None);
+    }
+
+    #[test]
+    fn test_dielectric_absorption() {
+        let mut rng = Rng::seed_from_u64(28);
+        // Of index 1 so that nothing is reflected.
+        let color = Color::new(0.8, 0.5, 0.1);
+        let density = 2.0;
+        let glass = Dielectric::new(1.0).with_absorption(color, density);
+        let media = pass(&glass, 1, true, &Media::default(), &mut rng);
+        for &d in [0.1, 1.0, 3.0].iter() {
+            // Leaves a slab of the thickness d.
+            let ray = Ray::new(Vec3::new(0.0, d, 0.0), -Vec3Unit::Y, 0.0).with_media(media.clone());
+            let (_, hit) = incoming(1.0);
+            let hit = Hit {
+                normal: -Vec3Unit::Y,
+                t: d,
+                ..hit
+            };
+            let albedo = glass.scatter(&ray, &hit, 1, &mut rng).albedo;
+            // Beer-Lambert law, with the attenuation coefficient such that
+            // light traveling 1 / density is tinted by the color.
+            for &(got, c) in [
+                (albedo.r, color.r),
+                (albedo.g, color.g),
+                (albedo.b, color.b),
+            ]
+            .iter()
+            {
+                let sigma = -c.ln() * density;
+                let want = (-sigma * d).exp();
+                assert!(
+                    (got - want).abs() < 1e-9,
+                    "d={}: got {}, want {}",
+                    d,
+                    got,
+                    want
+                );
+            }
+        }
+    }
+}
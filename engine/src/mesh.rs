@@ -0,0 +1,643 @@
+use crate::accel::{Accelerator, AcceleratorKind};
+use crate::binary::{read_f64, read_u64, write_f64, write_u64};
+use crate::geom::{Box3, IntoVec3, PackedVec3, Vec3};
+use crate::mesh_file::{parse_ply, parse_stl};
+use crate::ray::{Ray, RayBatch};
+use crate::rng::fnv1a;
+use crate::sampler::Sampler;
+use crate::shape::{Hit, Shape, ShapeVisitor, Triangle};
+use crate::texture::Texture;
+use crate::time::TimeRange;
+use anyhow::{bail, Result};
+use std::collections::HashMap;
+use std::fs::{self, File};
+use std::io::{self, BufReader, BufWriter, Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+const CACHE_MAGIC: &[u8; 8] = b"RTMESH03";
+
+#[derive(Debug)]
+struct MeshData {
+    vertices: Vec<PackedVec3>,
+    faces: Vec<[usize; 3]>,
+    // Texture coordinates of vertices, or empty.
+    uvs: Vec<[f64; 2]>,
+    // Unit normals of vertices, or empty.
+    normals: Vec<PackedVec3>,
+}
+
+impl MeshData {
+    fn new(
+        vertices: Vec<Vec3>,
+        faces: Vec<[usize; 3]>,
+        uvs: Vec<[f64; 2]>,
+        normals: Vec<Vec3>,
+    ) -> Self {
+        MeshData {
+            vertices: vertices.into_iter().map(PackedVec3::from).collect(),
+            faces,
+            uvs,
+            normals: normals.into_iter().map(PackedVec3::from).collect(),
+        }
+    }
+
+    fn vertex(&self, i: usize) -> Vec3 {
+        self.vertices[i].into()
+    }
+
+    fn normal(&self, i: usize) -> Vec3 {
+        self.normals[i].into()
+    }
+
+    fn triangle(&self, index: usize) -> Triangle {
+        let [i0, i1, i2] = self.faces[index];
+        Triangle::new(self.vertex(i0), self.vertex(i1), self.vertex(i2))
+    }
+}
+
+// File a mesh was loaded from, with the options of loading.
+#[derive(Clone, Debug)]
+struct MeshSource {
+    path: PathBuf,
+    smooth: bool,
+    cache: bool,
+}
+
+#[derive(Clone, Debug)]
+pub struct Mesh {
+    data: Arc<MeshData>,
+    accel: Arc<Accelerator<MeshFace>>,
+    source: Option<MeshSource>,
+    cull_backfaces: bool,
+}
+
+impl Shape for Mesh {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        if self.cull_backfaces {
+            self.hit_face(ray, t_min, t_max).map(|(hit, _)| hit)
+        } else {
+            self.accel.hit(ray, t_min, t_max)
+        }
+    }
+
+    fn hit_batch(&self, batch: &RayBatch, t_min: f64, t_max: &[f64]) -> Vec<Option<Hit>> {
+        self.hit_face_batch(batch, t_min, t_max)
+            .into_iter()
+            .map(|hit| hit.map(|(hit, _)| hit))
+            .collect()
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.accel.bounding_box(time)
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        self.accel.sampler(from, time)
+    }
+
+    fn is_empty(&self) -> bool {
+        self.accel.is_empty()
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        match &self.source {
+            Some(source) => visitor.mesh_file(
+                &source.path,
+                source.smooth,
+                source.cache,
+                self.cull_backfaces,
+            ),
+            None => {
+                let vertices: Vec<Vec3> = self.data.vertices.iter().map(|&v| v.into()).collect();
+                let normals: Vec<Vec3> = self.data.normals.iter().map(|&n| n.into()).collect();
+                visitor.mesh(
+                    &vertices,
+                    &self.data.faces,
+                    &self.data.uvs,
+                    &normals,
+                    self.cull_backfaces,
+                );
+            }
+        }
+    }
+}
+
+impl Mesh {
+    pub fn new(vertices: Vec<Vec3>, faces: Vec<[usize; 3]>) -> Self {
+        Self::with_attributes(vertices, faces, Vec::new(), Vec::new())
+    }
+
+    // Either of texture coordinates and normals of vertices may be empty. If
+    // given, hits report texture coordinates interpolated from the ones of
+    // vertices instead of barycentric coordinates, and normals interpolated
+    // likewise instead of the ones of flat faces.
+    pub fn with_attributes(
+        vertices: Vec<Vec3>,
+        faces: Vec<[usize; 3]>,
+        uvs: Vec<[f64; 2]>,
+        normals: Vec<Vec3>,
+    ) -> Self {
+        for face in faces.iter() {
+            for &i in face.iter() {
+                assert!(i < vertices.len(), "Vertex index out of range: {}", i);
+            }
+        }
+        assert!(
+            uvs.is_empty() || uvs.len() == vertices.len(),
+            "Texture coordinates must be given for all vertices"
+        );
+        assert!(
+            normals.is_empty() || normals.len() == vertices.len(),
+            "Normals must be given for all vertices"
+        );
+        Self::build(
+            Arc::new(MeshData::new(vertices, faces, uvs, normals)),
+            AcceleratorKind::Bvh,
+        )
+    }
+
+    fn build(data: Arc<MeshData>, accelerator: AcceleratorKind) -> Self {
+        let accel = Arc::new(Accelerator::new(
+            accelerator,
+            (0..data.faces.len()).map(|index| MeshFace {
+                data: data.clone(),
+                index,
+            }),
+            TimeRange::ZERO,
+        ));
+        Mesh {
+            data,
+            accel,
+            source: None,
+            cull_backfaces: false,
+        }
+    }
+
+    // Rebuilds the mesh with the acceleration structure of the kind, unless it
+    // already has one.
+    pub fn with_accelerator(self, accelerator: AcceleratorKind) -> Self {
+        if self.accel.kind() == accelerator {
+            return self;
+        }
+        Mesh {
+            source: self.source,
+            cull_backfaces: self.cull_backfaces,
+            ..Self::build(self.data, accelerator)
+        }
+    }
+
+    // Loads a mesh from a file in the format told by the extension, either STL
+    // or PLY. If smooth, normals are computed for files lacking them.
+    pub fn load(
+        path: impl AsRef<Path>,
+        smooth: bool,
+        accelerator: AcceleratorKind,
+    ) -> Result<Self> {
+        Self::load_file(path.as_ref(), smooth, accelerator, false)
+    }
+
+    // Same as load, but reuses the mesh and its acceleration structure saved
+    // in the cache file next to the file, named with the suffix .cache, if it
+    // was made from the same contents. Otherwise the cache file is written
+    // after loading.
+    pub fn load_cached(
+        path: impl AsRef<Path>,
+        smooth: bool,
+        accelerator: AcceleratorKind,
+    ) -> Result<Self> {
+        Self::load_file(path.as_ref(), smooth, accelerator, true)
+    }
+
+    fn load_file(
+        path: &Path,
+        smooth: bool,
+        accelerator: AcceleratorKind,
+        cache: bool,
+    ) -> Result<Self> {
+        let data = fs::read(path)?;
+        let source = MeshSource {
+            path: path.to_owned(),
+            smooth,
+            cache,
+        };
+        let mut cache_path = path.as_os_str().to_owned();
+        cache_path.push(".cache");
+        // Keyed by the contents and the options affecting them.
+        let key = fnv1a(
+            data.iter()
+                .chain([smooth as u8, accelerator as u8].iter())
+                .copied(),
+        );
+        if cache {
+            let cached = File::open(&cache_path)
+                .and_then(|file| Self::read_cache(&mut BufReader::new(file), key));
+            if let Ok(mesh) = cached {
+                return Ok(Mesh {
+                    source: Some(source),
+                    ..mesh
+                });
+            }
+        }
+
+        let extension = path
+            .extension()
+            .and_then(|ext| ext.to_str())
+            .unwrap_or_default()
+            .to_ascii_lowercase();
+        let (vertices, faces, mut normals) = match extension.as_str() {
+            "stl" => {
+                let (vertices, faces) = parse_stl(&data)?;
+                (vertices, faces, Vec::new())
+            }
+            "ply" => parse_ply(&data)?,
+            _ => bail!("Unknown mesh file format: {}", path.display()),
+        };
+        if smooth && normals.is_empty() {
+            normals = vertex_normals(&vertices, &faces);
+        }
+        let data = Arc::new(MeshData::new(vertices, faces, Vec::new(), normals));
+        let mesh = Mesh {
+            source: Some(source),
+            ..Mesh::build(data, accelerator)
+        };
+        if cache {
+            // Caching is best effort, as the directory may be read-only. The
+            // file is renamed when complete so that readers never see a
+            // partial one.
+            let mut temp_path = cache_path.clone();
+            temp_path.push(".tmp");
+            let _ = File::create(&temp_path)
+                .and_then(|file| {
+                    let mut writer = BufWriter::new(file);
+                    mesh.write_cache(&mut writer, key)?;
+                    writer.flush()
+                })
+                .and_then(|_| fs::rename(&temp_path, &cache_path));
+        }
+        Ok(mesh)
+    }
+
+    fn write_cache(&self, writer: &mut impl Write, key: u64) -> io::Result<()> {
+        let data = &self.data;
+        writer.write_all(CACHE_MAGIC)?;
+        write_u64(writer, key)?;
+        for vectors in [&data.vertices, &data.normals].iter() {
+            write_u64(writer, vectors.len() as u64)?;
+            for v in vectors.iter() {
+                let v = Vec3::from(*v);
+                write_f64(writer, v.x)?;
+                write_f64(writer, v.y)?;
+                write_f64(writer, v.z)?;
+            }
+        }
+        write_u64(writer, data.faces.len() as u64)?;
+        for face in data.faces.iter() {
+            for &i in face.iter() {
+                write_u64(writer, i as u64)?;
+            }
+        }
+        write_u64(writer, data.uvs.len() as u64)?;
+        for uv in data.uvs.iter() {
+            write_f64(writer, uv[0])?;
+            write_f64(writer, uv[1])?;
+        }
+        self.accel.save(writer, |face| face.index as u64)
+    }
+
+    fn read_cache(reader: &mut impl Read, key: u64) -> io::Result<Self> {
+        let invalid = |message| io::Error::new(io::ErrorKind::InvalidData, message);
+        let mut magic = [0; 8];
+        reader.read_exact(&mut magic)?;
+        if &magic != CACHE_MAGIC || read_u64(reader)? != key {
+            return Err(invalid("Stale mesh cache"));
+        }
+        let mut read_vectors = || -> io::Result<Vec<Vec3>> {
+            let mut vectors = Vec::new();
+            for _ in 0..read_u64(reader)? {
+                vectors.push(Vec3::new(
+                    read_f64(reader)?,
+                    read_f64(reader)?,
+                    read_f64(reader)?,
+                ));
+            }
+            Ok(vectors)
+        };
+        let vertices = read_vectors()?;
+        let normals = read_vectors()?;
+        let mut faces = Vec::new();
+        for _ in 0..read_u64(reader)? {
+            let mut face = [0; 3];
+            for i in face.iter_mut() {
+                *i = read_u64(reader)? as usize;
+            }
+            faces.push(face);
+        }
+        let mut uvs = Vec::new();
+        for _ in 0..read_u64(reader)? {
+            uvs.push([read_f64(reader)?, read_f64(reader)?]);
+        }
+        if faces.iter().flatten().any(|i| *i >= vertices.len())
+            || !(uvs.is_empty() || uvs.len() == vertices.len())
+            || !(normals.is_empty() || normals.len() == vertices.len())
+        {
+            return Err(invalid("Corrupted mesh cache"));
+        }
+
+        let data = Arc::new(MeshData::new(vertices, faces, uvs, normals));
+        let accel = Accelerator::load(reader, |index| {
+            let index = index as usize;
+            if index < data.faces.len() {
+                Some(MeshFace {
+                    data: data.clone(),
+                    index,
+                })
+            } else {
+                None
+            }
+        })?;
+        Ok(Mesh {
+            data,
+            accel: Arc::new(accel),
+            source: None,
+            cull_backfaces: false,
+        })
+    }
+
+    pub fn face_count(&self) -> usize {
+        self.data.faces.len()
+    }
+
+    // Skips faces whose backs are toward rays, which cannot be seen from
+    // outside of closed opaque meshes. Rays inside such as ones refracted by
+    // glass would see through them.
+    pub fn with_backface_culling(self, cull_backfaces: bool) -> Self {
+        Mesh {
+            cull_backfaces,
+            ..self
+        }
+    }
+
+    // Finds the closest hit along with the index of the face hit.
+    pub fn hit_face(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<(Hit, usize)> {
+        let hit = if self.cull_backfaces {
+            self.accel
+                .hit_shape_with(ray, t_min, t_max, MeshFace::hit_front)
+        } else {
+            self.accel.hit_shape(ray, t_min, t_max)
+        };
+        hit.map(|(hit, face)| (hit, face.index))
+    }
+
+    // Same as hit_face for the rays in the batch, each before its own t_max.
+    pub fn hit_face_batch(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: &[f64],
+    ) -> Vec<Option<(Hit, usize)>> {
+        let hits = if self.cull_backfaces {
+            self.accel
+                .hit_batch_with(batch, t_min, t_max, MeshFace::hit_front)
+        } else {
+            self.accel.hit_batch(batch, t_min, t_max)
+        };
+        hits.into_iter()
+            .map(|hit| hit.map(|(hit, face)| (hit, face.index)))
+            .collect()
+    }
+
+    // Returns a mesh of the faces whose indices satisfy the predicate.
+    pub fn select_faces(&self, keep: impl Fn(usize) -> bool) -> Mesh {
+        let data = Arc::new(MeshData {
+            vertices: self.data.vertices.clone(),
+            faces: (0..self.data.faces.len())
+                .filter(|i| keep(*i))
+                .map(|i| self.data.faces[i])
+                .collect(),
+            uvs: self.data.uvs.clone(),
+            normals: self.data.normals.clone(),
+        });
+        Self::build(data, self.accel.kind()).with_backface_culling(self.cull_backfaces)
+    }
+
+    // Splits each face into four the number of times, and then moves vertices
+    // along their normals by the luminance of the height texture times scale.
+    // Meshes have no texture coordinates, so the texture is looked up by the
+    // vertex position only, which suits solid textures like marble. If smooth,
+    // normals of displaced vertices are interpolated across faces.
+    pub fn displaced(
+        vertices: Vec<Vec3>,
+        faces: Vec<[usize; 3]>,
+        height: &dyn Texture,
+        scale: f64,
+        subdivisions: usize,
+        smooth: bool,
+    ) -> Self {
+        let (mut vertices, mut faces) = (vertices, faces);
+        for _ in 0..subdivisions {
+            let (v, f) = subdivide(vertices, &faces);
+            vertices = v;
+            faces = f;
+        }
+        let normals = vertex_normals(&vertices, &faces);
+        let vertices: Vec<Vec3> = vertices
+            .iter()
+            .zip(normals)
+            .map(|(&p, n)| p + n * (height.color(0.0, 0.0, p).luminance() * scale))
+            .collect();
+        let normals = if smooth {
+            vertex_normals(&vertices, &faces)
+        } else {
+            Vec::new()
+        };
+        Mesh::with_attributes(vertices, faces, Vec::new(), normals)
+    }
+}
+
+fn subdivide(mut vertices: Vec<Vec3>, faces: &[[usize; 3]]) -> (Vec<Vec3>, Vec<[usize; 3]>) {
+    // Midpoints are shared by faces on both sides of edges.
+    let mut midpoints = HashMap::new();
+    let mut midpoint = |i: usize, j: usize| {
+        *midpoints.entry((i.min(j), i.max(j))).or_insert_with(|| {
+            vertices.push((vertices[i] + vertices[j]) / 2.0);
+            vertices.len() - 1
+        })
+    };
+    let mut new_faces = Vec::with_capacity(faces.len() * 4);
+    for &[i0, i1, i2] in faces.iter() {
+        let m01 = midpoint(i0, i1);
+        let m12 = midpoint(i1, i2);
+        let m20 = midpoint(i2, i0);
+        new_faces.push([i0, m01, m20]);
+        new_faces.push([m01, i1, m12]);
+        new_faces.push([m20, m12, i2]);
+        new_faces.push([m01, m12, m20]);
+    }
+    (vertices, new_faces)
+}
+
+// Averages normals of faces around vertices, weighted by their areas.
+pub fn vertex_normals(vertices: &[Vec3], faces: &[[usize; 3]]) -> Vec<Vec3> {
+    let mut normals = vec![Vec3::ZERO; vertices.len()];
+    for &[i0, i1, i2] in faces.iter() {
+        let n = (vertices[i1] - vertices[i0]).cross(vertices[i2] - vertices[i0]);
+        for &i in [i0, i1, i2].iter() {
+            normals[i] = normals[i] + n;
+        }
+    }
+    normals
+        .into_iter()
+        .map(|n| {
+            if n.norm() > 0.0 {
+                n.unit().into_vec3()
+            } else {
+                n
+            }
+        })
+        .collect()
+}
+
+#[derive(Clone, Debug)]
+pub struct MeshFace {
+    data: Arc<MeshData>,
+    index: usize,
+}
+
+impl MeshFace {
+    // Tells if the ray hits the back of the face, where vertices are in the
+    // clockwise order, if at all.
+    fn faces_away(&self, ray: &Ray) -> bool {
+        let [i0, i1, i2] = self.data.faces[self.index];
+        let p0 = self.data.vertex(i0);
+        let n = (self.data.vertex(i1) - p0).cross(self.data.vertex(i2) - p0);
+        ray.dir.dot(n) >= 0.0
+    }
+
+    fn hit_front(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        if self.faces_away(ray) {
+            None
+        } else {
+            self.hit(ray, t_min, t_max)
+        }
+    }
+}
+
+impl Shape for MeshFace {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let hit = self.data.triangle(self.index).hit(ray, t_min, t_max)?;
+        let [i0, i1, i2] = self.data.faces[self.index];
+        let w = 1.0 - hit.u - hit.v;
+        let hit = if self.data.normals.is_empty() {
+            hit
+        } else {
+            let data = &self.data;
+            let n = data.normal(i0) * w + data.normal(i1) * hit.u + data.normal(i2) * hit.v;
+            // Interpolated normals are kept on the side of the face, or rays
+            // would appear to hit it from behind.
+            let n = if n.dot(hit.normal) < 0.0 { -n } else { n };
+            if n.norm() > 0.0 {
+                Hit {
+                    normal: n.unit(),
+                    ..hit
+                }
+            } else {
+                hit
+            }
+        };
+        if self.data.uvs.is_empty() {
+            return Some(hit);
+        }
+        let (uv0, uv1, uv2) = (self.data.uvs[i0], self.data.uvs[i1], self.data.uvs[i2]);
+        let u = w * uv0[0] + hit.u * uv1[0] + hit.v * uv2[0];
+        let v = w * uv0[1] + hit.u * uv1[1] + hit.v * uv2[1];
+
+        // The tangent is the derivative of the position by u.
+        let e1 = self.data.vertex(i1) - self.data.vertex(i0);
+        let e2 = self.data.vertex(i2) - self.data.vertex(i0);
+        let (du1, dv1) = (uv1[0] - uv0[0], uv1[1] - uv0[1]);
+        let (du2, dv2) = (uv2[0] - uv0[0], uv2[1] - uv0[1]);
+        let tangent = (e1 * dv2 - e2 * dv1) / (du1 * dv2 - du2 * dv1);
+        let tangent = if tangent.norm() > 0.0 && tangent.norm().is_finite() {
+            tangent.unit()
+        } else {
+            hit.tangent
+        };
+        Some(Hit {
+            tangent,
+            u,
+            v,
+            ..hit
+        })
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.data.triangle(self.index).bounding_box(time)
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        self.data.triangle(self.index).sampler(from, time)
+    }
+
+    fn is_empty(&self) -> bool {
+        self.data.triangle(self.index).is_empty()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::geom::Vec3Unit;
+
+    #[test]
+    fn test_backface_culling() {
+        // The front faces -z.
+        let mesh = Mesh::new(
+            vec![
+                Vec3::new(0.0, 0.0, 0.0),
+                Vec3::new(0.0, 1.0, 0.0),
+                Vec3::new(1.0, 0.0, 0.0),
+            ],
+            vec![[0, 1, 2]],
+        );
+        let front = Ray::new(Vec3::new(0.2, 0.2, -1.0), Vec3Unit::Z, 0.0);
+        let back = Ray::new(Vec3::new(0.2, 0.2, 1.0), -Vec3Unit::Z, 0.0);
+        assert!(mesh.hit(&back, 1e-8, f64::INFINITY).is_some());
+
+        let mesh = mesh.with_backface_culling(true);
+        assert!(mesh.hit(&front, 1e-8, f64::INFINITY).is_some());
+        assert!(mesh.hit(&back, 1e-8, f64::INFINITY).is_none());
+    }
+
+    #[test]
+    fn test_cache() {
+        let (vertices, faces) = subdivide(
+            vec![
+                Vec3::new(0.0, 0.0, 0.0),
+                Vec3::new(0.0, 1.0, 0.0),
+                Vec3::new(1.0, 0.0, 0.0),
+            ],
+            &[[0, 1, 2]],
+        );
+        let (vertices, faces) = subdivide(vertices, &faces);
+        let normals = vertex_normals(&vertices, &faces);
+        let mesh = Mesh::with_attributes(vertices, faces, Vec::new(), normals);
+
+        for kind in [AcceleratorKind::Bvh, AcceleratorKind::KdTree].iter() {
+            let mesh = mesh.clone().with_accelerator(*kind);
+            let mut buf = Vec::new();
+            mesh.write_cache(&mut buf, 42).unwrap();
+            let loaded = Mesh::read_cache(&mut buf.as_slice(), 42).unwrap();
+            assert_eq!(loaded.face_count(), 16);
+            assert_eq!(loaded.accel.kind(), *kind);
+            let ray = Ray::new(Vec3::new(0.3, 0.4, -1.0), Vec3Unit::Z, 0.0);
+            let (hit, face) = mesh.hit_face(&ray, 1e-8, f64::INFINITY).unwrap();
+            let (loaded_hit, loaded_face) = loaded.hit_face(&ray, 1e-8, f64::INFINITY).unwrap();
+            assert_eq!(face, loaded_face);
+            assert_eq!(hit.t, loaded_hit.t);
+
+            assert!(Mesh::read_cache(&mut buf.as_slice(), 43).is_err());
+            assert!(Mesh::read_cache(&mut &buf[..buf.len() - 1], 42).is_err());
+        }
+    }
+}
@@ -0,0 +1,386 @@
+// Loaders of triangle meshes in files exported by CAD tools and 3D scanners.
+// Polygons are split into triangle fans.
+
+use crate::geom::{IntoVec3, Vec3};
+use anyhow::{bail, Context, Result};
+use std::collections::HashMap;
+use std::str::SplitWhitespace;
+
+// Parses STL in either binary or ASCII. STL repeats vertices for every
+// triangle, so identical ones are merged.
+pub fn parse_stl(data: &[u8]) -> Result<(Vec<Vec3>, Vec<[usize; 3]>)> {
+    let is_binary = data.len() >= 84 && {
+        let count = u32::from_le_bytes([data[80], data[81], data[82], data[83]]) as usize;
+        data.len() == 84 + count * 50
+    };
+    let mut corners = Vec::new();
+    if is_binary {
+        for record in data[84..].chunks_exact(50) {
+            // Each record has a normal, three vertices and two attribute bytes.
+            let float = |i: usize| {
+                let b = &record[i * 4..i * 4 + 4];
+                f32::from_le_bytes([b[0], b[1], b[2], b[3]]) as f64
+            };
+            for i in 1..4 {
+                corners.push(Vec3::new(float(i * 3), float(i * 3 + 1), float(i * 3 + 2)));
+            }
+        }
+    } else {
+        let text = std::str::from_utf8(data).context("STL is neither binary nor ASCII")?;
+        let mut tokens = text.split_whitespace();
+        if tokens.next() != Some("solid") {
+            bail!("STL is neither binary nor ASCII");
+        }
+        while let Some(token) = tokens.next() {
+            if token == "vertex" {
+                let mut coord = || -> Result<f64> {
+                    let token = tokens.next().context("Truncated STL vertex")?;
+                    Ok(token.parse()?)
+                };
+                corners.push(Vec3::new(coord()?, coord()?, coord()?));
+            }
+        }
+        if corners.len() % 3 != 0 {
+            bail!("STL facets must have three vertices");
+        }
+    }
+
+    let mut indices = HashMap::new();
+    let mut vertices = Vec::new();
+    let corners: Vec<usize> = corners
+        .into_iter()
+        .map(|p| {
+            *indices
+                .entry([p.x.to_bits(), p.y.to_bits(), p.z.to_bits()])
+                .or_insert_with(|| {
+                    vertices.push(p);
+                    vertices.len() - 1
+                })
+        })
+        .collect();
+    let faces = corners
+        .chunks_exact(3)
+        .map(|c| [c[0], c[1], c[2]])
+        .collect();
+    Ok((vertices, faces))
+}
+
+#[derive(Clone, Copy, Debug)]
+enum Scalar {
+    I8,
+    U8,
+    I16,
+    U16,
+    I32,
+    U32,
+    F32,
+    F64,
+}
+
+impl Scalar {
+    fn parse(name: &str) -> Result<Scalar> {
+        Ok(match name {
+            "char" | "int8" => Scalar::I8,
+            "uchar" | "uint8" => Scalar::U8,
+            "short" | "int16" => Scalar::I16,
+            "ushort" | "uint16" => Scalar::U16,
+            "int" | "int32" => Scalar::I32,
+            "uint" | "uint32" => Scalar::U32,
+            "float" | "float32" => Scalar::F32,
+            "double" | "float64" => Scalar::F64,
+            _ => bail!("Unknown PLY type: {}", name),
+        })
+    }
+
+    fn size(self) -> usize {
+        match self {
+            Scalar::I8 | Scalar::U8 => 1,
+            Scalar::I16 | Scalar::U16 => 2,
+            Scalar::I32 | Scalar::U32 | Scalar::F32 => 4,
+            Scalar::F64 => 8,
+        }
+    }
+}
+
+struct Property {
+    name: String,
+    scalar: Scalar,
+    // Type of the length for list properties.
+    count: Option<Scalar>,
+}
+
+struct Element {
+    name: String,
+    len: usize,
+    properties: Vec<Property>,
+}
+
+enum Body<'a> {
+    Ascii(SplitWhitespace<'a>),
+    Binary { data: &'a [u8], big_endian: bool },
+}
+
+impl<'a> Body<'a> {
+    fn read(&mut self, scalar: Scalar) -> Result<f64> {
+        match self {
+            Body::Ascii(tokens) => {
+                let token = tokens.next().context("Truncated PLY")?;
+                Ok(token.parse()?)
+            }
+            Body::Binary { data, big_endian } => {
+                let size = scalar.size();
+                if data.len() < size {
+                    bail!("Truncated PLY");
+                }
+                let mut b = [0; 8];
+                b[..size].copy_from_slice(&data[..size]);
+                if *big_endian {
+                    b[..size].reverse();
+                }
+                *data = &data[size..];
+                Ok(match scalar {
+                    Scalar::I8 => b[0] as i8 as f64,
+                    Scalar::U8 => b[0] as f64,
+                    Scalar::I16 => i16::from_le_bytes([b[0], b[1]]) as f64,
+                    Scalar::U16 => u16::from_le_bytes([b[0], b[1]]) as f64,
+                    Scalar::I32 => i32::from_le_bytes([b[0], b[1], b[2], b[3]]) as f64,
+                    Scalar::U32 => u32::from_le_bytes([b[0], b[1], b[2], b[3]]) as f64,
+                    Scalar::F32 => f32::from_le_bytes([b[0], b[1], b[2], b[3]]) as f64,
+                    Scalar::F64 => f64::from_le_bytes(b),
+                })
+            }
+        }
+    }
+}
+
+// Parses PLY in ASCII or binary. Only vertex positions, vertex normals and
+// faces are read, and other elements and properties are skipped. Normals are
+// empty if vertices lack them.
+pub fn parse_ply(data: &[u8]) -> Result<(Vec<Vec3>, Vec<[usize; 3]>, Vec<Vec3>)> {
+    const END: &[u8] = b"end_header";
+    let end = data
+        .windows(END.len())
+        .position(|w| w == END)
+        .context("PLY header is not terminated")?;
+    let header = std::str::from_utf8(&data[..end])?;
+    let mut rest = &data[end + END.len()..];
+    // The header ends with a line break of either style.
+    if rest.starts_with(b"\r") {
+        rest = &rest[1..];
+    }
+    if rest.starts_with(b"\n") {
+        rest = &rest[1..];
+    }
+
+    let mut lines = header
+        .lines()
+        .map(|line| line.split_whitespace().collect::<Vec<_>>());
+    if lines.next().as_deref() != Some(&["ply"][..]) {
+        bail!("Not a PLY file");
+    }
+    let mut format = None;
+    let mut elements: Vec<Element> = Vec::new();
+    for words in lines {
+        match words.as_slice() {
+            ["format", f, _] => format = Some(f.to_string()),
+            ["element", name, len] => elements.push(Element {
+                name: name.to_string(),
+                len: len.parse()?,
+                properties: Vec::new(),
+            }),
+            ["property", "list", count, scalar, name] => elements
+                .last_mut()
+                .context("PLY property precedes elements")?
+                .properties
+                .push(Property {
+                    name: name.to_string(),
+                    scalar: Scalar::parse(scalar)?,
+                    count: Some(Scalar::parse(count)?),
+                }),
+            ["property", scalar, name] => elements
+                .last_mut()
+                .context("PLY property precedes elements")?
+                .properties
+                .push(Property {
+                    name: name.to_string(),
+                    scalar: Scalar::parse(scalar)?,
+                    count: None,
+                }),
+            _ => {}
+        }
+    }
+    let mut body = match format.as_deref() {
+        Some("ascii") => Body::Ascii(std::str::from_utf8(rest)?.split_whitespace()),
+        Some("binary_little_endian") => Body::Binary {
+            data: rest,
+            big_endian: false,
+        },
+        Some("binary_big_endian") => Body::Binary {
+            data: rest,
+            big_endian: true,
+        },
+        f => bail!("Unsupported PLY format: {:?}", f),
+    };
+
+    let normal_names = ["nx", "ny", "nz"];
+    let has_normals = elements.iter().any(|e| {
+        e.name == "vertex"
+            && e.properties
+                .iter()
+                .any(|p| normal_names.contains(&p.name.as_str()))
+    });
+    let mut vertices = Vec::new();
+    let mut normals = Vec::new();
+    let mut faces = Vec::new();
+    for element in elements.iter() {
+        for _ in 0..element.len {
+            let mut position = [0.0; 3];
+            let mut normal = [0.0; 3];
+            let mut polygon = Vec::new();
+            for property in element.properties.iter() {
+                let name = property.name.as_str();
+                match property.count {
+                    None => {
+                        let value = body.read(property.scalar)?;
+                        if element.name == "vertex" {
+                            if let Some(i) = ["x", "y", "z"].iter().position(|n| *n == name) {
+                                position[i] = value;
+                            }
+                            if let Some(i) = normal_names.iter().position(|n| *n == name) {
+                                normal[i] = value;
+                            }
+                        }
+                    }
+                    Some(count) => {
+                        let count = body.read(count)? as usize;
+                        let is_polygon = element.name == "face"
+                            && (name == "vertex_indices" || name == "vertex_index");
+                        for _ in 0..count {
+                            let value = body.read(property.scalar)?;
+                            if is_polygon {
+                                polygon.push(value as usize);
+                            }
+                        }
+                    }
+                }
+            }
+            if element.name == "vertex" {
+                vertices.push(Vec3::new(position[0], position[1], position[2]));
+                if has_normals {
+                    let n = Vec3::new(normal[0], normal[1], normal[2]);
+                    normals.push(if n.norm() > 0.0 {
+                        n.unit().into_vec3()
+                    } else {
+                        n
+                    });
+                }
+            }
+            for i in 2..polygon.len() {
+                faces.push([polygon[0], polygon[i - 1], polygon[i]]);
+            }
+        }
+    }
+    if let Some(face) = faces
+        .iter()
+        .find(|f| f.iter().any(|i| *i >= vertices.len()))
+    {
+        bail!("PLY face {:?} refers to a missing vertex", face);
+    }
+    Ok((vertices, faces, normals))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_stl() {
+        let ascii = "solid square
+            facet normal 0 0 1
+              outer loop
+                vertex 0 0 0
+                vertex 1 0 0
+                vertex 1 1 0
+              endloop
+            endfacet
+            facet normal 0 0 1
+              outer loop
+                vertex 0 0 0
+                vertex 1 1 0
+                vertex 0 1 0
+              endloop
+            endfacet
+            endsolid square";
+        let (vertices, faces) = parse_stl(ascii.as_bytes()).unwrap();
+        assert_eq!(vertices.len(), 4);
+        assert_eq!(faces, vec![[0, 1, 2], [0, 2, 3]]);
+
+        let mut binary = vec![0; 80];
+        binary.extend_from_slice(&1u32.to_le_bytes());
+        for v in [
+            0.0f32, 0.0, 1.0, 0.0, 0.0, 0.0, 1.0, 0.0, 0.0, 1.0, 1.0, 0.0,
+        ]
+        .iter()
+        {
+            binary.extend_from_slice(&v.to_le_bytes());
+        }
+        binary.extend_from_slice(&[0, 0]);
+        let (vertices, _) = parse_stl(&binary).unwrap();
+        assert_eq!(vertices.len(), 3);
+        assert_eq!(vertices[2].y, 1.0);
+    }
+
+    #[test]
+    fn test_parse_ply() {
+        let ascii = "ply
+format ascii 1.0
+comment a square with colors
+element vertex 4
+property float x
+property float y
+property float z
+property uchar red
+element face 1
+property list uchar int vertex_indices
+end_header
+0 0 0 255
+1 0 0 255
+1 1 0 255
+0 1 2 255
+4 0 1 2 3
+";
+        let (vertices, faces, normals) = parse_ply(ascii.as_bytes()).unwrap();
+        assert_eq!(vertices.len(), 4);
+        assert_eq!(vertices[3].z, 2.0);
+        assert_eq!(faces, vec![[0, 1, 2], [0, 2, 3]]);
+        assert!(normals.is_empty());
+
+        let mut binary = b"ply
+format binary_big_endian 1.0
+element vertex 3
+property double x
+property double y
+property double z
+property double nz
+element face 1
+property list uchar uint vertex_indices
+end_header
+"
+        .to_vec();
+        for v in [
+            0.0f64, 0.0, 0.0, 2.0, 1.0, 0.0, 0.0, 2.0, 0.0, 1.0, 0.0, 2.0,
+        ]
+        .iter()
+        {
+            binary.extend_from_slice(&v.to_be_bytes());
+        }
+        binary.push(3);
+        for i in [0u32, 1, 2].iter() {
+            binary.extend_from_slice(&i.to_be_bytes());
+        }
+        let (vertices, faces, normals) = parse_ply(&binary).unwrap();
+        assert_eq!(vertices[1].x, 1.0);
+        assert_eq!(faces, vec![[0, 1, 2]]);
+        assert_eq!(normals[2].z, 1.0);
+    }
+}
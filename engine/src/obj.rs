@@ -0,0 +1,369 @@
+// Importer of Wavefront OBJ files with their MTL material libraries. Faces of
+// a file become a single mesh, selecting materials of the groups they belong
+// to. Materials are mapped from the classic Phong-like parameters as follows:
+//
+// - emissive (Ke) ones to diffuse lights,
+// - transparent (d < 1 or Tr > 0) ones to dielectrics of the index (Ni),
+// - ones with a specular color (Ks) to PBR materials of the roughness derived
+//   from the exponent (Ns), which are metallic if they have no diffuse color,
+// - and others to Lambertian materials of the diffuse color (Kd), multiplied
+//   by the texture (map_Kd) if any.
+
+use crate::accel::AcceleratorKind;
+use crate::color::Color;
+use crate::geom::{IntoVec3, Mat4, Vec3};
+use crate::material::{Dielectric, DiffuseLight, Lambertian, Material, Pbr};
+use crate::mesh::{vertex_normals, Mesh};
+use crate::object::{MeshObject, ObjectPtr, SolidObject};
+use crate::texture::{Image, SolidColor, Texture, Tinted};
+use anyhow::{bail, Context, Result};
+use std::collections::HashMap;
+use std::path::Path;
+use std::str::SplitWhitespace;
+use std::sync::Arc;
+
+#[derive(Clone, Debug)]
+struct MaterialDef {
+    diffuse: Color,
+    specular: Color,
+    emissive: Color,
+    exponent: f64,
+    index: f64,
+    opacity: f64,
+    diffuse_map: Option<String>,
+}
+
+impl Default for MaterialDef {
+    fn default() -> Self {
+        MaterialDef {
+            diffuse: Color::new(0.8, 0.8, 0.8),
+            specular: Color::BLACK,
+            emissive: Color::BLACK,
+            exponent: 0.0,
+            index: 1.5,
+            opacity: 1.0,
+            diffuse_map: None,
+        }
+    }
+}
+
+// Indices to the position, the texture coordinates and the normal of a corner.
+type Corner = (usize, Option<usize>, Option<usize>);
+
+// Faces of a group using the same material.
+#[derive(Default)]
+struct Group {
+    material: Option<String>,
+    faces: Vec<[Corner; 3]>,
+}
+
+// Loads objects in the file, transformed by the matrix. If smooth, normals are
+// computed for groups lacking them. Meshes are built with the acceleration
+// structure of the kind.
+pub fn load_obj(
+    path: &Path,
+    transform: Mat4,
+    smooth: bool,
+    accelerator: AcceleratorKind,
+) -> Result<Vec<ObjectPtr>> {
+    let text = std::fs::read_to_string(path)?;
+    let dir = path.parent().unwrap_or_else(|| Path::new(""));
+
+    let mut positions = Vec::new();
+    let mut uvs = Vec::new();
+    let mut normals = Vec::new();
+    // Normals are transformed by the inverse transpose, and dropped along
+    // with the depth of meshes flattened by degenerate transforms.
+    let inv_transpose = transform.inverse().map(|m| m.transpose());
+    let mut groups = vec![Group::default()];
+    let mut definitions = HashMap::new();
+    for (number, line) in text.lines().enumerate() {
+        let mut words = line.split_whitespace();
+        let result = match words.next() {
+            Some("v") => floats(&mut words, 3).map(|v| {
+                positions.push(transform.transform_point(Vec3::new(v[0], v[1], v[2])));
+            }),
+            Some("vt") => floats(&mut words, 2).map(|v| uvs.push([v[0], v[1]])),
+            Some("vn") => floats(&mut words, 3).map(|v| {
+                let n = Vec3::new(v[0], v[1], v[2]);
+                normals.push(match &inv_transpose {
+                    Some(m) if n.norm() > 0.0 => Mat4::transform_normal(m, n.unit()).into_vec3(),
+                    _ => Vec3::ZERO,
+                });
+            }),
+            Some("f") => corners(words, positions.len(), uvs.len(), normals.len()).map(|corners| {
+                let group = groups.last_mut().unwrap();
+                for i in 2..corners.len() {
+                    group.faces.push([corners[0], corners[i - 1], corners[i]]);
+                }
+            }),
+            Some("usemtl") => {
+                groups.push(Group {
+                    material: words.next().map(|name| name.to_owned()),
+                    faces: Vec::new(),
+                });
+                Ok(())
+            }
+            Some("mtllib") => words.try_for_each(|name| {
+                let path = dir.join(name);
+                let library = parse_mtl(&path)
+                    .with_context(|| format!("Failed to load {}", path.display()))?;
+                definitions.extend(library);
+                Ok(())
+            }),
+            _ => Ok(()),
+        };
+        result.with_context(|| format!("Line {}: {}", number + 1, line))?;
+    }
+
+    // Groups using the same material share its index.
+    let mut material_indices = HashMap::new();
+    let mut materials: Vec<Arc<dyn Material>> = Vec::new();
+    let mut textures = HashMap::new();
+    let default = MaterialDef::default();
+    let mut faces = Vec::new();
+    let mut face_materials = Vec::new();
+    for group in groups.into_iter().filter(|g| !g.faces.is_empty()) {
+        let index = match material_indices.get(&group.material) {
+            Some(&index) => index,
+            None => {
+                let def = match &group.material {
+                    Some(name) => definitions
+                        .get(name)
+                        .with_context(|| format!("Unknown material: {}", name))?,
+                    None => &default,
+                };
+                materials.push(material(def, dir, &mut textures)?);
+                material_indices.insert(group.material.clone(), materials.len() - 1);
+                materials.len() - 1
+            }
+        };
+        face_materials.extend(std::iter::repeat(index).take(group.faces.len()));
+        faces.extend(group.faces);
+    }
+    if faces.is_empty() {
+        return Ok(Vec::new());
+    }
+
+    // Smoothed normals are computed per position so that they are shared
+    // across seams of texture coordinates.
+    let smoothed = if smooth {
+        let faces: Vec<[usize; 3]> = faces
+            .iter()
+            .map(|face| [face[0].0, face[1].0, face[2].0])
+            .collect();
+        vertex_normals(&positions, &faces)
+    } else {
+        Vec::new()
+    };
+    // Corners with the same position but different texture coordinates or
+    // normals become different vertices. If only some corners have them,
+    // others get zero texture coordinates, and smoothed normals or the ones of
+    // their faces.
+    let textured = faces.iter().flatten().any(|(_, uv, _)| uv.is_some());
+    let with_normals = smooth || faces.iter().flatten().any(|(_, _, n)| n.is_some());
+    let mut indices = HashMap::new();
+    let mut vertices = Vec::new();
+    let mut vertex_uvs = Vec::new();
+    let mut shading_normals = Vec::new();
+    let faces = faces
+        .iter()
+        .enumerate()
+        .map(|(i, face)| {
+            let mut indexed = [0; 3];
+            for (index, &(p, uv, n)) in indexed.iter_mut().zip(face.iter()) {
+                let flat = if n.is_none() && with_normals && !smooth {
+                    Some(i)
+                } else {
+                    None
+                };
+                *index = *indices.entry((p, uv, n, flat)).or_insert_with(|| {
+                    vertices.push(positions[p]);
+                    if textured {
+                        vertex_uvs.push(uv.map_or([0.0, 0.0], |uv| uvs[uv]));
+                    }
+                    if let Some(n) = n {
+                        shading_normals.push(normals[n]);
+                    } else if smooth {
+                        shading_normals.push(smoothed[p]);
+                    } else if with_normals {
+                        let [p0, p1, p2] = [face[0].0, face[1].0, face[2].0];
+                        let n =
+                            (positions[p1] - positions[p0]).cross(positions[p2] - positions[p0]);
+                        shading_normals.push(if n.norm() > 0.0 {
+                            n.unit().into_vec3()
+                        } else {
+                            n
+                        });
+                    }
+                    vertices.len() - 1
+                });
+            }
+            indexed
+        })
+        .collect();
+    let mesh = Mesh::with_attributes(vertices, faces, vertex_uvs, shading_normals)
+        .with_accelerator(accelerator);
+    Ok(vec![if materials.len() == 1 {
+        SolidObject::new_rc(mesh, materials.pop().unwrap())
+    } else {
+        MeshObject::new_rc(mesh, face_materials, materials)
+    }])
+}
+
+fn floats(words: &mut SplitWhitespace, n: usize) -> Result<Vec<f64>> {
+    let values = words
+        .take(n)
+        .map(|w| Ok(w.parse()?))
+        .collect::<Result<Vec<f64>>>()?;
+    if values.len() < n {
+        bail!("Expected {} numbers", n);
+    }
+    Ok(values)
+}
+
+// Parses corners of a face in the forms of v, v/vt, v//vn or v/vt/vn. Indices
+// start at 1, and negative ones count from the last.
+fn corners(
+    words: SplitWhitespace,
+    positions: usize,
+    uvs: usize,
+    normals: usize,
+) -> Result<Vec<Corner>> {
+    let index = |word: &str, len: usize| -> Result<usize> {
+        let i: i64 = word.parse()?;
+        let resolved = if i < 0 { len as i64 + i } else { i - 1 };
+        if !(0 <= resolved && resolved < len as i64) {
+            bail!("Index out of range: {}", i);
+        }
+        Ok(resolved as usize)
+    };
+    let corners = words
+        .map(|word| {
+            let mut parts = word.split('/');
+            let p = index(parts.next().unwrap_or_default(), positions)?;
+            let uv = match parts.next() {
+                Some(uv) if !uv.is_empty() => Some(index(uv, uvs)?),
+                _ => None,
+            };
+            let n = match parts.next() {
+                Some(n) if !n.is_empty() => Some(index(n, normals)?),
+                _ => None,
+            };
+            Ok((p, uv, n))
+        })
+        .collect::<Result<Vec<_>>>()?;
+    if corners.len() < 3 {
+        bail!("Faces must have at least three vertices");
+    }
+    Ok(corners)
+}
+
+fn parse_mtl(path: &Path) -> Result<HashMap<String, MaterialDef>> {
+    let text = std::fs::read_to_string(path)?;
+    let mut definitions = HashMap::new();
+    let mut current: Option<(String, MaterialDef)> = None;
+    for (number, line) in text.lines().enumerate() {
+        let mut words = line.split_whitespace();
+        let keyword = words.next();
+        if keyword == Some("newmtl") {
+            definitions.extend(current.take());
+            let name = words.next().context("Material has no name")?;
+            current = Some((name.to_owned(), MaterialDef::default()));
+            continue;
+        }
+        let def = match (&mut current, keyword) {
+            (Some((_, def)), Some(_)) => def,
+            _ => continue,
+        };
+        let color = |words: &mut SplitWhitespace| -> Result<Color> {
+            let c = floats(words, 3)?;
+            Ok(Color::new(c[0], c[1], c[2]))
+        };
+        let result = match keyword.unwrap() {
+            "Kd" => color(&mut words).map(|c| def.diffuse = c),
+            "Ks" => color(&mut words).map(|c| def.specular = c),
+            "Ke" => color(&mut words).map(|c| def.emissive = c),
+            "Ns" => floats(&mut words, 1).map(|v| def.exponent = v[0]),
+            "Ni" => floats(&mut words, 1).map(|v| def.index = v[0]),
+            "d" => floats(&mut words, 1).map(|v| def.opacity = v[0]),
+            "Tr" => floats(&mut words, 1).map(|v| def.opacity = 1.0 - v[0]),
+            // Options precede the file name.
+            "map_Kd" => {
+                def.diffuse_map = words.last().map(|name| name.to_owned());
+                Ok(())
+            }
+            _ => Ok(()),
+        };
+        result.with_context(|| format!("{}:{}: {}", path.display(), number + 1, line))?;
+    }
+    definitions.extend(current);
+    Ok(definitions)
+}
+
+fn material(
+    def: &MaterialDef,
+    dir: &Path,
+    textures: &mut HashMap<String, Arc<dyn Texture>>,
+) -> Result<Arc<dyn Material>> {
+    if def.emissive.luminance() > 0.0 {
+        return Ok(Arc::new(DiffuseLight::new(SolidColor::new(def.emissive))));
+    }
+    if def.opacity < 1.0 {
+        if !(def.index > 0.0) {
+            bail!("Invalid refractive index: {}", def.index);
+        }
+        return Ok(Arc::new(Dielectric::new(def.index)));
+    }
+    let diffuse: Arc<dyn Texture> = match &def.diffuse_map {
+        Some(name) => {
+            let image = match textures.get(name) {
+                Some(image) => image.clone(),
+                None => {
+                    let path = dir.join(name);
+                    let image: Arc<dyn Texture> = Arc::new(
+                        Image::load(&path)
+                            .with_context(|| format!("Failed to load {}", path.display()))?,
+                    );
+                    textures.insert(name.clone(), image.clone());
+                    image
+                }
+            };
+            Arc::new(Tinted::new(image, def.diffuse))
+        }
+        None => Arc::new(SolidColor::new(def.diffuse)),
+    };
+    if def.specular.luminance() > 0.0 {
+        // Blinn-Phong exponents roughly correspond to GGX roughness by
+        // alpha^2 = 2 / (Ns + 2), where alpha is the square of roughness.
+        let roughness = (2.0 / (def.exponent.max(0.0) + 2.0)).powf(0.25);
+        return Ok(if def.diffuse.luminance() > 0.0 {
+            Arc::new(Pbr::new(diffuse, roughness, 0.0))
+        } else {
+            Arc::new(Pbr::new(SolidColor::new(def.specular), roughness, 1.0))
+        });
+    }
+    Ok(Arc::new(Lambertian::new(diffuse)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_corners() {
+        let parsed = corners("1 2/1 -1//3 4/2/1".split_whitespace(), 4, 2, 3).unwrap();
+        assert_eq!(
+            parsed,
+            vec![
+                (0, None, None),
+                (1, Some(0), None),
+                (3, None, Some(2)),
+                (3, Some(1), Some(0))
+            ]
+        );
+        assert!(corners("1 2 5".split_whitespace(), 4, 0, 0).is_err());
+        assert!(corners("1 2".split_whitespace(), 4, 0, 0).is_err());
+        assert!(corners("1 2 3//1".split_whitespace(), 4, 0, 0).is_err());
+    }
+}
@@ -1,25 +1,92 @@
 use crate::color::Color;
-use crate::geom::{Axis, Box3, IntoVec3, Vec3};
+use crate::geom::{Axis, Box3, IntoVec3, Mat4, Vec3, Vec3Unit};
+use crate::grid::DensityGrid;
 use crate::material::{Material, Scatter, VolumeMaterial};
-use crate::ray::Ray;
-use crate::rng::Rng;
-use crate::sampler::{ConstantSampler, RotateSampler, Sampler};
-use crate::shape::{merge_shapes, PortalShape, Rotate, Shape, Translate, EMPTY_SHAPE};
+use crate::mesh::Mesh;
+use crate::ray::{Ray, RayBatch};
+use crate::rng::{fnv1a, Rng};
+use crate::sampler::ConstantSampler;
+use crate::shape::{
+    merge_shapes, PortalShape, Rotate, Scale, Shape, Transform, Translate, EMPTY_SHAPE,
+};
+use crate::stats;
 use crate::time::TimeRange;
+use anyhow::{bail, Result};
 use rand::Rng as _;
 use std::iter::FromIterator;
+use std::sync::atomic::{AtomicU64, Ordering};
 use std::sync::Arc;
 
 #[derive(Debug)]
 pub struct ObjectHit {
     pub t: f64,
+    // Surface normal facing outward, or None for volumes.
+    pub normal: Option<Vec3Unit>,
+    // ID of the innermost NamedObject containing the hit object, if any.
+    pub id: Option<u64>,
     pub scatter: Scatter,
 }
 
 pub trait Object: Sync + Send {
     fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit>;
+
+    // Replaces hits of the rays in the batch with closer ones, where rays
+    // without hits look for ones before t_max. Objects may override it to
+    // trace the rays together.
+    fn hit_batch(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: f64,
+        rng: &mut Rng,
+        hits: &mut [Option<ObjectHit>],
+    ) {
+        for (ray, hit) in batch.rays().iter().zip(hits.iter_mut()) {
+            let t_best = hit.as_ref().map_or(t_max, |h| h.t);
+            if let Some(closer) = self.hit(ray, t_min, t_best, rng) {
+                *hit = Some(closer);
+            }
+        }
+    }
+
     fn bounding_box(&self, time: TimeRange) -> Box3;
     fn important_shape(&self) -> Box<dyn Shape>;
+
+    // Calls the method of the visitor for the object with its parameters.
+    // Fails if the object cannot be described, e.g. in scene files.
+    fn describe(&self, _visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        bail!("Object cannot be described")
+    }
+}
+
+// Visits objects by their parameters, like ShapeVisitor. Visitors fail on
+// objects they cannot describe.
+pub trait ObjectVisitor {
+    fn translate(&mut self, offset: Vec3, object: &dyn Object) -> Result<()>;
+    fn rotate(&mut self, axis: Axis, theta: f64, object: &dyn Object) -> Result<()>;
+    fn scale(&mut self, factor: f64, object: &dyn Object) -> Result<()>;
+    fn named(&mut self, name: &str, object: &dyn Object) -> Result<()>;
+    fn solid(&mut self, shape: &dyn Shape, material: &dyn Material) -> Result<()>;
+    fn mesh(
+        &mut self,
+        mesh: &Mesh,
+        face_materials: &[usize],
+        materials: &[Arc<dyn Material>],
+    ) -> Result<()>;
+    fn volume(
+        &mut self,
+        boundary: &dyn Shape,
+        volume: &dyn VolumeMaterial,
+        density: f64,
+    ) -> Result<()>;
+    fn grid_volume(
+        &mut self,
+        boundary: &dyn Shape,
+        grid: &DensityGrid,
+        volume: &dyn VolumeMaterial,
+        density: f64,
+    ) -> Result<()>;
+    fn group(&mut self, objects: &[ObjectPtr]) -> Result<()>;
 }
 
 pub struct TranslateObject<O: Object> {
@@ -29,11 +96,14 @@ pub struct TranslateObject<O: Object> {
 
 impl<O: Object> Object for TranslateObject<O> {
     fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
-        let ray = Ray::new(ray.origin - self.offset, ray.dir, ray.time);
+        let ray =
+            Ray::new(ray.origin - self.offset, ray.dir, ray.time).with_media(ray.media.clone());
         self.object
             .hit(&ray, t_min, t_max, rng)
             .map(|hit| ObjectHit {
                 t: hit.t,
+                normal: hit.normal,
+                id: hit.id,
                 scatter: Scatter {
                     point: hit.scatter.point + self.offset,
                     emit: hit.scatter.emit,
@@ -50,6 +120,10 @@ impl<O: Object> Object for TranslateObject<O> {
     fn important_shape(&self) -> Box<dyn Shape> {
         Box::new(Translate::new(self.offset, self.object.important_shape()))
     }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.translate(self.offset, &self.object)
+    }
 }
 
 impl<O: Object> TranslateObject<O> {
@@ -70,18 +144,21 @@ impl<O: Object> Object for RotateObject<O> {
             ray.origin.rotate_around(self.axis, -self.theta),
             ray.dir.rotate_around(self.axis, -self.theta),
             ray.time,
-        );
+        )
+        .with_media(ray.media.clone());
         self.object
             .hit(&ray, t_min, t_max, rng)
             .map(|hit| ObjectHit {
                 t: hit.t,
+                normal: hit
+                    .normal
+                    .map(|normal| normal.rotate_around(self.axis, self.theta)),
+                id: hit.id,
                 scatter: Scatter {
                     point: hit.scatter.point.rotate_around(self.axis, self.theta),
                     albedo: hit.scatter.albedo,
                     emit: hit.scatter.emit,
-                    sampler: hit.scatter.sampler.map(|s| {
-                        Box::new(RotateSampler::new(self.axis, self.theta, s)) as Box<dyn Sampler>
-                    }),
+                    sampler: hit.scatter.sampler.map(|s| s.rotate(self.axis, self.theta)),
                 },
             })
     }
@@ -102,6 +179,10 @@ impl<O: Object> Object for RotateObject<O> {
             self.object.important_shape(),
         ))
     }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.rotate(self.axis, self.theta, &self.object)
+    }
 }
 
 impl<O: Object> RotateObject<O> {
@@ -114,21 +195,253 @@ impl<O: Object> RotateObject<O> {
     }
 }
 
+// Scales uniformly around the origin. Volumes inside keep their density in
+// unscaled units, so they look thinner when enlarged.
+pub struct ScaleObject<O: Object> {
+    factor: f64,
+    object: O,
+}
+
+impl<O: Object> Object for ScaleObject<O> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        let ray =
+            Ray::new(ray.origin / self.factor, ray.dir, ray.time).with_media(ray.media.clone());
+        self.object
+            .hit(&ray, t_min / self.factor, t_max / self.factor, rng)
+            .map(|hit| ObjectHit {
+                t: hit.t * self.factor,
+                normal: hit.normal,
+                id: hit.id,
+                scatter: Scatter {
+                    point: hit.scatter.point * self.factor,
+                    emit: hit.scatter.emit,
+                    albedo: hit.scatter.albedo,
+                    sampler: hit.scatter.sampler,
+                },
+            })
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.object.bounding_box(time).scale(self.factor)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        Box::new(Scale::new(self.factor, self.object.important_shape()))
+    }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.scale(self.factor, &self.object)
+    }
+}
+
+impl<O: Object> ScaleObject<O> {
+    pub fn new(factor: f64, object: O) -> Self {
+        assert!(factor > 0.0, "Scale factor must be positive: {}", factor);
+        ScaleObject { factor, object }
+    }
+}
+
+// Applies an arbitrary invertible affine transform. Scattered directions are
+// mapped with their probabilities, so materials are deformed along with shapes.
+pub struct TransformObject<O: Object> {
+    transform: Mat4,
+    inverse: Mat4,
+    normal_transform: Mat4,
+    object: O,
+}
+
+impl<O: Object> Object for TransformObject<O> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        let dir = self.inverse.transform_dir(ray.dir);
+        let scale = dir.abs();
+        let local = Ray::new(
+            self.inverse.transform_point(ray.origin),
+            dir.unit(),
+            ray.time,
+        )
+        .with_media(ray.media.clone());
+        self.object
+            .hit(&local, t_min * scale, t_max * scale, rng)
+            .map(|hit| ObjectHit {
+                t: hit.t / scale,
+                normal: hit
+                    .normal
+                    .map(|normal| self.normal_transform.transform_dir(normal).unit()),
+                id: hit.id,
+                scatter: Scatter {
+                    point: self.transform.transform_point(hit.scatter.point),
+                    albedo: hit.scatter.albedo,
+                    emit: hit.scatter.emit,
+                    sampler: hit
+                        .scatter
+                        .sampler
+                        .map(|s| s.transform(self.transform, self.inverse)),
+                },
+            })
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        let bb = self.object.bounding_box(time);
+        if bb.is_empty() {
+            return bb;
+        }
+        self.transform.transform_box(bb)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        Box::new(Transform::new(
+            self.transform,
+            self.object.important_shape(),
+        ))
+    }
+}
+
+impl<O: Object> TransformObject<O> {
+    // Panics if transform is singular.
+    pub fn new(transform: Mat4, object: O) -> Self {
+        let inverse = transform.inverse().expect("Singular transform");
+        TransformObject {
+            transform,
+            inverse,
+            normal_transform: inverse.transpose(),
+            object,
+        }
+    }
+}
+
+// Tags hits with an ID derived from the name, e.g. for masking objects in
+// compositing.
+pub struct NamedObject<O: Object> {
+    name: String,
+    id: u64,
+    object: O,
+}
+
+impl<O: Object> Object for NamedObject<O> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        self.object
+            .hit(ray, t_min, t_max, rng)
+            .map(|hit| ObjectHit {
+                id: hit.id.or(Some(self.id)),
+                ..hit
+            })
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.object.bounding_box(time)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        self.object.important_shape()
+    }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.named(&self.name, &self.object)
+    }
+}
+
+impl<O: Object> NamedObject<O> {
+    pub fn new(name: &str, object: O) -> Self {
+        NamedObject {
+            name: name.to_owned(),
+            id: object_id(name),
+            object,
+        }
+    }
+}
+
+impl<O: Object + 'static> NamedObject<O> {
+    pub fn new_rc(name: &str, object: O) -> ObjectPtr {
+        Arc::new(Self::new(name, object))
+    }
+}
+
+// Computes the ID of an object name, which is stable across runs and builds.
+pub fn object_id(name: &str) -> u64 {
+    fnv1a(name.bytes())
+}
+
 pub type ObjectPtr = Arc<dyn Object>;
 
+impl Object for ObjectPtr {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        self.as_ref().hit(ray, t_min, t_max, rng)
+    }
+
+    fn hit_batch(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: f64,
+        rng: &mut Rng,
+        hits: &mut [Option<ObjectHit>],
+    ) {
+        self.as_ref().hit_batch(batch, t_min, t_max, rng, hits)
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.as_ref().bounding_box(time)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        self.as_ref().important_shape()
+    }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        self.as_ref().describe(visitor)
+    }
+}
+
+// Returns a new ID for an object instance, which tells apart the media inside
+// objects sharing a material. Copies of an object by transforms share it.
+fn new_instance() -> u64 {
+    static NEXT: AtomicU64 = AtomicU64::new(0);
+    NEXT.fetch_add(1, Ordering::Relaxed)
+}
+
 pub struct SolidObject<S: Shape, M: Material> {
     shape: S,
     material: M,
+    instance: u64,
 }
 
 impl<S: Shape + Clone + 'static, M: Material> Object for SolidObject<S, M> {
     fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        stats::record(0, 1);
         self.shape.hit(ray, t_min, t_max).map(|hit| ObjectHit {
             t: hit.t,
-            scatter: self.material.scatter(ray, &hit, rng),
+            normal: Some(hit.normal),
+            id: None,
+            scatter: self.material.scatter(ray, &hit, self.instance, rng),
         })
     }
 
+    fn hit_batch(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: f64,
+        rng: &mut Rng,
+        hits: &mut [Option<ObjectHit>],
+    ) {
+        stats::record(0, batch.len() as u64);
+        let t_best = hits
+            .iter()
+            .map(|hit| hit.as_ref().map_or(t_max, |h| h.t))
+            .collect::<Vec<_>>();
+        let shape_hits = self.shape.hit_batch(batch, t_min, &t_best);
+        for ((ray, hit), shape_hit) in batch.rays().iter().zip(hits.iter_mut()).zip(shape_hits) {
+            if let Some(shape_hit) = shape_hit {
+                *hit = Some(ObjectHit {
+                    t: shape_hit.t,
+                    normal: Some(shape_hit.normal),
+                    id: None,
+                    scatter: self.material.scatter(ray, &shape_hit, self.instance, rng),
+                });
+            }
+        }
+    }
+
     fn bounding_box(&self, time: TimeRange) -> Box3 {
         self.shape.bounding_box(time)
     }
@@ -140,11 +453,19 @@ impl<S: Shape + Clone + 'static, M: Material> Object for SolidObject<S, M> {
             Box::new(EMPTY_SHAPE)
         }
     }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.solid(&self.shape, &self.material)
+    }
 }
 
 impl<S: Shape, M: Material> SolidObject<S, M> {
     pub fn new(shape: S, material: M) -> Self {
-        SolidObject { shape, material }
+        SolidObject {
+            shape,
+            material,
+            instance: new_instance(),
+        }
     }
 }
 
@@ -154,6 +475,101 @@ impl<S: Shape + Clone + 'static, M: Material + 'static> SolidObject<S, M> {
     }
 }
 
+// A mesh whose faces select their materials by indices, as groups of faces in
+// models often have different materials.
+pub struct MeshObject {
+    mesh: Mesh,
+    face_materials: Vec<usize>,
+    materials: Vec<Arc<dyn Material>>,
+    // Faces with important materials.
+    important: Mesh,
+    instance: u64,
+}
+
+impl Object for MeshObject {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        let (hit, face) = self.mesh.hit_face(ray, t_min, t_max)?;
+        let material = &self.materials[self.face_materials[face]];
+        Some(ObjectHit {
+            t: hit.t,
+            normal: Some(hit.normal),
+            id: None,
+            scatter: material.scatter(ray, &hit, self.instance, rng),
+        })
+    }
+
+    fn hit_batch(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: f64,
+        rng: &mut Rng,
+        hits: &mut [Option<ObjectHit>],
+    ) {
+        let t_best = hits
+            .iter()
+            .map(|hit| hit.as_ref().map_or(t_max, |h| h.t))
+            .collect::<Vec<_>>();
+        let face_hits = self.mesh.hit_face_batch(batch, t_min, &t_best);
+        for ((ray, hit), face_hit) in batch.rays().iter().zip(hits.iter_mut()).zip(face_hits) {
+            if let Some((face_hit, face)) = face_hit {
+                let material = &self.materials[self.face_materials[face]];
+                *hit = Some(ObjectHit {
+                    t: face_hit.t,
+                    normal: Some(face_hit.normal),
+                    id: None,
+                    scatter: material.scatter(ray, &face_hit, self.instance, rng),
+                });
+            }
+        }
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.mesh.bounding_box(time)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        if self.important.is_empty() {
+            Box::new(EMPTY_SHAPE)
+        } else {
+            Box::new(self.important.clone())
+        }
+    }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.mesh(&self.mesh, &self.face_materials, &self.materials)
+    }
+}
+
+impl MeshObject {
+    pub fn new(mesh: Mesh, face_materials: Vec<usize>, materials: Vec<Arc<dyn Material>>) -> Self {
+        assert_eq!(
+            face_materials.len(),
+            mesh.face_count(),
+            "Materials must be given for all faces"
+        );
+        for &i in face_materials.iter() {
+            assert!(i < materials.len(), "Material index out of range: {}", i);
+        }
+        let important = mesh.select_faces(|face| materials[face_materials[face]].important());
+        MeshObject {
+            mesh,
+            face_materials,
+            materials,
+            important,
+            instance: new_instance(),
+        }
+    }
+
+    pub fn new_rc(
+        mesh: Mesh,
+        face_materials: Vec<usize>,
+        materials: Vec<Arc<dyn Material>>,
+    ) -> ObjectPtr {
+        Arc::new(Self::new(mesh, face_materials, materials))
+    }
+}
+
 pub struct VolumeObject<S: Shape, V: VolumeMaterial> {
     boundary: S,
     volume: V,
@@ -178,6 +594,8 @@ impl<S: Shape, V: VolumeMaterial> Object for VolumeObject<S, V> {
         let point = ray.at(t);
         Some(ObjectHit {
             t,
+            normal: None,
+            id: None,
             scatter: self.volume.scatter(ray, point, rng),
         })
     }
@@ -189,6 +607,10 @@ impl<S: Shape, V: VolumeMaterial> Object for VolumeObject<S, V> {
     fn important_shape(&self) -> Box<dyn Shape> {
         Box::new(EMPTY_SHAPE)
     }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.volume(&self.boundary, &self.volume, self.density)
+    }
 }
 
 impl<S: Shape, V: VolumeMaterial> VolumeObject<S, V> {
@@ -207,6 +629,80 @@ impl<S: Shape + 'static, V: VolumeMaterial + 'static> VolumeObject<S, V> {
     }
 }
 
+// A volume whose density is given by a grid stretched over the bounding box
+// of the boundary, scaled by density. Scattering distances are sampled by
+// delta tracking against the maximum density.
+pub struct GridVolumeObject<S: Shape, V: VolumeMaterial> {
+    boundary: S,
+    bounds: Box3,
+    grid: Arc<DensityGrid>,
+    volume: V,
+    density: f64,
+}
+
+impl<S: Shape, V: VolumeMaterial> Object for GridVolumeObject<S, V> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        let hit0 = self.boundary.hit(ray, f64::NEG_INFINITY, f64::INFINITY)?;
+        let hit1 = self.boundary.hit(ray, hit0.t + 1e-8, f64::INFINITY)?;
+        let t0 = hit0.t.max(t_min);
+        let t1 = hit1.t.min(t_max);
+        let majorant = self.density * self.grid.max();
+        if t0 >= t1 || majorant <= 0.0 {
+            return None;
+        }
+        let extent = self.bounds.max - self.bounds.min;
+        let mut t = t0;
+        loop {
+            t += -rng.gen::<f64>().ln() / majorant;
+            if t >= t1 {
+                return None;
+            }
+            let point = ray.at(t);
+            let local = point - self.bounds.min;
+            let local = Vec3::new(local.x / extent.x, local.y / extent.y, local.z / extent.z);
+            if rng.gen::<f64>() * majorant < self.density * self.grid.density(local) {
+                return Some(ObjectHit {
+                    t,
+                    normal: None,
+                    id: None,
+                    scatter: self.volume.scatter(ray, point, rng),
+                });
+            }
+        }
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.boundary.bounding_box(time)
+    }
+
+    fn important_shape(&self) -> Box<dyn Shape> {
+        Box::new(EMPTY_SHAPE)
+    }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.grid_volume(&self.boundary, &self.grid, &self.volume, self.density)
+    }
+}
+
+impl<S: Shape, V: VolumeMaterial> GridVolumeObject<S, V> {
+    pub fn new(boundary: S, grid: Arc<DensityGrid>, volume: V, density: f64) -> Self {
+        let bounds = boundary.bounding_box(TimeRange::ZERO);
+        GridVolumeObject {
+            boundary,
+            bounds,
+            grid,
+            volume,
+            density,
+        }
+    }
+}
+
+impl<S: Shape + 'static, V: VolumeMaterial + 'static> GridVolumeObject<S, V> {
+    pub fn new_rc(shape: S, grid: Arc<DensityGrid>, volume: V, density: f64) -> ObjectPtr {
+        Arc::new(Self::new(shape, grid, volume, density))
+    }
+}
+
 pub struct PortalObject<S: PortalShape, T: PortalShape> {
     source: S,
     target: T,
@@ -231,11 +727,13 @@ impl<S: PortalShape, T: PortalShape> Object for PortalObject<S, T> {
             */
             ObjectHit {
                 t: hit.t,
+                normal: None,
+                id: None,
                 scatter: Scatter {
                     point: source.point,
                     emit: Color::BLACK,
                     albedo: Color::WHITE,
-                    sampler: Some(Box::new(ConstantSampler::new(new_dir))),
+                    sampler: Some(ConstantSampler::new(new_dir).into()),
                 },
             }
         })
@@ -266,19 +764,59 @@ impl<S: PortalShape + 'static, T: PortalShape + 'static> PortalObject<S, T> {
 pub struct Objects {
     children: Vec<ObjectPtr>,
     bb: Box3,
+    // Axis along which children are sorted, if they are.
+    axis: Option<Axis>,
 }
 
 impl Object for Objects {
     fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        stats::record(1, 0);
         if !ray.intersects(&self.bb, t_min, t_max) {
             return None;
         }
-        self.children
-            .iter()
-            .fold(None as Option<ObjectHit>, |best, obj| {
-                let t_best = best.as_ref().map_or(t_max, |h| h.t);
-                obj.hit(ray, t_min, t_best, rng).or(best)
-            })
+        // Children are visited front to back when possible, since farther hits
+        // found earlier are shaded only to be thrown away.
+        let mut best: Option<ObjectHit> = None;
+        let mut visit = |obj: &ObjectPtr| {
+            let t_best = best.as_ref().map_or(t_max, |h| h.t);
+            if let Some(hit) = obj.hit(ray, t_min, t_best, rng) {
+                best = Some(hit);
+            }
+        };
+        if self.axis.map_or(false, |axis| ray.dir.get(axis) < 0.0) {
+            self.children.iter().rev().for_each(&mut visit);
+        } else {
+            self.children.iter().for_each(&mut visit);
+        }
+        best
+    }
+
+    fn hit_batch(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: f64,
+        rng: &mut Rng,
+        hits: &mut [Option<ObjectHit>],
+    ) {
+        stats::record(batch.len() as u64, 0);
+        // Children are skipped together unless some ray passes through the
+        // box, which coherent rays mostly do or do not all together.
+        let any = hits.iter().enumerate().any(|(i, hit)| {
+            batch.intersects(i, &self.bb, t_min, hit.as_ref().map_or(t_max, |h| h.t))
+        });
+        if !any {
+            return;
+        }
+        let mut visit = |child: &ObjectPtr| child.hit_batch(batch, t_min, t_max, rng, hits);
+        if self
+            .axis
+            .map_or(false, |axis| batch.rays()[0].dir.get(axis) < 0.0)
+        {
+            self.children.iter().rev().for_each(&mut visit);
+        } else {
+            self.children.iter().for_each(&mut visit);
+        }
     }
 
     fn bounding_box(&self, _time: TimeRange) -> Box3 {
@@ -288,6 +826,10 @@ impl Object for Objects {
     fn important_shape(&self) -> Box<dyn Shape> {
         merge_shapes(self.children.iter().map(|child| child.important_shape()))
     }
+
+    fn describe(&self, visitor: &mut dyn ObjectVisitor) -> Result<()> {
+        visitor.group(&self.children)
+    }
 }
 
 impl Objects {
@@ -304,13 +846,16 @@ impl Objects {
                     .expect("NaN in coordinates")
             });
             let other = objects.split_off(objects.len() / 2);
-            Objects::new_flat(
-                vec![
-                    Arc::new(divide(objects, axis.next(), time)),
-                    Arc::new(divide(other, axis.next(), time)),
-                ],
-                time,
-            )
+            Objects {
+                axis: Some(axis),
+                ..Objects::new_flat(
+                    vec![
+                        Arc::new(divide(objects, axis.next(), time)),
+                        Arc::new(divide(other, axis.next(), time)),
+                    ],
+                    time,
+                )
+            }
         }
         divide(Vec::from_iter(objects), Axis::X, time)
     }
@@ -323,6 +868,7 @@ impl Objects {
         Objects {
             children: objects,
             bb,
+            axis: None,
         }
     }
 }
@@ -347,6 +893,8 @@ impl<V: VolumeMaterial, O: Object> Object for GlobalVolume<V, O> {
             } else {
                 Some(ObjectHit {
                     t,
+                    normal: None,
+                    id: None,
                     scatter: self.volume.scatter(ray, point, rng),
                 })
             }
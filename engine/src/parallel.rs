@@ -1,14 +1,145 @@
-#[cfg(rayon)]
-pub(crate) fn par_iter_mut<'data, T: 'data + Send>(
-    v: &'data mut Vec<T>,
-) -> rayon::slice::IterMut<'data, T> {
-    use rayon::prelude::*;
-    v.par_iter_mut()
-}
-
-#[cfg(not(rayon))]
-pub(crate) fn par_iter_mut<'data, T: 'data + Send>(
-    v: &'data mut Vec<T>,
-) -> std::slice::IterMut<'data, T> {
-    v.iter_mut()
+// Runs work for each job on up to limit workers of the current thread pool,
+// passing results to consume on the calling thread in the order they complete.
+// Workers pull jobs from a shared channel, so the number of tasks spawned does
+// not grow with the number of jobs.
+#[cfg(feature = "rayon")]
+pub(crate) fn parallel_map<J, R, F, C>(jobs: Vec<J>, limit: usize, work: F, mut consume: C)
+where
+    J: Send,
+    R: Send,
+    F: Fn(J) -> R + Sync,
+    C: FnMut(R),
+{
+    use std::sync::mpsc::channel;
+    use std::sync::Mutex;
+
+    // The calling thread waits for results below, and a worker of a pool of
+    // one thread would wait for tasks that only it can run, so such jobs run
+    // here instead.
+    if limit <= 1 || rayon::current_num_threads() == 1 {
+        for job in jobs {
+            consume(work(job));
+        }
+        return;
+    }
+
+    let (job_sender, job_receiver) = channel();
+    for job in jobs {
+        job_sender.send(job).unwrap();
+    }
+    drop(job_sender);
+    let job_receiver = &Mutex::new(job_receiver);
+    let work = &work;
+    rayon::in_place_scope(|scope| {
+        let (sender, receiver) = channel();
+        for _ in 0..limit {
+            let sender = sender.clone();
+            scope.spawn(move |_| loop {
+                let job = match job_receiver.lock().unwrap().recv() {
+                    Ok(job) => job,
+                    Err(_) => break,
+                };
+                sender.send(work(job)).ok();
+            });
+        }
+        drop(sender);
+        for result in receiver {
+            consume(result);
+        }
+    });
+}
+
+#[cfg(not(feature = "rayon"))]
+pub(crate) fn parallel_map<J, R, F, C>(jobs: Vec<J>, _limit: usize, work: F, mut consume: C)
+where
+    F: Fn(J) -> R,
+    C: FnMut(R),
+{
+    for job in jobs {
+        consume(work(job));
+    }
+}
+
+#[cfg(feature = "rayon")]
+pub(crate) fn num_threads() -> usize {
+    rayon::current_num_threads()
+}
+
+#[cfg(not(feature = "rayon"))]
+pub(crate) fn num_threads() -> usize {
+    1
+}
+
+// Index of the current thread in the thread pool, or 0 outside of it.
+#[cfg(feature = "rayon")]
+pub(crate) fn thread_index() -> usize {
+    rayon::current_thread_index().unwrap_or(0)
+}
+
+#[cfg(not(feature = "rayon"))]
+pub(crate) fn thread_index() -> usize {
+    0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_all_jobs_done() {
+        let mut results = vec![];
+        parallel_map((0..100).collect(), 4, |i: i32| i * i, |r| results.push(r));
+        results.sort();
+        assert_eq!(results, (0..100).map(|i| i * i).collect::<Vec<_>>());
+    }
+
+    #[test]
+    fn test_single_worker_keeps_order() {
+        let mut results = vec![];
+        parallel_map((0..100).collect(), 1, |i: i32| i, |r| results.push(r));
+        assert_eq!(results, (0..100).collect::<Vec<_>>());
+    }
+
+    #[cfg(feature = "rayon")]
+    #[test]
+    fn test_single_thread_pool() {
+        let pool = rayon::ThreadPoolBuilder::new()
+            .num_threads(1)
+            .build()
+            .unwrap();
+        let mut results = vec![];
+        pool.install(|| parallel_map((0..100).collect(), 4, |i: i32| i, |r| results.push(r)));
+        assert_eq!(results, (0..100).collect::<Vec<_>>());
+    }
+
+    #[cfg(feature = "rayon")]
+    #[test]
+    fn test_limit() {
+        use std::sync::atomic::{AtomicUsize, Ordering};
+        use std::time::Duration;
+
+        const LIMIT: usize = 3;
+        let pool = rayon::ThreadPoolBuilder::new()
+            .num_threads(LIMIT * 2)
+            .build()
+            .unwrap();
+        let active = AtomicUsize::new(0);
+        let max_active = AtomicUsize::new(0);
+        pool.install(|| {
+            parallel_map(
+                (0..30).collect(),
+                LIMIT,
+                |_: i32| {
+                    let n = active.fetch_add(1, Ordering::SeqCst) + 1;
+                    max_active.fetch_max(n, Ordering::SeqCst);
+                    std::thread::sleep(Duration::from_millis(10));
+                    active.fetch_sub(1, Ordering::SeqCst);
+                },
+                |_| {},
+            )
+        });
+        // How many run at once depends on scheduling, but never more.
+        let max_active = max_active.load(Ordering::SeqCst);
+        assert!(0 < max_active && max_active <= LIMIT, "{}", max_active);
+    }
 }
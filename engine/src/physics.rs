@@ -22,11 +22,86 @@ pub fn refract(in_dir: Vec3Unit, normal: Vec3Unit, ratio: f64) -> Option<Vec3Uni
         -normal
     };
     let cos = -in_dir.dot(in_normal).min(1.0);
-    let sin = (1.0 - cos * cos).sqrt();
-    if ratio * sin > 1.0 {
+    // Squared cosine of the refracted ray, 1 - ratio^2 * sin^2, arranged so
+    // that grazing rays don't lose precision.
+    let out_cos2 = (1.0 - ratio * ratio) + ratio * ratio * cos * cos;
+    if out_cos2 < 0.0 {
         return None;
     }
     let out_dir_perp = (in_dir + in_normal * cos) * ratio;
-    let out_dir_para = -(1.0 - out_dir_perp.norm()).abs().sqrt() * in_normal;
+    let out_dir_para = -out_cos2.sqrt() * in_normal;
     Some((out_dir_perp + out_dir_para).unit())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::geom::{Onb, Vec3};
+    use crate::rng::Rng;
+    use rand::{Rng as _, SeedableRng};
+
+    // Returns a normal and an incoming direction at a random angle to it,
+    // from either side. Many of them are almost grazing.
+    fn random_incidence(rng: &mut Rng) -> (Vec3Unit, Vec3Unit) {
+        let normal = Vec3Unit::random_on_unit_sphere(rng);
+        let onb = Onb::from_normal(normal);
+        let cos = if rng.gen_bool(0.5) {
+            10f64.powf(rng.gen_range(-12.0..0.0))
+        } else {
+            rng.gen_range(0.0..=1.0)
+        };
+        let sin = (1.0 - cos * cos).sqrt();
+        let phi = rng.gen_range(0.0..std::f64::consts::TAU);
+        let side = if rng.gen_bool(0.5) { 1.0 } else { -1.0 };
+        let in_dir = onb.to_world(Vec3::new(sin * phi.cos(), sin * phi.sin(), -cos * side));
+        (normal, in_dir.unit())
+    }
+
+    fn sin_to(dir: Vec3Unit, normal: Vec3Unit) -> f64 {
+        dir.cross(normal).abs()
+    }
+
+    #[test]
+    fn test_reflect() {
+        let mut rng = Rng::seed_from_u64(28);
+        for _ in 0..10000 {
+            let (normal, in_dir) = random_incidence(&mut rng);
+            let out_dir = reflect(in_dir, normal);
+            assert!((out_dir.into_vec3().abs() - 1.0).abs() < 1e-12);
+            assert!((out_dir.dot(normal) + in_dir.dot(normal)).abs() < 1e-12);
+            assert!((out_dir - in_dir).cross(normal).abs() < 1e-12);
+        }
+    }
+
+    #[test]
+    fn test_refract() {
+        let mut rng = Rng::seed_from_u64(28);
+        for _ in 0..10000 {
+            let (normal, in_dir) = random_incidence(&mut rng);
+            let ratio = rng.gen_range(0.5..2.0);
+            let sin_in = sin_to(in_dir, normal);
+            match refract(in_dir, normal, ratio) {
+                Some(out_dir) => {
+                    let msg = format!("{:?} {:?} {} -> {:?}", in_dir, normal, ratio, out_dir);
+                    assert!((out_dir.into_vec3().abs() - 1.0).abs() < 1e-12, "{}", msg);
+                    // Goes through the surface on the same side of the normal...
+                    assert!(out_dir.dot(normal) * in_dir.dot(normal) >= 0.0, "{}", msg);
+                    // ...bending in the same plane, following Snell's law.
+                    assert!(
+                        out_dir.cross(normal).dot(in_dir.cross(normal)) >= 0.0,
+                        "{}",
+                        msg
+                    );
+                    assert!(
+                        (sin_to(out_dir, normal) - ratio * sin_in).abs() < 1e-9,
+                        "{}",
+                        msg
+                    );
+                }
+                None => assert!(ratio * sin_in > 1.0 - 1e-12),
+            }
+            let out_dir = refract(in_dir, normal, 1.0).unwrap();
+            assert!((out_dir - in_dir).abs() < 1e-9);
+        }
+    }
+}
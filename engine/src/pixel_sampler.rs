@@ -0,0 +1,355 @@
+use crate::rng::{hash, pixel_hash, Rng};
+use rand::{Rng as _, SeedableRng};
+use std::sync::OnceLock;
+use strum_macros::{Display, EnumIter, EnumString};
+
+// Chooses positions of samples within a pixel. Points are in [0, 1)^2.
+pub trait PixelSampler: Sync + Send {
+    fn sample(&self, x: u32, y: u32, index: usize, rng: &mut Rng) -> (f64, f64);
+}
+
+#[derive(Copy, Clone, Debug, Display, EnumIter, EnumString, PartialEq)]
+pub enum PixelSampling {
+    #[strum(serialize = "uniform")]
+    Uniform,
+    #[strum(serialize = "stratified")]
+    Stratified,
+    #[strum(serialize = "halton")]
+    Halton,
+    #[strum(serialize = "sobol")]
+    Sobol,
+    #[strum(serialize = "bluenoise")]
+    BlueNoise,
+}
+
+impl PixelSampling {
+    pub fn new_sampler(self, samples_per_pixel: usize, seed: u64) -> Box<dyn PixelSampler> {
+        match self {
+            PixelSampling::Uniform => Box::new(UniformSampler),
+            PixelSampling::Stratified => Box::new(StratifiedSampler::new(samples_per_pixel, seed)),
+            PixelSampling::Halton => Box::new(HaltonSampler::new(seed)),
+            PixelSampling::Sobol => Box::new(SobolSampler::new(seed)),
+            PixelSampling::BlueNoise => Box::new(BlueNoiseSampler::new(seed)),
+        }
+    }
+}
+
+fn to_unit(bits: u64) -> f64 {
+    (bits >> 11) as f64 / (1u64 << 53) as f64
+}
+
+pub struct UniformSampler;
+
+impl PixelSampler for UniformSampler {
+    fn sample(&self, _x: u32, _y: u32, _index: usize, rng: &mut Rng) -> (f64, f64) {
+        (rng.gen(), rng.gen())
+    }
+}
+
+// Jittered grid sampling. When the number of samples is not a multiple of the
+// grid width, a randomly placed run of cells is left unsampled for each pixel.
+pub struct StratifiedSampler {
+    columns: usize,
+    cells: usize,
+    seed: u64,
+}
+
+impl StratifiedSampler {
+    pub fn new(samples_per_pixel: usize, seed: u64) -> Self {
+        let columns = ((samples_per_pixel as f64).sqrt().ceil() as usize).max(1);
+        let rows = (samples_per_pixel + columns - 1) / columns;
+        StratifiedSampler {
+            columns,
+            cells: (columns * rows).max(1),
+            seed,
+        }
+    }
+}
+
+impl PixelSampler for StratifiedSampler {
+    fn sample(&self, x: u32, y: u32, index: usize, rng: &mut Rng) -> (f64, f64) {
+        let offset = (pixel_hash(self.seed, x, y) % self.cells as u64) as usize;
+        let cell = (index + offset) % self.cells;
+        let (column, row) = (cell % self.columns, cell / self.columns);
+        let rows = self.cells / self.columns;
+        (
+            (column as f64 + rng.gen::<f64>()) / self.columns as f64,
+            (row as f64 + rng.gen::<f64>()) / rows as f64,
+        )
+    }
+}
+
+fn radical_inverse(base: u64, mut index: u64) -> f64 {
+    let inv_base = 1.0 / base as f64;
+    let mut scale = inv_base;
+    let mut result = 0.0;
+    while index > 0 {
+        result += (index % base) as f64 * scale;
+        index /= base;
+        scale *= inv_base;
+    }
+    result
+}
+
+// Halton sequence in bases 2 and 3 with a per-pixel Cranley-Patterson rotation
+// so that neighboring pixels do not share the same pattern.
+pub struct HaltonSampler {
+    seed: u64,
+}
+
+impl HaltonSampler {
+    pub fn new(seed: u64) -> Self {
+        HaltonSampler { seed }
+    }
+}
+
+impl PixelSampler for HaltonSampler {
+    fn sample(&self, x: u32, y: u32, index: usize, _rng: &mut Rng) -> (f64, f64) {
+        let h = pixel_hash(self.seed, x, y);
+        let (du, dv) = (to_unit(h), to_unit(hash(h)));
+        let u = radical_inverse(2, index as u64 + 1) + du;
+        let v = radical_inverse(3, index as u64 + 1) + dv;
+        (u.fract(), v.fract())
+    }
+}
+
+// The first two dimensions of the Sobol sequence, which form a (0, 2)-sequence
+// in base 2. Each pixel uses a random digital shift, which preserves the
+// stratification of the sequence.
+pub struct SobolSampler {
+    seed: u64,
+}
+
+impl SobolSampler {
+    pub fn new(seed: u64) -> Self {
+        SobolSampler { seed }
+    }
+}
+
+fn sobol2(mut index: u32) -> (u32, u32) {
+    let mut u = 0;
+    let mut v = 0;
+    let mut du = 1 << 31;
+    let mut dv = 1 << 31;
+    while index > 0 {
+        if index & 1 != 0 {
+            u ^= du;
+            v ^= dv;
+        }
+        index >>= 1;
+        du >>= 1;
+        dv ^= dv >> 1;
+    }
+    (u, v)
+}
+
+impl PixelSampler for SobolSampler {
+    fn sample(&self, x: u32, y: u32, index: usize, _rng: &mut Rng) -> (f64, f64) {
+        let h = pixel_hash(self.seed, x, y);
+        let (u, v) = sobol2(index as u32);
+        let u = u ^ h as u32;
+        let v = v ^ (h >> 32) as u32;
+        (
+            u as f64 / (1u64 << 32) as f64,
+            v as f64 / (1u64 << 32) as f64,
+        )
+    }
+}
+
+const MASK_SIZE: usize = 64;
+
+// Generates a blue noise dither mask with the void-and-cluster method. Returns
+// the rank of each pixel, which is a permutation of 0..MASK_SIZE^2.
+fn void_and_cluster() -> Vec<usize> {
+    const SIGMA: f64 = 1.5;
+    const N: usize = MASK_SIZE * MASK_SIZE;
+
+    // Gaussian energy contributed by a pixel, indexed by toroidal offset.
+    let mut kernel = vec![0.0; N];
+    for dy in 0..MASK_SIZE {
+        for dx in 0..MASK_SIZE {
+            let x = dx.min(MASK_SIZE - dx) as f64;
+            let y = dy.min(MASK_SIZE - dy) as f64;
+            kernel[dy * MASK_SIZE + dx] = (-(x * x + y * y) / (2.0 * SIGMA * SIGMA)).exp();
+        }
+    }
+    let update = |energy: &mut Vec<f64>, p: usize, sign: f64| {
+        let (px, py) = (p % MASK_SIZE, p / MASK_SIZE);
+        for y in 0..MASK_SIZE {
+            for x in 0..MASK_SIZE {
+                let dx = (x + MASK_SIZE - px) % MASK_SIZE;
+                let dy = (y + MASK_SIZE - py) % MASK_SIZE;
+                energy[y * MASK_SIZE + x] += sign * kernel[dy * MASK_SIZE + dx];
+            }
+        }
+    };
+    let tightest_cluster = |pattern: &Vec<bool>, energy: &Vec<f64>| {
+        (0..N)
+            .filter(|p| pattern[*p])
+            .max_by(|a, b| energy[*a].partial_cmp(&energy[*b]).unwrap())
+            .unwrap()
+    };
+    let largest_void = |pattern: &Vec<bool>, energy: &Vec<f64>| {
+        (0..N)
+            .filter(|p| !pattern[*p])
+            .min_by(|a, b| energy[*a].partial_cmp(&energy[*b]).unwrap())
+            .unwrap()
+    };
+
+    // Start from a random pattern and move points from clusters to voids
+    // until it becomes stable.
+    let mut rng = Rng::seed_from_u64(28);
+    let mut pattern = vec![false; N];
+    let mut energy = vec![0.0; N];
+    let mut ones = 0;
+    while ones < N / 10 {
+        let p = rng.gen_range(0..N);
+        if !pattern[p] {
+            pattern[p] = true;
+            update(&mut energy, p, 1.0);
+            ones += 1;
+        }
+    }
+    loop {
+        let cluster = tightest_cluster(&pattern, &energy);
+        pattern[cluster] = false;
+        update(&mut energy, cluster, -1.0);
+        let void = largest_void(&pattern, &energy);
+        pattern[void] = true;
+        update(&mut energy, void, 1.0);
+        if void == cluster {
+            break;
+        }
+    }
+
+    let mut rank = vec![0; N];
+
+    // Rank the initial points by removing clusters one by one.
+    let mut shrinking = pattern.clone();
+    let mut shrinking_energy = energy.clone();
+    for r in (0..ones).rev() {
+        let cluster = tightest_cluster(&shrinking, &shrinking_energy);
+        shrinking[cluster] = false;
+        update(&mut shrinking_energy, cluster, -1.0);
+        rank[cluster] = r;
+    }
+
+    // Rank the rest by filling voids one by one.
+    for r in ones..N {
+        let void = largest_void(&pattern, &energy);
+        pattern[void] = true;
+        update(&mut energy, void, 1.0);
+        rank[void] = r;
+    }
+    rank
+}
+
+// Returns the mask of void_and_cluster, which takes a while and is computed
+// only once.
+fn blue_noise_mask() -> &'static [usize] {
+    static MASK: OnceLock<Vec<usize>> = OnceLock::new();
+    MASK.get_or_init(void_and_cluster)
+}
+
+// Shifts the Sobol sequence by blue noise per pixel, so that errors in
+// neighboring pixels are negatively correlated and look like high frequency
+// noise instead of white noise.
+pub struct BlueNoiseSampler {
+    mask: &'static [usize],
+    offset: (usize, usize),
+}
+
+impl BlueNoiseSampler {
+    pub fn new(seed: u64) -> Self {
+        let h = hash(seed);
+        BlueNoiseSampler {
+            mask: blue_noise_mask(),
+            offset: (
+                (h % MASK_SIZE as u64) as usize,
+                (h / MASK_SIZE as u64 % MASK_SIZE as u64) as usize,
+            ),
+        }
+    }
+
+    fn mask_value(&self, x: usize, y: usize) -> f64 {
+        let x = (x + self.offset.0) % MASK_SIZE;
+        let y = (y + self.offset.1) % MASK_SIZE;
+        (self.mask[y * MASK_SIZE + x] as f64 + 0.5) / self.mask.len() as f64
+    }
+}
+
+impl PixelSampler for BlueNoiseSampler {
+    fn sample(&self, x: u32, y: u32, index: usize, _rng: &mut Rng) -> (f64, f64) {
+        let (x, y) = (x as usize, y as usize);
+        let du = self.mask_value(x, y);
+        let dv = self.mask_value(x + MASK_SIZE / 2, y + MASK_SIZE / 3);
+        let (u, v) = sobol2(index as u32);
+        (
+            (u as f64 / (1u64 << 32) as f64 + du).fract(),
+            (v as f64 / (1u64 << 32) as f64 + dv).fract(),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use strum::IntoEnumIterator;
+
+    // Every sampler should put exactly one sample in each cell of a square
+    // grid when the sample count matches.
+    fn check_stratified(sampling: PixelSampling, n: usize) {
+        let sampler = sampling.new_sampler(n * n, 28);
+        let mut rng = Rng::seed_from_u64(28);
+        let mut counts = vec![0; n * n];
+        for index in 0..n * n {
+            let (u, v) = sampler.sample(3, 5, index, &mut rng);
+            assert!((0.0..1.0).contains(&u) && (0.0..1.0).contains(&v));
+            counts[(v * n as f64) as usize * n + (u * n as f64) as usize] += 1;
+        }
+        assert!(counts.iter().all(|c| *c == 1), "{}: {:?}", sampling, counts);
+    }
+
+    #[test]
+    fn test_stratified() {
+        check_stratified(PixelSampling::Stratified, 7);
+        check_stratified(PixelSampling::Sobol, 8);
+    }
+
+    #[test]
+    fn test_mean() {
+        for sampling in PixelSampling::iter() {
+            let sampler = sampling.new_sampler(64, 28);
+            let mut rng = Rng::seed_from_u64(28);
+            let mut sum = (0.0, 0.0);
+            let mut count = 0;
+            for x in 0..32 {
+                for index in 0..64 {
+                    let (u, v) = sampler.sample(x, 0, index, &mut rng);
+                    assert!((0.0..1.0).contains(&u) && (0.0..1.0).contains(&v));
+                    sum = (sum.0 + u, sum.1 + v);
+                    count += 1;
+                }
+            }
+            let mean = (sum.0 / count as f64, sum.1 / count as f64);
+            assert!(
+                (mean.0 - 0.5).abs() < 0.02 && (mean.1 - 0.5).abs() < 0.02,
+                "{}: {:?}",
+                sampling,
+                mean
+            );
+        }
+    }
+
+    #[test]
+    fn test_blue_noise_mask() {
+        let mut mask = void_and_cluster();
+        mask.sort();
+        assert_eq!(mask, (0..MASK_SIZE * MASK_SIZE).collect::<Vec<_>>());
+
+        // Samplers share one mask.
+        let a = BlueNoiseSampler::new(1);
+        let b = BlueNoiseSampler::new(2);
+        assert!(std::ptr::eq(a.mask, b.mask));
+    }
+}
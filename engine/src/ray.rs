@@ -1,15 +1,28 @@
-use crate::geom::{Axis, Box3, IntoVec3, Vec3, Vec3Unit};
+use crate::color::Color;
+use crate::geom::{Axis, Box3, Box3x4, IntoVec3, Vec3, Vec3Unit};
+use std::sync::Arc;
 
 #[derive(Clone, Debug)]
 pub struct Ray {
     pub origin: Vec3,
     pub dir: Vec3Unit,
     pub time: f64,
+    // Dielectric media containing the origin.
+    pub media: Media,
 }
 
 impl Ray {
     pub fn new(origin: Vec3, dir: Vec3Unit, time: f64) -> Self {
-        Ray { origin, dir, time }
+        Ray {
+            origin,
+            dir,
+            time,
+            media: Media::default(),
+        }
+    }
+
+    pub fn with_media(self, media: Media) -> Self {
+        Ray { media, ..self }
     }
 
     pub fn at(&self, t: f64) -> Vec3 {
@@ -17,6 +30,11 @@ impl Ray {
     }
 
     pub fn intersects(&self, bb: &Box3, t_min: f64, t_max: f64) -> bool {
+        self.clip(bb, t_min, t_max).is_some()
+    }
+
+    // Returns the range of t within the box.
+    pub fn clip(&self, bb: &Box3, t_min: f64, t_max: f64) -> Option<(f64, f64)> {
         // FIXME: Handle NaN.
         fn range(ray: &Ray, bb: &Box3, axis: Axis) -> (f64, f64) {
             let t0 = (bb.min.get(axis) - ray.origin.get(axis)) / ray.dir.get(axis);
@@ -26,6 +44,166 @@ impl Ray {
         let (x_min, x_max) = range(self, bb, Axis::X);
         let (y_min, y_max) = range(self, bb, Axis::Y);
         let (z_min, z_max) = range(self, bb, Axis::Z);
-        t_min.max(x_min).max(y_min).max(z_min) <= t_max.min(x_max).min(y_max).min(z_max)
+        let t0 = t_min.max(x_min).max(y_min).max(z_min);
+        let t1 = t_max.min(x_max).min(y_max).min(z_max);
+        if t0 <= t1 {
+            Some((t0, t1))
+        } else {
+            None
+        }
+    }
+}
+
+// Rays traced together. Origins and inverse directions are laid out in arrays
+// of each coordinate, so that testing the rays against a box reads contiguous
+// memory.
+#[derive(Clone, Debug)]
+pub struct RayBatch {
+    rays: Vec<Ray>,
+    origins: [Vec<f64>; 3],
+    inv_dirs: [Vec<f64>; 3],
+}
+
+impl RayBatch {
+    pub fn new(rays: Vec<Ray>) -> Self {
+        let mut origins = [Vec::new(), Vec::new(), Vec::new()];
+        let mut inv_dirs = [Vec::new(), Vec::new(), Vec::new()];
+        for (k, &axis) in Axis::ALL.iter().enumerate() {
+            origins[k] = rays.iter().map(|ray| ray.origin.get(axis)).collect();
+            inv_dirs[k] = rays.iter().map(|ray| 1.0 / ray.dir.get(axis)).collect();
+        }
+        RayBatch {
+            rays,
+            origins,
+            inv_dirs,
+        }
+    }
+
+    pub fn rays(&self) -> &[Ray] {
+        &self.rays
+    }
+
+    pub fn len(&self) -> usize {
+        self.rays.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.rays.is_empty()
+    }
+
+    // Same as Ray::intersects for the ray of the index.
+    pub fn intersects(&self, index: usize, bb: &Box3, t_min: f64, t_max: f64) -> bool {
+        let (mut t0, mut t1) = (t_min, t_max);
+        for (k, &axis) in Axis::ALL.iter().enumerate() {
+            let origin = self.origins[k][index];
+            let inv_dir = self.inv_dirs[k][index];
+            let near = (bb.min.get(axis) - origin) * inv_dir;
+            let far = (bb.max.get(axis) - origin) * inv_dir;
+            t0 = t0.max(near.min(far));
+            t1 = t1.min(near.max(far));
+        }
+        t0 <= t1
+    }
+
+    // Same as Box3x4::enter for the ray of the index.
+    pub fn enter(&self, index: usize, boxes: &Box3x4, t_min: f64, t_max: f64) -> [f64; 4] {
+        let origin = Vec3::new(
+            self.origins[0][index],
+            self.origins[1][index],
+            self.origins[2][index],
+        );
+        let inv_dir = Vec3::new(
+            self.inv_dirs[0][index],
+            self.inv_dirs[1][index],
+            self.inv_dirs[2][index],
+        );
+        boxes.enter(origin, inv_dir, t_min, t_max)
+    }
+}
+
+// A dielectric medium. Where media overlap, the one of the highest priority
+// takes effect.
+#[derive(Clone, Copy, Debug)]
+pub struct Medium {
+    // Instance of the object whose inside it is.
+    pub id: u64,
+    pub priority: u32,
+    pub index: f64,
+    // Light traveling 1 / density is tinted by the color.
+    pub absorption: Option<(Color, f64)>,
+}
+
+// Media a ray is traveling in, in the order entered. Rays outside any medium,
+// which are the most, do not allocate.
+#[derive(Clone, Debug, Default)]
+pub struct Media {
+    entries: Option<Arc<Vec<Medium>>>,
+}
+
+impl Media {
+    pub fn contains(&self, id: u64) -> bool {
+        self.iter().any(|m| m.id == id)
+    }
+
+    pub fn push(&mut self, medium: Medium) {
+        if !self.contains(medium.id) {
+            Arc::make_mut(self.entries.get_or_insert_with(Default::default)).push(medium);
+        }
+    }
+
+    pub fn remove(&mut self, id: u64) {
+        if !self.contains(id) {
+            return;
+        }
+        if let Some(entries) = &mut self.entries {
+            Arc::make_mut(entries).retain(|m| m.id != id);
+            if entries.is_empty() {
+                self.entries = None;
+            }
+        }
+    }
+
+    // Returns the medium in effect, preferring inner ones among the same
+    // priority.
+    pub fn top(&self) -> Option<&Medium> {
+        self.iter().fold(None, |top, m| match top {
+            Some(top) if top.priority > m.priority => Some(top),
+            _ => Some(m),
+        })
+    }
+
+    fn iter(&self) -> impl Iterator<Item = &Medium> {
+        self.entries.iter().flat_map(|entries| entries.iter())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_media() {
+        let medium = |id, priority| Medium {
+            id,
+            priority,
+            index: 1.0 + id as f64 / 10.0,
+            absorption: None,
+        };
+        let mut media = Media::default();
+        assert!(media.top().is_none());
+        media.push(medium(1, 2));
+        media.push(medium(2, 1));
+        let outer = media.clone();
+        media.push(medium(3, 2));
+        media.push(medium(3, 2));
+        assert_eq!(media.top().unwrap().id, 3);
+        assert_eq!(outer.top().unwrap().id, 1);
+        media.remove(3);
+        assert_eq!(media.top().unwrap().id, 1);
+        media.remove(1);
+        assert_eq!(media.top().unwrap().id, 2);
+        assert!(!media.contains(1) && outer.contains(1));
+        media.remove(2);
+        assert!(media.entries.is_none());
     }
 }
@@ -1,105 +1,767 @@
 use crate::camera::Camera;
 use crate::color::Color;
-use crate::parallel::par_iter_mut;
-use crate::ray::Ray;
-use crate::rng::Rng;
-use crate::sampler::{MixedSampler, Sampler};
-use crate::shape::{Shape, EMPTY_SHAPE};
+use crate::frame::Frame;
+use crate::integrator::{Integrator, IntegratorKind};
+use crate::parallel::{num_threads, parallel_map, thread_index};
+use crate::pixel_sampler::{PixelSampler, PixelSampling};
+use crate::ray::RayBatch;
+use crate::rng::{hash, Generator, Rng};
+use crate::shape::{merge_shapes, Shape, EMPTY_SHAPE};
+use crate::stats::{self, RenderStats};
 use crate::world::World;
-use rand::Rng as _;
-use std::io::Result;
-use std::io::Write;
-use std::rc::Rc;
+use anyhow::{bail, Result};
+use log::debug;
+use std::fmt;
+use std::ops::Range;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
 
+#[derive(Clone, Debug)]
 pub struct RenderParams {
     pub width: u32,
     pub height: u32,
     pub samples_per_pixel: usize,
+    pub max_depth: usize,
     pub importance_sampling: bool,
+    pub tile_size: u32,
+    pub pixel_sampling: PixelSampling,
+    pub integrator: IntegratorKind,
+    // Maximum distance of occluders for the ambient occlusion integrator.
+    pub ao_distance: Option<f64>,
+    // All randomness in rendering derives from the seed, so the same scene
+    // renders to the same pixels whatever the tile size or the number of
+    // threads. Math functions of other platforms may round differently though.
+    pub seed: u64,
 }
 
-fn trace_ray(
-    ray: &Ray,
-    world: &World,
-    important: &dyn Shape,
-    rng: &mut Rng,
-    limit: isize,
-) -> Color {
-    if limit <= 0 {
-        return Color::BLACK;
-    }
-    if let Some(mut hit) = world.object.hit(ray, 1e-8, f64::INFINITY, rng) {
-        let scatter_sampler = std::mem::replace(&mut hit.scatter.sampler, None);
-        hit.scatter.emit
-            + hit.scatter.albedo
-                * scatter_sampler.map_or(Color::BLACK, |scatter_sampler| {
-                    let scatter_sampler: Rc<dyn Sampler> = scatter_sampler.into();
-                    let point = hit.scatter.point;
-                    let mut trace_sampler = scatter_sampler.clone();
-                    if let Some(important_sampler) = important.sampler(point, ray.time) {
-                        trace_sampler = Rc::new(MixedSampler::new(vec![
-                            scatter_sampler.clone(),
-                            important_sampler.into(),
-                        ]));
-                    }
-                    let (new_dir, weight) = trace_sampler.constant().map_or_else(
-                        || {
-                            let new_dir = trace_sampler.sample(rng);
-                            (
-                                new_dir,
-                                scatter_sampler.probability(new_dir)
-                                    / trace_sampler.probability(new_dir),
-                            )
-                        },
-                        |new_dir| (new_dir, 1.0),
-                    );
-                    if weight == 0.0 {
-                        return Color::BLACK;
-                    }
-                    weight
-                        * trace_ray(
-                            &Ray::new(point, new_dir, ray.time),
-                            world,
-                            important,
-                            rng,
-                            limit - 1,
-                        )
-                })
+impl RenderParams {
+    pub const DEFAULT: RenderParams = RenderParams {
+        width: 400,
+        height: 225,
+        samples_per_pixel: 100,
+        max_depth: 50,
+        importance_sampling: false,
+        tile_size: 32,
+        pixel_sampling: PixelSampling::Uniform,
+        integrator: IntegratorKind::Path,
+        ao_distance: None,
+        seed: 28,
+    };
+}
+
+impl Default for RenderParams {
+    fn default() -> Self {
+        Self::DEFAULT
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub struct Tile {
+    pub x: u32,
+    pub y: u32,
+    pub width: u32,
+    pub height: u32,
+}
+
+// Splits the image into tiles in scanline order, which is the order render
+// starts them in.
+pub fn make_tiles(params: &RenderParams) -> Vec<Tile> {
+    let size = params.tile_size;
+    let mut tiles = Vec::new();
+    for y in (0..params.height).step_by(size as usize) {
+        for x in (0..params.width).step_by(size as usize) {
+            tiles.push(Tile {
+                x,
+                y,
+                width: size.min(params.width - x),
+                height: size.min(params.height - y),
+            });
+        }
+    }
+    tiles
+}
+
+// Returns colors of pixels in the tile in scanline order, averaged over the
+// range of samples, or None if cancelled. Each pixel has its color followed by
+// its AOVs.
+fn render_tile(
+    tile: &Tile,
+    camera: &Camera,
+    integrator: &dyn Integrator,
+    aov_integrators: &[Box<dyn Integrator + '_>],
+    pixel_sampler: &dyn PixelSampler,
+    params: &RenderParams,
+    samples: Range<usize>,
+    seed: u64,
+    cancel: &AtomicBool,
+) -> Option<Vec<Color>> {
+    let stride = 1 + aov_integrators.len();
+    let mut colors = Vec::with_capacity((tile.width * tile.height) as usize * stride);
+    for y in tile.y..tile.y + tile.height {
+        for i in tile.x..tile.x + tile.width {
+            if cancel.load(Ordering::Relaxed) {
+                return None;
+            }
+            colors.extend(render_pixel(
+                i,
+                y,
+                camera,
+                integrator,
+                aov_integrators,
+                pixel_sampler,
+                params,
+                samples.clone(),
+                seed,
+                None,
+            ));
+        }
+    }
+    Some(colors)
+}
+
+// Returns the color of the pixel followed by its AOVs. The integrator also
+// describes the paths through log if it is given.
+fn render_pixel(
+    i: u32,
+    y: u32,
+    camera: &Camera,
+    integrator: &dyn Integrator,
+    aov_integrators: &[Box<dyn Integrator + '_>],
+    pixel_sampler: &dyn PixelSampler,
+    params: &RenderParams,
+    samples: Range<usize>,
+    seed: u64,
+    log: Option<&mut dyn FnMut(fmt::Arguments)>,
+) -> Vec<Color> {
+    let j = params.height - 1 - y;
+    // Each pixel has its own random number streams seeded by its position, so
+    // that the result depends neither on how the image is split into tiles nor
+    // on the threads rendering them. AOVs use another one so that they do not
+    // affect the image.
+    let mut rng = Rng::for_pixel(seed, i, y);
+    let mut aov_rng = Rng::for_pixel(!seed, i, y);
+    // Samples of a pixel are traced together as their rays are coherent.
+    let rays = samples
+        .clone()
+        .map(|index| {
+            let (du, dv) = pixel_sampler.sample(i, y, index, &mut rng);
+            let u = (i as f64 + du) / (params.width as f64);
+            let v = (j as f64 + dv) / (params.height as f64);
+            camera.ray(u, v, &mut rng)
+        })
+        .collect();
+    let batch = RayBatch::new(rays);
+    stats::record_paths(samples.len() as u64);
+    let colors = match log {
+        Some(log) => integrator.radiance_batch_logged(&batch, &mut rng, log),
+        None => integrator.radiance_batch(&batch, &mut rng),
+    };
+    let mut sums = vec![Color::BLACK; 1 + aov_integrators.len()];
+    for color in colors {
+        sums[0] = sums[0] + clamp_sample(color);
+    }
+    for (sum, aov_integrator) in sums[1..].iter_mut().zip(aov_integrators) {
+        for color in aov_integrator.radiance_batch(&batch, &mut aov_rng) {
+            *sum = *sum + clamp_sample(color);
+        }
+    }
+    sums.into_iter()
+        .map(|sum| sum / samples.len() as f64)
+        .collect()
+}
+
+// Clamps fireflies but keeps NaN so that bugs producing them show up in the
+// image rather than silently darkening pixels.
+fn clamp_sample(c: Color) -> Color {
+    if c.is_nan() {
+        c
     } else {
-        world.background.color(ray)
+        c.clamp(0.0, 1e10)
+    }
+}
+
+// Tile counts and stats only include tiles rendered in this call, so a resumed
+// render does not skew the ETA.
+pub struct Progress<'a> {
+    pub frame: &'a Frame,
+    pub completed_tiles: usize,
+    pub total_tiles: usize,
+    pub elapsed: Duration,
+    // The tile just completed.
+    pub tile: TileSpan,
+    pub stats: RenderStats,
+    // Estimated relative RMSE of the frame as of the last pass with an even
+    // number of samples, in progressive rendering only.
+    pub error: Option<f64>,
+}
+
+// Where and when a tile was rendered. Times are since the start of rendering,
+// and threads are indexes in the thread pool.
+#[derive(Clone, Copy, Debug)]
+pub struct TileSpan {
+    pub x: u32,
+    pub y: u32,
+    pub width: u32,
+    pub height: u32,
+    pub thread: usize,
+    pub start: Duration,
+    pub end: Duration,
+}
+
+impl Progress<'_> {
+    pub fn eta(&self) -> Option<Duration> {
+        if self.completed_tiles == 0 || self.elapsed == Duration::ZERO {
+            return None;
+        }
+        let remaining = (self.total_tiles - self.completed_tiles) as f64;
+        Some(
+            self.elapsed
+                .mul_f64(remaining / self.completed_tiles as f64),
+        )
     }
 }
 
+// Clocks are not available on wasm32-unknown-unknown, where elapsed time is
+// always reported as zero.
+#[cfg(not(target_arch = "wasm32"))]
+fn now() -> Option<Instant> {
+    Some(Instant::now())
+}
+
+#[cfg(target_arch = "wasm32")]
+fn now() -> Option<Instant> {
+    None
+}
+
+// Renders tiles not rendered yet in frame, calling progress after each tile.
+// Returns early with frame incomplete when cancel is set.
 pub fn render(
-    writer: &mut impl Write,
     camera: &Camera,
     world: &World,
     params: &RenderParams,
-    mut rngs: &mut Vec<Rng>,
+    frame: &mut Frame,
+    cancel: &AtomicBool,
+    progress: &mut dyn FnMut(&Progress),
 ) -> Result<()> {
-    let important = if params.importance_sampling {
-        let important = world.object.important_shape();
-        eprintln!("Important: {:?}", &important);
+    render_passes(camera, world, params, frame, cancel, progress, false)
+}
+
+// Renders the whole frame in passes of a sample per pixel, averaging them into
+// frame, so that the image can be looked at early and refines over time.
+// Progress is called after each tile of each pass, reporting the error of the
+// frame to stop early once it converges. When cancelled, pixels have either as
+// many samples as the last complete pass or one more.
+pub fn render_progressive(
+    camera: &Camera,
+    world: &World,
+    params: &RenderParams,
+    frame: &mut Frame,
+    cancel: &AtomicBool,
+    progress: &mut dyn FnMut(&Progress),
+) -> Result<()> {
+    render_passes(camera, world, params, frame, cancel, progress, true)
+}
+
+// Renders a tile by itself with the same samples as render, e.g. on a worker
+// of a distributed render. Returns colors of pixels as Frame::set_tile takes
+// them, and the work done.
+pub fn render_single_tile(
+    camera: &Camera,
+    world: &World,
+    params: &RenderParams,
+    aovs: &[IntegratorKind],
+    tile: &Tile,
+) -> Result<(Vec<Color>, RenderStats)> {
+    let inside = |start: u32, size: u32, limit: u32| {
+        size > 0 && start.checked_add(size).map_or(false, |end| end <= limit)
+    };
+    if !inside(tile.x, tile.width, params.width) || !inside(tile.y, tile.height, params.height) {
+        bail!(
+            "Tile {:?} is out of the image size {}x{}",
+            tile,
+            params.width,
+            params.height
+        );
+    }
+    let important = important_shape(world, params);
+    let integrator = params
+        .integrator
+        .new_integrator(world, important.as_ref(), params);
+    let aov_integrators: Vec<Box<dyn Integrator>> = aovs
+        .iter()
+        .map(|aov| aov.new_integrator(world, important.as_ref(), params))
+        .collect();
+    let pixel_sampler = params
+        .pixel_sampling
+        .new_sampler(params.samples_per_pixel, params.seed);
+    let stats_before = stats::get();
+    let colors = render_tile(
+        tile,
+        camera,
+        integrator.as_ref(),
+        &aov_integrators,
+        pixel_sampler.as_ref(),
+        params,
+        0..params.samples_per_pixel,
+        params.seed,
+        &AtomicBool::new(false),
+    )
+    .unwrap();
+    Ok((colors, stats::get() - stats_before))
+}
+
+// Renders the pixel at (x, y), counted from the top left, with the same
+// samples as render, describing the paths through log. The path integrator
+// describes every bounce, and others the radiance of each sample.
+pub fn trace_pixel(
+    camera: &Camera,
+    world: &World,
+    params: &RenderParams,
+    x: u32,
+    y: u32,
+    log: &mut dyn FnMut(fmt::Arguments),
+) -> Result<Color> {
+    if x >= params.width || y >= params.height {
+        bail!(
+            "Pixel ({}, {}) is out of the image size {}x{}",
+            x,
+            y,
+            params.width,
+            params.height
+        );
+    }
+    let important = important_shape(world, params);
+    let integrator = params
+        .integrator
+        .new_integrator(world, important.as_ref(), params);
+    let pixel_sampler = params
+        .pixel_sampling
+        .new_sampler(params.samples_per_pixel, params.seed);
+    let colors = render_pixel(
+        x,
+        y,
+        camera,
+        integrator.as_ref(),
+        &[],
+        pixel_sampler.as_ref(),
+        params,
+        0..params.samples_per_pixel,
+        params.seed,
+        Some(log),
+    );
+    Ok(colors[0])
+}
+
+fn important_shape(world: &World, params: &RenderParams) -> Box<dyn Shape> {
+    if params.importance_sampling {
+        let important = merge_shapes(vec![
+            world.object.important_shape(),
+            world.background.important_shape(),
+        ]);
+        debug!(shape:? = important; "Sampling important shapes");
         important
     } else {
-        eprintln!("Important: <Ignored>");
+        debug!("Not sampling important shapes");
         Box::new(EMPTY_SHAPE)
+    }
+}
+
+fn render_passes(
+    camera: &Camera,
+    world: &World,
+    params: &RenderParams,
+    frame: &mut Frame,
+    cancel: &AtomicBool,
+    progress: &mut dyn FnMut(&Progress),
+    progressive: bool,
+) -> Result<()> {
+    if params.width == 0 || params.height == 0 {
+        bail!(
+            "Image size must be positive: {}x{}",
+            params.width,
+            params.height
+        );
+    }
+    if params.tile_size == 0 {
+        bail!("Tile size must be positive");
+    }
+    if (frame.width(), frame.height()) != (params.width, params.height) {
+        bail!(
+            "Frame size {}x{} does not match the image size {}x{}",
+            frame.width(),
+            frame.height(),
+            params.width,
+            params.height
+        );
+    }
+    let important = important_shape(world, params);
+    let tiles: Vec<Tile> = make_tiles(params)
+        .into_iter()
+        .filter(|tile| progressive || !frame.is_rendered(tile.x, tile.y))
+        .collect();
+    let passes: Vec<Range<usize>> = if progressive {
+        (0..params.samples_per_pixel)
+            .map(|index| index..index + 1)
+            .collect()
+    } else {
+        vec![0..params.samples_per_pixel]
+    };
+    let integrator = params
+        .integrator
+        .new_integrator(world, important.as_ref(), params);
+    let aov_integrators: Vec<Box<dyn Integrator>> = frame
+        .aovs()
+        .iter()
+        .map(|aov| aov.new_integrator(world, important.as_ref(), params))
+        .collect();
+    let pixel_sampler = params
+        .pixel_sampling
+        .new_sampler(params.samples_per_pixel, params.seed);
+    let start = now();
+    let since_start = || start.map_or(Duration::ZERO, |start| start.elapsed());
+    let total_tiles = tiles.len() * passes.len();
+    let mut completed_tiles = 0;
+    let mut render_stats = RenderStats::default();
+    let stride = 1 + aov_integrators.len();
+    // Averages of the even passes, which differ from the averages of all the
+    // passes by as much as those differ from the true image.
+    let mut half = if progressive {
+        frame.pixels().to_vec()
+    } else {
+        Vec::new()
     };
-    for j in (0..params.height).rev() {
-        eprint!("{}/{}\n", params.height - 1 - j, params.height);
-        for i in 0..params.width {
-            let color = par_iter_mut(&mut rngs)
-                .map(|rng| {
-                    let u = (i as f64 + rng.gen::<f64>()) / (params.width as f64);
-                    let v = (j as f64 + rng.gen::<f64>()) / (params.height as f64);
-                    let ray = camera.ray(u, v, rng);
-                    trace_ray(&ray, world, important.as_ref(), rng, 50).clamp(0.0, 1e10)
-                })
-                .sum::<Color>()
-                / params.samples_per_pixel as f64;
-            let color = color.clamp(0.0, 1.0).gamma2();
-            writer.write(&color.encode())?;
+    let mut error = None;
+    for (pass, samples) in passes.into_iter().enumerate() {
+        if cancel.load(Ordering::Relaxed) {
+            break;
         }
+        // Passes draw different random numbers.
+        let seed = if progressive {
+            hash(params.seed.wrapping_add(pass as u64))
+        } else {
+            params.seed
+        };
+        // Running averages of the samples of the passes so far.
+        let blend = |old: Color, new: Color| {
+            if pass == 0 {
+                new
+            } else {
+                old + (new - old) / (pass + 1) as f64
+            }
+        };
+        parallel_map(
+            tiles.clone(),
+            num_threads(),
+            |tile| {
+                let tile_start = since_start();
+                let stats_before = stats::get();
+                let colors = render_tile(
+                    &tile,
+                    camera,
+                    integrator.as_ref(),
+                    &aov_integrators,
+                    pixel_sampler.as_ref(),
+                    params,
+                    samples.clone(),
+                    seed,
+                    cancel,
+                );
+                let span = TileSpan {
+                    x: tile.x,
+                    y: tile.y,
+                    width: tile.width,
+                    height: tile.height,
+                    thread: thread_index(),
+                    start: tile_start,
+                    end: since_start(),
+                };
+                (tile, colors, span, stats::get() - stats_before)
+            },
+            |(tile, colors, span, tile_stats)| {
+                let colors = match colors {
+                    Some(colors) => colors,
+                    None => return,
+                };
+                render_stats = render_stats + tile_stats;
+                for (k, pixel) in colors.chunks(stride).enumerate() {
+                    let k = k as u32;
+                    let (x, y) = (tile.x + k % tile.width, tile.y + k / tile.width);
+                    let index = (y * frame.width() + x) as usize;
+                    for (aov, color) in pixel[1..].iter().enumerate() {
+                        let old = frame.aov_pixels(aov)[index];
+                        frame.set_aov(aov, x, y, blend(old, *color));
+                    }
+                    let old = frame.pixels()[index];
+                    frame.set(x, y, blend(old, pixel[0]));
+                    if progressive && pass % 2 == 0 {
+                        half[index] = if pass == 0 {
+                            pixel[0]
+                        } else {
+                            half[index] + (pixel[0] - half[index]) / (pass / 2 + 1) as f64
+                        };
+                    }
+                }
+                completed_tiles += 1;
+                if progressive && pass % 2 == 1 && completed_tiles % tiles.len() == 0 {
+                    error = Some(relative_error(frame.pixels(), &half));
+                }
+                progress(&Progress {
+                    frame,
+                    completed_tiles,
+                    total_tiles,
+                    elapsed: since_start(),
+                    tile: span,
+                    stats: render_stats,
+                    error,
+                });
+            },
+        );
     }
     Ok(())
 }
+
+// Relative RMSE of the luminance of pixels, which is as sensitive to noise in
+// dark regions as in bright ones. NaN pixels are left to be reported by others.
+fn relative_error(pixels: &[Color], reference: &[Color]) -> f64 {
+    let mut sum = 0.0;
+    let mut count = 0;
+    for (p, r) in pixels.iter().zip(reference) {
+        let (p, r) = (p.luminance(), r.luminance());
+        let e = (p - r) / (p.abs() + 0.01);
+        if !e.is_nan() {
+            sum += e * e;
+            count += 1;
+        }
+    }
+    if count == 0 {
+        return 0.0;
+    }
+    (sum / count as f64).sqrt()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::scene::SceneRegistry;
+    use rand::SeedableRng;
+
+    // Returns bits of the pixels, rendered by the number of threads if rayon
+    // is enabled.
+    fn render_bits(params: &RenderParams, threads: usize) -> Vec<[u64; 3]> {
+        let (_, camera, world) = SceneRegistry::with_builtins()
+            .load("book1/final", &mut Rng::seed_from_u64(28))
+            .unwrap();
+        let mut frame = Frame::new(params.width, params.height);
+        let cancel = AtomicBool::new(false);
+        let run = || render(&camera, &world, params, &mut frame, &cancel, &mut |_| {}).unwrap();
+        #[cfg(feature = "rayon")]
+        rayon::ThreadPoolBuilder::new()
+            .num_threads(threads)
+            .build()
+            .unwrap()
+            .install(run);
+        #[cfg(not(feature = "rayon"))]
+        {
+            let _ = threads;
+            run();
+        }
+        frame
+            .pixels()
+            .iter()
+            .map(|c| [c.r.to_bits(), c.g.to_bits(), c.b.to_bits()])
+            .collect()
+    }
+
+    #[test]
+    fn test_progressive() {
+        let (_, camera, world) = SceneRegistry::with_builtins()
+            .load("book1/final", &mut Rng::seed_from_u64(28))
+            .unwrap();
+        let params = RenderParams {
+            width: 40,
+            height: 40,
+            samples_per_pixel: 16,
+            ..RenderParams::DEFAULT
+        };
+        let cancel = AtomicBool::new(false);
+        let mut frame = Frame::new(params.width, params.height);
+        render(&camera, &world, &params, &mut frame, &cancel, &mut |_| {}).unwrap();
+        let mut progressive = Frame::new(params.width, params.height);
+        let mut calls = 0;
+        let mut errors = Vec::new();
+        render_progressive(
+            &camera,
+            &world,
+            &params,
+            &mut progressive,
+            &cancel,
+            &mut |progress| {
+                calls += 1;
+                assert!(progress.frame.is_complete() == (calls >= progress.total_tiles / 16));
+                assert_eq!(progress.error.is_some(), calls >= progress.total_tiles / 8);
+                if calls % (progress.total_tiles / 8) == 0 {
+                    errors.push(progress.error.unwrap());
+                }
+            },
+        )
+        .unwrap();
+        assert_eq!(calls, make_tiles(&params).len() * 16);
+        // Errors shrink as samples add up.
+        assert_eq!(errors.len(), 8);
+        assert!(errors[7] < errors[0] * 0.6, "{:?}", errors);
+
+        // Noise differs, but not the brightness.
+        let mean = |frame: &Frame| {
+            frame.pixels().iter().map(|c| c.luminance()).sum::<f64>() / frame.pixels().len() as f64
+        };
+        let (expected, actual) = (mean(&frame), mean(&progressive));
+        assert!(
+            (actual - expected).abs() < 0.02 * expected,
+            "{} != {}",
+            actual,
+            expected
+        );
+    }
+
+    #[test]
+    fn test_stats() {
+        let (_, camera, world) = SceneRegistry::with_builtins()
+            .load("book1/final", &mut Rng::seed_from_u64(28))
+            .unwrap();
+        let params = RenderParams {
+            width: 20,
+            height: 20,
+            samples_per_pixel: 4,
+            tile_size: 8,
+            ..RenderParams::DEFAULT
+        };
+        let mut frame = Frame::new(params.width, params.height);
+        let cancel = AtomicBool::new(false);
+        let mut last = None;
+        render(
+            &camera,
+            &world,
+            &params,
+            &mut frame,
+            &cancel,
+            &mut |progress| {
+                last = Some(progress.stats);
+            },
+        )
+        .unwrap();
+        let stats = last.unwrap();
+        assert_eq!(stats.paths, 20 * 20 * 4);
+        // Every path traces at least a ray, and every surface hit is of a ray.
+        assert!(stats.rays >= stats.paths && stats.rays >= stats.bounces);
+        assert!(stats.average_depth().unwrap() > 1.0);
+        assert!(stats.nodes > 0 && stats.shapes > 0);
+    }
+
+    #[test]
+    fn test_render_single_tile() {
+        let (_, camera, world) = SceneRegistry::with_builtins()
+            .load("book1/final", &mut Rng::seed_from_u64(28))
+            .unwrap();
+        let params = RenderParams {
+            width: 20,
+            height: 12,
+            samples_per_pixel: 4,
+            tile_size: 8,
+            ..RenderParams::DEFAULT
+        };
+        let aovs = vec![IntegratorKind::Albedo];
+        let mut frame = Frame::with_aovs(params.width, params.height, aovs.clone());
+        let cancel = AtomicBool::new(false);
+        render(&camera, &world, &params, &mut frame, &cancel, &mut |_| {}).unwrap();
+
+        // Tiles rendered by themselves make up the same image.
+        let mut assembled = Frame::with_aovs(params.width, params.height, aovs.clone());
+        for tile in make_tiles(&params) {
+            let (colors, stats) =
+                render_single_tile(&camera, &world, &params, &aovs, &tile).unwrap();
+            assert_eq!(stats.paths, (tile.width * tile.height) as u64 * 4);
+            assembled.set_tile(&tile, &colors);
+        }
+        assert!(assembled.is_complete());
+        let bits = |pixels: &[Color]| -> Vec<[u64; 3]> {
+            pixels
+                .iter()
+                .map(|c| [c.r.to_bits(), c.g.to_bits(), c.b.to_bits()])
+                .collect()
+        };
+        assert_eq!(bits(assembled.pixels()), bits(frame.pixels()));
+        assert_eq!(bits(assembled.aov_pixels(0)), bits(frame.aov_pixels(0)));
+
+        let outside = Tile {
+            x: 16,
+            y: 0,
+            width: 8,
+            height: 8,
+        };
+        assert!(render_single_tile(&camera, &world, &params, &aovs, &outside).is_err());
+        let overflowing = Tile {
+            x: u32::MAX,
+            width: 2,
+            ..outside
+        };
+        assert!(render_single_tile(&camera, &world, &params, &aovs, &overflowing).is_err());
+    }
+
+    #[test]
+    fn test_trace_pixel() {
+        let (_, camera, world) = SceneRegistry::with_builtins()
+            .load("book1/final", &mut Rng::seed_from_u64(28))
+            .unwrap();
+        let params = RenderParams {
+            width: 40,
+            height: 40,
+            samples_per_pixel: 4,
+            ..RenderParams::DEFAULT
+        };
+        let mut frame = Frame::new(params.width, params.height);
+        let cancel = AtomicBool::new(false);
+        render(&camera, &world, &params, &mut frame, &cancel, &mut |_| {}).unwrap();
+
+        // The pixel has the same samples as in the image.
+        let (x, y) = (13, 29);
+        let mut lines = Vec::new();
+        let color = trace_pixel(&camera, &world, &params, x, y, &mut |args| {
+            lines.push(args.to_string())
+        })
+        .unwrap();
+        let expected = frame.pixels()[(y * params.width + x) as usize];
+        assert_eq!(
+            [color.r.to_bits(), color.g.to_bits(), color.b.to_bits()],
+            [
+                expected.r.to_bits(),
+                expected.g.to_bits(),
+                expected.b.to_bits()
+            ]
+        );
+        for index in 0..params.samples_per_pixel {
+            let prefix = format!("sample {}: radiance", index);
+            assert!(lines.iter().any(|line| line.starts_with(&prefix)));
+        }
+        assert!(lines.iter().any(|line| line.starts_with("  depth 0: ")));
+
+        assert!(trace_pixel(&camera, &world, &params, 40, 0, &mut |_| {}).is_err());
+    }
+
+    #[test]
+    fn test_deterministic() {
+        let params = RenderParams {
+            width: 40,
+            height: 40,
+            samples_per_pixel: 4,
+            tile_size: 16,
+            ..RenderParams::DEFAULT
+        };
+        let expected = render_bits(&params, 1);
+        assert!(expected == render_bits(&params, 4));
+        let params = RenderParams {
+            tile_size: 7,
+            ..params
+        };
+        assert!(expected == render_bits(&params, 3));
+    }
+}
@@ -1 +1,159 @@
+use rand::{Error, RngCore, SeedableRng};
+use std::fmt::Debug;
+
+// Random number generators rendering can use, which are reproducible from a
+// seed and cheap to create per pixel.
+pub trait Generator: RngCore + SeedableRng + Clone + Debug + Send + Sync {
+    // Returns the generator for the pixel, whose numbers depend only on the
+    // seed and the position.
+    fn for_pixel(seed: u64, x: u32, y: u32) -> Self {
+        Self::seed_from_u64(pixel_hash(seed, x, y))
+    }
+}
+
+impl Generator for rand_pcg::Pcg64Mcg {}
+
+impl Generator for Xoshiro256PlusPlus {}
+
+// The generator used everywhere, chosen at build time. PCG is the default, and
+// the xoshiro feature selects xoshiro256++, which avoids 128-bit
+// multiplication that is slow on some targets like WebAssembly. They give
+// different images from the same seed.
+#[cfg(not(feature = "xoshiro"))]
 pub type Rng = rand_pcg::Pcg64Mcg;
+#[cfg(feature = "xoshiro")]
+pub type Rng = Xoshiro256PlusPlus;
+
+// xoshiro256++ by Blackman and Vigna, a fast generator of 256-bit state.
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Xoshiro256PlusPlus {
+    s: [u64; 4],
+}
+
+impl SeedableRng for Xoshiro256PlusPlus {
+    type Seed = [u8; 32];
+
+    fn from_seed(seed: Self::Seed) -> Self {
+        let mut s = [0; 4];
+        for (i, word) in s.iter_mut().enumerate() {
+            let mut bytes = [0; 8];
+            bytes.copy_from_slice(&seed[i * 8..i * 8 + 8]);
+            *word = u64::from_le_bytes(bytes);
+        }
+        // The state must not be all zeros, which the generator never leaves.
+        if s == [0; 4] {
+            return Self::seed_from_u64(0);
+        }
+        Xoshiro256PlusPlus { s }
+    }
+
+    // Expands the seed by SplitMix64 as recommended by the authors.
+    fn seed_from_u64(seed: u64) -> Self {
+        let mut s = [0; 4];
+        for (i, word) in s.iter_mut().enumerate() {
+            *word = hash(seed.wrapping_add(i as u64 * 0x9e3779b97f4a7c15));
+        }
+        Xoshiro256PlusPlus { s }
+    }
+}
+
+impl RngCore for Xoshiro256PlusPlus {
+    fn next_u32(&mut self) -> u32 {
+        (self.next_u64() >> 32) as u32
+    }
+
+    fn next_u64(&mut self) -> u64 {
+        let s = &mut self.s;
+        let result = (s[0].wrapping_add(s[3])).rotate_left(23).wrapping_add(s[0]);
+        let t = s[1] << 17;
+        s[2] ^= s[0];
+        s[3] ^= s[1];
+        s[1] ^= s[2];
+        s[0] ^= s[3];
+        s[2] ^= t;
+        s[3] = s[3].rotate_left(45);
+        result
+    }
+
+    fn fill_bytes(&mut self, dest: &mut [u8]) {
+        for chunk in dest.chunks_mut(8) {
+            let bytes = self.next_u64().to_le_bytes();
+            chunk.copy_from_slice(&bytes[..chunk.len()]);
+        }
+    }
+
+    fn try_fill_bytes(&mut self, dest: &mut [u8]) -> Result<(), Error> {
+        self.fill_bytes(dest);
+        Ok(())
+    }
+}
+
+// SplitMix64 finalizer, used to derive seeds and per-pixel values
+// deterministically regardless of how many random numbers were consumed
+// before.
+pub(crate) fn hash(x: u64) -> u64 {
+    let mut z = x.wrapping_add(0x9e3779b97f4a7c15);
+    z = (z ^ (z >> 30)).wrapping_mul(0xbf58476d1ce4e5b9);
+    z = (z ^ (z >> 27)).wrapping_mul(0x94d049bb133111eb);
+    z ^ (z >> 31)
+}
+
+pub(crate) fn pixel_hash(seed: u64, x: u32, y: u32) -> u64 {
+    hash(seed ^ hash(((x as u64) << 32) | y as u64))
+}
+
+// 64-bit FNV-1a hash of bytes, used for IDs and keys that are saved or
+// compared across runs and builds unlike the hashers of std.
+pub(crate) fn fnv1a(data: impl IntoIterator<Item = u8>) -> u64 {
+    data.into_iter().fold(0xcbf29ce484222325, |hash, b| {
+        (hash ^ b as u64).wrapping_mul(0x100000001b3)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // Checks that numbers look uniform and that pixels get different streams.
+    fn check_generator<G: Generator>() {
+        let mut rng = G::for_pixel(28, 3, 4);
+        let n = 100000;
+        let mean = (0..n)
+            .map(|_| rng.next_u64() as f64 / u64::MAX as f64)
+            .sum::<f64>()
+            / n as f64;
+        assert!((mean - 0.5).abs() < 0.01, "{}", mean);
+        let mut other = G::for_pixel(28, 4, 3);
+        assert_ne!(G::for_pixel(28, 3, 4).next_u64(), other.next_u64());
+        let mut bytes = [0; 13];
+        rng.fill_bytes(&mut bytes);
+        assert!(bytes.iter().any(|&b| b != 0));
+    }
+
+    #[test]
+    fn test_generators() {
+        check_generator::<rand_pcg::Pcg64Mcg>();
+        check_generator::<Xoshiro256PlusPlus>();
+    }
+
+    #[test]
+    fn test_xoshiro() {
+        // From the reference implementation seeded with 1, 2, 3 and 4.
+        let mut rng = Xoshiro256PlusPlus { s: [1, 2, 3, 4] };
+        let want = [41943041, 58720359, 3588806011781223, 3591011842654386];
+        for &w in want.iter() {
+            assert_eq!(rng.next_u64(), w);
+        }
+        assert_eq!(
+            Xoshiro256PlusPlus::from_seed([0; 32]),
+            Xoshiro256PlusPlus::seed_from_u64(0)
+        );
+    }
+
+    #[test]
+    fn test_fnv1a() {
+        assert_eq!(fnv1a(std::iter::empty()), 0xcbf29ce484222325);
+        assert_eq!(fnv1a(b"a".iter().copied()), 0xaf63dc4c8601ec8c);
+        assert_eq!(fnv1a("foobar".bytes()), 0x85944171f73967e8);
+    }
+}
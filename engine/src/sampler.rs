@@ -1,6 +1,8 @@
-use crate::geom::{Axis, IntoVec3, Vec3, Vec3Unit};
+use crate::color::Color;
+use crate::geom::{Axis, IntoVec3, Mat4, Onb, Vec3, Vec3Unit};
+use crate::physics::reflect;
+use crate::ray::Media;
 use crate::rng::Rng;
-use itertools::Itertools;
 use rand::prelude::SliceRandom;
 use rand::Rng as _;
 use std::f64::consts::PI;
@@ -12,6 +14,19 @@ pub trait Sampler: Debug {
     fn constant(&self) -> Option<Vec3Unit>;
     fn sample(&self, rng: &mut Rng) -> Vec3Unit;
     fn probability(&self, dir: Vec3Unit) -> f64;
+
+    // Returns the fraction of the albedo scattered toward dir, for samplers
+    // not distributed exactly like the reflectance times the cosine. It is
+    // zero for directions light is absorbed in.
+    fn weight(&self, _dir: Vec3Unit) -> Color {
+        Color::WHITE
+    }
+
+    // Returns media the sampled ray travels in if they differ from the ones
+    // of the incoming ray, e.g. after refraction.
+    fn media(&self) -> Option<Media> {
+        None
+    }
 }
 
 impl Sampler for Box<dyn Sampler> {
@@ -24,6 +39,12 @@ impl Sampler for Box<dyn Sampler> {
     fn probability(&self, dir: Vec3Unit) -> f64 {
         self.as_ref().probability(dir)
     }
+    fn weight(&self, dir: Vec3Unit) -> Color {
+        self.as_ref().weight(dir)
+    }
+    fn media(&self) -> Option<Media> {
+        self.as_ref().media()
+    }
 }
 
 impl Sampler for Rc<dyn Sampler> {
@@ -36,6 +57,12 @@ impl Sampler for Rc<dyn Sampler> {
     fn probability(&self, dir: Vec3Unit) -> f64 {
         self.as_ref().probability(dir)
     }
+    fn weight(&self, dir: Vec3Unit) -> Color {
+        self.as_ref().weight(dir)
+    }
+    fn media(&self) -> Option<Media> {
+        self.as_ref().media()
+    }
 }
 
 impl Sampler for Arc<dyn Sampler> {
@@ -48,6 +75,12 @@ impl Sampler for Arc<dyn Sampler> {
     fn probability(&self, dir: Vec3Unit) -> f64 {
         self.as_ref().probability(dir)
     }
+    fn weight(&self, dir: Vec3Unit) -> Color {
+        self.as_ref().weight(dir)
+    }
+    fn media(&self) -> Option<Media> {
+        self.as_ref().media()
+    }
 }
 
 #[derive(Debug)]
@@ -61,7 +94,13 @@ impl Sampler for LambertianSampler {
     }
 
     fn sample(&self, rng: &mut Rng) -> Vec3Unit {
-        (self.out_normal + Vec3Unit::random_on_unit_sphere(rng)).unit()
+        // A point on the unit sphere tangent to the surface is distributed by
+        // cosine from the normal. It rarely cancels the normal out.
+        let dir = self.out_normal + Vec3Unit::random_on_unit_sphere(rng);
+        if dir.norm() < 1e-16 {
+            return self.out_normal;
+        }
+        dir.unit()
     }
 
     fn probability(&self, dir: Vec3Unit) -> f64 {
@@ -80,6 +119,127 @@ impl LambertianSampler {
     }
 }
 
+// Mirror reflection about microfacet normals distributed by GGX. alpha is the
+// roughness. Directions are weighted by the Fresnel reflectance at the
+// microfacet normal and Smith's masking-shadowing, and directions below the
+// surface have neither probability nor weight, so rays there are absorbed.
+#[derive(Debug)]
+pub struct GgxSampler {
+    // w is the normal and u is the tangent.
+    basis: Onb,
+    in_dir: Vec3Unit,
+    // Roughness along the tangent and the bitangent.
+    alpha_x: f64,
+    alpha_y: f64,
+    // Reflectance at normal incidence.
+    f0: Color,
+}
+
+impl Sampler for GgxSampler {
+    fn constant(&self) -> Option<Vec3Unit> {
+        None
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        let r1 = rng.gen::<f64>();
+        let r2 = 2.0 * PI * rng.gen::<f64>();
+        let phi = f64::atan2(self.alpha_y * r2.sin(), self.alpha_x * r2.cos());
+        let (sin_phi, cos_phi) = phi.sin_cos();
+        let inv_a2 = cos_phi * cos_phi / (self.alpha_x * self.alpha_x)
+            + sin_phi * sin_phi / (self.alpha_y * self.alpha_y);
+        let tan2 = r1 / ((1.0 - r1) * inv_a2);
+        let cos = 1.0 / (1.0 + tan2).sqrt();
+        let sin = (1.0 - cos * cos).max(0.0).sqrt();
+        let h = self
+            .basis
+            .to_world(Vec3::new(sin * cos_phi, sin * sin_phi, cos))
+            .unit();
+        reflect(self.in_dir, h)
+    }
+
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        if dir.dot(self.basis.w) <= 0.0 {
+            return 0.0;
+        }
+        let h = dir - self.in_dir;
+        if h.norm() == 0.0 {
+            return 0.0;
+        }
+        let h = h.unit();
+        let local = self.basis.to_local(h);
+        let cos = local.z;
+        if cos <= 0.0 {
+            return 0.0;
+        }
+        let hx = local.x / self.alpha_x;
+        let hy = local.y / self.alpha_y;
+        let d = 1.0 / (PI * self.alpha_x * self.alpha_y * (hx * hx + hy * hy + cos * cos).powi(2));
+        d * cos / (4.0 * dir.dot(h).abs())
+    }
+
+    // The BRDF times the cosine over the probability, F G (v.h) / ((n.v)(n.h)).
+    fn weight(&self, dir: Vec3Unit) -> Color {
+        let out_dir = -self.in_dir;
+        let (cos_out, cos_in) = (dir.dot(self.basis.w), out_dir.dot(self.basis.w));
+        let h = dir - self.in_dir;
+        if cos_out <= 0.0 || cos_in <= 0.0 || h.norm() == 0.0 {
+            return Color::BLACK;
+        }
+        let h = h.unit();
+        let cos_h = h.dot(self.basis.w);
+        let cos_vh = out_dir.dot(h);
+        if cos_h <= 0.0 || cos_vh <= 0.0 {
+            return Color::BLACK;
+        }
+        let fresnel = self.f0 + (1.0 - cos_vh).powi(5) * (Color::WHITE - self.f0);
+        let masking = 1.0 / ((1.0 + self.lambda(dir)) * (1.0 + self.lambda(out_dir)));
+        fresnel * (masking * cos_vh / (cos_in * cos_h))
+    }
+}
+
+impl GgxSampler {
+    // normal must face against in_dir. f0 is the reflectance at normal
+    // incidence, from which Schlick's approximation gives the others.
+    pub fn new(normal: Vec3Unit, in_dir: Vec3Unit, alpha: f64, f0: Color) -> Self {
+        GgxSampler {
+            basis: Onb::from_normal(normal),
+            in_dir,
+            alpha_x: alpha,
+            alpha_y: alpha,
+            f0,
+        }
+    }
+
+    // Roughness differs along the tangent and across it, which need not be
+    // exactly perpendicular to the normal.
+    pub fn anisotropic(
+        normal: Vec3Unit,
+        tangent: Vec3Unit,
+        in_dir: Vec3Unit,
+        alpha_x: f64,
+        alpha_y: f64,
+        f0: Color,
+    ) -> Self {
+        GgxSampler {
+            basis: Onb::from_normal_tangent(normal, tangent),
+            in_dir,
+            alpha_x,
+            alpha_y,
+            f0,
+        }
+    }
+
+    // Smith's Lambda of a direction above the surface, for the masking of
+    // microfacets seen from it.
+    fn lambda(&self, dir: Vec3Unit) -> f64 {
+        let local = self.basis.to_local(dir);
+        let x = self.alpha_x * local.x;
+        let y = self.alpha_y * local.y;
+        let tan2 = (x * x + y * y) / (local.z * local.z);
+        ((1.0 + tan2).sqrt() - 1.0) / 2.0
+    }
+}
+
 #[derive(Debug)]
 pub struct RotateSampler {
     axis: Axis,
@@ -102,6 +262,15 @@ impl Sampler for RotateSampler {
         self.sampler
             .probability(dir.rotate_around(self.axis, -self.theta))
     }
+
+    fn weight(&self, dir: Vec3Unit) -> Color {
+        self.sampler
+            .weight(dir.rotate_around(self.axis, -self.theta))
+    }
+
+    fn media(&self) -> Option<Media> {
+        self.sampler.media()
+    }
 }
 
 impl RotateSampler {
@@ -114,9 +283,184 @@ impl RotateSampler {
     }
 }
 
+// Maps directions by the linear part of an affine transform. Probabilities are
+// scaled by the Jacobian of the mapping between solid angles, which is
+// |det A| / |Aw|^3 for a unit direction w.
+#[derive(Debug)]
+pub struct TransformSampler {
+    transform: Mat4,
+    inverse: Mat4,
+    det: f64,
+    sampler: Box<dyn Sampler>,
+}
+
+impl Sampler for TransformSampler {
+    fn constant(&self) -> Option<Vec3Unit> {
+        self.sampler
+            .constant()
+            .map(|dir| self.transform.transform_dir(dir).unit())
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        self.transform
+            .transform_dir(self.sampler.sample(rng))
+            .unit()
+    }
+
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        let w = self.inverse.transform_dir(dir);
+        let len = w.abs();
+        self.sampler.probability(w.unit()) / (self.det * len * len * len)
+    }
+
+    fn weight(&self, dir: Vec3Unit) -> Color {
+        self.sampler.weight(self.inverse.transform_dir(dir).unit())
+    }
+
+    fn media(&self) -> Option<Media> {
+        self.sampler.media()
+    }
+}
+
+impl TransformSampler {
+    // transform must be invertible; inverse is its inverse.
+    pub fn new(transform: Mat4, inverse: Mat4, sampler: Box<dyn Sampler>) -> Self {
+        TransformSampler {
+            transform,
+            inverse,
+            det: transform.linear_determinant().abs(),
+            sampler,
+        }
+    }
+}
+
+// Samples directions scattered off materials. Every hit returns one, so it is
+// an enum rather than a boxed sampler to scatter without allocating, and the
+// transforms of enclosing objects are composed into one matrix instead of
+// wrapping it.
+#[derive(Debug)]
+pub struct ScatterSampler {
+    kind: ScatterKind,
+    // Linear part of the transform to the world, its inverse and the absolute
+    // determinant, as in TransformSampler.
+    transform: Option<(Mat4, Mat4, f64)>,
+}
+
+#[derive(Debug)]
+enum ScatterKind {
+    Lambertian(LambertianSampler),
+    Ggx(GgxSampler),
+    Sphere(SphereSampler),
+    Constant(ConstantSampler),
+}
+
+impl Sampler for ScatterSampler {
+    fn constant(&self) -> Option<Vec3Unit> {
+        let dir = self.local().constant()?;
+        Some(match &self.transform {
+            Some((transform, _, _)) => transform.transform_dir(dir).unit(),
+            None => dir,
+        })
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        let dir = self.local().sample(rng);
+        match &self.transform {
+            Some((transform, _, _)) => transform.transform_dir(dir).unit(),
+            None => dir,
+        }
+    }
+
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        match &self.transform {
+            Some((_, inverse, det)) => {
+                let w = inverse.transform_dir(dir);
+                let len = w.abs();
+                self.local().probability(w.unit()) / (det * len * len * len)
+            }
+            None => self.local().probability(dir),
+        }
+    }
+
+    fn weight(&self, dir: Vec3Unit) -> Color {
+        match &self.transform {
+            Some((_, inverse, _)) => self.local().weight(inverse.transform_dir(dir).unit()),
+            None => self.local().weight(dir),
+        }
+    }
+
+    fn media(&self) -> Option<Media> {
+        self.local().media()
+    }
+}
+
+impl ScatterSampler {
+    fn local(&self) -> &dyn Sampler {
+        match &self.kind {
+            ScatterKind::Lambertian(sampler) => sampler,
+            ScatterKind::Ggx(sampler) => sampler,
+            ScatterKind::Sphere(sampler) => sampler,
+            ScatterKind::Constant(sampler) => sampler,
+        }
+    }
+
+    // transform must be invertible; inverse is its inverse.
+    pub fn transform(self, transform: Mat4, inverse: Mat4) -> Self {
+        let (transform, inverse) = match self.transform {
+            Some((inner, inner_inverse, _)) => (transform * inner, inner_inverse * inverse),
+            None => (transform, inverse),
+        };
+        ScatterSampler {
+            kind: self.kind,
+            transform: Some((transform, inverse, transform.linear_determinant().abs())),
+        }
+    }
+
+    pub fn rotate(self, axis: Axis, theta: f64) -> Self {
+        self.transform(Mat4::rotation(axis, theta), Mat4::rotation(axis, -theta))
+    }
+}
+
+impl From<LambertianSampler> for ScatterSampler {
+    fn from(sampler: LambertianSampler) -> Self {
+        ScatterSampler {
+            kind: ScatterKind::Lambertian(sampler),
+            transform: None,
+        }
+    }
+}
+
+impl From<GgxSampler> for ScatterSampler {
+    fn from(sampler: GgxSampler) -> Self {
+        ScatterSampler {
+            kind: ScatterKind::Ggx(sampler),
+            transform: None,
+        }
+    }
+}
+
+impl From<SphereSampler> for ScatterSampler {
+    fn from(sampler: SphereSampler) -> Self {
+        ScatterSampler {
+            kind: ScatterKind::Sphere(sampler),
+            transform: None,
+        }
+    }
+}
+
+impl From<ConstantSampler> for ScatterSampler {
+    fn from(sampler: ConstantSampler) -> Self {
+        ScatterSampler {
+            kind: ScatterKind::Constant(sampler),
+            transform: None,
+        }
+    }
+}
+
 #[derive(Debug)]
 pub struct ConstantSampler {
     dir: Vec3Unit,
+    media: Option<Media>,
 }
 
 impl Sampler for ConstantSampler {
@@ -131,11 +475,22 @@ impl Sampler for ConstantSampler {
     fn probability(&self, _dir: Vec3Unit) -> f64 {
         f64::INFINITY
     }
+
+    fn media(&self) -> Option<Media> {
+        self.media.clone()
+    }
 }
 
 impl ConstantSampler {
     pub fn new(dir: Vec3Unit) -> Self {
-        ConstantSampler { dir }
+        ConstantSampler { dir, media: None }
+    }
+
+    pub fn with_media(self, media: Media) -> Self {
+        ConstantSampler {
+            media: Some(media),
+            ..self
+        }
     }
 }
 
@@ -242,6 +597,161 @@ impl SphereSampler {
     }
 }
 
+#[derive(Debug)]
+pub struct QuadSampler {
+    origin: Vec3,
+    u: Vec3,
+    v: Vec3,
+}
+
+impl Sampler for QuadSampler {
+    fn constant(&self) -> Option<Vec3Unit> {
+        None
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        let a = rng.gen::<f64>();
+        let b = rng.gen::<f64>();
+        (self.origin + self.u * a + self.v * b).unit()
+    }
+
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        let n = self.u.cross(self.v);
+        let cos = dir.dot(n);
+        if cos == 0.0 {
+            return 0.0;
+        }
+        let t = self.origin.dot(n) / cos;
+        if t <= 0.0 {
+            return 0.0;
+        }
+        let w = n / n.norm();
+        let p = dir * t - self.origin;
+        let a = w.dot(p.cross(self.v));
+        let b = w.dot(self.u.cross(p));
+        if a < 0.0 || a > 1.0 || b < 0.0 || b > 1.0 {
+            return 0.0;
+        }
+        // |n| is the area of the quad and cancels out with the cosine.
+        t * t / cos.abs()
+    }
+}
+
+impl QuadSampler {
+    pub fn new(origin: Vec3, u: Vec3, v: Vec3) -> Self {
+        QuadSampler { origin, u, v }
+    }
+}
+
+// Samples points uniformly on a disk, or an annulus if inner_radius is
+// positive.
+#[derive(Debug)]
+pub struct DiskSampler {
+    center: Vec3,
+    basis: Onb,
+    radius: f64,
+    inner_radius: f64,
+}
+
+impl Sampler for DiskSampler {
+    fn constant(&self) -> Option<Vec3Unit> {
+        None
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        let r2 = self.inner_radius * self.inner_radius;
+        let r = (r2 + rng.gen::<f64>() * (self.radius * self.radius - r2)).sqrt();
+        let phi = 2.0 * PI * rng.gen::<f64>();
+        (self.center
+            + self
+                .basis
+                .to_world(Vec3::new(r * phi.cos(), r * phi.sin(), 0.0)))
+        .unit()
+    }
+
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        let n = self.basis.w;
+        let cos = dir.dot(n);
+        if cos == 0.0 {
+            return 0.0;
+        }
+        let t = self.center.dot(n) / cos;
+        if t <= 0.0 {
+            return 0.0;
+        }
+        let d2 = (dir * t - self.center).norm();
+        if d2 < self.inner_radius * self.inner_radius || d2 > self.radius * self.radius {
+            return 0.0;
+        }
+        let area = PI * (self.radius * self.radius - self.inner_radius * self.inner_radius);
+        t * t / (cos.abs() * area)
+    }
+}
+
+impl DiskSampler {
+    pub fn new(center: Vec3, normal: Vec3Unit, radius: f64, inner_radius: f64) -> Self {
+        DiskSampler {
+            center,
+            basis: Onb::from_normal(normal),
+            radius,
+            inner_radius,
+        }
+    }
+}
+
+#[derive(Debug)]
+pub struct TriangleSampler {
+    p0: Vec3,
+    p1: Vec3,
+    p2: Vec3,
+}
+
+impl Sampler for TriangleSampler {
+    fn constant(&self) -> Option<Vec3Unit> {
+        None
+    }
+
+    fn sample(&self, rng: &mut Rng) -> Vec3Unit {
+        let r1 = rng.gen::<f64>().sqrt();
+        let r2 = rng.gen::<f64>();
+        (self.p0 * (1.0 - r1) + self.p1 * (r1 * (1.0 - r2)) + self.p2 * (r1 * r2)).unit()
+    }
+
+    fn probability(&self, dir: Vec3Unit) -> f64 {
+        let e1 = self.p1 - self.p0;
+        let e2 = self.p2 - self.p0;
+        let p = dir.cross(e2);
+        let det = e1.dot(p);
+        if det == 0.0 {
+            return 0.0;
+        }
+        let s = -self.p0;
+        let u = s.dot(p) / det;
+        if u < 0.0 || u > 1.0 {
+            return 0.0;
+        }
+        let q = s.cross(e1);
+        let v = dir.dot(q) / det;
+        if v < 0.0 || u + v > 1.0 {
+            return 0.0;
+        }
+        let t = e2.dot(q) / det;
+        if t <= 0.0 {
+            return 0.0;
+        }
+        let cross = e1.cross(e2);
+        let area = cross.abs() / 2.0;
+        let cos = dir.dot(cross.unit()).abs();
+        t * t / (cos * area)
+    }
+}
+
+impl TriangleSampler {
+    pub fn new(p0: Vec3, p1: Vec3, p2: Vec3) -> Self {
+        TriangleSampler { p0, p1, p2 }
+    }
+}
+
 #[derive(Debug)]
 pub struct MixedSampler<S: Sampler> {
     samplers: Vec<S>,
@@ -249,16 +759,15 @@ pub struct MixedSampler<S: Sampler> {
 
 impl<S: Sampler> Sampler for MixedSampler<S> {
     fn constant(&self) -> Option<Vec3Unit> {
-        let v = self
+        let mut constants = self
             .samplers
             .iter()
-            .filter_map(|sampler| sampler.constant())
-            .collect_vec();
-        match v.len() {
-            0 => None,
-            1 => Some(v[0]),
-            _ => panic!("Cannot mix multiple constant samplers"),
+            .filter_map(|sampler| sampler.constant());
+        let dir = constants.next();
+        if constants.next().is_some() {
+            panic!("Cannot mix multiple constant samplers");
         }
+        dir
     }
 
     fn sample(&self, rng: &mut Rng) -> Vec3Unit {
@@ -327,6 +836,80 @@ mod tests {
         );
     }
 
+    #[test]
+    fn test_quad_sampler() {
+        verify_sampler(
+            "QuadSampler",
+            QuadSampler::new(
+                Vec3::new(12.0, 33.0, 60.0),
+                Vec3::new(3.0, 11.0, 2.0),
+                Vec3::new(-2.0, 5.0, 27.0),
+            ),
+        );
+    }
+
+    #[test]
+    fn test_disk_sampler() {
+        verify_sampler(
+            "DiskSampler",
+            DiskSampler::new(
+                Vec3::new(12.0, 33.0, 60.0),
+                Vec3::new(3.0, -1.0, 2.0).unit(),
+                15.0,
+                5.0,
+            ),
+        );
+    }
+
+    #[test]
+    fn test_triangle_sampler() {
+        verify_sampler(
+            "TriangleSampler",
+            TriangleSampler::new(
+                Vec3::new(12.0, 33.0, 60.0),
+                Vec3::new(15.0, 44.0, 62.0),
+                Vec3::new(10.0, 38.0, 87.0),
+            ),
+        );
+    }
+
+    #[test]
+    fn test_ggx_sampler() {
+        // Samples below the surface are absorbed, so the probability should
+        // integrate to the fraction of samples above it.
+        let n = 1000000;
+        let mut rng = Rng::seed_from_u64(28);
+        let rng = &mut rng;
+        let normal = Vec3::new(1.0, 2.0, 3.0).unit();
+        let in_dir = Vec3::new(-1.0, 0.0, -1.0).unit();
+        let tangent = Vec3::new(1.0, -1.0, 0.0).unit();
+        for &(ax, ay) in [(0.2, 0.2), (0.5, 0.5), (1.0, 1.0), (0.1, 0.6), (0.8, 0.3)].iter() {
+            let sampler = if ax == ay {
+                GgxSampler::new(normal, in_dir, ax, Color::WHITE)
+            } else {
+                GgxSampler::anisotropic(normal, tangent, in_dir, ax, ay, Color::WHITE)
+            };
+            let integral = (0..n)
+                .map(|_| sampler.probability(Vec3Unit::random_on_unit_sphere(rng)))
+                .sum::<f64>()
+                / n as f64
+                * 4.0
+                * PI;
+            let above = (0..n)
+                .filter(|_| sampler.sample(rng).dot(normal) > 0.0)
+                .count() as f64
+                / n as f64;
+            assert!(
+                (above - integral).abs() < 0.03,
+                "alpha=({}, {}): got {}, want {}",
+                ax,
+                ay,
+                integral,
+                above
+            );
+        }
+    }
+
     #[test]
     fn test_lambertian_sampler() {
         verify_sampler(
@@ -355,6 +938,30 @@ mod tests {
         );
     }
 
+    #[test]
+    fn test_transform_sampler() {
+        let transform = Mat4::rotation(Axis::X, 0.4) * Mat4::scaling(Vec3::new(1.0, 3.0, 0.5));
+        verify_sampler(
+            "TransformSampler",
+            TransformSampler::new(
+                transform,
+                transform.inverse().unwrap(),
+                Box::new(SphereSampler::new(Vec3::new(10.0, 20.0, 30.0), 5.7)),
+            ),
+        );
+    }
+
+    #[test]
+    fn test_scatter_sampler() {
+        let transform = Mat4::rotation(Axis::X, 0.4) * Mat4::scaling(Vec3::new(1.0, 3.0, 0.5));
+        verify_sampler(
+            "ScatterSampler",
+            ScatterSampler::from(SphereSampler::new(Vec3::new(10.0, 20.0, 30.0), 5.7))
+                .rotate(Axis::Z, PI / 3.7)
+                .transform(transform, transform.inverse().unwrap()),
+        );
+    }
+
     #[test]
     fn test_mixed_sampler() {
         verify_sampler(
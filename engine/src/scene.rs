@@ -1,35 +1,44 @@
-use crate::background::Background;
+use crate::background::{Sky, Solid};
 use crate::camera::Camera;
 use crate::color::Color;
 use crate::geom::Vec3;
-use crate::geom::{Axis, Box3};
+use crate::geom::{Axis, Box3, Mat4};
+use crate::grid::DensityGrid;
+use crate::light::Light;
 use crate::material::DiffuseLight;
 use crate::material::Fog;
-use crate::material::{Dielectric, Lambertian, Metal};
+use crate::material::{Dielectric, Lambertian, Material, Metal, Pbr};
+use crate::mesh::Mesh;
 use crate::object::GlobalVolume;
+use crate::object::GridVolumeObject;
 use crate::object::Object;
 use crate::object::ObjectPtr;
 use crate::object::PortalObject;
 use crate::object::VolumeObject;
+use crate::object::{NamedObject, RotateObject, ScaleObject, TranslateObject};
 use crate::object::{Objects, SolidObject};
-use crate::object::{RotateObject, TranslateObject};
 use crate::renderer::RenderParams;
 use crate::rng::Rng;
+use crate::scene_graph::SceneNode;
 use crate::shape::Block;
 use crate::shape::LocalFlip;
 use crate::shape::MovingSphere;
 use crate::shape::Rectangle;
 use crate::shape::Sphere;
+use crate::shape::{Plane, Quad};
 use crate::shape::{Rotate, Translate};
 use crate::texture::SolidColor;
 use crate::texture::{Checker, Image, Marble};
 use crate::time::TimeRange;
 use crate::world::World;
+use anyhow::{bail, Context, Result};
 use itertools::Itertools;
 use rand::Rng as _;
+use std::collections::BTreeMap;
 use std::f64::consts::PI;
 use std::sync::Arc;
-use strum_macros::{Display, EnumIter, EnumString};
+use strum::{EnumMessage, IntoEnumIterator};
+use strum_macros::{Display, EnumIter, EnumMessage, EnumString};
 
 fn v(x: f64, y: f64, z: f64) -> Vec3 {
     Vec3::new(x, y, z)
@@ -42,29 +51,27 @@ fn c(r: f64, g: f64, b: f64) -> SolidColor {
 const RENDER_PARAMS_WIDE: RenderParams = RenderParams {
     width: 400,
     height: 225,
-    samples_per_pixel: 100,
-    importance_sampling: false,
+    ..RenderParams::DEFAULT
 };
 
 const RENDER_PARAMS_SQAURE: RenderParams = RenderParams {
     width: 400,
     height: 400,
-    samples_per_pixel: 100,
-    importance_sampling: false,
+    ..RenderParams::DEFAULT
 };
 
 const RENDER_PARAMS_ONE_WEEKEND_FINAL: RenderParams = RenderParams {
     width: 1200,
     height: 800,
     samples_per_pixel: 500,
-    importance_sampling: false,
+    ..RenderParams::DEFAULT
 };
 
 const RENDER_PARAMS_NEXT_WEEK_FINAL: RenderParams = RenderParams {
     width: 800,
     height: 800,
     samples_per_pixel: 10000,
-    importance_sampling: false,
+    ..RenderParams::DEFAULT
 };
 
 const RENDER_PARAMS_REST_OF_YOUR_LIFE_FINAL: RenderParams = RenderParams {
@@ -72,66 +79,145 @@ const RENDER_PARAMS_REST_OF_YOUR_LIFE_FINAL: RenderParams = RenderParams {
     height: 800,
     samples_per_pixel: 1000,
     importance_sampling: true,
+    ..RenderParams::DEFAULT
 };
 
 fn aspect_ratio(params: &RenderParams) -> f64 {
     params.width as f64 / params.height as f64
 }
 
-#[derive(Copy, Clone, Debug, Display, EnumIter, EnumString, PartialEq)]
+#[derive(Copy, Clone, Debug, Display, EnumIter, EnumMessage, EnumString, PartialEq)]
 pub enum Scene {
-    #[strum(serialize = "book1/image10")]
+    #[strum(
+        serialize = "book1/image10",
+        message = "Diffuse sphere on a ground sphere"
+    )]
     Book1Image10,
-    #[strum(serialize = "book1/image12")]
+    #[strum(
+        serialize = "book1/image12",
+        message = "Diffuse and fuzzed metal spheres"
+    )]
     Book1Image12,
-    #[strum(serialize = "book1/image14")]
+    #[strum(
+        serialize = "book1/image14",
+        message = "Glass spheres next to a metal sphere"
+    )]
     Book1Image14,
-    #[strum(serialize = "book1/image15")]
+    #[strum(
+        serialize = "book1/image15",
+        message = "Glass, diffuse and metal spheres"
+    )]
     Book1Image15,
-    #[strum(serialize = "book1/image16")]
+    #[strum(
+        serialize = "book1/image16",
+        message = "Hollow glass sphere next to diffuse and metal spheres"
+    )]
     Book1Image16,
-    #[strum(serialize = "book1/image19")]
+    #[strum(
+        serialize = "book1/image19",
+        message = "Hollow glass sphere seen by a distant camera"
+    )]
     Book1Image19,
-    #[strum(serialize = "book1/final")]
+    #[strum(
+        serialize = "book1/final",
+        message = "Random spheres with depth of field (One Weekend cover)"
+    )]
     Book1Final,
-    #[strum(serialize = "book2/image1")]
+    #[strum(
+        serialize = "book2/image1",
+        message = "Random spheres with bouncing motion blur"
+    )]
     Book2Image1,
-    #[strum(serialize = "book2/image2")]
+    #[strum(
+        serialize = "book2/image2",
+        message = "Random bouncing spheres on a checkered ground"
+    )]
     Book2Image2,
-    #[strum(serialize = "book2/image3")]
+    #[strum(serialize = "book2/image3", message = "Two checkered spheres")]
     Book2Image3,
-    #[strum(serialize = "book2/image13")]
+    #[strum(serialize = "book2/image13", message = "Marble spheres")]
     Book2Image13,
-    #[strum(serialize = "book2/image15")]
+    #[strum(serialize = "book2/image15", message = "Earth-textured sphere")]
     Book2Image15,
-    #[strum(serialize = "book2/image16")]
+    #[strum(
+        serialize = "book2/image16",
+        message = "Marble spheres lit by a rectangle light"
+    )]
     Book2Image16,
-    #[strum(serialize = "book2/image18")]
+    #[strum(serialize = "book2/image18", message = "Empty Cornell box")]
     Book2Image18,
-    #[strum(serialize = "book2/image19")]
+    #[strum(serialize = "book2/image19", message = "Cornell box with two blocks")]
     Book2Image19,
-    #[strum(serialize = "book2/image20")]
+    #[strum(
+        serialize = "book2/image20",
+        message = "Cornell box with two rotated blocks"
+    )]
     Book2Image20,
-    #[strum(serialize = "book2/image21")]
+    #[strum(
+        serialize = "book2/image21",
+        message = "Cornell box with blocks of smoke"
+    )]
     Book2Image21,
-    #[strum(serialize = "book2/final")]
+    #[strum(
+        serialize = "book2/final",
+        message = "All features of The Next Week (cover)"
+    )]
     Book2Final,
-    #[strum(serialize = "book3/image8")]
+    #[strum(
+        serialize = "book3/image8",
+        message = "Same as book2/image20, where The Rest of Your Life starts"
+    )]
     Book3Image8,
-    #[strum(serialize = "book3/image9")]
+    #[strum(serialize = "book3/image9", message = "Cornell box with a metal block")]
     Book3Image9,
-    #[strum(serialize = "book3/image12")]
+    #[strum(
+        serialize = "book3/image12",
+        message = "Cornell box with a glass sphere, importance sampled"
+    )]
     Book3Image12,
-    #[strum(serialize = "debug/glass_sphere")]
+    #[strum(
+        serialize = "debug/glass_sphere",
+        message = "Glass sphere over random blocks"
+    )]
     DebugGlassSphere,
-    #[strum(serialize = "debug/portal")]
+    #[strum(
+        serialize = "debug/portal",
+        message = "Cornell box with a portal between walls"
+    )]
     DebugPortal,
+    #[strum(serialize = "debug/mesh", message = "Icosahedron mesh")]
+    DebugMesh,
+    #[strum(serialize = "debug/quads", message = "Quads of five colors")]
+    DebugQuads,
+    #[strum(
+        serialize = "debug/instances",
+        message = "One mesh instanced with different transforms"
+    )]
+    DebugInstances,
+    #[strum(
+        serialize = "debug/assembly",
+        message = "Tables assembled in a scene graph"
+    )]
+    DebugAssembly,
+    #[strum(serialize = "debug/cloud", message = "Cloud from a density grid")]
+    DebugCloud,
+    #[strum(
+        serialize = "debug/pbr",
+        message = "Spheres of varying roughness, dielectric and metallic"
+    )]
+    DebugPbr,
+    #[strum(
+        serialize = "debug/lights",
+        message = "Balls under point, spot and directional lights"
+    )]
+    DebugLights,
 }
 
 impl Scene {
-    pub fn load(self, rng: &mut Rng) -> (RenderParams, Camera, World) {
+    // Fails if the scene needs files which are not available, e.g. textures.
+    pub fn load(self, rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
         use Scene::*;
-        match self {
+        Ok(match self {
             Book1Image10 => one_weekend::image10(rng),
             Book1Image12 => one_weekend::image12(rng),
             Book1Image14 => one_weekend::image14(rng),
@@ -143,19 +229,104 @@ impl Scene {
             Book2Image2 => next_week::image2(rng),
             Book2Image3 => next_week::image3(rng),
             Book2Image13 => next_week::image13(rng),
-            Book2Image15 => next_week::image15(rng),
+            Book2Image15 => next_week::image15(rng)?,
             Book2Image16 => next_week::image16(rng),
             Book2Image18 => next_week::image18(rng),
             Book2Image19 => next_week::image19(rng),
             Book2Image20 => next_week::image20(rng),
             Book2Image21 => next_week::image21(rng),
-            Book2Final => next_week::all_features(rng),
+            Book2Final => next_week::all_features(rng)?,
             Book3Image8 => rest_of_life::image8(rng),
             Book3Image9 => rest_of_life::image9(rng),
             Book3Image12 => rest_of_life::image12(rng),
             DebugGlassSphere => debug::glass_sphere(rng),
             DebugPortal => debug::portal(rng),
+            DebugMesh => debug::mesh(rng),
+            DebugQuads => debug::quads(rng),
+            DebugInstances => debug::instances(rng),
+            DebugAssembly => debug::assembly(rng)?,
+            DebugCloud => debug::cloud(rng)?,
+            DebugPbr => debug::pbr(rng),
+            DebugLights => debug::lights(rng),
+        })
+    }
+}
+
+pub type SceneBuilder =
+    Arc<dyn Fn(&mut Rng) -> Result<(RenderParams, Camera, World)> + Send + Sync>;
+
+#[derive(Clone)]
+struct SceneEntry {
+    description: String,
+    builder: SceneBuilder,
+}
+
+// Scenes looked up by name. Programs embedding the engine can register their
+// own scenes in addition to the built-in ones.
+#[derive(Clone)]
+pub struct SceneRegistry {
+    entries: BTreeMap<String, SceneEntry>,
+}
+
+impl SceneRegistry {
+    pub fn new() -> Self {
+        SceneRegistry {
+            entries: BTreeMap::new(),
+        }
+    }
+
+    // Returns a registry with the built-in scenes.
+    pub fn with_builtins() -> Self {
+        let mut registry = Self::new();
+        for scene in Scene::iter() {
+            registry.register(
+                &scene.to_string(),
+                scene.get_message().unwrap_or_default(),
+                move |rng| scene.load(rng),
+            );
         }
+        registry
+    }
+
+    // Registers a scene with a one-line description, replacing the one of
+    // the same name if any.
+    pub fn register(
+        &mut self,
+        name: &str,
+        description: &str,
+        builder: impl Fn(&mut Rng) -> Result<(RenderParams, Camera, World)> + Send + Sync + 'static,
+    ) {
+        self.entries.insert(
+            name.to_owned(),
+            SceneEntry {
+                description: description.to_owned(),
+                builder: Arc::new(builder),
+            },
+        );
+    }
+
+    pub fn get(&self, name: &str) -> Option<&SceneBuilder> {
+        self.entries.get(name).map(|entry| &entry.builder)
+    }
+
+    // Returns names and descriptions of scenes in sorted order.
+    pub fn list(&self) -> impl Iterator<Item = (&str, &str)> {
+        self.entries
+            .iter()
+            .map(|(name, entry)| (name.as_str(), entry.description.as_str()))
+    }
+
+    pub fn load(&self, name: &str, rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
+        match self.get(name) {
+            Some(builder) => builder(rng),
+            None => bail!("Unknown scene: {}", name),
+        }
+    }
+}
+
+impl Default for SceneRegistry {
+    fn default() -> Self {
+        Self::with_builtins()
     }
 }
 
@@ -196,7 +367,7 @@ pub mod debug {
             time,
         );
         let camera = new_basic_camera(aspect_ratio(&params), time);
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn balls_above(rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -253,11 +424,7 @@ pub mod debug {
             10.0,
             time,
         );
-        (
-            params,
-            camera,
-            World::new(Objects::new(balls, time), Background::SKY),
-        )
+        (params, camera, World::new(Objects::new(balls, time), Sky))
     }
 
     pub fn glass_sphere(rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -313,7 +480,7 @@ pub mod debug {
             1.0,
             time,
         );
-        (params, camera, World::new(all, Background::BLACK))
+        (params, camera, World::new(all, Solid::BLACK))
     }
 
     pub fn portal(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -384,7 +551,343 @@ pub mod debug {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
+    }
+
+    // Regular icosahedron inscribed in a sphere.
+    fn icosahedron(center: Vec3, radius: f64) -> Mesh {
+        let t = (1.0 + 5.0f64.sqrt()) / 2.0;
+        let scale = radius / (1.0 + t * t).sqrt();
+        Mesh::new(
+            vec![
+                v(-1.0, t, 0.0),
+                v(1.0, t, 0.0),
+                v(-1.0, -t, 0.0),
+                v(1.0, -t, 0.0),
+                v(0.0, -1.0, t),
+                v(0.0, 1.0, t),
+                v(0.0, -1.0, -t),
+                v(0.0, 1.0, -t),
+                v(t, 0.0, -1.0),
+                v(t, 0.0, 1.0),
+                v(-t, 0.0, -1.0),
+                v(-t, 0.0, 1.0),
+            ]
+            .into_iter()
+            .map(|p| center + p * scale)
+            .collect(),
+            vec![
+                [0, 11, 5],
+                [0, 5, 1],
+                [0, 1, 7],
+                [0, 7, 10],
+                [0, 10, 11],
+                [1, 5, 9],
+                [5, 11, 4],
+                [11, 10, 2],
+                [10, 7, 6],
+                [7, 1, 8],
+                [3, 9, 4],
+                [3, 4, 2],
+                [3, 2, 6],
+                [3, 6, 8],
+                [3, 8, 9],
+                [4, 9, 5],
+                [2, 4, 11],
+                [6, 2, 10],
+                [8, 6, 7],
+                [9, 8, 1],
+            ],
+        )
+    }
+
+    pub fn mesh(_rng: &mut Rng) -> (RenderParams, Camera, World) {
+        let params = RENDER_PARAMS_WIDE;
+        let time = TimeRange::ZERO;
+        let icosahedron = icosahedron(v(0.0, 0.0, -1.0), 0.5);
+        let objects = Objects::new(
+            vec![
+                SolidObject::new_rc(
+                    Sphere::new(v(0.0, -100.5, -1.0), 100.0),
+                    Lambertian::new(c(0.8, 0.8, 0.0)),
+                ),
+                SolidObject::new_rc(icosahedron, Lambertian::new(c(0.7, 0.3, 0.3))),
+            ],
+            time,
+        );
+        let camera = new_basic_camera(aspect_ratio(&params), time);
+        (params, camera, World::new(objects, Sky))
+    }
+
+    // One mesh placed many times with different transforms.
+    pub fn instances(_rng: &mut Rng) -> (RenderParams, Camera, World) {
+        let params = RENDER_PARAMS_WIDE;
+        let time = TimeRange::ZERO;
+        let icosahedron = icosahedron(Vec3::ZERO, 1.0);
+        let mut objects: Vec<ObjectPtr> = vec![SolidObject::new_rc(
+            Sphere::new(v(0.0, -1000.0, 0.0), 1000.0),
+            Lambertian::new(c(0.5, 0.5, 0.5)),
+        )];
+        for i in 0..8 {
+            let angle = PI * 2.0 * i as f64 / 8.0;
+            let size = 0.3 + 0.1 * i as f64;
+            let color = Color::new(0.2 + 0.1 * i as f64, 0.3, 0.9 - 0.1 * i as f64);
+            objects.push(Arc::new(TranslateObject::new(
+                v(4.0 * angle.cos(), size, 4.0 * angle.sin()),
+                RotateObject::new(
+                    Axis::Y,
+                    angle,
+                    ScaleObject::new(
+                        size,
+                        SolidObject::new(
+                            icosahedron.clone(),
+                            Lambertian::new(SolidColor::new(color)),
+                        ),
+                    ),
+                ),
+            )));
+        }
+        let camera = Camera::new(
+            v(0.0, 6.0, -9.0),
+            Vec3::ZERO,
+            PI / 4.0,
+            aspect_ratio(&params),
+            0.0,
+            1.0,
+            time,
+        );
+        (params, camera, World::new(Objects::new(objects, time), Sky))
+    }
+
+    // A table assembled from blocks, placed as a unit with nested transforms.
+    pub fn assembly(_rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
+        let params = RENDER_PARAMS_WIDE;
+        let time = TimeRange::ZERO;
+        let wood = Arc::new(Lambertian::new(c(0.6, 0.4, 0.2))) as Arc<dyn Material>;
+        let mut table = SceneNode::new(Mat4::IDENTITY);
+        table.add_object(SolidObject::new_rc(
+            Block::new(Box3::new(v(-1.0, 0.9, -0.6), v(1.0, 1.0, 0.6))),
+            wood.clone(),
+        ));
+        for &(x, z) in [(-0.9, -0.5), (0.8, -0.5), (-0.9, 0.4), (0.8, 0.4)].iter() {
+            table.add_object(SolidObject::new_rc(
+                Block::new(Box3::new(v(x, 0.0, z), v(x + 0.1, 0.9, z + 0.1))),
+                wood.clone(),
+            ));
+        }
+        let table = Arc::new(table);
+
+        let mut root = SceneNode::new(Mat4::IDENTITY);
+        root.add_object(SolidObject::new_rc(
+            Sphere::new(v(0.0, -1000.0, 0.0), 1000.0),
+            Lambertian::new(c(0.5, 0.5, 0.5)),
+        ));
+        for (i, &(x, angle, scale)) in [(-2.5, 0.3, 1.0), (0.0, -0.2, 0.6), (2.5, 0.8, 1.3)]
+            .iter()
+            .enumerate()
+        {
+            let mut node = SceneNode::new(
+                Mat4::translation(v(x, 0.0, 0.0))
+                    * Mat4::rotation(Axis::Y, angle)
+                    * Mat4::scaling(v(1.0, scale, 1.0)),
+            );
+            node.add_child(table.clone());
+            // A ball on each table, placed relative to the table.
+            let mut ball = SceneNode::new(Mat4::translation(v(0.0, 1.25, 0.0)));
+            ball.add_object(SolidObject::new_rc(
+                Sphere::new(Vec3::ZERO, 0.25),
+                Metal::new(c(0.9, 0.9, 0.9), 0.1 * i as f64),
+            ));
+            node.add_child(Arc::new(ball));
+            root.add_child(Arc::new(node));
+        }
+        let camera = Camera::new(
+            v(0.0, 3.0, -7.0),
+            v(0.0, 0.7, 0.0),
+            PI / 4.0,
+            aspect_ratio(&params),
+            0.0,
+            1.0,
+            time,
+        );
+        Ok((params, camera, World::new(root.build(time)?, Sky)))
+    }
+
+    // A cloud made of random blobs on a density grid.
+    pub fn cloud(rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
+        let params = RENDER_PARAMS_WIDE;
+        let time = TimeRange::ZERO;
+        const N: usize = 40;
+        let blobs: Vec<(Vec3, f64)> = (0..40)
+            .map(|_| {
+                let center = v(
+                    rng.gen_range(0.2..0.8),
+                    rng.gen_range(0.35..0.55),
+                    rng.gen_range(0.3..0.7),
+                );
+                (center, rng.gen_range(0.05..0.1))
+            })
+            .collect();
+        let mut values = Vec::with_capacity(N * N * N);
+        for k in 0..N {
+            for j in 0..N {
+                for i in 0..N {
+                    let p = v(i as f64 + 0.5, j as f64 + 0.5, k as f64 + 0.5) / N as f64;
+                    let density: f64 = blobs
+                        .iter()
+                        .map(|&(center, radius)| (-(p - center).norm() / (radius * radius)).exp())
+                        .sum();
+                    values.push(density.min(1.0) as f32);
+                }
+            }
+        }
+        let grid = Arc::new(DensityGrid::new([N, N, N], values)?);
+        let objects: Vec<ObjectPtr> = vec![
+            SolidObject::new_rc(
+                Sphere::new(v(0.0, -1000.0, 0.0), 1000.0),
+                Lambertian::new(c(0.4, 0.5, 0.3)),
+            ),
+            GridVolumeObject::new_rc(
+                Block::new(Box3::new(v(-3.0, 0.0, -3.0), v(3.0, 6.0, 3.0))),
+                grid,
+                Fog::new(Color::WHITE),
+                8.0,
+            ),
+        ];
+        let camera = Camera::new(
+            v(0.0, 3.0, -10.0),
+            v(0.0, 2.5, 0.0),
+            PI / 4.0,
+            aspect_ratio(&params),
+            0.0,
+            1.0,
+            time,
+        );
+        Ok((params, camera, World::new(Objects::new(objects, time), Sky)))
+    }
+
+    // Roughness increases from left to right. The front row is metallic.
+    pub fn pbr(_rng: &mut Rng) -> (RenderParams, Camera, World) {
+        let params = RENDER_PARAMS_WIDE;
+        let time = TimeRange::ZERO;
+        let mut objects: Vec<ObjectPtr> = vec![SolidObject::new_rc(
+            Sphere::new(v(0.0, -1000.0, 0.0), 1000.0),
+            Lambertian::new(Checker::new(c(0.2, 0.2, 0.2), c(0.8, 0.8, 0.8), 1.0)),
+        )];
+        for i in 0..5 {
+            let roughness = i as f64 / 4.0;
+            let x = 2.4 * (2.0 - i as f64);
+            objects.push(SolidObject::new_rc(
+                Sphere::new(v(x, 1.0, 1.5), 1.0),
+                Pbr::new(c(0.8, 0.2, 0.2), roughness, 0.0),
+            ));
+            objects.push(SolidObject::new_rc(
+                Sphere::new(v(x, 1.0, -1.5), 1.0),
+                Pbr::new(c(0.95, 0.75, 0.4), roughness, 1.0),
+            ));
+        }
+        let camera = Camera::new(
+            v(0.0, 4.0, -12.0),
+            v(0.0, 1.0, 0.0),
+            PI / 4.0,
+            aspect_ratio(&params),
+            0.0,
+            1.0,
+            time,
+        );
+        (params, camera, World::new(Objects::new(objects, time), Sky))
+    }
+
+    pub fn lights(_rng: &mut Rng) -> (RenderParams, Camera, World) {
+        let params = RENDER_PARAMS_WIDE;
+        let time = TimeRange::ZERO;
+        let objects: Vec<ObjectPtr> = vec![
+            SolidObject::new_rc(
+                Sphere::new(v(0.0, -1000.0, 0.0), 1000.0),
+                Lambertian::new(c(0.7, 0.7, 0.7)),
+            ),
+            SolidObject::new_rc(
+                Sphere::new(v(-2.2, 1.0, 0.0), 1.0),
+                Lambertian::new(c(0.7, 0.2, 0.2)),
+            ),
+            SolidObject::new_rc(
+                Sphere::new(v(0.0, 1.0, 0.0), 1.0),
+                Metal::new(c(0.8, 0.8, 0.8), 0.3),
+            ),
+            SolidObject::new_rc(
+                Sphere::new(v(2.2, 1.0, 0.0), 1.0),
+                Lambertian::new(c(0.2, 0.3, 0.7)),
+            ),
+        ];
+        let lights = vec![
+            Light::point(v(-2.2, 3.5, -1.5), Color::new(8.0, 7.0, 5.0)),
+            Light::spot(
+                v(2.2, 5.0, -2.0),
+                v(0.0, -5.0, 2.0),
+                Color::new(30.0, 30.0, 40.0),
+                PI / 18.0,
+                PI / 9.0,
+            ),
+            Light::directional(v(1.0, -1.0, 1.0), Color::new(0.3, 0.3, 0.3)),
+        ];
+        let camera = Camera::new(
+            v(0.0, 3.0, -9.0),
+            v(0.0, 1.0, 0.0),
+            PI / 4.0,
+            aspect_ratio(&params),
+            0.0,
+            1.0,
+            time,
+        );
+        (
+            params,
+            camera,
+            World::new(Objects::new(objects, time), Solid::BLACK).with_lights(lights),
+        )
+    }
+
+    pub fn quads(_rng: &mut Rng) -> (RenderParams, Camera, World) {
+        let params = RENDER_PARAMS_SQAURE;
+        let time = TimeRange::ZERO;
+        let objects = Objects::new(
+            vec![
+                SolidObject::new_rc(
+                    Quad::new(v(-3.0, -2.0, 5.0), v(0.0, 0.0, -4.0), v(0.0, 4.0, 0.0)),
+                    Lambertian::new(c(1.0, 0.2, 0.2)),
+                ),
+                SolidObject::new_rc(
+                    Quad::new(v(-2.0, -2.0, 0.0), v(4.0, 0.0, 0.0), v(0.0, 4.0, 0.0)),
+                    Lambertian::new(c(0.2, 1.0, 0.2)),
+                ),
+                SolidObject::new_rc(
+                    Quad::new(v(3.0, -2.0, 1.0), v(0.0, 0.0, 4.0), v(0.0, 4.0, 0.0)),
+                    Lambertian::new(c(0.2, 0.2, 1.0)),
+                ),
+                SolidObject::new_rc(
+                    Quad::new(v(-2.0, 3.0, 1.0), v(4.0, 0.0, 0.0), v(0.0, 0.0, 4.0)),
+                    Lambertian::new(c(1.0, 0.5, 0.0)),
+                ),
+                SolidObject::new_rc(
+                    Quad::new(v(-2.0, -3.0, 5.0), v(4.0, 0.0, 0.0), v(0.0, 0.0, -4.0)),
+                    Lambertian::new(c(0.2, 0.8, 0.8)),
+                ),
+                SolidObject::new_rc(
+                    Plane::new(v(0.0, -3.5, 0.0), v(0.0, 1.0, 0.0)),
+                    Lambertian::new(Checker::new(c(0.2, 0.3, 0.1), c(0.9, 0.9, 0.9), 1.0)),
+                ),
+            ],
+            time,
+        );
+        let camera = Camera::new(
+            v(0.0, 0.0, 9.0),
+            Vec3::ZERO,
+            PI * 4.0 / 9.0,
+            aspect_ratio(&params),
+            0.0,
+            1.0,
+            time,
+        );
+        (params, camera, World::new(objects, Sky))
     }
 }
 
@@ -421,7 +924,7 @@ pub mod one_weekend {
             time,
         );
         let camera = new_basic_camera(aspect_ratio(&params), time);
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn image12(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -449,7 +952,7 @@ pub mod one_weekend {
             time,
         );
         let camera = new_basic_camera(aspect_ratio(&params), time);
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn image14(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -471,7 +974,7 @@ pub mod one_weekend {
             time,
         );
         let camera = new_basic_camera(aspect_ratio(&params), time);
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn image15(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -496,7 +999,7 @@ pub mod one_weekend {
             time,
         );
         let camera = new_basic_camera(aspect_ratio(&params), time);
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn image16(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -522,7 +1025,7 @@ pub mod one_weekend {
             time,
         );
         let camera = new_basic_camera(aspect_ratio(&params), time);
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn image19(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -556,7 +1059,7 @@ pub mod one_weekend {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn balls(rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -613,11 +1116,7 @@ pub mod one_weekend {
             10.0,
             time,
         );
-        (
-            params,
-            camera,
-            World::new(Objects::new(balls, time), Background::SKY),
-        )
+        (params, camera, World::new(Objects::new(balls, time), Sky))
     }
 }
 
@@ -625,6 +1124,12 @@ pub mod one_weekend {
 pub mod next_week {
     use super::*;
 
+    const EARTH_PATH: &str = "third_party/earthmap.jpg";
+
+    fn earth() -> Result<Image> {
+        Image::load(EARTH_PATH).with_context(|| format!("Failed to load {}", EARTH_PATH))
+    }
+
     fn random_balls(rng: &mut Rng, checker: bool) -> (RenderParams, Camera, World) {
         let params = RENDER_PARAMS_WIDE;
         let time = TimeRange::new(0.0, 1.0);
@@ -690,11 +1195,7 @@ pub mod next_week {
             10.0,
             time,
         );
-        (
-            params,
-            camera,
-            World::new(Objects::new(balls, time), Background::SKY),
-        )
+        (params, camera, World::new(Objects::new(balls, time), Sky))
     }
 
     pub fn image1(rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -731,7 +1232,7 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
     pub fn image13(rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -760,13 +1261,13 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::SKY))
+        (params, camera, World::new(objects, Sky))
     }
 
-    pub fn image15(_rng: &mut Rng) -> (RenderParams, Camera, World) {
+    pub fn image15(_rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
         let params = RENDER_PARAMS_WIDE;
         let time = TimeRange::ZERO;
-        let image = Image::load("third_party/earthmap.jpg").expect("failed to load image");
+        let image = earth()?;
         let objects = Objects::new(
             vec![SolidObject::new_rc(
                 Sphere::new(v(0.0, 0.0, 0.0), 2.0),
@@ -783,7 +1284,7 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::SKY))
+        Ok((params, camera, World::new(objects, Sky)))
     }
 
     pub fn image16(rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -816,7 +1317,7 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
     }
 
     pub fn image18(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -864,7 +1365,7 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
     }
 
     pub fn image19(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -920,7 +1421,7 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
     }
 
     pub fn image20(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -990,7 +1491,7 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
     }
 
     pub fn image21(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -1062,10 +1563,10 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
     }
 
-    pub fn all_features(rng: &mut Rng) -> (RenderParams, Camera, World) {
+    pub fn all_features(rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
         let params = RENDER_PARAMS_NEXT_WEEK_FINAL;
         let time = TimeRange::new(0.0, 1.0);
 
@@ -1121,7 +1622,7 @@ pub mod next_week {
                 // Earth sphere
                 SolidObject::new_rc(
                     Sphere::new(v(400.0, 200.0, 400.0), 100.0),
-                    Lambertian::new(Image::load("third_party/earthmap.jpg").unwrap()),
+                    Lambertian::new(earth()?),
                 ),
                 // Marble sphere
                 SolidObject::new_rc(
@@ -1185,7 +1686,7 @@ pub mod next_week {
             1.0,
             time,
         );
-        (params, camera, World::new(all, Background::BLACK))
+        Ok((params, camera, World::new(all, Solid::BLACK)))
     }
 }
 
@@ -1264,7 +1765,7 @@ pub mod rest_of_life {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
     }
 
     pub fn image12(_rng: &mut Rng) -> (RenderParams, Camera, World) {
@@ -1276,44 +1777,68 @@ pub mod rest_of_life {
         let light = DiffuseLight::new(c(15.0, 15.0, 15.0));
         let objects = Objects::new(
             vec![
-                SolidObject::new_rc(
-                    Rectangle::new(Axis::X, 555.0, 0.0, 555.0, 0.0, 555.0),
-                    green.clone(),
+                NamedObject::new_rc(
+                    "green_wall",
+                    SolidObject::new(
+                        Rectangle::new(Axis::X, 555.0, 0.0, 555.0, 0.0, 555.0),
+                        green.clone(),
+                    ),
                 ),
-                SolidObject::new_rc(
-                    Rectangle::new(Axis::X, 0.0, 0.0, 555.0, 0.0, 555.0),
-                    red.clone(),
+                NamedObject::new_rc(
+                    "red_wall",
+                    SolidObject::new(
+                        Rectangle::new(Axis::X, 0.0, 0.0, 555.0, 0.0, 555.0),
+                        red.clone(),
+                    ),
                 ),
-                SolidObject::new_rc(
-                    Rectangle::new(Axis::Y, 554.0, 227.0, 332.0, 213.0, 343.0),
-                    light.clone(),
+                NamedObject::new_rc(
+                    "light",
+                    SolidObject::new(
+                        Rectangle::new(Axis::Y, 554.0, 227.0, 332.0, 213.0, 343.0),
+                        light.clone(),
+                    ),
                 ),
-                SolidObject::new_rc(
-                    Rectangle::new(Axis::Y, 0.0, 0.0, 555.0, 0.0, 555.0),
-                    white.clone(),
+                NamedObject::new_rc(
+                    "floor",
+                    SolidObject::new(
+                        Rectangle::new(Axis::Y, 0.0, 0.0, 555.0, 0.0, 555.0),
+                        white.clone(),
+                    ),
                 ),
-                SolidObject::new_rc(
-                    Rectangle::new(Axis::Y, 555.0, 0.0, 555.0, 0.0, 555.0),
-                    white.clone(),
+                NamedObject::new_rc(
+                    "ceiling",
+                    SolidObject::new(
+                        Rectangle::new(Axis::Y, 555.0, 0.0, 555.0, 0.0, 555.0),
+                        white.clone(),
+                    ),
                 ),
-                SolidObject::new_rc(
-                    Rectangle::new(Axis::Z, 555.0, 0.0, 555.0, 0.0, 555.0),
-                    white.clone(),
+                NamedObject::new_rc(
+                    "back_wall",
+                    SolidObject::new(
+                        Rectangle::new(Axis::Z, 555.0, 0.0, 555.0, 0.0, 555.0),
+                        white.clone(),
+                    ),
                 ),
-                SolidObject::new_rc(
-                    Translate::new(
-                        v(265.0, 0.0, 295.0),
-                        Rotate::new(
-                            Axis::Y,
-                            PI / 12.0,
-                            Block::new(Box3::new(v(0.0, 0.0, 0.0), v(165.0, 330.0, 165.0))),
+                NamedObject::new_rc(
+                    "box",
+                    SolidObject::new(
+                        Translate::new(
+                            v(265.0, 0.0, 295.0),
+                            Rotate::new(
+                                Axis::Y,
+                                PI / 12.0,
+                                Block::new(Box3::new(v(0.0, 0.0, 0.0), v(165.0, 330.0, 165.0))),
+                            ),
                         ),
+                        white.clone(),
                     ),
-                    white.clone(),
                 ),
-                SolidObject::new_rc(
-                    Sphere::new(v(190.0, 90.0, 190.0), 90.0),
-                    Dielectric::new(1.5),
+                NamedObject::new_rc(
+                    "sphere",
+                    SolidObject::new(
+                        Sphere::new(v(190.0, 90.0, 190.0), 90.0),
+                        Dielectric::new(1.5),
+                    ),
                 ),
             ],
             time,
@@ -1327,6 +1852,37 @@ pub mod rest_of_life {
             1.0,
             time,
         );
-        (params, camera, World::new(objects, Background::BLACK))
+        (params, camera, World::new(objects, Solid::BLACK))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use rand::SeedableRng;
+
+    #[test]
+    fn test_registry() {
+        let mut registry = SceneRegistry::with_builtins();
+        assert!(registry
+            .list()
+            .any(|(name, description)| name == "book1/final" && !description.is_empty()));
+        registry.register("custom", "A custom scene", |rng| {
+            let (params, camera, world) = one_weekend::image10(rng);
+            Ok((
+                RenderParams {
+                    width: 12,
+                    ..params
+                },
+                camera,
+                world,
+            ))
+        });
+        let descriptions = registry.list().map(|(_, d)| d).collect_vec();
+        assert_eq!(descriptions.iter().unique().count(), descriptions.len());
+        let mut rng = Rng::seed_from_u64(28);
+        let (params, _, _) = registry.load("custom", &mut rng).unwrap();
+        assert_eq!(params.width, 12);
+        assert!(registry.load("no/such/scene", &mut rng).is_err());
     }
 }
@@ -0,0 +1,2342 @@
+// Scenes described in YAML (or JSON, which is a subset of YAML) files.
+//
+// Textures and materials can be defined by name at the top level and referred
+// to from multiple objects. Other files can be included to share definitions;
+// their objects are added to the scene, and their definitions can be
+// overridden by the including file.
+
+use crate::accel::AcceleratorKind;
+use crate::background::{
+    Background, BackgroundVisitor, Daylight, Environment, Gradient, Sky, Solid,
+};
+use crate::camera::Camera;
+use crate::color::Color;
+use crate::environment::EnvironmentMap;
+use crate::geom::{Axis, Box3, IntoVec3, Mat4, Vec3, Vec3Unit};
+use crate::gltf::load_gltf;
+use crate::grid::DensityGrid;
+use crate::heightfield::Heightfield;
+use crate::light::Light;
+use crate::material::{
+    Bump, Coated, Dielectric, DiffuseLight, Fog, Lambertian, Material, MaterialVisitor, Metal, Mix,
+    Pbr, VolumeMaterial, VolumeVisitor,
+};
+use crate::mesh::{vertex_normals, Mesh};
+use crate::obj::load_obj;
+use crate::object::{
+    GridVolumeObject, MeshObject, NamedObject, Object, ObjectPtr, ObjectVisitor, Objects,
+    RotateObject, ScaleObject, SolidObject, TranslateObject, VolumeObject,
+};
+use crate::renderer::RenderParams;
+use crate::rng::Rng;
+use crate::sdf::{Sdf, SdfShape};
+use crate::shape::{
+    Block, Capsule, Cone, Csg, CsgOp, Cylinder, Disk, Ellipsoid, MovingSphere, Plane, Quad,
+    Rectangle, Rotate, Scale, Shape, ShapeVisitor, Sphere, Translate, Triangle,
+};
+use crate::sky::SkyModel;
+use crate::texture::{Checker, Image, Marble, SolidColor, Texture, TextureVisitor};
+use crate::time::TimeRange;
+use crate::world::World;
+use anyhow::{anyhow, bail, Context, Result};
+use serde::de::value::{MapAccessDeserializer, SeqAccessDeserializer};
+use serde::de::{self, MapAccess, SeqAccess};
+use serde::{Deserialize, Deserializer, Serialize};
+use std::collections::{BTreeMap, HashMap};
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+// Each subdivision quadruples faces, which files parsed from untrusted sources
+// must not fill memory with.
+const MAX_PARSED_SUBDIVISIONS: usize = 5;
+
+#[derive(Clone, Debug, Default, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct SceneFile {
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub include: Vec<PathBuf>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub params: Option<ParamsDesc>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub camera: Option<CameraDesc>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub background: Option<BackgroundDesc>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub textures: BTreeMap<String, TextureDesc>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub materials: BTreeMap<String, MaterialDesc>,
+    #[serde(default)]
+    pub objects: Vec<ObjectDesc>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub models: Vec<ModelDesc>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub lights: Vec<LightDesc>,
+}
+
+// Render parameters not specified are taken from RenderParams::DEFAULT.
+#[derive(Clone, Debug, Default, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct ParamsDesc {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub width: Option<u32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub height: Option<u32>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub samples_per_pixel: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub max_depth: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub importance_sampling: Option<bool>,
+    // Acceleration structure of meshes, bvh or kd_tree.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub accelerator: Option<AcceleratorKind>,
+}
+
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct CameraDesc {
+    pub look_from: [f64; 3],
+    pub look_at: [f64; 3],
+    // Vertical field of view in degrees.
+    #[serde(default = "default_vfov")]
+    pub vfov: f64,
+    #[serde(default)]
+    pub aperture: f64,
+    // Defaults to the distance between look_from and look_at.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub focus_dist: Option<f64>,
+    // Shutter open and close times.
+    #[serde(default)]
+    pub time: [f64; 2],
+}
+
+fn default_vfov() -> f64 {
+    40.0
+}
+
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum BackgroundDesc {
+    Sky,
+    Black,
+    Color([f64; 3]),
+    Gradient {
+        bottom: [f64; 3],
+        top: [f64; 3],
+    },
+    Daylight {
+        sun: [f64; 3],
+    },
+    // Preetham analytic sky. Angles are in degrees.
+    Physical {
+        elevation: f64,
+        azimuth: f64,
+        turbidity: f64,
+    },
+    // Equirectangular Radiance HDR image.
+    Environment {
+        path: PathBuf,
+    },
+}
+
+// Lights of no size. Directions point where the light travels. Spot angles
+// are half angles in degrees; the light fades out from inner_angle, which
+// defaults to angle, to angle.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case", deny_unknown_fields)]
+pub enum LightDesc {
+    Point {
+        position: [f64; 3],
+        intensity: [f64; 3],
+    },
+    Directional {
+        direction: [f64; 3],
+        irradiance: [f64; 3],
+    },
+    Spot {
+        position: [f64; 3],
+        direction: [f64; 3],
+        intensity: [f64; 3],
+        angle: f64,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        inner_angle: Option<f64>,
+    },
+}
+
+#[derive(Clone, Copy, Debug, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AxisDesc {
+    X,
+    Y,
+    Z,
+}
+
+// Signed distance functions of sdf shapes.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case", deny_unknown_fields)]
+pub enum SdfDesc {
+    Sphere {
+        center: [f64; 3],
+        radius: f64,
+    },
+    // Edges of the box of the size are rounded by the radius.
+    RoundBox {
+        center: [f64; 3],
+        size: [f64; 3],
+        radius: f64,
+    },
+    // Ring around the y axis.
+    Torus {
+        center: [f64; 3],
+        major_radius: f64,
+        minor_radius: f64,
+    },
+    Mandelbulb {
+        center: [f64; 3],
+        scale: f64,
+        #[serde(default = "default_mandelbulb_power")]
+        power: f64,
+        #[serde(default = "default_mandelbulb_iterations")]
+        iterations: usize,
+    },
+    // Union blended over the distance k.
+    SmoothUnion {
+        a: Box<SdfDesc>,
+        b: Box<SdfDesc>,
+        k: f64,
+    },
+}
+
+fn default_mandelbulb_power() -> f64 {
+    8.0
+}
+
+fn default_mandelbulb_iterations() -> usize {
+    10
+}
+
+#[derive(Clone, Copy, Debug, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum CsgOpDesc {
+    Union,
+    Intersection,
+    Difference,
+}
+
+// A texture is referred by a color, a name or an inline definition.
+#[derive(Clone, Debug, Serialize)]
+#[serde(untagged)]
+pub enum TextureRef {
+    Color([f64; 3]),
+    Name(String),
+    Inline(Box<TextureDesc>),
+}
+
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case", deny_unknown_fields)]
+pub enum TextureDesc {
+    Color {
+        color: [f64; 3],
+    },
+    Checker {
+        even: TextureRef,
+        odd: TextureRef,
+        stride: f64,
+    },
+    Marble {
+        scale: f64,
+    },
+    // The path is relative to the scene file.
+    Image {
+        path: PathBuf,
+    },
+}
+
+// A material is referred by a name or an inline definition.
+#[derive(Clone, Debug, Serialize)]
+#[serde(untagged)]
+pub enum MaterialRef {
+    Name(String),
+    Inline(MaterialDesc),
+}
+
+// References are deserialized by their forms rather than as untagged enums,
+// so that errors in inline definitions, e.g. unknown fields, are reported
+// instead of "data did not match any variant".
+impl<'de> Deserialize<'de> for TextureRef {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        struct Visitor;
+
+        impl<'de> de::Visitor<'de> for Visitor {
+            type Value = TextureRef;
+
+            fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+                f.write_str("a color, a texture name or a texture definition")
+            }
+
+            fn visit_str<E: de::Error>(self, name: &str) -> Result<TextureRef, E> {
+                Ok(TextureRef::Name(name.to_owned()))
+            }
+
+            fn visit_seq<A: SeqAccess<'de>>(self, seq: A) -> Result<TextureRef, A::Error> {
+                Deserialize::deserialize(SeqAccessDeserializer::new(seq)).map(TextureRef::Color)
+            }
+
+            fn visit_map<A: MapAccess<'de>>(self, map: A) -> Result<TextureRef, A::Error> {
+                Deserialize::deserialize(MapAccessDeserializer::new(map)).map(TextureRef::Inline)
+            }
+        }
+
+        deserializer.deserialize_any(Visitor)
+    }
+}
+
+impl<'de> Deserialize<'de> for MaterialRef {
+    fn deserialize<D: Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        struct Visitor;
+
+        impl<'de> de::Visitor<'de> for Visitor {
+            type Value = MaterialRef;
+
+            fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+                f.write_str("a material name or a material definition")
+            }
+
+            fn visit_str<E: de::Error>(self, name: &str) -> Result<MaterialRef, E> {
+                Ok(MaterialRef::Name(name.to_owned()))
+            }
+
+            fn visit_map<A: MapAccess<'de>>(self, map: A) -> Result<MaterialRef, A::Error> {
+                Deserialize::deserialize(MapAccessDeserializer::new(map)).map(MaterialRef::Inline)
+            }
+        }
+
+        deserializer.deserialize_any(Visitor)
+    }
+}
+
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case", deny_unknown_fields)]
+pub enum MaterialDesc {
+    Lambertian {
+        texture: TextureRef,
+    },
+    Metal {
+        texture: TextureRef,
+        fuzz: f64,
+    },
+    // Where dielectrics overlap, the one of the highest priority takes effect.
+    Dielectric {
+        index: f64,
+        #[serde(default, skip_serializing_if = "is_zero")]
+        priority: u32,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        absorption: Option<AbsorptionDesc>,
+    },
+    DiffuseLight {
+        texture: TextureRef,
+    },
+    // Metallic-roughness material. All parameters are in [0, 1]. Anisotropy
+    // makes it rougher along the direction of increasing u.
+    Pbr {
+        texture: TextureRef,
+        roughness: f64,
+        #[serde(default)]
+        metallic: f64,
+        #[serde(default, skip_serializing_if = "is_zero_f64")]
+        anisotropy: f64,
+    },
+    // A smooth clear coat of the refractive index over the front of the base.
+    Coated {
+        base: Box<MaterialRef>,
+        #[serde(default = "default_coat_index")]
+        index: f64,
+    },
+    // Scatters with b in the fraction of the luminance of the mask, which may
+    // be a gray color for a constant weight, and with a otherwise.
+    Mix {
+        a: Box<MaterialRef>,
+        b: Box<MaterialRef>,
+        mask: TextureRef,
+    },
+    // Perturbs normals of the base by the luminance of the height texture
+    // times scale.
+    Bump {
+        base: Box<MaterialRef>,
+        height: TextureRef,
+        scale: f64,
+    },
+}
+
+fn default_coat_index() -> f64 {
+    1.5
+}
+
+fn default_capped() -> bool {
+    true
+}
+
+// Light traveling 1 / density inside a dielectric is tinted by the color.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct AbsorptionDesc {
+    pub color: [f64; 3],
+    pub density: f64,
+}
+
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case", deny_unknown_fields)]
+pub enum ShapeDesc {
+    Sphere {
+        center: [f64; 3],
+        radius: f64,
+    },
+    MovingSphere {
+        center0: [f64; 3],
+        center1: [f64; 3],
+        time: [f64; 2],
+        radius: f64,
+    },
+    // An axis-aligned rectangle at axis = a, spanning [b_min, b_max] and
+    // [c_min, c_max] on the following axes.
+    Rectangle {
+        axis: AxisDesc,
+        a: f64,
+        b_min: f64,
+        b_max: f64,
+        c_min: f64,
+        c_max: f64,
+    },
+    Quad {
+        origin: [f64; 3],
+        u: [f64; 3],
+        v: [f64; 3],
+    },
+    Plane {
+        point: [f64; 3],
+        normal: [f64; 3],
+    },
+    Triangle {
+        p0: [f64; 3],
+        p1: [f64; 3],
+        p2: [f64; 3],
+    },
+    Block {
+        min: [f64; 3],
+        max: [f64; 3],
+    },
+    // Radii are along the axes.
+    Ellipsoid {
+        center: [f64; 3],
+        radii: [f64; 3],
+    },
+    // Between the centers of the bottom and the top.
+    Cylinder {
+        p0: [f64; 3],
+        p1: [f64; 3],
+        radius: f64,
+        #[serde(default = "default_capped")]
+        capped: bool,
+    },
+    Cone {
+        base: [f64; 3],
+        apex: [f64; 3],
+        radius: f64,
+        #[serde(default = "default_capped")]
+        capped: bool,
+    },
+    // A hole of the inner radius makes it an annulus.
+    Disk {
+        center: [f64; 3],
+        normal: [f64; 3],
+        radius: f64,
+        #[serde(default, skip_serializing_if = "is_zero_f64")]
+        inner_radius: f64,
+    },
+    // Points within the radius from the segment.
+    Capsule {
+        p0: [f64; 3],
+        p1: [f64; 3],
+        radius: f64,
+    },
+    Mesh {
+        vertices: Vec<[f64; 3]>,
+        faces: Vec<[usize; 3]>,
+        // Texture coordinates of vertices.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        uvs: Vec<[f64; 2]>,
+        // Normals of vertices interpolated across faces.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        normals: Vec<[f64; 3]>,
+        // Computes normals of vertices from the faces around them instead.
+        #[serde(default, skip_serializing_if = "is_false")]
+        smooth: bool,
+        // Skips faces seen from behind, i.e. with vertices in the clockwise
+        // order, which saves time on closed opaque meshes but breaks
+        // transparent ones.
+        #[serde(default, skip_serializing_if = "is_false")]
+        cull_backfaces: bool,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        displacement: Option<DisplacementDesc>,
+        // Indices of faces to materials of the object.
+        #[serde(default, skip_serializing_if = "Vec::is_empty")]
+        face_materials: Vec<usize>,
+    },
+    // Terrain whose heights are the luminance of the grayscale image,
+    // spanning the box of the size from min. The top of the image is toward
+    // +z.
+    Heightfield {
+        path: PathBuf,
+        min: [f64; 3],
+        size: [f64; 3],
+    },
+    // Mesh loaded from an STL or PLY file. Normals are computed if smooth and
+    // the file lacks them. If cache, the mesh with its BVH is saved next to
+    // the file with the suffix .cache, and reused while the file is unchanged.
+    MeshFile {
+        path: PathBuf,
+        #[serde(default, skip_serializing_if = "is_false")]
+        smooth: bool,
+        #[serde(default, skip_serializing_if = "is_false")]
+        cache: bool,
+        #[serde(default, skip_serializing_if = "is_false")]
+        cull_backfaces: bool,
+    },
+    Translate {
+        offset: [f64; 3],
+        shape: Box<ShapeDesc>,
+    },
+    // Rotates around the axis by degrees.
+    Rotate {
+        axis: AxisDesc,
+        degrees: f64,
+        shape: Box<ShapeDesc>,
+    },
+    // Scales uniformly around the origin.
+    Scale {
+        factor: f64,
+        shape: Box<ShapeDesc>,
+    },
+    // Surface where the signed distance function is zero.
+    Sdf {
+        function: SdfDesc,
+    },
+    // Combines closed shapes as solids. Difference carves b out of a.
+    Csg {
+        op: CsgOpDesc,
+        a: Box<ShapeDesc>,
+        b: Box<ShapeDesc>,
+    },
+}
+
+// An object is a shape with either a surface material or a volume. Meshes may
+// instead have materials selected by their faces.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct ObjectDesc {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub name: Option<String>,
+    pub shape: ShapeDesc,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub material: Option<MaterialRef>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub materials: Vec<MaterialRef>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub volume: Option<VolumeDesc>,
+}
+
+// Objects imported from a glTF 2.0 file, either .gltf or .glb, or a Wavefront
+// OBJ file with its material libraries, scaled and then moved by the offset.
+// Normals are computed for meshes lacking them if smooth.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct ModelDesc {
+    pub path: PathBuf,
+    #[serde(default = "default_model_scale")]
+    pub scale: f64,
+    #[serde(default)]
+    pub offset: [f64; 3],
+    #[serde(default, skip_serializing_if = "is_false")]
+    pub smooth: bool,
+}
+
+fn default_model_scale() -> f64 {
+    1.0
+}
+
+// A medium filling the shape. Its density is constant, or given by a NRRD
+// density grid stretched over the bounding box of the shape and scaled by
+// density.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct VolumeDesc {
+    pub color: [f64; 3],
+    pub density: f64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub grid: Option<PathBuf>,
+}
+
+// Moves mesh vertices along their normals by the luminance of the texture at
+// them times scale, after splitting faces into four the number of times.
+#[derive(Clone, Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct DisplacementDesc {
+    pub texture: TextureRef,
+    pub scale: f64,
+    #[serde(default)]
+    pub subdivisions: usize,
+}
+
+fn is_zero(n: &u32) -> bool {
+    *n == 0
+}
+
+fn is_zero_f64(x: &f64) -> bool {
+    *x == 0.0
+}
+
+fn is_false(b: &bool) -> bool {
+    !*b
+}
+
+pub(crate) fn vec3(v: [f64; 3]) -> Vec3 {
+    Vec3::new(v[0], v[1], v[2])
+}
+
+fn color(c: [f64; 3]) -> Color {
+    Color::new(c[0], c[1], c[2])
+}
+
+fn axis(axis: AxisDesc) -> Axis {
+    match axis {
+        AxisDesc::X => Axis::X,
+        AxisDesc::Y => Axis::Y,
+        AxisDesc::Z => Axis::Z,
+    }
+}
+
+fn vec3_desc(v: Vec3) -> [f64; 3] {
+    [v.x, v.y, v.z]
+}
+
+fn color_desc(c: Color) -> [f64; 3] {
+    [c.r, c.g, c.b]
+}
+
+fn axis_desc(axis: Axis) -> AxisDesc {
+    match axis {
+        Axis::X => AxisDesc::X,
+        Axis::Y => AxisDesc::Y,
+        Axis::Z => AxisDesc::Z,
+    }
+}
+
+fn sdf(desc: &SdfDesc) -> Result<Sdf> {
+    Ok(match desc {
+        SdfDesc::Sphere { center, radius } => Sdf::Sphere {
+            center: vec3(*center),
+            radius: *radius,
+        },
+        SdfDesc::RoundBox {
+            center,
+            size,
+            radius,
+        } => {
+            if !(*radius >= 0.0 && size.iter().all(|s| *s >= 2.0 * radius)) {
+                bail!("Round box radius must be in [0, size / 2]");
+            }
+            Sdf::RoundBox {
+                center: vec3(*center),
+                half_size: vec3(*size) / 2.0,
+                radius: *radius,
+            }
+        }
+        SdfDesc::Torus {
+            center,
+            major_radius,
+            minor_radius,
+        } => Sdf::Torus {
+            center: vec3(*center),
+            major_radius: *major_radius,
+            minor_radius: *minor_radius,
+        },
+        SdfDesc::Mandelbulb {
+            center,
+            scale,
+            power,
+            iterations,
+        } => {
+            if !(*scale > 0.0 && *power > 1.0) {
+                bail!("Mandelbulb needs a positive scale and a power above 1");
+            }
+            Sdf::Mandelbulb {
+                center: vec3(*center),
+                scale: *scale,
+                power: *power,
+                iterations: *iterations,
+            }
+        }
+        SdfDesc::SmoothUnion { a, b, k } => {
+            if !(*k > 0.0) {
+                bail!("Smooth union distance must be positive: {}", k);
+            }
+            Sdf::SmoothUnion {
+                a: Box::new(sdf(a)?),
+                b: Box::new(sdf(b)?),
+                k: *k,
+            }
+        }
+    })
+}
+
+fn sdf_desc(sdf: &Sdf) -> SdfDesc {
+    match sdf {
+        Sdf::Sphere { center, radius } => SdfDesc::Sphere {
+            center: vec3_desc(*center),
+            radius: *radius,
+        },
+        Sdf::RoundBox {
+            center,
+            half_size,
+            radius,
+        } => SdfDesc::RoundBox {
+            center: vec3_desc(*center),
+            size: vec3_desc(*half_size * 2.0),
+            radius: *radius,
+        },
+        Sdf::Torus {
+            center,
+            major_radius,
+            minor_radius,
+        } => SdfDesc::Torus {
+            center: vec3_desc(*center),
+            major_radius: *major_radius,
+            minor_radius: *minor_radius,
+        },
+        Sdf::Mandelbulb {
+            center,
+            scale,
+            power,
+            iterations,
+        } => SdfDesc::Mandelbulb {
+            center: vec3_desc(*center),
+            scale: *scale,
+            power: *power,
+            iterations: *iterations,
+        },
+        Sdf::SmoothUnion { a, b, k } => SdfDesc::SmoothUnion {
+            a: Box::new(sdf_desc(a)),
+            b: Box::new(sdf_desc(b)),
+            k: *k,
+        },
+    }
+}
+
+fn csg_op(op: CsgOpDesc) -> CsgOp {
+    match op {
+        CsgOpDesc::Union => CsgOp::Union,
+        CsgOpDesc::Intersection => CsgOp::Intersection,
+        CsgOpDesc::Difference => CsgOp::Difference,
+    }
+}
+
+fn csg_op_desc(op: CsgOp) -> CsgOpDesc {
+    match op {
+        CsgOp::Union => CsgOpDesc::Union,
+        CsgOp::Intersection => CsgOpDesc::Intersection,
+        CsgOp::Difference => CsgOpDesc::Difference,
+    }
+}
+
+// Describes a texture by a reference, by a color if possible.
+fn texture_ref(texture: &dyn Texture) -> Option<TextureRef> {
+    let mut export = TextureExport(None);
+    texture.describe(&mut export);
+    Some(match export.0? {
+        TextureDesc::Color { color } => TextureRef::Color(color),
+        desc => TextureRef::Inline(Box::new(desc)),
+    })
+}
+
+// Describes the texture visited, and the ones in it.
+struct TextureExport(Option<TextureDesc>);
+
+impl TextureVisitor for TextureExport {
+    fn solid(&mut self, color: Color) {
+        self.0 = Some(TextureDesc::Color {
+            color: color_desc(color),
+        });
+    }
+
+    fn checker(&mut self, even: &dyn Texture, odd: &dyn Texture, stride: f64) {
+        self.0 = (|| {
+            Some(TextureDesc::Checker {
+                even: texture_ref(even)?,
+                odd: texture_ref(odd)?,
+                stride,
+            })
+        })();
+    }
+
+    // The noise is not described; it is generated again when loaded.
+    fn marble(&mut self, scale: f64) {
+        self.0 = Some(TextureDesc::Marble { scale });
+    }
+
+    fn image(&mut self, path: &Path) {
+        self.0 = Some(TextureDesc::Image {
+            path: path.to_owned(),
+        });
+    }
+}
+
+// Describes a material inline, or returns None if it is not supported.
+fn material_ref(material: &dyn Material) -> Option<MaterialRef> {
+    let mut export = MaterialExport(None);
+    material.describe(&mut export);
+    export.0.map(MaterialRef::Inline)
+}
+
+struct MaterialExport(Option<MaterialDesc>);
+
+impl MaterialVisitor for MaterialExport {
+    fn lambertian(&mut self, texture: &dyn Texture) {
+        self.0 = texture_ref(texture).map(|texture| MaterialDesc::Lambertian { texture });
+    }
+
+    fn metal(&mut self, texture: &dyn Texture, fuzz: f64) {
+        self.0 = texture_ref(texture).map(|texture| MaterialDesc::Metal { texture, fuzz });
+    }
+
+    fn pbr(&mut self, texture: &dyn Texture, roughness: f64, metallic: f64, anisotropy: f64) {
+        self.0 = texture_ref(texture).map(|texture| MaterialDesc::Pbr {
+            texture,
+            roughness,
+            metallic,
+            anisotropy,
+        });
+    }
+
+    fn coated(&mut self, base: &dyn Material, index: f64) {
+        self.0 = material_ref(base).map(|base| MaterialDesc::Coated {
+            base: Box::new(base),
+            index,
+        });
+    }
+
+    fn mix(&mut self, a: &dyn Material, b: &dyn Material, mask: &dyn Texture) {
+        self.0 = (|| {
+            Some(MaterialDesc::Mix {
+                a: Box::new(material_ref(a)?),
+                b: Box::new(material_ref(b)?),
+                mask: texture_ref(mask)?,
+            })
+        })();
+    }
+
+    fn bump(&mut self, base: &dyn Material, height: &dyn Texture, scale: f64) {
+        self.0 = (|| {
+            Some(MaterialDesc::Bump {
+                base: Box::new(material_ref(base)?),
+                height: texture_ref(height)?,
+                scale,
+            })
+        })();
+    }
+
+    fn dielectric(&mut self, index: f64, priority: u32, absorption: Option<(Color, f64)>) {
+        self.0 = Some(MaterialDesc::Dielectric {
+            index,
+            priority,
+            absorption: absorption.map(|(color, density)| AbsorptionDesc {
+                color: color_desc(color),
+                density,
+            }),
+        });
+    }
+
+    fn diffuse_light(&mut self, texture: &dyn Texture) {
+        self.0 = texture_ref(texture).map(|texture| MaterialDesc::DiffuseLight { texture });
+    }
+}
+
+// Describes a volume of the density, or returns None if it is not supported.
+fn volume_desc(volume: &dyn VolumeMaterial, density: f64) -> Option<VolumeDesc> {
+    let mut export = VolumeExport(None);
+    volume.describe(&mut export);
+    export.0.map(|color| VolumeDesc {
+        color: color_desc(color),
+        density,
+        grid: None,
+    })
+}
+
+// Takes the color of the volume visited.
+struct VolumeExport(Option<Color>);
+
+impl VolumeVisitor for VolumeExport {
+    fn fog(&mut self, color: Color) {
+        self.0 = Some(color);
+    }
+}
+
+// Describes a shape, or returns None if it is not supported.
+fn shape_desc(shape: &dyn Shape) -> Option<ShapeDesc> {
+    let mut export = ShapeExport(None);
+    shape.describe(&mut export);
+    export.0
+}
+
+struct ShapeExport(Option<ShapeDesc>);
+
+impl ShapeVisitor for ShapeExport {
+    fn sphere(&mut self, center: Vec3, radius: f64) {
+        self.0 = Some(ShapeDesc::Sphere {
+            center: vec3_desc(center),
+            radius,
+        });
+    }
+
+    fn ellipsoid(&mut self, center: Vec3, radii: Vec3) {
+        self.0 = Some(ShapeDesc::Ellipsoid {
+            center: vec3_desc(center),
+            radii: vec3_desc(radii),
+        });
+    }
+
+    fn moving_sphere(&mut self, center0: Vec3, center1: Vec3, time: TimeRange, radius: f64) {
+        self.0 = Some(ShapeDesc::MovingSphere {
+            center0: vec3_desc(center0),
+            center1: vec3_desc(center1),
+            time: [time.lo, time.hi],
+            radius,
+        });
+    }
+
+    fn rectangle(&mut self, axis: Axis, a: f64, b_min: f64, b_max: f64, c_min: f64, c_max: f64) {
+        self.0 = Some(ShapeDesc::Rectangle {
+            axis: axis_desc(axis),
+            a,
+            b_min,
+            b_max,
+            c_min,
+            c_max,
+        });
+    }
+
+    fn quad(&mut self, origin: Vec3, u: Vec3, v: Vec3) {
+        self.0 = Some(ShapeDesc::Quad {
+            origin: vec3_desc(origin),
+            u: vec3_desc(u),
+            v: vec3_desc(v),
+        });
+    }
+
+    fn plane(&mut self, point: Vec3, normal: Vec3Unit) {
+        self.0 = Some(ShapeDesc::Plane {
+            point: vec3_desc(point),
+            normal: vec3_desc(normal.into_vec3()),
+        });
+    }
+
+    fn triangle(&mut self, p0: Vec3, p1: Vec3, p2: Vec3) {
+        self.0 = Some(ShapeDesc::Triangle {
+            p0: vec3_desc(p0),
+            p1: vec3_desc(p1),
+            p2: vec3_desc(p2),
+        });
+    }
+
+    fn cylinder(&mut self, p0: Vec3, p1: Vec3, radius: f64, capped: bool) {
+        self.0 = Some(ShapeDesc::Cylinder {
+            p0: vec3_desc(p0),
+            p1: vec3_desc(p1),
+            radius,
+            capped,
+        });
+    }
+
+    fn cone(&mut self, base: Vec3, apex: Vec3, radius: f64, capped: bool) {
+        self.0 = Some(ShapeDesc::Cone {
+            base: vec3_desc(base),
+            apex: vec3_desc(apex),
+            radius,
+            capped,
+        });
+    }
+
+    fn capsule(&mut self, p0: Vec3, p1: Vec3, radius: f64) {
+        self.0 = Some(ShapeDesc::Capsule {
+            p0: vec3_desc(p0),
+            p1: vec3_desc(p1),
+            radius,
+        });
+    }
+
+    fn disk(&mut self, center: Vec3, normal: Vec3Unit, radius: f64, inner_radius: f64) {
+        self.0 = Some(ShapeDesc::Disk {
+            center: vec3_desc(center),
+            normal: vec3_desc(normal.into_vec3()),
+            radius,
+            inner_radius,
+        });
+    }
+
+    fn block(&mut self, min: Vec3, max: Vec3) {
+        self.0 = Some(ShapeDesc::Block {
+            min: vec3_desc(min),
+            max: vec3_desc(max),
+        });
+    }
+
+    fn translate(&mut self, offset: Vec3, shape: &dyn Shape) {
+        self.0 = shape_desc(shape).map(|shape| ShapeDesc::Translate {
+            offset: vec3_desc(offset),
+            shape: Box::new(shape),
+        });
+    }
+
+    fn rotate(&mut self, axis: Axis, theta: f64, shape: &dyn Shape) {
+        self.0 = shape_desc(shape).map(|shape| ShapeDesc::Rotate {
+            axis: axis_desc(axis),
+            degrees: theta.to_degrees(),
+            shape: Box::new(shape),
+        });
+    }
+
+    fn scale(&mut self, factor: f64, shape: &dyn Shape) {
+        self.0 = shape_desc(shape).map(|shape| ShapeDesc::Scale {
+            factor,
+            shape: Box::new(shape),
+        });
+    }
+
+    fn csg(&mut self, op: CsgOp, a: &dyn Shape, b: &dyn Shape) {
+        self.0 = (|| {
+            Some(ShapeDesc::Csg {
+                op: csg_op_desc(op),
+                a: Box::new(shape_desc(a)?),
+                b: Box::new(shape_desc(b)?),
+            })
+        })();
+    }
+
+    fn mesh(
+        &mut self,
+        vertices: &[Vec3],
+        faces: &[[usize; 3]],
+        uvs: &[[f64; 2]],
+        normals: &[Vec3],
+        cull_backfaces: bool,
+    ) {
+        self.0 = Some(ShapeDesc::Mesh {
+            vertices: vertices.iter().map(|v| vec3_desc(*v)).collect(),
+            faces: faces.to_vec(),
+            uvs: uvs.to_vec(),
+            normals: normals.iter().map(|n| vec3_desc(*n)).collect(),
+            smooth: false,
+            cull_backfaces,
+            displacement: None,
+            face_materials: Vec::new(),
+        });
+    }
+
+    fn mesh_file(&mut self, path: &Path, smooth: bool, cache: bool, cull_backfaces: bool) {
+        self.0 = Some(ShapeDesc::MeshFile {
+            path: path.to_owned(),
+            smooth,
+            cache,
+            cull_backfaces,
+        });
+    }
+
+    fn sdf(&mut self, sdf: &Sdf) {
+        self.0 = Some(ShapeDesc::Sdf {
+            function: sdf_desc(sdf),
+        });
+    }
+
+    fn heightfield(&mut self, path: &Path, min: Vec3, size: Vec3) {
+        self.0 = Some(ShapeDesc::Heightfield {
+            path: path.to_owned(),
+            min: vec3_desc(min),
+            size: vec3_desc(size),
+        });
+    }
+}
+
+// Appends descriptions of the objects visited. Every object has its own
+// inline materials.
+struct ObjectExport(Vec<ObjectDesc>);
+
+impl ObjectExport {
+    // Describes the object, and applies f to the shapes of the descriptions.
+    fn wrap(&mut self, object: &dyn Object, f: impl Fn(ShapeDesc) -> ShapeDesc) -> Result<()> {
+        let start = self.0.len();
+        object.describe(self)?;
+        for object in self.0[start..].iter_mut() {
+            object.shape = f(object.shape.clone());
+        }
+        Ok(())
+    }
+
+    fn shape(shape: &dyn Shape) -> Result<ShapeDesc> {
+        shape_desc(shape).ok_or_else(|| anyhow!("Shape cannot be described: {:?}", shape))
+    }
+
+    fn material(material: &dyn Material) -> Result<MaterialRef> {
+        material_ref(material).ok_or_else(|| anyhow!("Material cannot be described"))
+    }
+
+    fn volume(volume: &dyn VolumeMaterial, density: f64) -> Result<VolumeDesc> {
+        volume_desc(volume, density).ok_or_else(|| anyhow!("Volume cannot be described"))
+    }
+}
+
+impl ObjectVisitor for ObjectExport {
+    fn translate(&mut self, offset: Vec3, object: &dyn Object) -> Result<()> {
+        self.wrap(object, |shape| ShapeDesc::Translate {
+            offset: vec3_desc(offset),
+            shape: Box::new(shape),
+        })
+    }
+
+    fn rotate(&mut self, axis: Axis, theta: f64, object: &dyn Object) -> Result<()> {
+        self.wrap(object, |shape| ShapeDesc::Rotate {
+            axis: axis_desc(axis),
+            degrees: theta.to_degrees(),
+            shape: Box::new(shape),
+        })
+    }
+
+    fn scale(&mut self, factor: f64, object: &dyn Object) -> Result<()> {
+        self.wrap(object, |shape| ShapeDesc::Scale {
+            factor,
+            shape: Box::new(shape),
+        })
+    }
+
+    fn named(&mut self, name: &str, object: &dyn Object) -> Result<()> {
+        let start = self.0.len();
+        object.describe(self)?;
+        for object in self.0[start..].iter_mut() {
+            object.name.get_or_insert_with(|| name.to_owned());
+        }
+        Ok(())
+    }
+
+    fn solid(&mut self, shape: &dyn Shape, material: &dyn Material) -> Result<()> {
+        self.0.push(ObjectDesc {
+            name: None,
+            shape: Self::shape(shape)?,
+            material: Some(Self::material(material)?),
+            materials: Vec::new(),
+            volume: None,
+        });
+        Ok(())
+    }
+
+    fn mesh(
+        &mut self,
+        mesh: &Mesh,
+        face_materials: &[usize],
+        materials: &[Arc<dyn Material>],
+    ) -> Result<()> {
+        let mut shape = Self::shape(mesh)?;
+        match &mut shape {
+            ShapeDesc::Mesh {
+                face_materials: faces,
+                ..
+            } => *faces = face_materials.to_vec(),
+            shape => bail!("Shape cannot have face materials: {:?}", shape),
+        }
+        let materials = materials
+            .iter()
+            .map(|material| Self::material(material.as_ref()))
+            .collect::<Result<_>>()?;
+        self.0.push(ObjectDesc {
+            name: None,
+            shape,
+            material: None,
+            materials,
+            volume: None,
+        });
+        Ok(())
+    }
+
+    fn volume(
+        &mut self,
+        boundary: &dyn Shape,
+        volume: &dyn VolumeMaterial,
+        density: f64,
+    ) -> Result<()> {
+        self.0.push(ObjectDesc {
+            name: None,
+            shape: Self::shape(boundary)?,
+            material: None,
+            materials: Vec::new(),
+            volume: Some(Self::volume(volume, density)?),
+        });
+        Ok(())
+    }
+
+    fn grid_volume(
+        &mut self,
+        boundary: &dyn Shape,
+        grid: &DensityGrid,
+        volume: &dyn VolumeMaterial,
+        density: f64,
+    ) -> Result<()> {
+        let path = grid
+            .path()
+            .ok_or_else(|| anyhow!("Density grid not loaded from a file cannot be described"))?;
+        self.0.push(ObjectDesc {
+            name: None,
+            shape: Self::shape(boundary)?,
+            material: None,
+            materials: Vec::new(),
+            volume: Some(VolumeDesc {
+                grid: Some(path.to_owned()),
+                ..Self::volume(volume, density)?
+            }),
+        });
+        Ok(())
+    }
+
+    fn group(&mut self, objects: &[ObjectPtr]) -> Result<()> {
+        for object in objects {
+            object.describe(self)?;
+        }
+        Ok(())
+    }
+}
+
+// Describes a background, or fails if it is not supported.
+fn background_desc(background: &dyn Background) -> Result<BackgroundDesc> {
+    let mut export = BackgroundExport(None);
+    background.describe(&mut export);
+    export
+        .0
+        .ok_or_else(|| anyhow!("Background cannot be described"))
+}
+
+struct BackgroundExport(Option<BackgroundDesc>);
+
+impl BackgroundVisitor for BackgroundExport {
+    fn sky(&mut self) {
+        self.0 = Some(BackgroundDesc::Sky);
+    }
+
+    fn solid(&mut self, color: Color) {
+        self.0 = Some(BackgroundDesc::Color(color_desc(color)));
+    }
+
+    fn gradient(&mut self, bottom: Color, top: Color) {
+        self.0 = Some(BackgroundDesc::Gradient {
+            bottom: color_desc(bottom),
+            top: color_desc(top),
+        });
+    }
+
+    fn daylight(&mut self, sun: Vec3Unit) {
+        self.0 = Some(BackgroundDesc::Daylight {
+            sun: vec3_desc(sun.into_vec3()),
+        });
+    }
+
+    fn physical(&mut self, sky: &SkyModel) {
+        self.0 = Some(BackgroundDesc::Physical {
+            elevation: sky.elevation(),
+            azimuth: sky.azimuth(),
+            turbidity: sky.turbidity(),
+        });
+    }
+
+    fn environment(&mut self, map: &EnvironmentMap) {
+        self.0 = Some(BackgroundDesc::Environment {
+            path: map.path().to_owned(),
+        });
+    }
+}
+
+// Inverts Camera::new(). The aspect ratio is not included as it is determined
+// by the image size.
+impl From<&Camera> for CameraDesc {
+    fn from(camera: &Camera) -> Self {
+        let center = camera.lower_left_corner + camera.horizontal / 2.0 + camera.vertical / 2.0;
+        let focus_dist = (center - camera.origin).abs();
+        let viewport_height = camera.vertical.abs() / focus_dist;
+        let fov = 2.0 * (viewport_height / 2.0).tan();
+        CameraDesc {
+            look_from: vec3_desc(camera.origin),
+            look_at: vec3_desc(center),
+            vfov: fov.to_degrees(),
+            aperture: camera.lens_radius * 2.0,
+            focus_dist: Some(focus_dist),
+            time: [camera.time.lo, camera.time.hi],
+        }
+    }
+}
+
+impl SceneFile {
+    // Reads a scene file and the files it includes.
+    pub fn read(path: &Path) -> Result<SceneFile> {
+        Self::read_nested(path, None, &mut Vec::new())
+    }
+
+    // Reads a scene file whose paths must be within root if any.
+    fn read_nested(
+        path: &Path,
+        root: Option<&Path>,
+        stack: &mut Vec<PathBuf>,
+    ) -> Result<SceneFile> {
+        let canonical = path
+            .canonicalize()
+            .with_context(|| format!("Failed to open {}", path.display()))?;
+        if stack.contains(&canonical) {
+            bail!("Circular include of {}", path.display());
+        }
+        let text = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        let file = SceneFile::from_yaml(&text)
+            .with_context(|| format!("Failed to parse {}", path.display()))?;
+        let dir = path.parent().unwrap_or_else(|| Path::new(""));
+
+        stack.push(canonical);
+        let merged = Self::include_nested(file, dir, root, stack)?;
+        stack.pop();
+        Ok(merged)
+    }
+
+    // Parses a scene file from an untrusted source, e.g. one uploaded, as if
+    // it were in dir, and reads the files it includes. It reads no files out
+    // of dir and writes none, i.e. mesh caches, and its meshes are subdivided
+    // at most MAX_PARSED_SUBDIVISIONS times.
+    pub fn parse(text: &str, dir: &Path) -> Result<SceneFile> {
+        let root = dir
+            .canonicalize()
+            .with_context(|| format!("Failed to open {}", dir.display()))?;
+        let mut file = Self::include_nested(
+            SceneFile::from_yaml(text)?,
+            &root,
+            Some(&root),
+            &mut Vec::new(),
+        )?;
+        let mut subdivisions = 0;
+        file.visit_shapes(&mut |shape| match shape {
+            ShapeDesc::MeshFile { cache, .. } => *cache = false,
+            ShapeDesc::Mesh {
+                displacement: Some(displacement),
+                ..
+            } => subdivisions = subdivisions.max(displacement.subdivisions),
+            _ => {}
+        });
+        if subdivisions > MAX_PARSED_SUBDIVISIONS {
+            bail!(
+                "Meshes are subdivided at most {} times: {}",
+                MAX_PARSED_SUBDIVISIONS,
+                subdivisions
+            );
+        }
+        Ok(file)
+    }
+
+    fn include_nested(
+        mut file: SceneFile,
+        dir: &Path,
+        root: Option<&Path>,
+        stack: &mut Vec<PathBuf>,
+    ) -> Result<SceneFile> {
+        file.visit_paths(&mut |path| *path = dir.join(&*path));
+        if let Some(root) = root {
+            file.confine_paths(root)?;
+        }
+        let mut merged = SceneFile::default();
+        for include in file.include.drain(..) {
+            let included = Self::read_nested(&include, root, stack)?;
+            merged.merge(included);
+        }
+        merged.merge(file);
+        Ok(merged)
+    }
+
+    // Makes paths in the file canonical, failing if any is missing or out of
+    // root, which is canonical too, e.g. by .. or symbolic links.
+    fn confine_paths(&mut self, root: &Path) -> Result<()> {
+        let mut outside = None;
+        self.visit_paths(&mut |path| match path.canonicalize() {
+            Ok(canonical) if canonical.starts_with(root) => *path = canonical,
+            _ => {
+                outside.get_or_insert_with(|| path.clone());
+            }
+        });
+        match outside {
+            Some(path) => bail!("{} is missing or out of {}", path.display(), root.display()),
+            None => Ok(()),
+        }
+    }
+
+    // Calls f with every shape of objects, including the ones in others.
+    fn visit_shapes(&mut self, f: &mut dyn FnMut(&mut ShapeDesc)) {
+        fn visit(shape: &mut ShapeDesc, f: &mut dyn FnMut(&mut ShapeDesc)) {
+            f(shape);
+            match shape {
+                ShapeDesc::Translate { shape, .. }
+                | ShapeDesc::Rotate { shape, .. }
+                | ShapeDesc::Scale { shape, .. } => visit(shape, f),
+                ShapeDesc::Csg { a, b, .. } => {
+                    visit(a, f);
+                    visit(b, f);
+                }
+                _ => {}
+            }
+        }
+        for object in self.objects.iter_mut() {
+            visit(&mut object.shape, f);
+        }
+    }
+
+    // Overrides definitions with the ones in other and appends its objects.
+    fn merge(&mut self, other: SceneFile) {
+        self.params = other.params.or_else(|| self.params.take());
+        self.camera = other.camera.or_else(|| self.camera.take());
+        self.background = other.background.or_else(|| self.background.take());
+        self.textures.extend(other.textures);
+        self.materials.extend(other.materials);
+        self.objects.extend(other.objects);
+        self.models.extend(other.models);
+        self.lights.extend(other.lights);
+    }
+
+    // Calls f with every path in the file, i.e. of included files, images,
+    // meshes and volume grids.
+    fn visit_paths(&mut self, f: &mut dyn FnMut(&mut PathBuf)) {
+        fn texture_ref(texture: &mut TextureRef, f: &mut dyn FnMut(&mut PathBuf)) {
+            if let TextureRef::Inline(texture) = texture {
+                texture_desc(texture, f);
+            }
+        }
+        fn texture_desc(texture: &mut TextureDesc, f: &mut dyn FnMut(&mut PathBuf)) {
+            match texture {
+                TextureDesc::Checker { even, odd, .. } => {
+                    texture_ref(even, f);
+                    texture_ref(odd, f);
+                }
+                TextureDesc::Image { path } => f(path),
+                TextureDesc::Color { .. } | TextureDesc::Marble { .. } => {}
+            }
+        }
+        fn shape_desc(shape: &mut ShapeDesc, f: &mut dyn FnMut(&mut PathBuf)) {
+            match shape {
+                ShapeDesc::Mesh {
+                    displacement: Some(displacement),
+                    ..
+                } => texture_ref(&mut displacement.texture, f),
+                ShapeDesc::MeshFile { path, .. } | ShapeDesc::Heightfield { path, .. } => f(path),
+                ShapeDesc::Translate { shape, .. }
+                | ShapeDesc::Rotate { shape, .. }
+                | ShapeDesc::Scale { shape, .. } => shape_desc(shape, f),
+                ShapeDesc::Csg { a, b, .. } => {
+                    shape_desc(a, f);
+                    shape_desc(b, f);
+                }
+                _ => {}
+            }
+        }
+        fn material_ref(material: &mut MaterialRef, f: &mut dyn FnMut(&mut PathBuf)) {
+            if let MaterialRef::Inline(material) = material {
+                material_desc(material, f);
+            }
+        }
+        fn material_desc(material: &mut MaterialDesc, f: &mut dyn FnMut(&mut PathBuf)) {
+            match material {
+                MaterialDesc::Lambertian { texture }
+                | MaterialDesc::Metal { texture, .. }
+                | MaterialDesc::DiffuseLight { texture }
+                | MaterialDesc::Pbr { texture, .. } => texture_ref(texture, f),
+                MaterialDesc::Coated { base, .. } => material_ref(base, f),
+                MaterialDesc::Mix { a, b, mask } => {
+                    material_ref(a, f);
+                    material_ref(b, f);
+                    texture_ref(mask, f);
+                }
+                MaterialDesc::Bump { base, height, .. } => {
+                    material_ref(base, f);
+                    texture_ref(height, f);
+                }
+                MaterialDesc::Dielectric { .. } => {}
+            }
+        }
+
+        for include in self.include.iter_mut() {
+            f(include);
+        }
+        for model in self.models.iter_mut() {
+            f(&mut model.path);
+        }
+        if let Some(BackgroundDesc::Environment { path }) = &mut self.background {
+            f(path);
+        }
+        for texture in self.textures.values_mut() {
+            texture_desc(texture, f);
+        }
+        for material in self.materials.values_mut() {
+            material_desc(material, f);
+        }
+        for object in self.objects.iter_mut() {
+            shape_desc(&mut object.shape, f);
+            for material in object
+                .material
+                .iter_mut()
+                .chain(object.materials.iter_mut())
+            {
+                material_ref(material, f);
+            }
+            if let Some(VolumeDesc {
+                grid: Some(grid), ..
+            }) = &mut object.volume
+            {
+                f(grid);
+            }
+        }
+    }
+
+    pub fn load(&self, rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
+        let mut params = RenderParams::DEFAULT;
+        if let Some(desc) = &self.params {
+            params.width = desc.width.unwrap_or(params.width);
+            params.height = desc.height.unwrap_or(params.height);
+            params.samples_per_pixel = desc.samples_per_pixel.unwrap_or(params.samples_per_pixel);
+            params.max_depth = desc.max_depth.unwrap_or(params.max_depth);
+            params.importance_sampling = desc
+                .importance_sampling
+                .unwrap_or(params.importance_sampling);
+        }
+
+        let desc = match &self.camera {
+            Some(desc) => desc,
+            None => bail!("Camera is not specified"),
+        };
+        let time = TimeRange::new(desc.time[0], desc.time[1]);
+        let camera = Camera::from_desc(desc, params.width as f64 / params.height as f64);
+
+        let accelerator = self
+            .params
+            .as_ref()
+            .and_then(|desc| desc.accelerator)
+            .unwrap_or_default();
+        let mut builder = Builder {
+            file: self,
+            rng,
+            accelerator,
+            textures: HashMap::new(),
+            materials: HashMap::new(),
+            grids: HashMap::new(),
+        };
+        let mut objects = self
+            .objects
+            .iter()
+            .map(|object| builder.object(object))
+            .collect::<Result<Vec<_>>>()?;
+        for model in self.models.iter() {
+            if !(model.scale > 0.0) {
+                bail!("Model scale must be positive: {}", model.scale);
+            }
+            let transform = Mat4::translation(vec3(model.offset))
+                * Mat4::scaling(Vec3::new(model.scale, model.scale, model.scale));
+            let is_obj = model
+                .path
+                .extension()
+                .map_or(false, |ext| ext.eq_ignore_ascii_case("obj"));
+            let loaded = if is_obj {
+                load_obj(&model.path, transform, model.smooth, accelerator)
+            } else {
+                load_gltf(&model.path, transform, model.smooth, accelerator)
+            };
+            objects.extend(
+                loaded.with_context(|| format!("Failed to load {}", model.path.display()))?,
+            );
+        }
+
+        let background: Arc<dyn Background> =
+            match self.background.clone().unwrap_or(BackgroundDesc::Black) {
+                BackgroundDesc::Sky => Arc::new(Sky),
+                BackgroundDesc::Black => Arc::new(Solid::BLACK),
+                BackgroundDesc::Color(c) => Arc::new(Solid(color(c))),
+                BackgroundDesc::Gradient { bottom, top } => Arc::new(Gradient {
+                    bottom: color(bottom),
+                    top: color(top),
+                }),
+                BackgroundDesc::Daylight { sun } => {
+                    let sun = vec3(sun);
+                    if !(sun.norm() > 0.0) {
+                        bail!("Invalid sun direction: {:?}", sun);
+                    }
+                    Arc::new(Daylight { sun: sun.unit() })
+                }
+                BackgroundDesc::Physical {
+                    elevation,
+                    azimuth,
+                    turbidity,
+                } => Arc::new(SkyModel::new(elevation, azimuth, turbidity)?),
+                BackgroundDesc::Environment { path } => Arc::new(Environment(Arc::new(
+                    EnvironmentMap::load(&path)
+                        .with_context(|| format!("Failed to load {}", path.display()))?,
+                ))),
+            };
+        let lights = self.lights.iter().map(light).collect::<Result<Vec<_>>>()?;
+        let world = World::new(Objects::new(objects, time), background).with_lights(lights);
+        Ok((params, camera, world))
+    }
+
+    // Describes a loaded scene. Fails if the scene has objects not supported
+    // by scene files, e.g. portals. Named textures and materials are not
+    // recovered; every object has its own inline definitions.
+    pub fn from_scene(params: &RenderParams, camera: &Camera, world: &World) -> Result<SceneFile> {
+        let mut export = ObjectExport(Vec::new());
+        world
+            .object
+            .describe(&mut export)
+            .context("Failed to describe the scene")?;
+        Ok(SceneFile {
+            params: Some(ParamsDesc {
+                width: Some(params.width),
+                height: Some(params.height),
+                samples_per_pixel: Some(params.samples_per_pixel),
+                max_depth: Some(params.max_depth),
+                importance_sampling: Some(params.importance_sampling),
+                accelerator: None,
+            }),
+            camera: Some(camera.into()),
+            background: Some(background_desc(world.background.as_ref())?),
+            objects: export.0,
+            lights: world.lights.iter().map(light_desc).collect(),
+            ..SceneFile::default()
+        })
+    }
+
+    // Parses a scene file without reading the files it includes. Paths in it
+    // are left as they are.
+    pub fn from_yaml(text: &str) -> Result<SceneFile> {
+        Ok(serde_yaml::from_str(text)?)
+    }
+
+    pub fn to_yaml(&self) -> Result<String> {
+        Ok(serde_yaml::to_string(self)?)
+    }
+}
+
+// Builds objects, sharing named textures and materials among them.
+struct Builder<'a> {
+    file: &'a SceneFile,
+    rng: &'a mut Rng,
+    accelerator: AcceleratorKind,
+    textures: HashMap<String, Option<Arc<dyn Texture>>>,
+    materials: HashMap<String, Option<Arc<dyn Material>>>,
+    // Grids loaded so far, shared by objects referring to the same file.
+    grids: HashMap<PathBuf, Arc<DensityGrid>>,
+}
+
+impl Builder<'_> {
+    fn texture_ref(&mut self, texture: &TextureRef) -> Result<Arc<dyn Texture>> {
+        match texture {
+            TextureRef::Color(c) => Ok(Arc::new(SolidColor::new(color(*c)))),
+            TextureRef::Inline(desc) => self.texture(desc),
+            TextureRef::Name(name) => {
+                match self.textures.get(name) {
+                    Some(Some(texture)) => return Ok(texture.clone()),
+                    Some(None) => bail!("Texture {} refers to itself", name),
+                    None => {}
+                }
+                let file = self.file;
+                let desc = match file.textures.get(name) {
+                    Some(desc) => desc,
+                    None => bail!("Unknown texture: {}", name),
+                };
+                // Mark in progress to detect cycles.
+                self.textures.insert(name.clone(), None);
+                let texture = self.texture(desc)?;
+                self.textures.insert(name.clone(), Some(texture.clone()));
+                Ok(texture)
+            }
+        }
+    }
+
+    fn texture(&mut self, desc: &TextureDesc) -> Result<Arc<dyn Texture>> {
+        Ok(match desc {
+            TextureDesc::Color { color: c } => Arc::new(SolidColor::new(color(*c))),
+            TextureDesc::Checker { even, odd, stride } => Arc::new(Checker::new(
+                self.texture_ref(even)?,
+                self.texture_ref(odd)?,
+                *stride,
+            )),
+            TextureDesc::Marble { scale } => Arc::new(Marble::new(*scale, self.rng)),
+            TextureDesc::Image { path } => Arc::new(
+                Image::load(path).with_context(|| format!("Failed to load {}", path.display()))?,
+            ),
+        })
+    }
+
+    fn material_ref(&mut self, material: &MaterialRef) -> Result<Arc<dyn Material>> {
+        match material {
+            MaterialRef::Inline(desc) => self.material(desc),
+            MaterialRef::Name(name) => {
+                match self.materials.get(name) {
+                    Some(Some(material)) => return Ok(material.clone()),
+                    Some(None) => bail!("Material {} refers to itself", name),
+                    None => {}
+                }
+                let file = self.file;
+                let desc = match file.materials.get(name) {
+                    Some(desc) => desc,
+                    None => bail!("Unknown material: {}", name),
+                };
+                // Mark in progress to detect cycles.
+                self.materials.insert(name.clone(), None);
+                let material = self.material(desc)?;
+                self.materials.insert(name.clone(), Some(material.clone()));
+                Ok(material)
+            }
+        }
+    }
+
+    fn material(&mut self, desc: &MaterialDesc) -> Result<Arc<dyn Material>> {
+        Ok(match desc {
+            MaterialDesc::Lambertian { texture } => {
+                Arc::new(Lambertian::new(self.texture_ref(texture)?))
+            }
+            MaterialDesc::Metal { texture, fuzz } => {
+                Arc::new(Metal::new(self.texture_ref(texture)?, *fuzz))
+            }
+            MaterialDesc::Dielectric {
+                index,
+                priority,
+                absorption,
+            } => {
+                let dielectric = Dielectric::new(*index).with_priority(*priority);
+                Arc::new(match absorption {
+                    None => dielectric,
+                    Some(AbsorptionDesc { color: c, density }) => {
+                        if !(*density >= 0.0) {
+                            bail!("Absorption density must not be negative: {}", density);
+                        }
+                        dielectric.with_absorption(color(*c), *density)
+                    }
+                })
+            }
+            MaterialDesc::DiffuseLight { texture } => {
+                Arc::new(DiffuseLight::new(self.texture_ref(texture)?))
+            }
+            MaterialDesc::Pbr {
+                texture,
+                roughness,
+                metallic,
+                anisotropy,
+            } => {
+                if ![roughness, metallic, anisotropy]
+                    .iter()
+                    .all(|x| (0.0..=1.0).contains(*x))
+                {
+                    bail!("Roughness, metallic and anisotropy must be in [0, 1]");
+                }
+                Arc::new(
+                    Pbr::new(self.texture_ref(texture)?, *roughness, *metallic)
+                        .with_anisotropy(*anisotropy),
+                )
+            }
+            MaterialDesc::Coated { base, index } => {
+                Arc::new(Coated::new(self.material_ref(base)?, *index))
+            }
+            MaterialDesc::Mix { a, b, mask } => Arc::new(Mix::new(
+                self.material_ref(a)?,
+                self.material_ref(b)?,
+                self.texture_ref(mask)?,
+            )),
+            MaterialDesc::Bump {
+                base,
+                height,
+                scale,
+            } => Arc::new(Bump::new(
+                self.material_ref(base)?,
+                self.texture_ref(height)?,
+                *scale,
+            )),
+        })
+    }
+
+    fn grid(&mut self, path: &Path) -> Result<Arc<DensityGrid>> {
+        if let Some(grid) = self.grids.get(path) {
+            return Ok(grid.clone());
+        }
+        let grid = Arc::new(
+            DensityGrid::load(path)
+                .with_context(|| format!("Failed to load {}", path.display()))?,
+        );
+        self.grids.insert(path.to_owned(), grid.clone());
+        Ok(grid)
+    }
+
+    fn shape(&mut self, desc: &ShapeDesc) -> Result<Arc<dyn Shape>> {
+        Ok(match desc {
+            ShapeDesc::Sphere { center, radius } => Arc::new(Sphere::new(vec3(*center), *radius)),
+            ShapeDesc::MovingSphere {
+                center0,
+                center1,
+                time,
+                radius,
+            } => Arc::new(MovingSphere::new(
+                vec3(*center0),
+                vec3(*center1),
+                TimeRange::new(time[0], time[1]),
+                *radius,
+            )),
+            ShapeDesc::Rectangle {
+                axis: a_axis,
+                a,
+                b_min,
+                b_max,
+                c_min,
+                c_max,
+            } => Arc::new(Rectangle::new(
+                axis(*a_axis),
+                *a,
+                *b_min,
+                *b_max,
+                *c_min,
+                *c_max,
+            )),
+            ShapeDesc::Quad { origin, u, v } => {
+                Arc::new(Quad::new(vec3(*origin), vec3(*u), vec3(*v)))
+            }
+            ShapeDesc::Plane { point, normal } => Arc::new(Plane::new(vec3(*point), vec3(*normal))),
+            ShapeDesc::Triangle { p0, p1, p2 } => {
+                Arc::new(Triangle::new(vec3(*p0), vec3(*p1), vec3(*p2)))
+            }
+            ShapeDesc::Block { min, max } => {
+                Arc::new(Block::new(Box3::new(vec3(*min), vec3(*max))))
+            }
+            ShapeDesc::Ellipsoid { center, radii } => {
+                if !radii.iter().all(|r| *r > 0.0) {
+                    bail!("Ellipsoid radii must be positive: {:?}", radii);
+                }
+                Arc::new(Ellipsoid::new(vec3(*center), vec3(*radii)))
+            }
+            ShapeDesc::Cylinder {
+                p0,
+                p1,
+                radius,
+                capped,
+            } => Arc::new(Cylinder::new(vec3(*p0), vec3(*p1), *radius, *capped)),
+            ShapeDesc::Cone {
+                base,
+                apex,
+                radius,
+                capped,
+            } => Arc::new(Cone::new(vec3(*base), vec3(*apex), *radius, *capped)),
+            ShapeDesc::Disk {
+                center,
+                normal,
+                radius,
+                inner_radius,
+            } => {
+                if !(0.0 <= *inner_radius && inner_radius < radius) {
+                    bail!("Disk inner radius must be in [0, radius)");
+                }
+                Arc::new(Disk::new(
+                    vec3(*center),
+                    vec3(*normal),
+                    *radius,
+                    *inner_radius,
+                ))
+            }
+            ShapeDesc::Capsule { p0, p1, radius } => {
+                Arc::new(Capsule::new(vec3(*p0), vec3(*p1), *radius))
+            }
+            ShapeDesc::Mesh { face_materials, .. } => {
+                if !face_materials.is_empty() {
+                    bail!("Meshes with face materials must be objects with materials");
+                }
+                Arc::new(self.mesh(desc)?)
+            }
+            ShapeDesc::MeshFile {
+                path,
+                smooth,
+                cache,
+                cull_backfaces,
+            } => {
+                let mesh = if *cache {
+                    Mesh::load_cached(path, *smooth, self.accelerator)
+                } else {
+                    Mesh::load(path, *smooth, self.accelerator)
+                };
+                Arc::new(
+                    mesh.with_context(|| format!("Failed to load {}", path.display()))?
+                        .with_backface_culling(*cull_backfaces),
+                )
+            }
+            ShapeDesc::Heightfield { path, min, size } => {
+                if size.iter().any(|s| *s <= 0.0) {
+                    bail!("Heightfield size must be positive: {:?}", size);
+                }
+                Arc::new(
+                    Heightfield::load(path, vec3(*min), vec3(*size))
+                        .with_context(|| format!("Failed to load {}", path.display()))?,
+                )
+            }
+            ShapeDesc::Translate { offset, shape: s } => {
+                Arc::new(Translate::new(vec3(*offset), self.shape(s)?))
+            }
+            ShapeDesc::Rotate {
+                axis: r_axis,
+                degrees,
+                shape: s,
+            } => Arc::new(Rotate::new(
+                axis(*r_axis),
+                degrees.to_radians(),
+                self.shape(s)?,
+            )),
+            ShapeDesc::Scale { factor, shape: s } => {
+                if !(*factor > 0.0) {
+                    bail!("Scale factor must be positive: {}", factor);
+                }
+                Arc::new(Scale::new(*factor, self.shape(s)?))
+            }
+            ShapeDesc::Sdf { function } => Arc::new(SdfShape::new(sdf(function)?)),
+            ShapeDesc::Csg { op, a, b } => {
+                Arc::new(Csg::new(csg_op(*op), self.shape(a)?, self.shape(b)?))
+            }
+        })
+    }
+
+    fn mesh(&mut self, desc: &ShapeDesc) -> Result<Mesh> {
+        match desc {
+            ShapeDesc::Mesh {
+                vertices,
+                faces,
+                uvs,
+                normals,
+                smooth,
+                cull_backfaces,
+                displacement,
+                face_materials,
+            } => {
+                if let Some(face) = faces
+                    .iter()
+                    .find(|f| f.iter().any(|i| *i >= vertices.len()))
+                {
+                    bail!("Mesh face {:?} refers to a missing vertex", face);
+                }
+                if !uvs.is_empty() && uvs.len() != vertices.len() {
+                    bail!("Mesh must have texture coordinates for all vertices or none");
+                }
+                if !normals.is_empty() && normals.len() != vertices.len() {
+                    bail!("Mesh must have normals for all vertices or none");
+                }
+                if normals.iter().any(|n| vec3(*n).norm() == 0.0) {
+                    bail!("Mesh normals must be nonzero");
+                }
+                if !normals.is_empty() && *smooth {
+                    bail!("Meshes with normals cannot be smoothed");
+                }
+                if !uvs.is_empty() && displacement.is_some() {
+                    bail!("Displaced meshes cannot have texture coordinates");
+                }
+                if !normals.is_empty() && displacement.is_some() {
+                    bail!("Displaced meshes cannot have normals");
+                }
+                if !face_materials.is_empty() && displacement.is_some() {
+                    bail!("Displaced meshes cannot have face materials");
+                }
+                let vertices: Vec<Vec3> = vertices.iter().map(|v| vec3(*v)).collect();
+                let mesh = match displacement {
+                    None => {
+                        let normals = if *smooth {
+                            vertex_normals(&vertices, faces)
+                        } else {
+                            normals
+                                .iter()
+                                .map(|n| vec3(*n).unit().into_vec3())
+                                .collect()
+                        };
+                        Mesh::with_attributes(vertices, faces.clone(), uvs.clone(), normals)
+                    }
+                    Some(d) => Mesh::displaced(
+                        vertices,
+                        faces.clone(),
+                        self.texture_ref(&d.texture)?.as_ref(),
+                        d.scale,
+                        d.subdivisions,
+                        *smooth,
+                    ),
+                };
+                Ok(mesh
+                    .with_accelerator(self.accelerator)
+                    .with_backface_culling(*cull_backfaces))
+            }
+            _ => bail!("Shape is not a mesh: {:?}", desc),
+        }
+    }
+
+    // Builds a mesh, possibly moved by transforms, whose faces select the
+    // materials by indices.
+    fn mesh_object(
+        &mut self,
+        desc: &ShapeDesc,
+        materials: &[Arc<dyn Material>],
+    ) -> Result<ObjectPtr> {
+        Ok(match desc {
+            ShapeDesc::Translate { offset, shape } => Arc::new(TranslateObject::new(
+                vec3(*offset),
+                self.mesh_object(shape, materials)?,
+            )),
+            ShapeDesc::Rotate {
+                axis: r_axis,
+                degrees,
+                shape,
+            } => Arc::new(RotateObject::new(
+                axis(*r_axis),
+                degrees.to_radians(),
+                self.mesh_object(shape, materials)?,
+            )),
+            ShapeDesc::Scale { factor, shape } => {
+                if !(*factor > 0.0) {
+                    bail!("Scale factor must be positive: {}", factor);
+                }
+                Arc::new(ScaleObject::new(
+                    *factor,
+                    self.mesh_object(shape, materials)?,
+                ))
+            }
+            ShapeDesc::Mesh { face_materials, .. } => {
+                let mesh = self.mesh(desc)?;
+                if face_materials.len() != mesh.face_count() {
+                    bail!("Mesh must have materials for all faces");
+                }
+                if let Some(i) = face_materials.iter().find(|i| **i >= materials.len()) {
+                    bail!("Mesh face refers to a missing material: {}", i);
+                }
+                MeshObject::new_rc(mesh, face_materials.clone(), materials.to_vec())
+            }
+            _ => bail!("Objects with materials must be meshes"),
+        })
+    }
+
+    fn object(&mut self, desc: &ObjectDesc) -> Result<ObjectPtr> {
+        let object: ObjectPtr = match (&desc.material, desc.materials.is_empty(), &desc.volume) {
+            (Some(material), true, None) => {
+                SolidObject::new_rc(self.shape(&desc.shape)?, self.material_ref(material)?)
+            }
+            (None, false, None) => {
+                let materials = desc
+                    .materials
+                    .iter()
+                    .map(|material| self.material_ref(material))
+                    .collect::<Result<Vec<_>>>()?;
+                self.mesh_object(&desc.shape, &materials)?
+            }
+            (None, true, Some(volume)) => {
+                let shape = self.shape(&desc.shape)?;
+                match &volume.grid {
+                    None => {
+                        VolumeObject::new_rc(shape, Fog::new(color(volume.color)), volume.density)
+                    }
+                    Some(path) => GridVolumeObject::new_rc(
+                        shape,
+                        self.grid(path)?,
+                        Fog::new(color(volume.color)),
+                        volume.density,
+                    ),
+                }
+            }
+            _ => bail!("Object must have either a material, materials or a volume"),
+        };
+        Ok(match &desc.name {
+            Some(name) => NamedObject::new_rc(name, object),
+            None => object,
+        })
+    }
+}
+
+fn light(desc: &LightDesc) -> Result<Light> {
+    fn direction(v: [f64; 3]) -> Result<Vec3> {
+        let v = vec3(v);
+        if !(v.norm() > 0.0) {
+            bail!("Invalid light direction: {:?}", v);
+        }
+        Ok(v)
+    }
+    Ok(match desc {
+        LightDesc::Point {
+            position,
+            intensity,
+        } => Light::point(vec3(*position), color(*intensity)),
+        LightDesc::Directional {
+            direction: dir,
+            irradiance,
+        } => Light::directional(direction(*dir)?, color(*irradiance)),
+        LightDesc::Spot {
+            position,
+            direction: dir,
+            intensity,
+            angle,
+            inner_angle,
+        } => {
+            let inner_angle = inner_angle.unwrap_or(*angle);
+            if !(0.0 <= inner_angle && inner_angle <= *angle && *angle <= 180.0) {
+                bail!("Invalid spot angles: {}, {}", inner_angle, angle);
+            }
+            Light::spot(
+                vec3(*position),
+                direction(*dir)?,
+                color(*intensity),
+                inner_angle.to_radians(),
+                angle.to_radians(),
+            )
+        }
+    })
+}
+
+fn light_desc(light: &Light) -> LightDesc {
+    match *light {
+        Light::Point {
+            position,
+            intensity,
+        } => LightDesc::Point {
+            position: vec3_desc(position),
+            intensity: color_desc(intensity),
+        },
+        Light::Directional {
+            direction,
+            irradiance,
+        } => LightDesc::Directional {
+            direction: vec3_desc(direction.into_vec3()),
+            irradiance: color_desc(irradiance),
+        },
+        Light::Spot {
+            position,
+            direction,
+            intensity,
+            cos_inner,
+            cos_outer,
+        } => LightDesc::Spot {
+            position: vec3_desc(position),
+            direction: vec3_desc(direction.into_vec3()),
+            intensity: color_desc(intensity),
+            angle: cos_outer.acos().to_degrees(),
+            inner_angle: Some(cos_inner.acos().to_degrees()),
+        },
+    }
+}
+
+// Loads a scene from a YAML or JSON file.
+pub fn load_scene_file(path: &Path, rng: &mut Rng) -> Result<(RenderParams, Camera, World)> {
+    SceneFile::read(path)?.load(rng)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::geom::Vec3Unit;
+    use crate::ray::Ray;
+    use rand::SeedableRng;
+
+    fn write(dir: &Path, name: &str, text: &str) -> PathBuf {
+        let path = dir.join(name);
+        std::fs::write(&path, text).unwrap();
+        path
+    }
+
+    #[test]
+    fn test_include() {
+        let dir = std::env::temp_dir().join(format!("scene_file_test_{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        write(
+            &dir,
+            "common.yaml",
+            r#"
+materials:
+  white:
+    type: lambertian
+    texture: [0.73, 0.73, 0.73]
+objects:
+  - shape: {type: sphere, center: [0, -1000, 0], radius: 1000}
+    material: white
+"#,
+        );
+        let path = write(
+            &dir,
+            "scene.yaml",
+            r#"
+include: [common.yaml]
+params:
+  width: 40
+  height: 20
+camera:
+  look_from: [0, 1, -5]
+  look_at: [0, 1, 0]
+background: sky
+objects:
+  - name: ball
+    shape:
+      type: translate
+      offset: [0, 1, 0]
+      shape: {type: sphere, center: [0, 0, 0], radius: 1}
+    material: white
+"#,
+        );
+        let (params, _camera, world) = load_scene_file(&path, &mut Rng::seed_from_u64(28)).unwrap();
+        // Files parsed as if they were in the directory include the same.
+        let text = std::fs::read_to_string(&path).unwrap();
+        let parsed = SceneFile::parse(&text, &dir).unwrap();
+        // But no files out of the directory.
+        let outside = dir.parent().unwrap().canonicalize().unwrap();
+        let outside = write(
+            &outside,
+            &format!("{}.yaml", std::process::id()),
+            "objects: []",
+        );
+        for include in [
+            format!("../{}", outside.file_name().unwrap().to_str().unwrap()),
+            outside.to_str().unwrap().to_owned(),
+            "missing.yaml".to_owned(),
+        ]
+        .iter()
+        {
+            let text = format!("include: [{:?}]", include);
+            let err = SceneFile::parse(&text, &dir).unwrap_err();
+            assert!(err.to_string().contains("missing or out of"), "{}", err);
+        }
+        std::fs::remove_file(&outside).unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+        assert_eq!(parsed.objects.len(), 2);
+
+        assert_eq!((params.width, params.height), (40, 20));
+        let mut rng = Rng::seed_from_u64(28);
+        let ray = Ray::new(Vec3::new(0.0, 1.0, -5.0), Vec3Unit::Z, 0.0);
+        let hit = world
+            .object
+            .hit(&ray, 1e-8, f64::INFINITY, &mut rng)
+            .unwrap();
+        assert!((hit.t - 4.0).abs() < 1e-8);
+        assert!(hit.id.is_some());
+        let ray = Ray::new(Vec3::new(3.0, 1.0, -5.0), -Vec3Unit::Y, 0.0);
+        let hit = world
+            .object
+            .hit(&ray, 1e-8, f64::INFINITY, &mut rng)
+            .unwrap();
+        assert!((hit.t - 1.0).abs() < 0.1);
+        assert!(hit.id.is_none());
+    }
+
+    #[test]
+    fn test_export() {
+        let text = r#"
+camera: {look_from: [0, 1, -5], look_at: [0, 1, 0], vfov: 30}
+objects:
+  - name: ball
+    shape:
+      type: rotate
+      axis: y
+      degrees: 30
+      shape: {type: block, min: [-1, 0, -1], max: [1, 2, 1]}
+    material: {type: metal, texture: [0.5, 0.5, 0.5], fuzz: 0.1}
+"#;
+        let file: SceneFile = serde_yaml::from_str(text).unwrap();
+        let (params, camera, world) = file.load(&mut Rng::seed_from_u64(28)).unwrap();
+        let exported = SceneFile::from_scene(&params, &camera, &world).unwrap();
+        let exported: SceneFile = serde_yaml::from_str(&exported.to_yaml().unwrap()).unwrap();
+
+        let camera = exported.camera.unwrap();
+        assert!((camera.vfov - 30.0).abs() < 1e-8);
+        assert_eq!(exported.objects.len(), 1);
+        let object = &exported.objects[0];
+        assert_eq!(object.name.as_deref(), Some("ball"));
+        match &object.shape {
+            ShapeDesc::Rotate { degrees, shape, .. } => {
+                assert!((degrees - 30.0).abs() < 1e-8);
+                assert!(matches!(**shape, ShapeDesc::Block { .. }));
+            }
+            shape => panic!("Unexpected shape: {:?}", shape),
+        }
+        assert!(matches!(
+            object.material,
+            Some(MaterialRef::Inline(MaterialDesc::Metal { .. }))
+        ));
+    }
+
+    #[test]
+    fn test_face_materials() {
+        let text = r#"
+camera: {look_from: [0, 0, -5], look_at: [0, 0, 0]}
+objects:
+  - shape:
+      type: translate
+      offset: [0, 1, 0]
+      shape:
+        type: mesh
+        vertices: [[0, 0, 0], [1, 0, 0], [0, 1, 0], [1, 1, 0]]
+        faces: [[0, 2, 1], [1, 2, 3]]
+        face_materials: [1, 0]
+    materials:
+      - {type: lambertian, texture: [0.5, 0.5, 0.5]}
+      - {type: diffuse_light, texture: [1, 1, 1]}
+"#;
+        let file: SceneFile = serde_yaml::from_str(text).unwrap();
+        let (params, camera, world) = file.load(&mut Rng::seed_from_u64(28)).unwrap();
+        let exported = SceneFile::from_scene(&params, &camera, &world).unwrap();
+        let object = &exported.objects[0];
+        assert!(object.material.is_none());
+        assert_eq!(object.materials.len(), 2);
+        match &object.shape {
+            ShapeDesc::Translate { shape, .. } => match &**shape {
+                ShapeDesc::Mesh { face_materials, .. } => assert_eq!(face_materials, &[1, 0]),
+                shape => panic!("Unexpected shape: {:?}", shape),
+            },
+            shape => panic!("Unexpected shape: {:?}", shape),
+        }
+
+        let mut file: SceneFile = serde_yaml::from_str(text).unwrap();
+        if let ShapeDesc::Translate { shape, .. } = &mut file.objects[0].shape {
+            if let ShapeDesc::Mesh { face_materials, .. } = &mut **shape {
+                face_materials.push(0);
+            }
+        }
+        assert!(file.load(&mut Rng::seed_from_u64(28)).is_err());
+    }
+
+    #[test]
+    fn test_errors() {
+        let parse = |text: &str| {
+            serde_yaml::from_str::<SceneFile>(text)
+                .map_err(anyhow::Error::from)
+                .and_then(|file| file.load(&mut Rng::seed_from_u64(28)).map(|_| ()))
+        };
+        let camera = "camera: {look_from: [0, 0, -1], look_at: [0, 0, 0]}\n";
+        assert!(parse(camera).is_ok());
+        assert!(parse("objects: []\n").is_err());
+        assert!(parse(&format!(
+            "{}objects:\n  - shape: {{type: sphere, center: [0, 0, 0], radius: 1}}\n    material: nothing\n",
+            camera
+        ))
+        .is_err());
+        assert!(parse(&format!(
+            "{}textures:\n  a: {{type: checker, even: b, odd: [0, 0, 0], stride: 1}}\n  b: {{type: checker, even: a, odd: [0, 0, 0], stride: 1}}\nobjects:\n  - shape: {{type: sphere, center: [0, 0, 0], radius: 1}}\n    material: {{type: lambertian, texture: a}}\n",
+            camera
+        ))
+        .is_err());
+        assert!(parse(&format!(
+            "{}materials:\n  coat: {{type: coated, base: coat}}\nobjects:\n  - shape: {{type: sphere, center: [0, 0, 0], radius: 1}}\n    material: coat\n",
+            camera
+        ))
+        .is_err());
+
+        // Unknown fields of inline definitions are named.
+        let err = parse(&format!(
+            "{}objects:\n  - shape: {{type: sphere, center: [0, 0, 0], radius: 1}}\n    material: {{type: metal, texture: [1, 1, 1], fuz: 0.1}}\n",
+            camera
+        ))
+        .unwrap_err();
+        assert!(err.to_string().contains("unknown field `fuz`"), "{}", err);
+    }
+}
@@ -0,0 +1,116 @@
+// Hierarchical scene description where nodes group objects and other nodes
+// under a transform relative to their parent, so that assemblies can be
+// positioned as units.
+//
+// The graph is flattened when built: each object is wrapped once with the
+// composed transform of its ancestors, and all of them are put into a single
+// BVH. Objects are shared by reference, so a node added to multiple parents is
+// instanced without copying its geometry.
+
+use crate::geom::Mat4;
+use crate::object::{ObjectPtr, Objects, TransformObject};
+use crate::time::TimeRange;
+use anyhow::{bail, Result};
+use std::sync::Arc;
+
+#[derive(Clone)]
+pub struct SceneNode {
+    transform: Mat4,
+    objects: Vec<ObjectPtr>,
+    children: Vec<Arc<SceneNode>>,
+}
+
+impl SceneNode {
+    pub fn new(transform: Mat4) -> Self {
+        SceneNode {
+            transform,
+            objects: Vec::new(),
+            children: Vec::new(),
+        }
+    }
+
+    pub fn add_object(&mut self, object: ObjectPtr) -> &mut Self {
+        self.objects.push(object);
+        self
+    }
+
+    pub fn add_child(&mut self, child: Arc<SceneNode>) -> &mut Self {
+        self.children.push(child);
+        self
+    }
+
+    // Returns objects in world coordinates. Fails if a composed transform is
+    // singular.
+    pub fn flatten(&self) -> Result<Vec<ObjectPtr>> {
+        let mut objects = Vec::new();
+        self.flatten_into(Mat4::IDENTITY, &mut objects)?;
+        Ok(objects)
+    }
+
+    fn flatten_into(&self, parent: Mat4, objects: &mut Vec<ObjectPtr>) -> Result<()> {
+        let transform = parent * self.transform;
+        if transform == Mat4::IDENTITY {
+            objects.extend(self.objects.iter().cloned());
+        } else if !self.objects.is_empty() {
+            if transform.inverse().is_none() {
+                bail!("Singular transform in scene graph: {:?}", transform);
+            }
+            objects.extend(self.objects.iter().map(|object| {
+                Arc::new(TransformObject::new(transform, object.clone())) as ObjectPtr
+            }));
+        }
+        for child in self.children.iter() {
+            child.flatten_into(transform, objects)?;
+        }
+        Ok(())
+    }
+
+    pub fn build(&self, time: TimeRange) -> Result<Objects> {
+        Ok(Objects::new(self.flatten()?, time))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::color::Color;
+    use crate::geom::{Axis, Vec3, Vec3Unit};
+    use crate::material::Lambertian;
+    use crate::object::{Object, SolidObject};
+    use crate::ray::Ray;
+    use crate::rng::Rng;
+    use crate::shape::Sphere;
+    use crate::texture::SolidColor;
+    use rand::SeedableRng;
+
+    #[test]
+    fn test_nested_transforms() {
+        let ball = SolidObject::new_rc(
+            Sphere::new(Vec3::ZERO, 1.0),
+            Lambertian::new(SolidColor::new(Color::WHITE)),
+        );
+        let mut leaf = SceneNode::new(Mat4::translation(Vec3::new(0.0, 0.0, 5.0)));
+        leaf.add_object(ball);
+        let leaf = Arc::new(leaf);
+        let mut root = SceneNode::new(Mat4::rotation(Axis::Y, std::f64::consts::PI / 2.0));
+        root.add_child(leaf.clone())
+            .add_child(Arc::new(SceneNode::new(Mat4::scaling(Vec3::new(
+                1.0, 1.0, 2.0,
+            )))));
+        let objects = root.build(TimeRange::ZERO).unwrap();
+
+        // The ball is moved to +Z and then rotated to +X.
+        let mut rng = Rng::seed_from_u64(28);
+        let ray = Ray::new(Vec3::new(10.0, 0.0, 0.0), -Vec3Unit::X, 0.0);
+        let hit = objects.hit(&ray, 1e-8, f64::INFINITY, &mut rng).unwrap();
+        assert!((hit.t - 4.0).abs() < 1e-8);
+        let normal = hit.normal.unwrap();
+        assert!((normal.x - 1.0).abs() < 1e-8);
+        let bb = objects.bounding_box(TimeRange::ZERO);
+        assert!((bb.min.x - 4.0).abs() < 1e-8 && (bb.max.x - 6.0).abs() < 1e-8);
+
+        let mut singular = SceneNode::new(Mat4::scaling(Vec3::new(1.0, 0.0, 1.0)));
+        singular.add_child(leaf);
+        assert!(singular.flatten().is_err());
+    }
+}
@@ -0,0 +1,648 @@
+// Checks of scene files for values which parse but are unlikely to be
+// intended, e.g. NaN coordinates or spheres of no radius. Many of them would
+// otherwise render nothing or garbage without an error, and some panic while
+// loading, so those are errors rather than warnings.
+
+use crate::geom::{IntoVec3, Vec3};
+use crate::scene_file::{
+    BackgroundDesc, LightDesc, MaterialDesc, MaterialRef, SceneFile, SdfDesc, ShapeDesc,
+    TextureDesc, TextureRef,
+};
+use std::fmt::{self, Display};
+
+// A problem found in a scene file, prefixed by where it is, e.g.
+// "objects[2].shape: radius must be positive: 0". Errors are values the scene
+// can't be loaded with: non-finite numbers, zero or negative sizes, zero
+// directions and unknown names. The others only look unintended.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Problem {
+    pub message: String,
+    pub error: bool,
+}
+
+impl Display for Problem {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+impl SceneFile {
+    // Returns the problems found. Names of textures and materials are checked
+    // too, so that all problems are reported at once rather than the first one
+    // failing the load.
+    pub fn validate(&self) -> Vec<Problem> {
+        let mut validator = Validator {
+            file: self,
+            at: String::new(),
+            problems: Vec::new(),
+        };
+        validator.scene();
+        validator.problems
+    }
+}
+
+struct Validator<'a> {
+    file: &'a SceneFile,
+    // Where the values being checked are, e.g. "objects[2].shape".
+    at: String,
+    problems: Vec<Problem>,
+}
+
+fn vec3(v: [f64; 3]) -> Vec3 {
+    Vec3::new(v[0], v[1], v[2])
+}
+
+impl<'a> Validator<'a> {
+    fn push(&mut self, message: impl Display, error: bool) {
+        let message = if self.at.is_empty() {
+            message.to_string()
+        } else {
+            format!("{}: {}", self.at, message)
+        };
+        self.problems.push(Problem { message, error });
+    }
+
+    fn report(&mut self, message: impl Display) {
+        self.push(message, false);
+    }
+
+    fn error(&mut self, message: impl Display) {
+        self.push(message, true);
+    }
+
+    // Runs the check of values under the field, which may be an index like
+    // "[2]".
+    fn within(&mut self, field: impl Display, check: impl FnOnce(&mut Self)) {
+        let len = self.at.len();
+        let field = field.to_string();
+        if !self.at.is_empty() && !field.starts_with('[') {
+            self.at.push('.');
+        }
+        self.at.push_str(&field);
+        check(self);
+        self.at.truncate(len);
+    }
+
+    fn finite(&mut self, name: &str, values: &[f64]) -> bool {
+        if values.iter().all(|x| x.is_finite()) {
+            return true;
+        }
+        if let [x] = values {
+            self.error(format_args!("{} must be finite: {}", name, x));
+        } else {
+            self.error(format_args!("{} must be finite: {:?}", name, values));
+        }
+        false
+    }
+
+    fn positive(&mut self, name: &str, x: f64) {
+        if self.finite(name, &[x]) && !(x > 0.0) {
+            self.error(format_args!("{} must be positive: {}", name, x));
+        }
+    }
+
+    fn non_negative(&mut self, name: &str, x: f64) {
+        if self.finite(name, &[x]) && x < 0.0 {
+            self.report(format_args!("{} must not be negative: {}", name, x));
+        }
+    }
+
+    fn unit_range(&mut self, name: &str, x: f64) {
+        if self.finite(name, &[x]) && !(0.0..=1.0).contains(&x) {
+            self.report(format_args!("{} must be in [0, 1]: {}", name, x));
+        }
+    }
+
+    fn nonzero(&mut self, name: &str, v: [f64; 3]) {
+        if self.finite(name, &v) && !(vec3(v).norm() > 0.0) {
+            self.error(format_args!("{} must not be zero", name));
+        }
+    }
+
+    fn color(&mut self, name: &str, c: [f64; 3]) {
+        if self.finite(name, &c) && c.iter().any(|x| *x < 0.0) {
+            self.report(format_args!("{} must not be negative: {:?}", name, c));
+        }
+    }
+
+    fn distinct(&mut self, names: (&str, &str), p: [f64; 3], q: [f64; 3]) {
+        if self.finite(names.0, &p) && self.finite(names.1, &q) && p == q {
+            self.error(format_args!("{} and {} must differ", names.0, names.1));
+        }
+    }
+
+    fn scene(&mut self) {
+        let file = self.file;
+        if let Some(params) = &file.params {
+            self.within("params", |v| {
+                for (name, value) in [
+                    ("width", params.width.map(|n| n as usize)),
+                    ("height", params.height.map(|n| n as usize)),
+                    ("samples_per_pixel", params.samples_per_pixel),
+                ]
+                .iter()
+                {
+                    if *value == Some(0) {
+                        v.report(format_args!("{} must be positive", name));
+                    }
+                }
+            });
+        }
+        self.within("camera", |v| v.camera());
+        if let Some(background) = &file.background {
+            self.within("background", |v| v.background(background));
+        }
+        for (name, texture) in file.textures.iter() {
+            self.within(format_args!("textures.{}", name), |v| {
+                v.texture_desc(texture)
+            });
+        }
+        for (name, material) in file.materials.iter() {
+            self.within(format_args!("materials.{}", name), |v| {
+                v.material_desc(material)
+            });
+        }
+        for (i, object) in file.objects.iter().enumerate() {
+            self.within(format_args!("objects[{}]", i), |v| {
+                v.within("shape", |v| v.shape(&object.shape));
+                if let Some(material) = &object.material {
+                    v.within("material", |v| v.material_ref(material));
+                }
+                for (i, material) in object.materials.iter().enumerate() {
+                    v.within(format_args!("materials[{}]", i), |v| {
+                        v.material_ref(material)
+                    });
+                }
+                if let Some(volume) = &object.volume {
+                    v.within("volume", |v| {
+                        v.color("color", volume.color);
+                        v.non_negative("density", volume.density);
+                    });
+                }
+            });
+        }
+        for (i, model) in file.models.iter().enumerate() {
+            self.within(format_args!("models[{}]", i), |v| {
+                v.positive("scale", model.scale);
+                v.finite("offset", &model.offset);
+            });
+        }
+        for (i, light) in file.lights.iter().enumerate() {
+            self.within(format_args!("lights[{}]", i), |v| v.light(light));
+        }
+    }
+
+    fn camera(&mut self) {
+        let camera = match &self.file.camera {
+            Some(camera) => camera,
+            None => return self.error("not specified"),
+        };
+        self.distinct(("look_from", "look_at"), camera.look_from, camera.look_at);
+        let dir = vec3(camera.look_at) - vec3(camera.look_from);
+        // The up direction of the image is taken from +y, which is lost if the
+        // camera looks along it.
+        if dir.norm() > 0.0 && dir.x.hypot(dir.z) <= 1e-9 * dir.abs() {
+            self.report("looks straight up or down, which leaves the up direction undefined");
+        }
+        if self.finite("vfov", &[camera.vfov]) && !(0.0 < camera.vfov && camera.vfov < 180.0) {
+            self.report(format_args!("vfov must be in (0, 180): {}", camera.vfov));
+        }
+        self.non_negative("aperture", camera.aperture);
+        if let Some(focus_dist) = camera.focus_dist {
+            self.positive("focus_dist", focus_dist);
+        }
+        if self.finite("time", &camera.time) && camera.time[0] > camera.time[1] {
+            self.report(format_args!("time must not go back: {:?}", camera.time));
+        }
+    }
+
+    fn background(&mut self, background: &BackgroundDesc) {
+        match background {
+            BackgroundDesc::Sky | BackgroundDesc::Black | BackgroundDesc::Environment { .. } => {}
+            BackgroundDesc::Color(c) => self.color("color", *c),
+            BackgroundDesc::Gradient { bottom, top } => {
+                self.color("bottom", *bottom);
+                self.color("top", *top);
+            }
+            BackgroundDesc::Daylight { sun } => self.nonzero("sun", *sun),
+            BackgroundDesc::Physical {
+                elevation,
+                azimuth,
+                turbidity,
+            } => {
+                self.finite("elevation", &[*elevation]);
+                self.finite("azimuth", &[*azimuth]);
+                self.positive("turbidity", *turbidity);
+            }
+        }
+    }
+
+    fn texture_ref(&mut self, texture: &TextureRef) {
+        match texture {
+            TextureRef::Color(c) => self.color("color", *c),
+            TextureRef::Name(name) => {
+                if !self.file.textures.contains_key(name) {
+                    self.error(format_args!("unknown texture: {}", name));
+                }
+            }
+            TextureRef::Inline(desc) => self.texture_desc(desc),
+        }
+    }
+
+    fn texture_desc(&mut self, texture: &TextureDesc) {
+        match texture {
+            TextureDesc::Color { color } => self.color("color", *color),
+            TextureDesc::Checker { even, odd, stride } => {
+                self.within("even", |v| v.texture_ref(even));
+                self.within("odd", |v| v.texture_ref(odd));
+                if self.finite("stride", &[*stride]) && *stride == 0.0 {
+                    self.report("stride must not be zero");
+                }
+            }
+            TextureDesc::Marble { scale } => {
+                self.finite("scale", &[*scale]);
+            }
+            TextureDesc::Image { .. } => {}
+        }
+    }
+
+    fn material_ref(&mut self, material: &MaterialRef) {
+        match material {
+            MaterialRef::Name(name) => {
+                if !self.file.materials.contains_key(name) {
+                    self.error(format_args!("unknown material: {}", name));
+                }
+            }
+            MaterialRef::Inline(desc) => self.material_desc(desc),
+        }
+    }
+
+    fn material_desc(&mut self, material: &MaterialDesc) {
+        match material {
+            MaterialDesc::Lambertian { texture } | MaterialDesc::DiffuseLight { texture } => {
+                self.within("texture", |v| v.texture_ref(texture));
+            }
+            MaterialDesc::Metal { texture, fuzz } => {
+                self.within("texture", |v| v.texture_ref(texture));
+                self.unit_range("fuzz", *fuzz);
+            }
+            MaterialDesc::Dielectric {
+                index, absorption, ..
+            } => {
+                self.positive("index", *index);
+                if let Some(absorption) = absorption {
+                    self.within("absorption", |v| {
+                        v.color("color", absorption.color);
+                        v.non_negative("density", absorption.density);
+                    });
+                }
+            }
+            MaterialDesc::Pbr {
+                texture,
+                roughness,
+                metallic,
+                anisotropy,
+            } => {
+                self.within("texture", |v| v.texture_ref(texture));
+                self.unit_range("roughness", *roughness);
+                self.unit_range("metallic", *metallic);
+                self.unit_range("anisotropy", *anisotropy);
+            }
+            MaterialDesc::Coated { base, index } => {
+                self.within("base", |v| v.material_ref(base));
+                self.positive("index", *index);
+            }
+            MaterialDesc::Mix { a, b, mask } => {
+                self.within("a", |v| v.material_ref(a));
+                self.within("b", |v| v.material_ref(b));
+                self.within("mask", |v| v.texture_ref(mask));
+            }
+            MaterialDesc::Bump {
+                base,
+                height,
+                scale,
+            } => {
+                self.within("base", |v| v.material_ref(base));
+                self.within("height", |v| v.texture_ref(height));
+                self.finite("scale", &[*scale]);
+            }
+        }
+    }
+
+    fn shape(&mut self, shape: &ShapeDesc) {
+        match shape {
+            ShapeDesc::Sphere { center, radius } => {
+                self.finite("center", center);
+                self.positive("radius", *radius);
+            }
+            ShapeDesc::MovingSphere {
+                center0,
+                center1,
+                time,
+                radius,
+            } => {
+                self.finite("center0", center0);
+                self.finite("center1", center1);
+                if self.finite("time", time) && !(time[0] < time[1]) {
+                    self.report(format_args!("time must be increasing: {:?}", time));
+                }
+                self.positive("radius", *radius);
+            }
+            ShapeDesc::Rectangle {
+                a,
+                b_min,
+                b_max,
+                c_min,
+                c_max,
+                ..
+            } => {
+                if self.finite("a", &[*a])
+                    && self.finite(
+                        "b_min, b_max, c_min, c_max",
+                        &[*b_min, *b_max, *c_min, *c_max],
+                    )
+                    && !(b_min < b_max && c_min < c_max)
+                {
+                    self.report("must have minimums below maximums");
+                }
+            }
+            ShapeDesc::Quad { origin, u, v } => {
+                self.finite("origin", origin);
+                if self.finite("u", u) && self.finite("v", v) {
+                    if !(vec3(*u).cross(vec3(*v)).norm() > 0.0) {
+                        self.report("u and v must span an area");
+                    }
+                }
+            }
+            ShapeDesc::Plane { point, normal } => {
+                self.finite("point", point);
+                self.nonzero("normal", *normal);
+            }
+            ShapeDesc::Triangle { p0, p1, p2 } => {
+                if self.finite("p0", p0) && self.finite("p1", p1) && self.finite("p2", p2) {
+                    let (p0, p1, p2) = (vec3(*p0), vec3(*p1), vec3(*p2));
+                    if !((p1 - p0).cross(p2 - p0).norm() > 0.0) {
+                        self.report("vertices must not be on a line");
+                    }
+                }
+            }
+            ShapeDesc::Block { min, max } => {
+                if self.finite("min", min)
+                    && self.finite("max", max)
+                    && !min.iter().zip(max.iter()).all(|(a, b)| a < b)
+                {
+                    self.report(format_args!("min must be below max: {:?}, {:?}", min, max));
+                }
+            }
+            ShapeDesc::Ellipsoid { center, radii } => {
+                self.finite("center", center);
+                if self.finite("radii", radii) && !radii.iter().all(|r| *r > 0.0) {
+                    self.error(format_args!("radii must be positive: {:?}", radii));
+                }
+            }
+            ShapeDesc::Cylinder { p0, p1, radius, .. } | ShapeDesc::Capsule { p0, p1, radius } => {
+                self.distinct(("p0", "p1"), *p0, *p1);
+                self.positive("radius", *radius);
+            }
+            ShapeDesc::Cone {
+                base, apex, radius, ..
+            } => {
+                self.distinct(("base", "apex"), *base, *apex);
+                self.positive("radius", *radius);
+            }
+            ShapeDesc::Disk {
+                center,
+                normal,
+                radius,
+                inner_radius,
+            } => {
+                self.finite("center", center);
+                self.nonzero("normal", *normal);
+                self.positive("radius", *radius);
+                if self.finite("inner_radius", &[*inner_radius])
+                    && !(0.0 <= *inner_radius && inner_radius < radius)
+                {
+                    self.report(format_args!(
+                        "inner_radius must be in [0, radius): {}",
+                        inner_radius
+                    ));
+                }
+            }
+            ShapeDesc::Mesh {
+                vertices,
+                faces,
+                uvs,
+                normals,
+                ..
+            } => {
+                let bad = vertices.iter().filter(|p| !p.iter().all(|x| x.is_finite()));
+                let count = bad.count();
+                if count > 0 {
+                    self.error(format_args!("{} vertices are not finite", count));
+                }
+                if faces.iter().flatten().any(|i| *i >= vertices.len()) {
+                    self.error("faces refer to missing vertices");
+                } else {
+                    let count = faces
+                        .iter()
+                        .filter(|f| {
+                            let (p0, p1, p2) = (
+                                vec3(vertices[f[0]]),
+                                vec3(vertices[f[1]]),
+                                vec3(vertices[f[2]]),
+                            );
+                            !((p1 - p0).cross(p2 - p0).norm() > 0.0)
+                        })
+                        .count();
+                    if count > 0 {
+                        self.report(format_args!("{} faces have no area", count));
+                    }
+                }
+                if !uvs.iter().flatten().all(|x| x.is_finite()) {
+                    self.error("uvs must be finite");
+                }
+                if normals
+                    .iter()
+                    .any(|n| !n.iter().all(|x| x.is_finite()) || !(vec3(*n).norm() > 0.0))
+                {
+                    self.error("normals must be finite and nonzero");
+                }
+            }
+            ShapeDesc::Heightfield { min, size, .. } => {
+                self.finite("min", min);
+                if self.finite("size", size) && !size.iter().all(|s| *s > 0.0) {
+                    self.error(format_args!("size must be positive: {:?}", size));
+                }
+            }
+            ShapeDesc::MeshFile { .. } => {}
+            ShapeDesc::Translate { offset, shape } => {
+                self.finite("offset", offset);
+                self.within("shape", |v| v.shape(shape));
+            }
+            ShapeDesc::Rotate { degrees, shape, .. } => {
+                self.finite("degrees", &[*degrees]);
+                self.within("shape", |v| v.shape(shape));
+            }
+            ShapeDesc::Scale { factor, shape } => {
+                self.positive("factor", *factor);
+                self.within("shape", |v| v.shape(shape));
+            }
+            ShapeDesc::Sdf { function } => self.within("function", |v| v.sdf(function)),
+            ShapeDesc::Csg { a, b, .. } => {
+                self.within("a", |v| v.shape(a));
+                self.within("b", |v| v.shape(b));
+            }
+        }
+    }
+
+    fn sdf(&mut self, sdf: &SdfDesc) {
+        match sdf {
+            SdfDesc::Sphere { center, radius } => {
+                self.finite("center", center);
+                self.positive("radius", *radius);
+            }
+            SdfDesc::RoundBox {
+                center,
+                size,
+                radius,
+            } => {
+                self.finite("center", center);
+                if self.finite("size", size) && !size.iter().all(|s| *s > 0.0) {
+                    self.error(format_args!("size must be positive: {:?}", size));
+                }
+                self.non_negative("radius", *radius);
+            }
+            SdfDesc::Torus {
+                center,
+                major_radius,
+                minor_radius,
+            } => {
+                self.finite("center", center);
+                self.positive("major_radius", *major_radius);
+                self.positive("minor_radius", *minor_radius);
+            }
+            SdfDesc::Mandelbulb {
+                center,
+                scale,
+                power,
+                ..
+            } => {
+                self.finite("center", center);
+                self.positive("scale", *scale);
+                self.finite("power", &[*power]);
+            }
+            SdfDesc::SmoothUnion { a, b, k } => {
+                self.within("a", |v| v.sdf(a));
+                self.within("b", |v| v.sdf(b));
+                self.positive("k", *k);
+            }
+        }
+    }
+
+    fn light(&mut self, light: &LightDesc) {
+        match light {
+            LightDesc::Point {
+                position,
+                intensity,
+            } => {
+                self.finite("position", position);
+                self.color("intensity", *intensity);
+            }
+            LightDesc::Directional {
+                direction,
+                irradiance,
+            } => {
+                self.nonzero("direction", *direction);
+                self.color("irradiance", *irradiance);
+            }
+            LightDesc::Spot {
+                position,
+                direction,
+                intensity,
+                angle,
+                inner_angle,
+            } => {
+                self.finite("position", position);
+                self.nonzero("direction", *direction);
+                self.color("intensity", *intensity);
+                if self.finite("angle", &[*angle]) && !(0.0 < *angle && *angle <= 180.0) {
+                    self.report(format_args!("angle must be in (0, 180]: {}", angle));
+                }
+                if let Some(inner_angle) = inner_angle {
+                    if self.finite("inner_angle", &[*inner_angle])
+                        && !(0.0 <= *inner_angle && inner_angle <= angle)
+                    {
+                        self.report(format_args!(
+                            "inner_angle must be in [0, angle]: {}",
+                            inner_angle
+                        ));
+                    }
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_validate() {
+        let text = r#"
+camera: {look_from: [0, 5, 0], look_at: [0, 0, 0]}
+textures:
+  checker: {type: checker, even: [1, 1, 1], odd: dark, stride: 0}
+objects:
+  - shape: {type: sphere, center: [0, 0, 0], radius: 1}
+    material: {type: lambertian, texture: checker}
+  - shape:
+      type: translate
+      offset: [0, 1, 0]
+      shape: {type: triangle, p0: [0, 0, 0], p1: [1, 1, 1], p2: [2, 2, 2]}
+    material: {type: dielectric, index: 1.5}
+  - shape: {type: sphere, center: [0, 0, 0], radius: 0}
+    material: missing
+lights:
+  - {type: directional, direction: [0, 0, 0], irradiance: [1, 1, 1]}
+"#;
+        let mut file = SceneFile::from_yaml(text).unwrap();
+        if let ShapeDesc::Sphere { center, .. } = &mut file.objects[0].shape {
+            center[1] = f64::NAN;
+        }
+        let problems = file.validate();
+        assert_eq!(
+            problems
+                .iter()
+                .map(|p| (p.message.as_str(), p.error))
+                .collect::<Vec<_>>(),
+            vec![
+                (
+                    "camera: looks straight up or down, which leaves the up direction undefined",
+                    false
+                ),
+                ("textures.checker.odd: unknown texture: dark", true),
+                ("textures.checker: stride must not be zero", false),
+                (
+                    "objects[0].shape: center must be finite: [0.0, NaN, 0.0]",
+                    true
+                ),
+                (
+                    "objects[1].shape.shape: vertices must not be on a line",
+                    false
+                ),
+                ("objects[2].shape: radius must be positive: 0", true),
+                ("objects[2].material: unknown material: missing", true),
+                ("lights[0]: direction must not be zero", true),
+            ]
+        );
+
+        let text = r#"
+camera: {look_from: [0, 1, -5], look_at: [0, 1, 0]}
+objects:
+  - shape: {type: sphere, center: [0, 0, 0], radius: 1}
+    material: {type: lambertian, texture: [0.5, 0.5, 0.5]}
+"#;
+        assert!(SceneFile::from_yaml(text).unwrap().validate().is_empty());
+    }
+}
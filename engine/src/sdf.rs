@@ -0,0 +1,262 @@
+// Shapes defined by signed distance functions, which are negative inside, and
+// rendered by sphere tracing. They suit forms hard to model with meshes, like
+// fractals and smooth blends of primitives.
+
+use crate::geom::{Box3, Onb, Vec3, Vec3Unit};
+use crate::ray::Ray;
+use crate::sampler::Sampler;
+use crate::shape::{Hit, Shape, ShapeVisitor};
+use crate::time::TimeRange;
+
+#[derive(Clone, Debug)]
+pub enum Sdf {
+    Sphere {
+        center: Vec3,
+        radius: f64,
+    },
+    // Box of the half size whose edges are rounded by the radius.
+    RoundBox {
+        center: Vec3,
+        half_size: Vec3,
+        radius: f64,
+    },
+    // Ring around the y axis.
+    Torus {
+        center: Vec3,
+        major_radius: f64,
+        minor_radius: f64,
+    },
+    // Power 8 gives the classic bulb, which fits in a sphere of radius about
+    // 1.2 times the scale.
+    Mandelbulb {
+        center: Vec3,
+        scale: f64,
+        power: f64,
+        iterations: usize,
+    },
+    // Union blended over the distance k.
+    SmoothUnion {
+        a: Box<Sdf>,
+        b: Box<Sdf>,
+        k: f64,
+    },
+}
+
+impl Sdf {
+    // Returns the signed distance to the surface, which may underestimate.
+    pub fn distance(&self, p: Vec3) -> f64 {
+        match self {
+            Sdf::Sphere { center, radius } => (p - *center).abs() - radius,
+            Sdf::RoundBox {
+                center,
+                half_size,
+                radius,
+            } => {
+                let p = p - *center;
+                let q = Vec3::new(
+                    p.x.abs() - half_size.x + radius,
+                    p.y.abs() - half_size.y + radius,
+                    p.z.abs() - half_size.z + radius,
+                );
+                let outside = Vec3::new(q.x.max(0.0), q.y.max(0.0), q.z.max(0.0)).abs();
+                let inside = q.x.max(q.y).max(q.z).min(0.0);
+                outside + inside - radius
+            }
+            Sdf::Torus {
+                center,
+                major_radius,
+                minor_radius,
+            } => {
+                let p = p - *center;
+                let ring = (p.x * p.x + p.z * p.z).sqrt() - major_radius;
+                (ring * ring + p.y * p.y).sqrt() - minor_radius
+            }
+            Sdf::Mandelbulb {
+                center,
+                scale,
+                power,
+                iterations,
+            } => mandelbulb((p - *center) / *scale, *power, *iterations) * scale,
+            Sdf::SmoothUnion { a, b, k } => {
+                let da = a.distance(p);
+                let db = b.distance(p);
+                let h = (0.5 + 0.5 * (db - da) / k).max(0.0).min(1.0);
+                db * (1.0 - h) + da * h - k * h * (1.0 - h)
+            }
+        }
+    }
+
+    pub fn bounding_box(&self) -> Box3 {
+        let around = |center: Vec3, r: Vec3| Box3::new(center - r, center + r);
+        match self {
+            Sdf::Sphere { center, radius } => around(*center, Vec3::new(*radius, *radius, *radius)),
+            Sdf::RoundBox {
+                center, half_size, ..
+            } => around(*center, *half_size),
+            Sdf::Torus {
+                center,
+                major_radius,
+                minor_radius,
+            } => {
+                let r = major_radius + minor_radius;
+                around(*center, Vec3::new(r, *minor_radius, r))
+            }
+            Sdf::Mandelbulb { center, scale, .. } => {
+                let r = 1.2 * scale;
+                around(*center, Vec3::new(r, r, r))
+            }
+            Sdf::SmoothUnion { a, b, k } => {
+                // Blending bulges out by at most k / 4.
+                let bb = a.bounding_box().union(b.bounding_box());
+                let pad = Vec3::new(*k, *k, *k) / 4.0;
+                Box3::new(bb.min - pad, bb.max + pad)
+            }
+        }
+    }
+}
+
+fn mandelbulb(p: Vec3, power: f64, iterations: usize) -> f64 {
+    let mut z = p;
+    let mut dr = 1.0;
+    let mut r = z.abs();
+    for _ in 0..iterations {
+        if r > 2.0 || r == 0.0 {
+            break;
+        }
+        let theta = (z.z / r).acos() * power;
+        let phi = z.y.atan2(z.x) * power;
+        dr = r.powf(power - 1.0) * power * dr + 1.0;
+        let zr = r.powf(power);
+        z = Vec3::new(
+            theta.sin() * phi.cos(),
+            theta.sin() * phi.sin(),
+            theta.cos(),
+        ) * zr
+            + p;
+        r = z.abs();
+    }
+    if r == 0.0 {
+        return 0.0;
+    }
+    0.5 * r.ln() * r / dr
+}
+
+#[derive(Clone, Debug)]
+pub struct SdfShape {
+    sdf: Sdf,
+    bb: Box3,
+}
+
+impl Shape for SdfShape {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        const EPS: f64 = 1e-4;
+        const MAX_STEPS: usize = 256;
+        let (t0, t1) = ray.clip(&self.bb, t_min, t_max)?;
+        let mut t = t0;
+        // Rays leaving the surface start on it, so step off it first.
+        for _ in 0..16 {
+            if self.sdf.distance(ray.at(t)).abs() >= 4.0 * EPS {
+                break;
+            }
+            t += 4.0 * EPS;
+        }
+        for _ in 0..MAX_STEPS {
+            if t > t1 {
+                return None;
+            }
+            let point = ray.at(t);
+            let d = self.sdf.distance(point).abs();
+            if d < EPS {
+                let normal = self.normal(point);
+                return Some(Hit {
+                    point,
+                    normal,
+                    tangent: Onb::from_normal(normal).u,
+                    t,
+                    u: 0.0,
+                    v: 0.0,
+                });
+            }
+            t += d;
+        }
+        None
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        self.bb
+    }
+
+    fn sampler(&self, _from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        None
+    }
+
+    fn is_empty(&self) -> bool {
+        self.bb.is_empty()
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.sdf(&self.sdf);
+    }
+}
+
+impl SdfShape {
+    pub fn new(sdf: Sdf) -> Self {
+        // Padded so that marching starts off the surface.
+        let bb = sdf.bounding_box();
+        let pad = Vec3::new(1e-3, 1e-3, 1e-3);
+        SdfShape {
+            sdf,
+            bb: Box3::new(bb.min - pad, bb.max + pad),
+        }
+    }
+
+    fn normal(&self, p: Vec3) -> Vec3Unit {
+        const H: f64 = 1e-6;
+        let f = |dx: f64, dy: f64, dz: f64| self.sdf.distance(p + Vec3::new(dx, dy, dz));
+        Vec3::new(
+            f(H, 0.0, 0.0) - f(-H, 0.0, 0.0),
+            f(0.0, H, 0.0) - f(0.0, -H, 0.0),
+            f(0.0, 0.0, H) - f(0.0, 0.0, -H),
+        )
+        .unit()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_hit() {
+        let shape = SdfShape::new(Sdf::SmoothUnion {
+            a: Box::new(Sdf::Sphere {
+                center: Vec3::new(0.0, 0.0, 0.0),
+                radius: 1.0,
+            }),
+            b: Box::new(Sdf::RoundBox {
+                center: Vec3::new(5.0, 0.0, 0.0),
+                half_size: Vec3::new(1.0, 1.0, 1.0),
+                radius: 0.1,
+            }),
+            k: 0.1,
+        });
+        let ray = Ray::new(Vec3::new(0.0, 0.0, -5.0), Vec3Unit::Z, 0.0);
+        let hit = shape.hit(&ray, 1e-8, f64::INFINITY).unwrap();
+        assert!((hit.t - 4.0).abs() < 1e-4);
+        assert!((hit.normal.z + 1.0).abs() < 1e-4);
+
+        // A ray leaving the surface from inside hits the other side.
+        let ray = Ray::new(hit.point, Vec3Unit::Z, 0.0);
+        let hit = shape.hit(&ray, 1e-8, f64::INFINITY).unwrap();
+        assert!((hit.t - 2.0).abs() < 1e-4);
+        assert!((hit.normal.z - 1.0).abs() < 1e-4);
+
+        // A ray leaving outward hits nothing.
+        let ray = Ray::new(hit.point, Vec3Unit::Z, 0.0);
+        assert!(shape.hit(&ray, 1e-8, f64::INFINITY).is_none());
+
+        let ray = Ray::new(Vec3::new(5.0, 0.0, -5.0), Vec3Unit::Z, 0.0);
+        let hit = shape.hit(&ray, 1e-8, f64::INFINITY).unwrap();
+        assert!((hit.t - 4.0).abs() < 1e-4);
+    }
+}
@@ -1,15 +1,23 @@
-use crate::geom::{Axis, Box3, IntoVec3, Vec3, Vec3Unit};
-use crate::ray::Ray;
-use crate::sampler::{MixedSampler, RectangleSampler, RotateSampler, Sampler, SphereSampler};
+use crate::geom::{Axis, Box3, IntoVec3, Mat4, Onb, Vec3, Vec3Unit};
+use crate::ray::{Ray, RayBatch};
+use crate::sampler::{
+    DiskSampler, MixedSampler, QuadSampler, RectangleSampler, RotateSampler, Sampler,
+    SphereSampler, TransformSampler, TriangleSampler,
+};
+use crate::sdf::Sdf;
 use crate::time::TimeRange;
 use itertools::Itertools;
 use std::f64::consts::PI;
 use std::fmt::Debug;
+use std::path::Path;
+use std::sync::Arc;
 
 #[derive(Clone, Debug)]
 pub struct Hit {
     pub point: Vec3,
     pub normal: Vec3Unit,
+    // Direction in which u increases along the surface.
+    pub tangent: Vec3Unit,
     pub t: f64,
     pub u: f64,
     pub v: f64,
@@ -20,6 +28,54 @@ pub trait Shape: Debug + Sync + Send {
     fn bounding_box(&self, time: TimeRange) -> Box3;
     fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>>;
     fn is_empty(&self) -> bool;
+
+    // Finds hits of the rays in the batch, each before its own t_max. Shapes
+    // may override it to trace the rays together.
+    fn hit_batch(&self, batch: &RayBatch, t_min: f64, t_max: &[f64]) -> Vec<Option<Hit>> {
+        batch
+            .rays()
+            .iter()
+            .zip(t_max.iter())
+            .map(|(ray, t_max)| self.hit(ray, t_min, *t_max))
+            .collect()
+    }
+
+    // Calls the method of the visitor for the shape with its parameters, or
+    // none if the shape cannot be described, e.g. in scene files.
+    fn describe(&self, _visitor: &mut dyn ShapeVisitor) {}
+}
+
+// Visits shapes by their parameters. Shapes made of other shapes pass them on
+// to be visited in turn.
+pub trait ShapeVisitor {
+    fn sphere(&mut self, center: Vec3, radius: f64);
+    fn ellipsoid(&mut self, center: Vec3, radii: Vec3);
+    fn moving_sphere(&mut self, center0: Vec3, center1: Vec3, time: TimeRange, radius: f64);
+    fn rectangle(&mut self, axis: Axis, a: f64, b_min: f64, b_max: f64, c_min: f64, c_max: f64);
+    fn quad(&mut self, origin: Vec3, u: Vec3, v: Vec3);
+    fn plane(&mut self, point: Vec3, normal: Vec3Unit);
+    fn triangle(&mut self, p0: Vec3, p1: Vec3, p2: Vec3);
+    fn cylinder(&mut self, p0: Vec3, p1: Vec3, radius: f64, capped: bool);
+    fn cone(&mut self, base: Vec3, apex: Vec3, radius: f64, capped: bool);
+    fn capsule(&mut self, p0: Vec3, p1: Vec3, radius: f64);
+    fn disk(&mut self, center: Vec3, normal: Vec3Unit, radius: f64, inner_radius: f64);
+    fn block(&mut self, min: Vec3, max: Vec3);
+    fn translate(&mut self, offset: Vec3, shape: &dyn Shape);
+    fn rotate(&mut self, axis: Axis, theta: f64, shape: &dyn Shape);
+    fn scale(&mut self, factor: f64, shape: &dyn Shape);
+    fn csg(&mut self, op: CsgOp, a: &dyn Shape, b: &dyn Shape);
+    // Normals and texture coordinates of vertices may be empty.
+    fn mesh(
+        &mut self,
+        vertices: &[Vec3],
+        faces: &[[usize; 3]],
+        uvs: &[[f64; 2]],
+        normals: &[Vec3],
+        cull_backfaces: bool,
+    );
+    fn mesh_file(&mut self, path: &Path, smooth: bool, cache: bool, cull_backfaces: bool);
+    fn sdf(&mut self, sdf: &Sdf);
+    fn heightfield(&mut self, path: &Path, min: Vec3, size: Vec3);
 }
 
 impl Shape for Box<dyn Shape> {
@@ -27,6 +83,36 @@ impl Shape for Box<dyn Shape> {
         self.as_ref().hit(ray, t_min, t_max)
     }
 
+    fn hit_batch(&self, batch: &RayBatch, t_min: f64, t_max: &[f64]) -> Vec<Option<Hit>> {
+        self.as_ref().hit_batch(batch, t_min, t_max)
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.as_ref().bounding_box(time)
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        self.as_ref().sampler(from, time)
+    }
+
+    fn is_empty(&self) -> bool {
+        self.as_ref().is_empty()
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        self.as_ref().describe(visitor)
+    }
+}
+
+impl Shape for Arc<dyn Shape> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        self.as_ref().hit(ray, t_min, t_max)
+    }
+
+    fn hit_batch(&self, batch: &RayBatch, t_min: f64, t_max: &[f64]) -> Vec<Option<Hit>> {
+        self.as_ref().hit_batch(batch, t_min, t_max)
+    }
+
     fn bounding_box(&self, time: TimeRange) -> Box3 {
         self.as_ref().bounding_box(time)
     }
@@ -38,6 +124,10 @@ impl Shape for Box<dyn Shape> {
     fn is_empty(&self) -> bool {
         self.as_ref().is_empty()
     }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        self.as_ref().describe(visitor)
+    }
 }
 
 #[derive(Clone, Debug)]
@@ -84,8 +174,10 @@ impl Shape for Sphere {
     fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
         let oc = ray.origin - self.center;
         let b2 = ray.dir.dot(oc);
-        let c = oc.norm() - self.radius * self.radius;
-        let discriminant = b2 * b2 - c;
+        // Equals b2^2 - (|oc|^2 - r^2), but measured from the point on the line
+        // closest to the center so that it doesn't cancel out for small spheres
+        // far away.
+        let discriminant = self.radius * self.radius - (oc - ray.dir * b2).norm();
         if discriminant < 0.0 {
             return None;
         }
@@ -114,6 +206,7 @@ impl Shape for Sphere {
         Some(Hit {
             point,
             normal,
+            tangent: sphere_tangent(normal),
             t,
             u,
             v,
@@ -135,6 +228,10 @@ impl Shape for Sphere {
     fn is_empty(&self) -> bool {
         self.radius == 0.0
     }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.sphere(self.center, self.radius);
+    }
 }
 
 impl Sphere {
@@ -143,6 +240,60 @@ impl Sphere {
     }
 }
 
+// Returns the direction of increasing u on a sphere, i.e. eastward.
+fn sphere_tangent(normal: Vec3Unit) -> Vec3Unit {
+    let t = Vec3::new(normal.z, 0.0, -normal.x);
+    if t.norm() < 1e-16 {
+        return Vec3Unit::X;
+    }
+    t.unit()
+}
+
+// Sphere stretched along the axes to the radii. It is a unit sphere under a
+// transform, which takes care of normals.
+#[derive(Debug)]
+pub struct Ellipsoid {
+    center: Vec3,
+    radii: Vec3,
+    shape: Transform<Sphere>,
+}
+
+impl Shape for Ellipsoid {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        self.shape.hit(ray, t_min, t_max)
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        Box3::new(self.center - self.radii, self.center + self.radii)
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        self.shape.sampler(from, time)
+    }
+
+    fn is_empty(&self) -> bool {
+        self.radii.x == 0.0 || self.radii.y == 0.0 || self.radii.z == 0.0
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.ellipsoid(self.center, self.radii);
+    }
+}
+
+impl Ellipsoid {
+    // Panics if any of the radii is zero.
+    pub fn new(center: Vec3, radii: Vec3) -> Self {
+        Ellipsoid {
+            center,
+            radii,
+            shape: Transform::new(
+                Mat4::translation(center) * Mat4::scaling(radii),
+                Sphere::new(Vec3::ZERO, 1.0),
+            ),
+        }
+    }
+}
+
 #[derive(Clone, Debug)]
 pub struct MovingSphere {
     center0: Vec3,
@@ -156,8 +307,8 @@ impl Shape for MovingSphere {
         let center = self.center_at(ray.time);
         let oc = ray.origin - center;
         let b2 = ray.dir.dot(oc);
-        let c = oc.norm() - self.radius * self.radius;
-        let discriminant = b2 * b2 - c;
+        // See Sphere::hit.
+        let discriminant = self.radius * self.radius - (oc - ray.dir * b2).norm();
         if discriminant < 0.0 {
             return None;
         }
@@ -186,6 +337,7 @@ impl Shape for MovingSphere {
         Some(Hit {
             point,
             normal,
+            tangent: sphere_tangent(normal),
             t,
             u,
             v,
@@ -209,6 +361,10 @@ impl Shape for MovingSphere {
     fn is_empty(&self) -> bool {
         self.radius == 0.0
     }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.moving_sphere(self.center0, self.center1, self.time, self.radius);
+    }
 }
 
 impl MovingSphere {
@@ -255,6 +411,7 @@ impl Shape for Rectangle {
         Some(Hit {
             point,
             normal,
+            tangent: Vec3Unit::Y.rotate_axes(Axis::X, self.axis),
             t,
             u,
             v,
@@ -287,6 +444,12 @@ impl Shape for Rectangle {
     fn is_empty(&self) -> bool {
         self.b_min >= self.b_max || self.c_min >= self.c_max
     }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.rectangle(
+            self.axis, self.a, self.b_min, self.b_max, self.c_min, self.c_max,
+        );
+    }
 }
 
 impl PortalShape for Rectangle {
@@ -313,6 +476,260 @@ impl Rectangle {
     }
 }
 
+#[derive(Clone, Debug)]
+pub struct Quad {
+    origin: Vec3,
+    u: Vec3,
+    v: Vec3,
+}
+
+impl Shape for Quad {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let n = self.u.cross(self.v);
+        let t = (self.origin - ray.origin).dot(n) / ray.dir.dot(n);
+        if t.is_nan() || t < t_min || t > t_max {
+            return None;
+        }
+        let point = ray.at(t);
+        let w = n / n.norm();
+        let p = point - self.origin;
+        let u = w.dot(p.cross(self.v));
+        let v = w.dot(self.u.cross(p));
+        if u < 0.0 || u > 1.0 || v < 0.0 || v > 1.0 {
+            return None;
+        }
+        Some(Hit {
+            point,
+            normal: n.unit(),
+            tangent: self.u.unit(),
+            t,
+            u,
+            v,
+        })
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        [
+            self.origin,
+            self.origin + self.u,
+            self.origin + self.v,
+            self.origin + self.u + self.v,
+        ]
+        .iter()
+        .map(|&p| Box3::new(p, p))
+        .fold(Box3::EMPTY, Box3::union)
+    }
+
+    fn sampler(&self, from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        if self.is_empty() {
+            None
+        } else {
+            Some(Box::new(QuadSampler::new(
+                self.origin - from,
+                self.u,
+                self.v,
+            )))
+        }
+    }
+
+    fn is_empty(&self) -> bool {
+        self.u.cross(self.v).norm() == 0.0
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.quad(self.origin, self.u, self.v);
+    }
+}
+
+impl PortalShape for Quad {
+    fn surface(&self, u: f64, v: f64) -> SurfacePoint {
+        SurfacePoint {
+            point: self.origin + self.u * u + self.v * v,
+            du: self.u.unit(),
+            dv: self.v.unit(),
+        }
+    }
+}
+
+impl Quad {
+    pub fn new(origin: Vec3, u: Vec3, v: Vec3) -> Self {
+        Quad { origin, u, v }
+    }
+}
+
+#[derive(Clone, Debug)]
+pub struct Plane {
+    point: Vec3,
+    normal: Vec3Unit,
+    u_axis: Vec3Unit,
+    v_axis: Vec3Unit,
+}
+
+impl Shape for Plane {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let t = (self.point - ray.origin).dot(self.normal) / ray.dir.dot(self.normal);
+        if t.is_nan() || t < t_min || t > t_max {
+            return None;
+        }
+        let point = ray.at(t);
+        let p = point - self.point;
+        Some(Hit {
+            point,
+            normal: self.normal,
+            tangent: self.u_axis,
+            t,
+            u: p.dot(self.u_axis).rem_euclid(1.0),
+            v: p.dot(self.v_axis).rem_euclid(1.0),
+        })
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        // A plane is unbounded unless it is perpendicular to an axis.
+        let mut bb = Box3::new(-Vec3::INFINITY, Vec3::INFINITY);
+        if self.normal.y == 0.0 && self.normal.z == 0.0 {
+            bb.min.x = self.point.x;
+            bb.max.x = self.point.x;
+        } else if self.normal.z == 0.0 && self.normal.x == 0.0 {
+            bb.min.y = self.point.y;
+            bb.max.y = self.point.y;
+        } else if self.normal.x == 0.0 && self.normal.y == 0.0 {
+            bb.min.z = self.point.z;
+            bb.max.z = self.point.z;
+        }
+        bb
+    }
+
+    fn sampler(&self, _from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        None
+    }
+
+    fn is_empty(&self) -> bool {
+        false
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.plane(self.point, self.normal);
+    }
+}
+
+impl Plane {
+    pub fn new(point: Vec3, normal: Vec3) -> Self {
+        let basis = Onb::from_normal(normal.unit());
+        Plane {
+            point,
+            normal: basis.w,
+            u_axis: basis.u,
+            v_axis: basis.v,
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug)]
+pub struct Triangle {
+    p0: Vec3,
+    p1: Vec3,
+    p2: Vec3,
+}
+
+impl Shape for Triangle {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        // Watertight ray/triangle intersection by Woop, Benthin and Wald (2013).
+        // Vertices are transformed into a ray-aligned space where the ray
+        // direction is the Z axis, so edges shared by adjacent triangles are
+        // evaluated with exactly the same arithmetic.
+        let kz = if ray.dir.x.abs() > ray.dir.y.abs() {
+            if ray.dir.x.abs() > ray.dir.z.abs() {
+                Axis::X
+            } else {
+                Axis::Z
+            }
+        } else if ray.dir.y.abs() > ray.dir.z.abs() {
+            Axis::Y
+        } else {
+            Axis::Z
+        };
+        let (kx, ky) = if ray.dir.get(kz) < 0.0 {
+            (kz.next().next(), kz.next())
+        } else {
+            (kz.next(), kz.next().next())
+        };
+        let sx = ray.dir.get(kx) / ray.dir.get(kz);
+        let sy = ray.dir.get(ky) / ray.dir.get(kz);
+        let sz = 1.0 / ray.dir.get(kz);
+
+        let a = self.p0 - ray.origin;
+        let b = self.p1 - ray.origin;
+        let c = self.p2 - ray.origin;
+        let ax = a.get(kx) - sx * a.get(kz);
+        let ay = a.get(ky) - sy * a.get(kz);
+        let bx = b.get(kx) - sx * b.get(kz);
+        let by = b.get(ky) - sy * b.get(kz);
+        let cx = c.get(kx) - sx * c.get(kz);
+        let cy = c.get(ky) - sy * c.get(kz);
+
+        let e0 = cx * by - cy * bx;
+        let e1 = ax * cy - ay * cx;
+        let e2 = bx * ay - by * ax;
+        if (e0 < 0.0 || e1 < 0.0 || e2 < 0.0) && (e0 > 0.0 || e1 > 0.0 || e2 > 0.0) {
+            return None;
+        }
+        let det = e0 + e1 + e2;
+        if det == 0.0 {
+            return None;
+        }
+
+        let t = (e0 * a.get(kz) + e1 * b.get(kz) + e2 * c.get(kz)) * sz / det;
+        if t.is_nan() || t < t_min || t > t_max {
+            return None;
+        }
+
+        let u = e1 / det;
+        let v = e2 / det;
+        let point = self.p0 * (1.0 - u - v) + self.p1 * u + self.p2 * v;
+        let normal = (self.p1 - self.p0).cross(self.p2 - self.p0).unit();
+        Some(Hit {
+            point,
+            normal,
+            tangent: (self.p1 - self.p0).unit(),
+            t,
+            u,
+            v,
+        })
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        Box3::new(self.p0, self.p0)
+            .union(Box3::new(self.p1, self.p1))
+            .union(Box3::new(self.p2, self.p2))
+    }
+
+    fn sampler(&self, from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        if self.is_empty() {
+            None
+        } else {
+            Some(Box::new(TriangleSampler::new(
+                self.p0 - from,
+                self.p1 - from,
+                self.p2 - from,
+            )))
+        }
+    }
+
+    fn is_empty(&self) -> bool {
+        (self.p1 - self.p0).cross(self.p2 - self.p0).norm() == 0.0
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.triangle(self.p0, self.p1, self.p2);
+    }
+}
+
+impl Triangle {
+    pub fn new(p0: Vec3, p1: Vec3, p2: Vec3) -> Self {
+        Triangle { p0, p1, p2 }
+    }
+}
+
 #[derive(Debug)]
 pub struct LocalFlip<S: PortalShape> {
     shape: S,
@@ -323,6 +740,7 @@ impl<S: PortalShape> Shape for LocalFlip<S> {
         self.shape.hit(ray, t_min, t_max).map(|hit| Hit {
             point: hit.point,
             normal: hit.normal,
+            tangent: -hit.tangent,
             t: hit.t,
             u: 1.0 - hit.u,
             v: hit.v,
@@ -377,6 +795,7 @@ impl<S: PortalShape> Shape for LocalRotate<S> {
         self.shape.hit(ray, t_min, t_max).map(|hit| Hit {
             point: hit.point,
             normal: hit.normal,
+            tangent: hit.normal.cross(hit.tangent).unit(),
             t: hit.t,
             u: hit.v,
             v: 1.0 - hit.u,
@@ -421,6 +840,459 @@ impl<S: PortalShape> LocalRotate<S> {
     }
 }
 
+// Part of a solid of revolution which a ray hit.
+#[derive(Clone, Copy)]
+enum Part {
+    Side,
+    Bottom,
+    Top,
+}
+
+// Returns the roots of a t^2 + 2 half_b t + c = 0 in increasing order.
+fn solve_quadratic(a: f64, half_b: f64, c: f64) -> Option<(f64, f64)> {
+    if a.abs() < 1e-12 {
+        return None;
+    }
+    let discriminant = half_b * half_b - a * c;
+    if discriminant < 0.0 {
+        return None;
+    }
+    let droot = discriminant.sqrt();
+    let t1 = (-half_b - droot) / a;
+    let t2 = (-half_b + droot) / a;
+    Some((t1.min(t2), t1.max(t2)))
+}
+
+// Keeps the nearest part hit within the range.
+struct NearestPart {
+    t_min: f64,
+    t_max: f64,
+    nearest: Option<(f64, Part)>,
+}
+
+impl NearestPart {
+    fn new(t_min: f64, t_max: f64) -> Self {
+        NearestPart {
+            t_min,
+            t_max,
+            nearest: None,
+        }
+    }
+
+    fn add(&mut self, t: f64, part: Part) {
+        if self.t_min <= t && t <= self.t_max {
+            self.t_max = t;
+            self.nearest = Some((t, part));
+        }
+    }
+}
+
+// Returns texture coordinates of a point on a disk of the radius around the
+// local z axis.
+fn disk_uv(p: Vec3, radius: f64) -> (f64, f64) {
+    ((p.x / radius + 1.0) / 2.0, (p.y / radius + 1.0) / 2.0)
+}
+
+// Returns the angle of a point around the local z axis in [0, 1), and the
+// direction in which it increases.
+fn around_axis(p: Vec3) -> (f64, Vec3) {
+    let u = (f64::atan2(p.y, p.x) / (2.0 * PI)).rem_euclid(1.0);
+    let tangent = Vec3::new(-p.y, p.x, 0.0);
+    if tangent.norm() < 1e-16 {
+        (u, Vec3::new(1.0, 0.0, 0.0))
+    } else {
+        (u, tangent)
+    }
+}
+
+fn segment_box(p0: Vec3, p1: Vec3, radius: f64) -> Box3 {
+    let r = Vec3::new(radius, radius, radius);
+    Box3::new(p0 - r, p0 + r).union(Box3::new(p1 - r, p1 + r))
+}
+
+// Cylinder between the centers of its bottom and top, optionally closed by
+// disks at the ends. Shapes of revolution are computed around the local z
+// axis from the bottom.
+#[derive(Clone, Debug)]
+pub struct Cylinder {
+    p0: Vec3,
+    p1: Vec3,
+    radius: f64,
+    capped: bool,
+    basis: Onb,
+    height: f64,
+}
+
+impl Shape for Cylinder {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let o = self.basis.to_local(ray.origin - self.p0);
+        let d = self.basis.to_local(ray.dir);
+        let mut nearest = NearestPart::new(t_min, t_max);
+        if let Some((t1, t2)) = solve_quadratic(
+            d.x * d.x + d.y * d.y,
+            o.x * d.x + o.y * d.y,
+            o.x * o.x + o.y * o.y - self.radius * self.radius,
+        ) {
+            for &t in [t1, t2].iter() {
+                let z = o.z + t * d.z;
+                if 0.0 <= z && z <= self.height {
+                    nearest.add(t, Part::Side);
+                }
+            }
+        }
+        if self.capped && d.z != 0.0 {
+            for &(z, part) in [(0.0, Part::Bottom), (self.height, Part::Top)].iter() {
+                let t = (z - o.z) / d.z;
+                let p = o + d * t;
+                if p.x * p.x + p.y * p.y <= self.radius * self.radius {
+                    nearest.add(t, part);
+                }
+            }
+        }
+        let (t, part) = nearest.nearest?;
+        let p = o + d * t;
+        let (normal, tangent, u, v) = match part {
+            Part::Side => {
+                let (u, tangent) = around_axis(p);
+                (Vec3::new(p.x, p.y, 0.0), tangent, u, p.z / self.height)
+            }
+            Part::Bottom | Part::Top => {
+                let (u, v) = disk_uv(p, self.radius);
+                let z = if let Part::Top = part { 1.0 } else { -1.0 };
+                (Vec3::new(0.0, 0.0, z), Vec3::new(1.0, 0.0, 0.0), u, v)
+            }
+        };
+        Some(Hit {
+            point: ray.at(t),
+            normal: self.basis.to_world(normal).unit(),
+            tangent: self.basis.to_world(tangent).unit(),
+            t,
+            u,
+            v,
+        })
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        segment_box(self.p0, self.p1, self.radius)
+    }
+
+    fn sampler(&self, from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        let center = (self.p0 + self.p1) / 2.0;
+        let radius = (self.height * self.height / 4.0 + self.radius * self.radius).sqrt();
+        Some(Box::new(SphereSampler::new(center - from, radius)))
+    }
+
+    fn is_empty(&self) -> bool {
+        self.radius == 0.0 || self.height == 0.0
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.cylinder(self.p0, self.p1, self.radius, self.capped);
+    }
+}
+
+impl Cylinder {
+    pub fn new(p0: Vec3, p1: Vec3, radius: f64, capped: bool) -> Self {
+        let axis = p1 - p0;
+        Cylinder {
+            p0,
+            p1,
+            radius,
+            capped,
+            basis: Onb::from_normal(if axis.norm() > 0.0 {
+                axis.unit()
+            } else {
+                Vec3Unit::Y
+            }),
+            height: axis.abs(),
+        }
+    }
+}
+
+// Cone from the center of its base to the apex, optionally closed by a disk at
+// the base.
+#[derive(Clone, Debug)]
+pub struct Cone {
+    base: Vec3,
+    apex: Vec3,
+    radius: f64,
+    capped: bool,
+    basis: Onb,
+    height: f64,
+}
+
+impl Shape for Cone {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        if self.height == 0.0 {
+            return None;
+        }
+        let o = self.basis.to_local(ray.origin - self.base);
+        let d = self.basis.to_local(ray.dir);
+        // The radius shrinks by k per height to the apex.
+        let k = self.radius / self.height;
+        let r0 = self.radius - k * o.z;
+        let mut nearest = NearestPart::new(t_min, t_max);
+        if let Some((t1, t2)) = solve_quadratic(
+            d.x * d.x + d.y * d.y - k * k * d.z * d.z,
+            o.x * d.x + o.y * d.y + r0 * k * d.z,
+            o.x * o.x + o.y * o.y - r0 * r0,
+        ) {
+            for &t in [t1, t2].iter() {
+                let z = o.z + t * d.z;
+                if 0.0 <= z && z <= self.height {
+                    nearest.add(t, Part::Side);
+                }
+            }
+        }
+        if self.capped && d.z != 0.0 {
+            let t = -o.z / d.z;
+            let p = o + d * t;
+            if p.x * p.x + p.y * p.y <= self.radius * self.radius {
+                nearest.add(t, Part::Bottom);
+            }
+        }
+        let (t, part) = nearest.nearest?;
+        let p = o + d * t;
+        let (normal, tangent, u, v) = match part {
+            Part::Side => {
+                let (u, tangent) = around_axis(p);
+                let rho = (p.x * p.x + p.y * p.y).sqrt();
+                let normal = if rho > 0.0 {
+                    Vec3::new(
+                        p.x / rho * self.height,
+                        p.y / rho * self.height,
+                        self.radius,
+                    )
+                } else {
+                    Vec3::new(0.0, 0.0, 1.0)
+                };
+                (normal, tangent, u, p.z / self.height)
+            }
+            Part::Bottom | Part::Top => {
+                let (u, v) = disk_uv(p, self.radius);
+                (Vec3::new(0.0, 0.0, -1.0), Vec3::new(1.0, 0.0, 0.0), u, v)
+            }
+        };
+        Some(Hit {
+            point: ray.at(t),
+            normal: self.basis.to_world(normal).unit(),
+            tangent: self.basis.to_world(tangent).unit(),
+            t,
+            u,
+            v,
+        })
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        segment_box(self.base, self.base, self.radius).union(Box3::new(self.apex, self.apex))
+    }
+
+    fn sampler(&self, from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        let center = (self.base + self.apex) / 2.0;
+        let radius = (self.height * self.height / 4.0 + self.radius * self.radius).sqrt();
+        Some(Box::new(SphereSampler::new(center - from, radius)))
+    }
+
+    fn is_empty(&self) -> bool {
+        self.radius == 0.0 || self.height == 0.0
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.cone(self.base, self.apex, self.radius, self.capped);
+    }
+}
+
+impl Cone {
+    pub fn new(base: Vec3, apex: Vec3, radius: f64, capped: bool) -> Self {
+        let axis = apex - base;
+        Cone {
+            base,
+            apex,
+            radius,
+            capped,
+            basis: Onb::from_normal(if axis.norm() > 0.0 {
+                axis.unit()
+            } else {
+                Vec3Unit::Y
+            }),
+            height: axis.abs(),
+        }
+    }
+}
+
+// Cylinder between two points with hemispheres at the ends, i.e. points
+// within the radius from the segment.
+#[derive(Clone, Debug)]
+pub struct Capsule {
+    p0: Vec3,
+    p1: Vec3,
+    radius: f64,
+    basis: Onb,
+    height: f64,
+}
+
+impl Shape for Capsule {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let o = self.basis.to_local(ray.origin - self.p0);
+        let d = self.basis.to_local(ray.dir);
+        let r2 = self.radius * self.radius;
+        let mut nearest = NearestPart::new(t_min, t_max);
+        if let Some((t1, t2)) = solve_quadratic(
+            d.x * d.x + d.y * d.y,
+            o.x * d.x + o.y * d.y,
+            o.x * o.x + o.y * o.y - r2,
+        ) {
+            for &t in [t1, t2].iter() {
+                let z = o.z + t * d.z;
+                if 0.0 <= z && z <= self.height {
+                    nearest.add(t, Part::Side);
+                }
+            }
+        }
+        // Each hemisphere is the part of its sphere beyond the end.
+        for &(z, part) in [(0.0, Part::Bottom), (self.height, Part::Top)].iter() {
+            let oc = o - Vec3::new(0.0, 0.0, z);
+            if let Some((t1, t2)) = solve_quadratic(d.norm(), oc.dot(d), oc.norm() - r2) {
+                for &t in [t1, t2].iter() {
+                    let dz = oc.z + t * d.z;
+                    let beyond = if let Part::Top = part {
+                        dz >= 0.0
+                    } else {
+                        dz <= 0.0
+                    };
+                    if beyond {
+                        nearest.add(t, part);
+                    }
+                }
+            }
+        }
+        let (t, part) = nearest.nearest?;
+        let p = o + d * t;
+        let (u, tangent) = around_axis(p);
+        let normal = match part {
+            Part::Side => Vec3::new(p.x, p.y, 0.0),
+            Part::Bottom => p,
+            Part::Top => p - Vec3::new(0.0, 0.0, self.height),
+        };
+        let v = ((p.z + self.radius) / (self.height + 2.0 * self.radius))
+            .max(0.0)
+            .min(1.0);
+        Some(Hit {
+            point: ray.at(t),
+            normal: self.basis.to_world(normal).unit(),
+            tangent: self.basis.to_world(tangent).unit(),
+            t,
+            u,
+            v,
+        })
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        segment_box(self.p0, self.p1, self.radius)
+    }
+
+    fn sampler(&self, from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        let center = (self.p0 + self.p1) / 2.0;
+        let radius = self.height / 2.0 + self.radius;
+        Some(Box::new(SphereSampler::new(center - from, radius)))
+    }
+
+    fn is_empty(&self) -> bool {
+        self.radius == 0.0
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.capsule(self.p0, self.p1, self.radius);
+    }
+}
+
+impl Capsule {
+    pub fn new(p0: Vec3, p1: Vec3, radius: f64) -> Self {
+        let axis = p1 - p0;
+        Capsule {
+            p0,
+            p1,
+            radius,
+            basis: Onb::from_normal(if axis.norm() > 0.0 {
+                axis.unit()
+            } else {
+                Vec3Unit::Y
+            }),
+            height: axis.abs(),
+        }
+    }
+}
+
+// Flat disk facing the normal, with a hole of the inner radius if positive.
+#[derive(Clone, Debug)]
+pub struct Disk {
+    center: Vec3,
+    basis: Onb,
+    radius: f64,
+    inner_radius: f64,
+}
+
+impl Shape for Disk {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let normal = self.basis.w;
+        let t = (self.center - ray.origin).dot(normal) / ray.dir.dot(normal);
+        if !(t_min <= t && t <= t_max) {
+            return None;
+        }
+        let point = ray.at(t);
+        let p = self.basis.to_local(point - self.center);
+        let d2 = p.x * p.x + p.y * p.y;
+        if d2 < self.inner_radius * self.inner_radius || d2 > self.radius * self.radius {
+            return None;
+        }
+        let (u, v) = disk_uv(p, self.radius);
+        Some(Hit {
+            point,
+            normal,
+            tangent: self.basis.u,
+            t,
+            u,
+            v,
+        })
+    }
+
+    fn bounding_box(&self, _time: TimeRange) -> Box3 {
+        // Extents of the disk along the axes, slightly padded for flat boxes.
+        let n = self.basis.w;
+        let extent = |a: f64| self.radius * (1.0 - a * a).max(0.0).sqrt() + 1e-6;
+        let r = Vec3::new(extent(n.x), extent(n.y), extent(n.z));
+        Box3::new(self.center - r, self.center + r)
+    }
+
+    fn sampler(&self, from: Vec3, _time: f64) -> Option<Box<dyn Sampler>> {
+        Some(Box::new(DiskSampler::new(
+            self.center - from,
+            self.basis.w,
+            self.radius,
+            self.inner_radius,
+        )))
+    }
+
+    fn is_empty(&self) -> bool {
+        self.radius <= self.inner_radius
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.disk(self.center, self.basis.w, self.radius, self.inner_radius);
+    }
+}
+
+impl Disk {
+    pub fn new(center: Vec3, normal: Vec3, radius: f64, inner_radius: f64) -> Self {
+        Disk {
+            center,
+            basis: Onb::from_normal(normal.unit()),
+            radius,
+            inner_radius,
+        }
+    }
+}
+
 #[derive(Clone, Debug)]
 pub struct Block {
     bb: Box3,
@@ -443,6 +1315,10 @@ impl Shape for Block {
     fn is_empty(&self) -> bool {
         self.bb.is_empty()
     }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.block(self.bb.min, self.bb.max);
+    }
 }
 
 impl Block {
@@ -473,6 +1349,7 @@ impl<S: Shape> Shape for Translate<S> {
         self.shape.hit(&ray, t_min, t_max).map(|hit| Hit {
             point: hit.point + self.offset,
             normal: hit.normal,
+            tangent: hit.tangent,
             t: hit.t,
             u: hit.u,
             v: hit.v,
@@ -490,6 +1367,10 @@ impl<S: Shape> Shape for Translate<S> {
     fn is_empty(&self) -> bool {
         self.shape.is_empty()
     }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.translate(self.offset, &self.shape);
+    }
 }
 
 impl<S: Shape + Clone> Clone for Translate<S> {
@@ -524,6 +1405,7 @@ impl<S: Shape> Shape for Rotate<S> {
         self.shape.hit(&ray, t_min, t_max).map(|hit| Hit {
             point: hit.point.rotate_around(self.axis, self.theta),
             normal: hit.normal.rotate_around(self.axis, self.theta),
+            tangent: hit.tangent.rotate_around(self.axis, self.theta),
             t: hit.t,
             u: hit.u,
             v: hit.v,
@@ -550,6 +1432,10 @@ impl<S: Shape> Shape for Rotate<S> {
     fn is_empty(&self) -> bool {
         self.shape.is_empty()
     }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.rotate(self.axis, self.theta, &self.shape);
+    }
 }
 
 impl<S: Shape + Clone> Clone for Rotate<S> {
@@ -568,6 +1454,127 @@ impl<S: Shape> Rotate<S> {
     }
 }
 
+// Scales uniformly around the origin. Non-uniform scaling is not supported as
+// it would distort directions sampled by the shape.
+#[derive(Debug)]
+pub struct Scale<S: Shape> {
+    factor: f64,
+    shape: S,
+}
+
+impl<S: Shape> Shape for Scale<S> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let ray = Ray::new(ray.origin / self.factor, ray.dir, ray.time);
+        self.shape
+            .hit(&ray, t_min / self.factor, t_max / self.factor)
+            .map(|hit| Hit {
+                point: hit.point * self.factor,
+                normal: hit.normal,
+                tangent: hit.tangent,
+                t: hit.t * self.factor,
+                u: hit.u,
+                v: hit.v,
+            })
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        self.shape.bounding_box(time).scale(self.factor)
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        self.shape.sampler(from / self.factor, time)
+    }
+
+    fn is_empty(&self) -> bool {
+        self.shape.is_empty()
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.scale(self.factor, &self.shape);
+    }
+}
+
+impl<S: Shape + Clone> Clone for Scale<S> {
+    fn clone(&self) -> Self {
+        Self {
+            factor: self.factor,
+            shape: self.shape.clone(),
+        }
+    }
+}
+
+impl<S: Shape> Scale<S> {
+    pub fn new(factor: f64, shape: S) -> Self {
+        assert!(factor > 0.0, "Scale factor must be positive: {}", factor);
+        Scale { factor, shape }
+    }
+}
+
+// Applies an arbitrary invertible affine transform.
+#[derive(Clone, Debug)]
+pub struct Transform<S: Shape> {
+    transform: Mat4,
+    inverse: Mat4,
+    normal_transform: Mat4,
+    shape: S,
+}
+
+impl<S: Shape> Shape for Transform<S> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let dir = self.inverse.transform_dir(ray.dir);
+        let scale = dir.abs();
+        let local = Ray::new(
+            self.inverse.transform_point(ray.origin),
+            dir.unit(),
+            ray.time,
+        );
+        self.shape
+            .hit(&local, t_min * scale, t_max * scale)
+            .map(|hit| Hit {
+                point: self.transform.transform_point(hit.point),
+                normal: self.normal_transform.transform_dir(hit.normal).unit(),
+                tangent: self.transform.transform_dir(hit.tangent).unit(),
+                t: hit.t / scale,
+                u: hit.u,
+                v: hit.v,
+            })
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        let bb = self.shape.bounding_box(time);
+        if bb.is_empty() {
+            return bb;
+        }
+        self.transform.transform_box(bb)
+    }
+
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        self.shape
+            .sampler(self.inverse.transform_point(from), time)
+            .map(|sampler| {
+                Box::new(TransformSampler::new(self.transform, self.inverse, sampler))
+                    as Box<dyn Sampler>
+            })
+    }
+
+    fn is_empty(&self) -> bool {
+        self.shape.is_empty()
+    }
+}
+
+impl<S: Shape> Transform<S> {
+    // Panics if transform is singular.
+    pub fn new(transform: Mat4, shape: S) -> Self {
+        let inverse = transform.inverse().expect("Singular transform");
+        Transform {
+            transform,
+            inverse,
+            normal_transform: inverse.transpose(),
+            shape,
+        }
+    }
+}
+
 #[derive(Debug)]
 pub struct Union<S: Shape> {
     children: Vec<S>,
@@ -627,6 +1634,163 @@ impl<S: Shape> Union<S> {
     }
 }
 
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum CsgOp {
+    Union,
+    Intersection,
+    // Carves b out of a.
+    Difference,
+}
+
+impl CsgOp {
+    fn inside(self, in_a: bool, in_b: bool) -> bool {
+        match self {
+            CsgOp::Union => in_a || in_b,
+            CsgOp::Intersection => in_a && in_b,
+            CsgOp::Difference => in_a && !in_b,
+        }
+    }
+}
+
+const CSG_EPS: f64 = 1e-8;
+
+// Returns where to look for the boundary after one at t, which is relative to
+// t far away so that it still moves forward. It is not greater than t only if
+// t is infinite.
+fn csg_after(t: f64) -> f64 {
+    t + CSG_EPS * t.abs().max(1.0)
+}
+
+// Counts boundaries of a shape along the ray, which is odd if it starts inside.
+fn crossings(shape: &impl Shape, ray: &Ray, t_min: f64) -> usize {
+    let mut count = 0;
+    let mut t = t_min;
+    while let Some(hit) = shape.hit(ray, t, f64::INFINITY) {
+        count += 1;
+        let next = csg_after(hit.t);
+        if !(next > t) {
+            break;
+        }
+        t = next;
+    }
+    count
+}
+
+// Constructive solid geometry of two closed shapes. A ray is followed through
+// the boundaries of both children, and the result is hit where the ray enters
+// or leaves the combined solid.
+#[derive(Clone, Debug)]
+pub struct Csg<A: Shape, B: Shape> {
+    op: CsgOp,
+    a: A,
+    b: B,
+}
+
+impl<A: Shape, B: Shape> Shape for Csg<A, B> {
+    fn hit(&self, ray: &Ray, t_min: f64, t_max: f64) -> Option<Hit> {
+        let mut in_a = crossings(&self.a, ray, t_min) % 2 == 1;
+        let mut in_b = crossings(&self.b, ray, t_min) % 2 == 1;
+        let mut hit_a = self.a.hit(ray, t_min, t_max);
+        let mut hit_b = self.b.hit(ray, t_min, t_max);
+        loop {
+            let from_a = match (&hit_a, &hit_b) {
+                (None, None) => return None,
+                (Some(_), None) => true,
+                (None, Some(_)) => false,
+                (Some(a), Some(b)) => a.t <= b.t,
+            };
+            let inside = self.op.inside(in_a, in_b);
+            let hit = if from_a {
+                in_a = !in_a;
+                hit_a.take().unwrap()
+            } else {
+                in_b = !in_b;
+                hit_b.take().unwrap()
+            };
+            if self.op.inside(in_a, in_b) != inside {
+                // Make the normal face outward of the combined solid.
+                let normal = if (ray.dir.dot(hit.normal) < 0.0) == !inside {
+                    hit.normal
+                } else {
+                    -hit.normal
+                };
+                return Some(Hit { normal, ..hit });
+            }
+            let next = csg_after(hit.t);
+            if !(next > hit.t) {
+                return None;
+            }
+            if from_a {
+                hit_a = self.a.hit(ray, next, t_max);
+            } else {
+                hit_b = self.b.hit(ray, next, t_max);
+            }
+        }
+    }
+
+    fn bounding_box(&self, time: TimeRange) -> Box3 {
+        let a = self.a.bounding_box(time);
+        let b = self.b.bounding_box(time);
+        match self.op {
+            CsgOp::Union => a.union(b),
+            CsgOp::Intersection => {
+                let min = Vec3::new(
+                    a.min.x.max(b.min.x),
+                    a.min.y.max(b.min.y),
+                    a.min.z.max(b.min.z),
+                );
+                let max = Vec3::new(
+                    a.max.x.min(b.max.x),
+                    a.max.y.min(b.max.y),
+                    a.max.z.min(b.max.z),
+                );
+                if min.x > max.x || min.y > max.y || min.z > max.z {
+                    Box3::EMPTY
+                } else {
+                    Box3::new(min, max)
+                }
+            }
+            CsgOp::Difference => a,
+        }
+    }
+
+    // Samples the children, which cover the combined solid.
+    fn sampler(&self, from: Vec3, time: f64) -> Option<Box<dyn Sampler>> {
+        match self.op {
+            CsgOp::Union => {
+                let samplers = vec![self.a.sampler(from, time), self.b.sampler(from, time)]
+                    .into_iter()
+                    .flatten()
+                    .collect_vec();
+                if samplers.is_empty() {
+                    None
+                } else {
+                    Some(Box::new(MixedSampler::new(samplers)))
+                }
+            }
+            CsgOp::Intersection | CsgOp::Difference => self.a.sampler(from, time),
+        }
+    }
+
+    fn is_empty(&self) -> bool {
+        match self.op {
+            CsgOp::Union => self.a.is_empty() && self.b.is_empty(),
+            CsgOp::Intersection => self.a.is_empty() || self.b.is_empty(),
+            CsgOp::Difference => self.a.is_empty(),
+        }
+    }
+
+    fn describe(&self, visitor: &mut dyn ShapeVisitor) {
+        visitor.csg(self.op, &self.a, &self.b);
+    }
+}
+
+impl<A: Shape, B: Shape> Csg<A, B> {
+    pub fn new(op: CsgOp, a: A, b: B) -> Self {
+        Csg { op, a, b }
+    }
+}
+
 pub fn merge_shapes(shapes: impl IntoIterator<Item = Box<dyn Shape>>) -> Box<dyn Shape> {
     let mut shapes = shapes.into_iter().filter(|s| !s.is_empty()).collect_vec();
     match shapes.len() {
@@ -635,3 +1799,111 @@ pub fn merge_shapes(shapes: impl IntoIterator<Item = Box<dyn Shape>>) -> Box<dyn
         _ => Box::new(Union::new(shapes)),
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::rng::Rng;
+    use rand::{Rng as _, SeedableRng};
+
+    fn assert_on_sphere(sphere: &Sphere, ray: &Ray, hit: &Hit) {
+        let msg = format!("{:?} {:?} -> {:?}", sphere, ray, hit);
+        let distance = (hit.point - sphere.center).abs();
+        assert!(
+            (distance - sphere.radius).abs() <= 1e-8 * sphere.radius,
+            "{}",
+            msg
+        );
+        assert!((hit.normal.into_vec3().abs() - 1.0).abs() < 1e-9, "{}", msg);
+        assert!(hit.normal.dot(hit.point - sphere.center) > 0.0, "{}", msg);
+        assert!((0.0..=1.0).contains(&hit.u), "{}", msg);
+        assert!((0.0..=1.0).contains(&hit.v), "{}", msg);
+    }
+
+    #[test]
+    fn test_sphere_hit_on_surface() {
+        let mut rng = Rng::seed_from_u64(28);
+        let mut hits = 0;
+        for _ in 0..10000 {
+            let radius = 10f64.powf(rng.gen_range(-6.0..3.0));
+            let sphere = Sphere::new(Vec3::random_in_unit_sphere(&mut rng) * 10.0, radius);
+
+            // Rays from outside aimed around the sphere, many of them grazing.
+            let distance = radius * 10f64.powf(rng.gen_range(0.0..4.0));
+            let origin = sphere.center + Vec3Unit::random_on_unit_sphere(&mut rng) * distance;
+            let target = sphere.center
+                + Vec3Unit::random_on_unit_sphere(&mut rng) * (radius * rng.gen_range(0.9..1.1));
+            let ray = Ray::new(origin, (target - origin).unit(), 0.0);
+            if let Some(hit) = sphere.hit(&ray, 0.0, f64::INFINITY) {
+                assert_on_sphere(&sphere, &ray, &hit);
+                hits += 1;
+            }
+
+            // Rays from inside always hit.
+            let origin = sphere.center + Vec3::random_in_unit_sphere(&mut rng) * radius;
+            let ray = Ray::new(origin, Vec3Unit::random_on_unit_sphere(&mut rng), 0.0);
+            let hit = sphere.hit(&ray, 0.0, f64::INFINITY).unwrap();
+            assert_on_sphere(&sphere, &ray, &hit);
+        }
+        assert!(hits > 1000, "{}", hits);
+    }
+
+    #[test]
+    fn test_csg_hit() {
+        let a = Sphere::new(Vec3::ZERO, 1.0);
+        let b = Sphere::new(Vec3::new(1.0, 0.0, 0.0), 1.0);
+        let from_left = Ray::new(
+            Vec3::new(-5.0, 0.0, 0.0),
+            Vec3::new(1.0, 0.0, 0.0).unit(),
+            0.0,
+        );
+        let from_right = Ray::new(
+            Vec3::new(5.0, 0.0, 0.0),
+            Vec3::new(-1.0, 0.0, 0.0).unit(),
+            0.0,
+        );
+        for (op, ray, t, normal_x) in [
+            (CsgOp::Union, &from_left, 4.0, -1.0),
+            (CsgOp::Union, &from_right, 3.0, 1.0),
+            (CsgOp::Intersection, &from_left, 5.0, -1.0),
+            (CsgOp::Intersection, &from_right, 4.0, 1.0),
+            (CsgOp::Difference, &from_left, 4.0, -1.0),
+            (CsgOp::Difference, &from_right, 5.0, 1.0),
+        ] {
+            let csg = Csg::new(op, a.clone(), b.clone());
+            let hit = csg.hit(ray, 1e-8, f64::INFINITY).expect("hit");
+            assert!((hit.t - t).abs() < 1e-9, "{:?} {:?} {:?}", op, ray, hit);
+            assert!(
+                (hit.normal.into_vec3() - Vec3::new(normal_x, 0.0, 0.0)).abs() < 1e-9,
+                "{:?} {:?} {:?}",
+                op,
+                ray,
+                hit
+            );
+        }
+
+        // Rays starting inside leave where the combined solid ends.
+        let inside = Ray::new(
+            Vec3::new(0.5, 0.0, 0.0),
+            Vec3::new(1.0, 0.0, 0.0).unit(),
+            0.0,
+        );
+        let csg = Csg::new(CsgOp::Intersection, a.clone(), b.clone());
+        let hit = csg.hit(&inside, 1e-8, f64::INFINITY).expect("hit");
+        assert!((hit.t - 0.5).abs() < 1e-9, "{:?}", hit);
+        assert!(hit.normal.x > 0.0, "{:?}", hit);
+        let csg = Csg::new(CsgOp::Difference, a, b);
+        assert!(csg.hit(&inside, 1e-8, f64::INFINITY).is_none());
+    }
+
+    #[test]
+    fn test_csg_hit_far() {
+        // Steps along the ray must not vanish in rounding far from its origin.
+        let a = Sphere::new(Vec3::new(1e9, 0.0, 0.0), 1e3);
+        let b = Sphere::new(Vec3::new(1e9 + 1e3, 0.0, 0.0), 1e3);
+        let ray = Ray::new(Vec3::ZERO, Vec3::new(1.0, 0.0, 0.0).unit(), 0.0);
+        let csg = Csg::new(CsgOp::Difference, a, b);
+        let hit = csg.hit(&ray, 1e-8, f64::INFINITY).expect("hit");
+        assert!((hit.t - (1e9 - 1e3)).abs() < 1e-3, "{:?}", hit);
+    }
+}
@@ -0,0 +1,169 @@
+// Analytic daylight sky by Preetham, Shirley and Smits, "A Practical Analytic
+// Model for Daylight" (1999).
+//
+// The sun is placed by its elevation above the horizon and its azimuth, which
+// is measured from +X toward +Z. The sun disk is drawn larger and dimmer than
+// the real one so that it converges without being sampled directly.
+
+use crate::color::Color;
+use crate::geom::{IntoVec3, Vec3, Vec3Unit};
+use anyhow::{bail, Result};
+use std::f64::consts::PI;
+
+// Converts sky luminance in kcd/m^2 to scene radiance.
+const SCALE: f64 = 0.05;
+const SUN_COS: f64 = 0.9994;
+const SUN_RADIANCE: f64 = 50.0;
+
+#[derive(Clone, Copy, Debug)]
+pub struct SkyModel {
+    elevation: f64,
+    azimuth: f64,
+    turbidity: f64,
+    sun: Vec3Unit,
+    // Zenith values and Perez coefficients of luminance and chromaticities.
+    zenith: [f64; 3],
+    perez: [[f64; 5]; 3],
+    sun_color: Color,
+}
+
+impl SkyModel {
+    // Angles are in degrees. Turbidity is 2 for a clear sky and around 10 for
+    // a hazy one.
+    pub fn new(elevation: f64, azimuth: f64, turbidity: f64) -> Result<Self> {
+        if !(0.0..=90.0).contains(&elevation) {
+            bail!("Sun elevation must be in [0, 90]: {}", elevation);
+        }
+        if !(2.0..=10.0).contains(&turbidity) {
+            bail!("Turbidity must be in [2, 10]: {}", turbidity);
+        }
+        let t = turbidity;
+        let (el, az) = (elevation.to_radians(), azimuth.to_radians());
+        let sun = Vec3::new(el.cos() * az.cos(), el.sin(), el.cos() * az.sin()).unit();
+
+        // Zenith angle of the sun.
+        let ts = PI / 2.0 - el;
+        let chi = (4.0 / 9.0 - t / 120.0) * (PI - 2.0 * ts);
+        let zenith_y = (4.0453 * t - 4.9710) * chi.tan() - 0.2155 * t + 2.4192;
+        let poly = |c: [f64; 4]| c[0] * ts.powi(3) + c[1] * ts.powi(2) + c[2] * ts + c[3];
+        let zenith_x = t * t * poly([0.00166, -0.00375, 0.00209, 0.0])
+            + t * poly([-0.02903, 0.06377, -0.03202, 0.00394])
+            + poly([0.11693, -0.21196, 0.06052, 0.25886]);
+        let zenith_yc = t * t * poly([0.00275, -0.00610, 0.00317, 0.0])
+            + t * poly([-0.04214, 0.08970, -0.04153, 0.00516])
+            + poly([0.15346, -0.26756, 0.06670, 0.26688]);
+        let perez = [
+            [
+                0.1787 * t - 1.4630,
+                -0.3554 * t + 0.4275,
+                -0.0227 * t + 5.3251,
+                0.1206 * t - 2.5771,
+                -0.0670 * t + 0.3703,
+            ],
+            [
+                -0.0193 * t - 0.2592,
+                -0.0665 * t + 0.0008,
+                -0.0004 * t + 0.2125,
+                -0.0641 * t - 0.8989,
+                -0.0033 * t + 0.0452,
+            ],
+            [
+                -0.0167 * t - 0.2608,
+                -0.0950 * t + 0.0092,
+                -0.0079 * t + 0.2102,
+                -0.0441 * t - 1.6537,
+                -0.0109 * t + 0.0529,
+            ],
+        ];
+
+        // The sun reddens through more air near the horizon.
+        let air_mass = 1.0 / (ts.cos() + 0.15 * (93.885 - ts.to_degrees()).powf(-1.253));
+        let extinction = |k: f64| (-air_mass * k * t).exp();
+        let sun_color = Color::new(extinction(0.02), extinction(0.04), extinction(0.08));
+
+        Ok(SkyModel {
+            elevation,
+            azimuth,
+            turbidity,
+            sun,
+            zenith: [zenith_y, zenith_x, zenith_yc],
+            perez,
+            sun_color,
+        })
+    }
+
+    pub fn elevation(&self) -> f64 {
+        self.elevation
+    }
+
+    pub fn azimuth(&self) -> f64 {
+        self.azimuth
+    }
+
+    pub fn turbidity(&self) -> f64 {
+        self.turbidity
+    }
+
+    pub fn color(&self, dir: Vec3Unit) -> Color {
+        let cos_gamma = dir.dot(self.sun);
+        if dir.y >= 0.0 && cos_gamma > SUN_COS {
+            return self.sun_color * SUN_RADIANCE;
+        }
+        // Below the horizon is a gray ground lit by the sky near the horizon.
+        let (cos_theta, ground) = if dir.y < 0.0 {
+            (0.01, 0.3)
+        } else {
+            (dir.y.max(0.01), 1.0)
+        };
+        let gamma = cos_gamma.max(-1.0).min(1.0).acos();
+        let sun_theta = PI / 2.0 - self.elevation.to_radians();
+        let perez = |c: [f64; 5], cos_theta: f64, gamma: f64| {
+            (1.0 + c[0] * (c[1] / cos_theta).exp())
+                * (1.0 + c[2] * (c[3] * gamma).exp() + c[4] * gamma.cos().powi(2))
+        };
+        let value = |i: usize| {
+            self.zenith[i] * perez(self.perez[i], cos_theta, gamma)
+                / perez(self.perez[i], 1.0, sun_theta)
+        };
+        xyy_to_rgb(value(1), value(2), value(0) * SCALE * ground)
+    }
+}
+
+// Converts CIE xyY to linear sRGB.
+fn xyy_to_rgb(x: f64, y: f64, luminance: f64) -> Color {
+    if !(y > 0.0) {
+        return Color::BLACK;
+    }
+    let cx = x / y * luminance;
+    let cy = luminance;
+    let cz = (1.0 - x - y) / y * luminance;
+    Color::new(
+        3.2406 * cx - 1.5372 * cy - 0.4986 * cz,
+        -0.9689 * cx + 1.8758 * cy + 0.0415 * cz,
+        0.0557 * cx - 0.2040 * cy + 1.0570 * cz,
+    )
+    .clamp(0.0, f64::MAX)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_sky() {
+        let sky = SkyModel::new(45.0, 0.0, 3.0).unwrap();
+        let zenith = sky.color(Vec3Unit::Y);
+        assert!(zenith.b > zenith.r, "zenith = {:?}", zenith);
+        assert!(zenith.luminance() > 0.1 && zenith.luminance() < 10.0);
+        let sun = sky.color(Vec3::new(1.0, 1.0, 0.0).unit());
+        assert!(sun.luminance() > 10.0);
+        for i in 0..100 {
+            let a = i as f64;
+            let dir = Vec3::new(a.cos(), (a * 0.37).sin(), a.sin()).unit();
+            let c = sky.color(dir);
+            assert!(c.r.is_finite() && c.g.is_finite() && c.b.is_finite());
+        }
+        assert!(SkyModel::new(-1.0, 0.0, 3.0).is_err());
+        assert!(SkyModel::new(30.0, 0.0, 1.0).is_err());
+    }
+}
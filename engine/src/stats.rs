@@ -0,0 +1,92 @@
+use std::cell::Cell;
+
+// Counts of work done while tracing rays, to find what makes scenes slow to
+// render. Counts only grow; differences of two snapshots tell the work done in
+// between.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub struct RenderStats {
+    // Rays traced into the world, including shadow rays and rays of AOVs.
+    pub rays: u64,
+    // Paths traced from the camera, and the surfaces they hit.
+    pub paths: u64,
+    pub bounces: u64,
+    // Nodes of BVHs, kd-trees and object groups visited.
+    pub nodes: u64,
+    // Shapes intersected.
+    pub shapes: u64,
+}
+
+impl RenderStats {
+    // Average number of surfaces hit by a path, or None if no path was traced
+    // by an integrator counting bounces.
+    pub fn average_depth(&self) -> Option<f64> {
+        if self.paths == 0 || self.bounces == 0 {
+            return None;
+        }
+        Some(self.bounces as f64 / self.paths as f64)
+    }
+}
+
+impl std::ops::Add for RenderStats {
+    type Output = RenderStats;
+    fn add(self, rhs: Self) -> Self::Output {
+        RenderStats {
+            rays: self.rays + rhs.rays,
+            paths: self.paths + rhs.paths,
+            bounces: self.bounces + rhs.bounces,
+            nodes: self.nodes + rhs.nodes,
+            shapes: self.shapes + rhs.shapes,
+        }
+    }
+}
+
+impl std::ops::Sub for RenderStats {
+    type Output = RenderStats;
+    fn sub(self, rhs: Self) -> Self::Output {
+        RenderStats {
+            rays: self.rays - rhs.rays,
+            paths: self.paths - rhs.paths,
+            bounces: self.bounces - rhs.bounces,
+            nodes: self.nodes - rhs.nodes,
+            shapes: self.shapes - rhs.shapes,
+        }
+    }
+}
+
+thread_local! {
+    static STATS: Cell<RenderStats> = Cell::new(RenderStats::default());
+}
+
+fn update(f: impl FnOnce(&mut RenderStats)) {
+    STATS.with(|stats| {
+        let mut s = stats.get();
+        f(&mut s);
+        stats.set(s);
+    });
+}
+
+// Adds counts to the ones of the current thread. Traversals count in locals
+// and record once, so that counting costs little.
+pub fn record(nodes: u64, shapes: u64) {
+    update(|s| {
+        s.nodes += nodes;
+        s.shapes += shapes;
+    });
+}
+
+pub fn record_rays(rays: u64) {
+    update(|s| s.rays += rays);
+}
+
+pub fn record_paths(paths: u64) {
+    update(|s| s.paths += paths);
+}
+
+pub fn record_bounce() {
+    update(|s| s.bounces += 1);
+}
+
+// Returns counts recorded on the current thread so far.
+pub fn get() -> RenderStats {
+    STATS.with(|stats| stats.get())
+}
@@ -2,16 +2,40 @@ use crate::color::Color;
 use crate::geom::{IntoVec3, Vec3, Vec3Unit};
 use crate::rng::Rng;
 use anyhow::Result;
-use jpeg_decoder::{ImageInfo, PixelFormat};
+use jpeg_decoder::PixelFormat;
 use rand::seq::SliceRandom;
 use std::error::Error;
 use std::fs::File;
-use std::io::BufReader;
-use std::path::Path;
+use std::io::{BufReader, Read};
+use std::iter::repeat;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
 use std::{fmt, io};
 
 pub trait Texture: Sync + Send {
     fn color(&self, u: f64, v: f64, p: Vec3) -> Color;
+
+    // Calls the method of the visitor for the texture with its parameters, or
+    // none if the texture cannot be described.
+    fn describe(&self, _visitor: &mut dyn TextureVisitor) {}
+}
+
+// Visits textures by their parameters, like ShapeVisitor.
+pub trait TextureVisitor {
+    fn solid(&mut self, color: Color);
+    fn checker(&mut self, even: &dyn Texture, odd: &dyn Texture, stride: f64);
+    fn marble(&mut self, scale: f64);
+    fn image(&mut self, path: &Path);
+}
+
+impl Texture for Arc<dyn Texture> {
+    fn color(&self, u: f64, v: f64, p: Vec3) -> Color {
+        self.as_ref().color(u, v, p)
+    }
+
+    fn describe(&self, visitor: &mut dyn TextureVisitor) {
+        self.as_ref().describe(visitor)
+    }
 }
 
 #[derive(Clone, Copy, Debug)]
@@ -21,6 +45,10 @@ impl Texture for SolidColor {
     fn color(&self, _u: f64, _v: f64, _p: Vec3) -> Color {
         self.0
     }
+
+    fn describe(&self, visitor: &mut dyn TextureVisitor) {
+        visitor.solid(self.0);
+    }
 }
 
 impl SolidColor {
@@ -52,6 +80,10 @@ impl<A: Texture, B: Texture> Texture for Checker<A, B> {
             self.odd.color(u, v, p)
         }
     }
+
+    fn describe(&self, visitor: &mut dyn TextureVisitor) {
+        visitor.checker(&self.even, &self.odd, self.stride);
+    }
 }
 
 impl<A: Texture, B: Texture> Checker<A, B> {
@@ -60,6 +92,25 @@ impl<A: Texture, B: Texture> Checker<A, B> {
     }
 }
 
+// Multiplies colors of the texture by the factor.
+#[derive(Clone)]
+pub struct Tinted<T: Texture> {
+    texture: T,
+    factor: Color,
+}
+
+impl<T: Texture> Texture for Tinted<T> {
+    fn color(&self, u: f64, v: f64, p: Vec3) -> Color {
+        self.texture.color(u, v, p) * self.factor
+    }
+}
+
+impl<T: Texture> Tinted<T> {
+    pub fn new(texture: T, factor: Color) -> Self {
+        Tinted { texture, factor }
+    }
+}
+
 #[derive(Clone)]
 pub struct Marble {
     perlin: Perlin,
@@ -71,6 +122,11 @@ impl Texture for Marble {
         // Color::WHITE * ((self.perlin.noise(p * self.scale) + 1.0) * 0.5)
         Color::WHITE * (0.5 * (1.0 + (self.scale * p.z + 10.0 * self.perlin.turbulence(p)).sin()))
     }
+
+    // The noise is not described; it is generated again when loaded.
+    fn describe(&self, visitor: &mut dyn TextureVisitor) {
+        visitor.marble(self.scale);
+    }
 }
 
 impl Marble {
@@ -84,15 +140,40 @@ impl Marble {
 
 #[derive(Clone)]
 pub struct Image {
+    // None for images decoded from memory.
+    path: Option<PathBuf>,
     pixels: Vec<u8>,
-    info: ImageInfo,
+    width: usize,
+    height: usize,
 }
 
 impl Texture for Image {
     fn color(&self, u: f64, v: f64, _p: Vec3) -> Color {
-        let i = ((self.info.height as f64 * (1.0 - v)) as u16).min(self.info.height - 1) as usize;
-        let j = ((self.info.width as f64 * u) as u16).min(self.info.width - 1) as usize;
-        let offset = (i * self.info.width as usize + j) * 3;
+        let i = ((self.height as f64 * (1.0 - v)) as usize).min(self.height - 1);
+        let j = ((self.width as f64 * u) as usize).min(self.width - 1);
+        self.pixel(j, i)
+    }
+
+    // Images not loaded from files cannot be described.
+    fn describe(&self, visitor: &mut dyn TextureVisitor) {
+        if let Some(path) = &self.path {
+            visitor.image(path);
+        }
+    }
+}
+
+impl Image {
+    pub fn width(&self) -> usize {
+        self.width
+    }
+
+    pub fn height(&self) -> usize {
+        self.height
+    }
+
+    // Returns the pixel at the column x and the row y counted from the top.
+    pub fn pixel(&self, x: usize, y: usize) -> Color {
+        let offset = (y * self.width + x) * 3;
         fn f(b: u8) -> f64 {
             b as f64 / 255.0
         }
@@ -102,12 +183,35 @@ impl Texture for Image {
             f(self.pixels[offset + 2]),
         )
     }
-}
 
-impl Image {
     pub fn load(path: impl AsRef<Path>) -> Result<Image> {
-        let file = File::open(path)?;
-        let mut decoder = jpeg_decoder::Decoder::new(BufReader::new(file));
+        let path = path.as_ref();
+        let is_png = path
+            .extension()
+            .map_or(false, |ext| ext.eq_ignore_ascii_case("png"));
+        let reader = BufReader::new(File::open(path)?);
+        let image = if is_png {
+            Self::decode_png(reader)?
+        } else {
+            Self::decode_jpeg(reader)?
+        };
+        Ok(Image {
+            path: Some(path.to_owned()),
+            ..image
+        })
+    }
+
+    // Decodes a PNG or JPEG image in memory.
+    pub fn decode(data: &[u8], is_png: bool) -> Result<Image> {
+        if is_png {
+            Self::decode_png(data)
+        } else {
+            Self::decode_jpeg(data)
+        }
+    }
+
+    fn decode_jpeg(reader: impl Read) -> Result<Image> {
+        let mut decoder = jpeg_decoder::Decoder::new(reader);
         let pixels = decoder.decode()?;
         let info = decoder.info().unwrap();
         if info.pixel_format != PixelFormat::RGB24 {
@@ -117,7 +221,45 @@ impl Image {
             )))
             .into());
         }
-        Ok(Image { pixels, info })
+        Ok(Image {
+            path: None,
+            pixels,
+            width: info.width as usize,
+            height: info.height as usize,
+        })
+    }
+
+    fn decode_png(reader: impl Read) -> Result<Image> {
+        let mut decoder = png::Decoder::new(reader);
+        decoder.set_transformations(png::Transformations::EXPAND | png::Transformations::STRIP_16);
+        let (info, mut reader) = decoder.read_info().map_err(ImageError::Png)?;
+        let mut buf = vec![0; info.buffer_size()];
+        reader.next_frame(&mut buf).map_err(ImageError::Png)?;
+        let pixels = match info.color_type {
+            png::ColorType::RGB => buf,
+            png::ColorType::RGBA => buf
+                .chunks_exact(4)
+                .flat_map(|p| p[..3].iter().copied())
+                .collect(),
+            png::ColorType::Grayscale => buf.iter().flat_map(|&g| repeat(g).take(3)).collect(),
+            png::ColorType::GrayscaleAlpha => buf
+                .chunks_exact(2)
+                .flat_map(|p| repeat(p[0]).take(3))
+                .collect(),
+            png::ColorType::Indexed => {
+                return Err(ImageError::Unsupported(format!(
+                    "Unsupported color type: {:?}",
+                    info.color_type
+                ))
+                .into())
+            }
+        };
+        Ok(Image {
+            path: None,
+            pixels,
+            width: info.width as usize,
+            height: info.height as usize,
+        })
     }
 }
 
@@ -125,6 +267,8 @@ impl Image {
 pub enum ImageError {
     Io(io::Error),
     Decoder(jpeg_decoder::Error),
+    Png(png::DecodingError),
+    Unsupported(String),
 }
 
 impl fmt::Display for ImageError {
@@ -132,6 +276,8 @@ impl fmt::Display for ImageError {
         match self {
             ImageError::Io(e) => e.fmt(f),
             ImageError::Decoder(e) => e.fmt(f),
+            ImageError::Png(e) => e.fmt(f),
+            ImageError::Unsupported(msg) => msg.fmt(f),
         }
     }
 }
@@ -1,16 +1,47 @@
 use crate::background::Background;
-use crate::object::Object;
+use crate::light::Light;
+use crate::object::{Object, ObjectHit};
+use crate::ray::{Ray, RayBatch};
+use crate::rng::Rng;
+use crate::stats;
+use std::sync::Arc;
 
 pub struct World {
     pub object: Box<dyn Object>,
-    pub background: Background,
+    pub background: Arc<dyn Background>,
+    // Delta lights, which rays never hit.
+    pub lights: Vec<Light>,
 }
 
 impl World {
-    pub fn new<O: Object + 'static>(object: O, background: Background) -> Self {
+    pub fn new<O: Object + 'static, B: Background + 'static>(object: O, background: B) -> Self {
         World {
             object: Box::new(object),
-            background,
+            background: Arc::new(background),
+            lights: Vec::new(),
         }
     }
+
+    pub fn with_lights(mut self, lights: Vec<Light>) -> Self {
+        self.lights = lights;
+        self
+    }
+
+    // Same as the ones of the object, but counts rays in stats.
+    pub fn hit(&self, ray: &Ray, t_min: f64, t_max: f64, rng: &mut Rng) -> Option<ObjectHit> {
+        stats::record_rays(1);
+        self.object.hit(ray, t_min, t_max, rng)
+    }
+
+    pub fn hit_batch(
+        &self,
+        batch: &RayBatch,
+        t_min: f64,
+        t_max: f64,
+        rng: &mut Rng,
+        hits: &mut [Option<ObjectHit>],
+    ) {
+        stats::record_rays(batch.len() as u64);
+        self.object.hit_batch(batch, t_min, t_max, rng, hits);
+    }
 }
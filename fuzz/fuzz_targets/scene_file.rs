@@ -0,0 +1,23 @@
+// Parses arbitrary text as a scene file, which must fail cleanly if it is not
+// one. Parsed files are validated and must survive a round trip through YAML.
+// They are not loaded since it may read other files or take unbounded time,
+// e.g. for many subdivisions.
+
+#![no_main]
+
+use engine::SceneFile;
+use libfuzzer_sys::fuzz_target;
+
+fuzz_target!(|data: &[u8]| {
+    let text = match std::str::from_utf8(data) {
+        Ok(text) => text,
+        Err(_) => return,
+    };
+    let file = match SceneFile::from_yaml(text) {
+        Ok(file) => file,
+        Err(_) => return,
+    };
+    file.validate();
+    let yaml = file.to_yaml().unwrap();
+    SceneFile::from_yaml(&yaml).unwrap();
+});
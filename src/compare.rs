@@ -0,0 +1,63 @@
+// The compare subcommand, which prints how much an image differs from a
+// reference and draws where.
+
+use anyhow::{Context, Result};
+use clap::Clap;
+use engine::{compare_images, false_color, pixel_differences, ImageData};
+use std::fs::File;
+use std::io::BufWriter;
+use std::path::{Path, PathBuf};
+
+// Compares an image with a reference, printing RMSE, PSNR and SSIM.
+#[derive(Clap)]
+pub struct CompareOpts {
+    reference: PathBuf,
+    image: PathBuf,
+    // Writes the differences of pixels in false colors to this PNG.
+    #[clap(long)]
+    diff: Option<PathBuf>,
+    // Difference drawn in the brightest color, the largest one by default.
+    #[clap(long)]
+    diff_scale: Option<f64>,
+}
+
+pub fn run(opts: &CompareOpts) -> Result<()> {
+    let load = |path: &Path| {
+        ImageData::load(path).with_context(|| format!("Failed to load {}", path.display()))
+    };
+    let reference = load(&opts.reference)?;
+    let image = load(&opts.image)?;
+    let comparison = compare_images(&reference, &image)?;
+    println!("RMSE  {:.6}", comparison.rmse);
+    println!("PSNR  {:.2} dB", comparison.psnr);
+    println!("SSIM  {:.4}", comparison.ssim);
+    if let Some(path) = &opts.diff {
+        write_diff(path, &reference, &image, opts.diff_scale)
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+    }
+    Ok(())
+}
+
+fn write_diff(
+    path: &Path,
+    reference: &ImageData,
+    image: &ImageData,
+    scale: Option<f64>,
+) -> Result<()> {
+    let diffs = pixel_differences(reference, image);
+    let scale = scale.unwrap_or_else(|| diffs.iter().cloned().fold(0.0, f64::max));
+    let data: Vec<u8> = diffs
+        .iter()
+        .flat_map(|d| {
+            // Identical images are drawn black.
+            let t = if scale > 0.0 { d / scale } else { 0.0 };
+            false_color(t).to_vec()
+        })
+        .collect();
+    let file = File::create(path)?;
+    let mut encoder = png::Encoder::new(BufWriter::new(file), reference.width, reference.height);
+    encoder.set_color(png::ColorType::RGB);
+    encoder.set_depth(png::BitDepth::Eight);
+    encoder.write_header()?.write_image_data(&data)?;
+    Ok(())
+}
@@ -0,0 +1,628 @@
+// Distributed rendering over HTTP. Workers render tiles they are asked for,
+// and the coordinator, which is a render run with worker addresses, hands out
+// tiles, retries the ones of failing workers elsewhere and assembles the
+// image. Tiles render to the same pixels wherever they are rendered.
+//
+// Jobs are the command lines of coordinators, which workers load scenes with
+// as if they were run with them, so scene files must be at the same paths on
+// every machine.
+//
+// Workers trust coordinators like users trust their shells: a job can read
+// any file the worker can as a scene and keep its CPUs busy. So workers only
+// listen on loopback addresses unless they share a secret with coordinators,
+// which both are run with in $RAYTRACING_WORKER_SECRET and is sent with every
+// request.
+//
+// Workers serve metrics of the tiles they render for Prometheus at /metrics.
+
+use crate::http::{
+    check_listen, env_secret, read_request, request, respond, serve, Request, StatusError,
+};
+use crate::metrics::{self, Metrics};
+use anyhow::{bail, Context, Result};
+use clap::Clap;
+use engine::{
+    make_tiles, render_single_tile, Camera, Color, Frame, IntegratorKind, Progress, RenderParams,
+    RenderStats, Tile, TileSpan, World,
+};
+use log::{info, warn};
+use std::collections::{HashMap, VecDeque};
+use std::convert::TryInto;
+use std::net::{SocketAddr, TcpListener, TcpStream};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::mpsc::{self, Receiver, RecvTimeoutError, Sender};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+// Requests failing this many times in a row give up on the worker.
+const MAX_FAILURES: u32 = 3;
+// Tiles of many samples take long, but not this long.
+const TILE_TIMEOUT: Duration = Duration::from_secs(600);
+const INFO_TIMEOUT: Duration = Duration::from_secs(10);
+// Jobs are command lines.
+const MAX_JOB: usize = 1 << 20;
+const SECRET_ENV: &str = "RAYTRACING_WORKER_SECRET";
+
+// Serves tiles of renders to coordinators.
+#[derive(Clap)]
+pub struct WorkerOpts {
+    #[clap(long, default_value = "127.0.0.1:8642")]
+    listen: String,
+    // Tiles rendered at once, the number of CPUs by default.
+    #[clap(long)]
+    threads: Option<usize>,
+}
+
+// What workers render, loaded from a job.
+pub struct Job {
+    pub params: RenderParams,
+    pub camera: Camera,
+    pub world: World,
+    pub aovs: Vec<IntegratorKind>,
+}
+
+type Loader = dyn Fn(&str) -> Result<Job> + Send + Sync;
+
+struct WorkerState {
+    threads: usize,
+    secret: Option<String>,
+    load: Box<Loader>,
+    // The last job loaded, which is usually the one of the next request.
+    job: Mutex<Option<(String, Arc<Job>)>>,
+    metrics: Mutex<Metrics>,
+}
+
+pub struct Worker {
+    addr: SocketAddr,
+}
+
+impl Worker {
+    // Starts serving on the address in background threads, which run until
+    // the process exits. Requests must have the secret if any. load turns jobs
+    // into scenes.
+    pub fn start(
+        addr: &str,
+        threads: usize,
+        secret: Option<String>,
+        load: impl Fn(&str) -> Result<Job> + Send + Sync + 'static,
+    ) -> Result<Self> {
+        let listener =
+            TcpListener::bind(addr).with_context(|| format!("Failed to listen on {}", addr))?;
+        let addr = listener.local_addr()?;
+        let state = Arc::new(WorkerState {
+            threads,
+            secret,
+            load: Box::new(load),
+            job: Mutex::new(None),
+            metrics: Mutex::new(Metrics::default()),
+        });
+        // Coordinators retry failed requests.
+        thread::spawn(move || {
+            serve(listener, move |stream| {
+                handle(stream, &state).ok();
+            })
+        });
+        Ok(Worker { addr })
+    }
+
+    pub fn addr(&self) -> SocketAddr {
+        self.addr
+    }
+}
+
+pub fn run_worker(
+    opts: &WorkerOpts,
+    load: impl Fn(&str) -> Result<Job> + Send + Sync + 'static,
+) -> Result<()> {
+    let threads = match opts.threads {
+        Some(threads) => threads,
+        None => thread::available_parallelism().map_or(1, |n| n.get()),
+    };
+    if threads == 0 {
+        bail!("Threads must be positive");
+    }
+    let secret = secret();
+    check_listen(&opts.listen, secret.as_deref(), SECRET_ENV)?;
+    let worker = Worker::start(&opts.listen, threads, secret, load)?;
+    info!(addr:% = worker.addr(), threads; "Waiting for tiles");
+    loop {
+        thread::park();
+    }
+}
+
+// Returns the secret shared by workers and coordinators, if set.
+pub fn secret() -> Option<String> {
+    env_secret(SECRET_ENV)
+}
+
+fn handle(mut stream: TcpStream, state: &WorkerState) -> std::io::Result<()> {
+    let request = read_request(&stream, MAX_JOB, state.secret.as_deref())?;
+    match (request.method.as_str(), request.route()) {
+        ("GET", "/info") => respond(
+            &mut stream,
+            "200 OK",
+            "text/plain",
+            format!("threads {}\n", state.threads).as_bytes(),
+        ),
+        ("GET", "/metrics") => {
+            let metrics = state.metrics.lock().unwrap().encode();
+            respond(
+                &mut stream,
+                "200 OK",
+                metrics::CONTENT_TYPE,
+                metrics.as_bytes(),
+            )
+        }
+        ("POST", "/render") => match render(&request, state) {
+            Ok(data) => respond(&mut stream, "200 OK", "application/octet-stream", &data),
+            // Bad jobs fail the same way on every worker, which coordinators
+            // should not retry.
+            Err(err) => respond(
+                &mut stream,
+                "400 Bad Request",
+                "text/plain",
+                format!("{:#}\n", err).as_bytes(),
+            ),
+        },
+        _ => respond(&mut stream, "404 Not Found", "text/plain", b"Not found\n"),
+    }
+}
+
+fn render(request: &Request, state: &WorkerState) -> Result<Vec<u8>> {
+    let param = |name: &str| -> Result<u32> {
+        match request.query(name).map(|value| value.parse()) {
+            Some(Ok(value)) => Ok(value),
+            _ => bail!("Invalid {}", name),
+        }
+    };
+    let tile = Tile {
+        x: param("x")?,
+        y: param("y")?,
+        width: param("width")?,
+        height: param("height")?,
+    };
+    let text = std::str::from_utf8(&request.body).context("Invalid job")?;
+    let job = {
+        // Requests of a new job wait for the one loading it.
+        let mut cached = state.job.lock().unwrap();
+        match &*cached {
+            Some((cached_text, job)) if cached_text == text => Arc::clone(job),
+            _ => {
+                info!("Loading a new job");
+                let job = Arc::new((state.load)(text)?);
+                *cached = Some((text.to_owned(), Arc::clone(&job)));
+                job
+            }
+        }
+    };
+    let start = Instant::now();
+    let (colors, stats) =
+        render_single_tile(&job.camera, &job.world, &job.params, &job.aovs, &tile)?;
+    state
+        .metrics
+        .lock()
+        .unwrap()
+        .record_tile(start.elapsed(), &stats);
+    Ok(encode_tile(&colors, &stats))
+}
+
+// Describes the render for workers by the command line of this process.
+pub fn job_from_args() -> Result<String> {
+    let args: Vec<String> = std::env::args().skip(1).collect();
+    if args.iter().any(|arg| arg.contains('\n')) {
+        bail!("Arguments must not contain newlines to render on workers");
+    }
+    Ok(args.join("\n"))
+}
+
+// Tiles are sent as counts of RenderStats followed by colors, all in little
+// endian, so that colors arrive exactly as rendered.
+fn encode_tile(colors: &[Color], stats: &RenderStats) -> Vec<u8> {
+    let mut data = Vec::with_capacity(5 * 8 + colors.len() * 3 * 8);
+    for count in [
+        stats.rays,
+        stats.paths,
+        stats.bounces,
+        stats.nodes,
+        stats.shapes,
+    ]
+    .iter()
+    {
+        data.extend_from_slice(&count.to_le_bytes());
+    }
+    for color in colors {
+        for value in [color.r, color.g, color.b].iter() {
+            data.extend_from_slice(&value.to_le_bytes());
+        }
+    }
+    data
+}
+
+fn decode_tile(data: &[u8], tile: &Tile, stride: usize) -> Result<(Vec<Color>, RenderStats)> {
+    let pixels = (tile.width * tile.height) as usize;
+    if data.len() != 5 * 8 + pixels * stride * 3 * 8 {
+        bail!(
+            "Tile of {} bytes does not have {} pixels of {} colors",
+            data.len(),
+            pixels,
+            stride
+        );
+    }
+    let words: Vec<[u8; 8]> = data
+        .chunks_exact(8)
+        .map(|chunk| chunk.try_into().unwrap())
+        .collect();
+    let count = |i: usize| u64::from_le_bytes(words[i]);
+    let stats = RenderStats {
+        rays: count(0),
+        paths: count(1),
+        bounces: count(2),
+        nodes: count(3),
+        shapes: count(4),
+    };
+    let colors = words[5..]
+        .chunks_exact(3)
+        .map(|rgb| {
+            Color::new(
+                f64::from_le_bytes(rgb[0]),
+                f64::from_le_bytes(rgb[1]),
+                f64::from_le_bytes(rgb[2]),
+            )
+        })
+        .collect();
+    Ok((colors, stats))
+}
+
+enum Message {
+    Done {
+        tile: Tile,
+        colors: Vec<Color>,
+        stats: RenderStats,
+        span: TileSpan,
+    },
+    // The thread gave up on its worker after failures.
+    Lost {
+        worker: String,
+    },
+    // The worker could not render the job, which no other worker can either.
+    Rejected {
+        worker: String,
+        error: anyhow::Error,
+    },
+}
+
+// Renders tiles not rendered yet in frame on the workers, which have the
+// secret if any, calling progress after each tile like render does. Each
+// worker gets as many tiles at once as it has threads. Returns early with
+// frame incomplete when cancel is set.
+pub fn render_distributed(
+    workers: &[String],
+    secret: Option<&str>,
+    job: &str,
+    params: &RenderParams,
+    frame: &mut Frame,
+    cancel: &AtomicBool,
+    progress: &mut dyn FnMut(&Progress),
+) -> Result<()> {
+    let start = Instant::now();
+    let stride = 1 + frame.aovs().len();
+    let tiles: VecDeque<Tile> = make_tiles(params)
+        .into_iter()
+        .filter(|tile| !frame.is_rendered(tile.x, tile.y))
+        .collect();
+    let total_tiles = tiles.len();
+    let queue = Arc::new(Mutex::new(tiles));
+    let stop = Arc::new(AtomicBool::new(false));
+    let job = Arc::new(job.to_owned());
+    let secret = Arc::new(secret.map(str::to_owned));
+    let (sender, receiver) = mpsc::channel();
+    let mut threads = HashMap::new();
+    let mut spawned = 0;
+    for worker in workers {
+        let count = match worker_threads(worker, secret.as_deref()) {
+            Ok(count) => count,
+            Err(err) => {
+                warn!(worker:% = worker, error:% = format!("{:#}", err); "Skipping worker");
+                continue;
+            }
+        };
+        info!(worker:% = worker, threads = count; "Rendering on worker");
+        for _ in 0..count {
+            let index = spawned;
+            spawned += 1;
+            let (worker, secret, job, queue, stop, sender) = (
+                worker.clone(),
+                Arc::clone(&secret),
+                Arc::clone(&job),
+                Arc::clone(&queue),
+                Arc::clone(&stop),
+                sender.clone(),
+            );
+            thread::spawn(move || {
+                let worker = (worker.as_str(), secret.as_deref());
+                work(index, worker, &job, &queue, &stop, stride, start, &sender)
+            });
+        }
+        threads.insert(worker.clone(), count);
+    }
+    drop(sender);
+    if threads.is_empty() {
+        bail!("No workers are available");
+    }
+    let result = collect_tiles(
+        &receiver,
+        threads,
+        total_tiles,
+        frame,
+        cancel,
+        progress,
+        start,
+    );
+    stop.store(true, Ordering::Relaxed);
+    result
+}
+
+// Sends a request to the worker with the secret if any.
+fn request_worker(
+    worker: &str,
+    secret: Option<&str>,
+    method: &str,
+    path: &str,
+    body: &[u8],
+    timeout: Duration,
+) -> Result<Vec<u8>> {
+    let auth = secret.map(|secret| format!("Bearer {}", secret));
+    let headers: Vec<_> = auth
+        .iter()
+        .map(|auth| ("Authorization", auth.as_str()))
+        .collect();
+    request(worker, method, path, &headers, body, timeout)
+}
+
+fn worker_threads(worker: &str, secret: Option<&str>) -> Result<usize> {
+    let info = request_worker(worker, secret, "GET", "/info", &[], INFO_TIMEOUT)?;
+    let info = String::from_utf8_lossy(&info);
+    match info.trim().strip_prefix("threads ").map(|n| n.parse()) {
+        Some(Ok(threads)) if threads > 0 => Ok(threads),
+        _ => bail!("Invalid worker info: {:?}", info),
+    }
+}
+
+// Renders tiles from the queue on the worker, given with its secret, until
+// stopped. Threads wait for more tiles when the queue is empty, as tiles of
+// failing workers come back.
+fn work(
+    index: usize,
+    (worker, secret): (&str, Option<&str>),
+    job: &str,
+    queue: &Mutex<VecDeque<Tile>>,
+    stop: &AtomicBool,
+    stride: usize,
+    start: Instant,
+    sender: &Sender<Message>,
+) {
+    let mut failures = 0;
+    while !stop.load(Ordering::Relaxed) {
+        let tile = match queue.lock().unwrap().pop_front() {
+            Some(tile) => tile,
+            None => {
+                thread::sleep(Duration::from_millis(10));
+                continue;
+            }
+        };
+        let tile_start = start.elapsed();
+        let path = format!(
+            "/render?x={}&y={}&width={}&height={}",
+            tile.x, tile.y, tile.width, tile.height
+        );
+        let result = request_worker(worker, secret, "POST", &path, job.as_bytes(), TILE_TIMEOUT)
+            .and_then(|data| decode_tile(&data, &tile, stride));
+        match result {
+            Ok((colors, stats)) => {
+                failures = 0;
+                let span = TileSpan {
+                    x: tile.x,
+                    y: tile.y,
+                    width: tile.width,
+                    height: tile.height,
+                    thread: index,
+                    start: tile_start,
+                    end: start.elapsed(),
+                };
+                let done = Message::Done {
+                    tile,
+                    colors,
+                    stats,
+                    span,
+                };
+                if sender.send(done).is_err() {
+                    return;
+                }
+            }
+            Err(error) => {
+                queue.lock().unwrap().push_back(tile);
+                // Neither bad jobs nor wrong secrets get better by retrying.
+                let rejected = error
+                    .downcast_ref::<StatusError>()
+                    .map_or(false, |err| err.status == 400 || err.status == 401);
+                if rejected {
+                    let worker = worker.to_owned();
+                    sender.send(Message::Rejected { worker, error }).ok();
+                    return;
+                }
+                failures += 1;
+                if failures >= MAX_FAILURES {
+                    warn!(worker, error:% = format!("{:#}", error); "Giving up on worker");
+                    let worker = worker.to_owned();
+                    sender.send(Message::Lost { worker }).ok();
+                    return;
+                }
+                warn!(worker, error:% = format!("{:#}", error); "Retrying tile");
+                thread::sleep(Duration::from_secs(failures as u64));
+            }
+        }
+    }
+}
+
+fn collect_tiles(
+    receiver: &Receiver<Message>,
+    mut threads: HashMap<String, usize>,
+    total_tiles: usize,
+    frame: &mut Frame,
+    cancel: &AtomicBool,
+    progress: &mut dyn FnMut(&Progress),
+    start: Instant,
+) -> Result<()> {
+    let mut completed_tiles = 0;
+    let mut render_stats = RenderStats::default();
+    while completed_tiles < total_tiles {
+        if cancel.load(Ordering::Relaxed) {
+            return Ok(());
+        }
+        let message = match receiver.recv_timeout(Duration::from_millis(100)) {
+            Ok(message) => message,
+            Err(RecvTimeoutError::Timeout) => continue,
+            Err(RecvTimeoutError::Disconnected) => bail!("All workers failed"),
+        };
+        match message {
+            Message::Done {
+                tile,
+                colors,
+                stats,
+                span,
+            } => {
+                frame.set_tile(&tile, &colors);
+                completed_tiles += 1;
+                render_stats = render_stats + stats;
+                progress(&Progress {
+                    frame,
+                    completed_tiles,
+                    total_tiles,
+                    elapsed: start.elapsed(),
+                    tile: span,
+                    stats: render_stats,
+                    error: None,
+                });
+            }
+            Message::Lost { worker } => {
+                let count = threads.get_mut(&worker).unwrap();
+                *count -= 1;
+                if *count == 0 {
+                    threads.remove(&worker);
+                    warn!(worker:% = worker, remaining = threads.len(); "Lost worker");
+                }
+            }
+            Message::Rejected { worker, error } => {
+                return Err(error.context(format!("Worker {} failed to render", worker)));
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use engine::{render, Rng, SceneRegistry};
+    use rand::SeedableRng;
+
+    fn load(job: &str) -> Result<Job> {
+        let (params, camera, world) =
+            SceneRegistry::with_builtins().load(job, &mut Rng::seed_from_u64(28))?;
+        Ok(Job {
+            params: RenderParams {
+                width: 24,
+                height: 16,
+                samples_per_pixel: 2,
+                tile_size: 8,
+                ..params
+            },
+            camera,
+            world,
+            aovs: vec![IntegratorKind::Normal],
+        })
+    }
+
+    #[test]
+    fn test_render_distributed() {
+        let job = load("book1/image12").unwrap();
+        let cancel = AtomicBool::new(false);
+        let mut expected = Frame::with_aovs(job.params.width, job.params.height, job.aovs.clone());
+        render(
+            &job.camera,
+            &job.world,
+            &job.params,
+            &mut expected,
+            &cancel,
+            &mut |_| {},
+        )
+        .unwrap();
+
+        // Tiles of the dead worker are rendered on the other.
+        let secret = "s3cret";
+        let worker = Worker::start("127.0.0.1:0", 2, Some(secret.to_owned()), load).unwrap();
+        let dead = TcpListener::bind("127.0.0.1:0").unwrap();
+        let workers = vec![
+            worker.addr().to_string(),
+            dead.local_addr().unwrap().to_string(),
+        ];
+        drop(dead);
+        let mut frame = Frame::with_aovs(job.params.width, job.params.height, job.aovs.clone());
+        let mut calls = 0;
+        render_distributed(
+            &workers,
+            Some(secret),
+            "book1/image12",
+            &job.params,
+            &mut frame,
+            &cancel,
+            &mut |_| calls += 1,
+        )
+        .unwrap();
+        assert_eq!(calls, 6);
+        let bits = |pixels: &[Color]| -> Vec<[u64; 3]> {
+            pixels
+                .iter()
+                .map(|c| [c.r.to_bits(), c.g.to_bits(), c.b.to_bits()])
+                .collect()
+        };
+        assert_eq!(bits(frame.pixels()), bits(expected.pixels()));
+        assert_eq!(bits(frame.aov_pixels(0)), bits(expected.aov_pixels(0)));
+        let metrics = request_worker(
+            &workers[0],
+            Some(secret),
+            "GET",
+            "/metrics",
+            &[],
+            INFO_TIMEOUT,
+        )
+        .map(|body| String::from_utf8(body).unwrap())
+        .unwrap();
+        assert!(
+            metrics
+                .lines()
+                .any(|line| line == "raytracing_tile_duration_seconds_count 6"),
+            "{}",
+            metrics
+        );
+
+        let mut frame = Frame::with_aovs(job.params.width, job.params.height, job.aovs.clone());
+        let err = render_distributed(
+            &workers[..1],
+            Some(secret),
+            "no/such/scene",
+            &job.params,
+            &mut frame,
+            &cancel,
+            &mut |_| {},
+        )
+        .unwrap_err();
+        assert!(format!("{:#}", err).contains("400"), "{:#}", err);
+
+        for secret in [None, Some("wrong")].iter() {
+            let err = worker_threads(&workers[0], *secret).unwrap_err();
+            assert!(format!("{:#}", err).contains("401"), "{:#}", err);
+        }
+    }
+}
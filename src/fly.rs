@@ -0,0 +1,135 @@
+// Camera moved by input of the window in fly-through mode, so that cameras can
+// be placed without editing and rendering scene files over and over.
+
+use crate::window::Motion;
+use engine::{CameraDesc, Vec3};
+use std::f64::consts::PI;
+use std::time::Duration;
+
+// Radians turned per pixel the mouse is dragged.
+const DRAG_TURN: f64 = 0.005;
+// Radians turned per second an arrow key is held.
+const KEY_TURN: f64 = 1.0;
+// Looking straight up or down leaves the camera without an up direction.
+const MAX_PITCH: f64 = PI / 2.0 * 0.99;
+
+pub struct FlyCamera {
+    desc: CameraDesc,
+    position: Vec3,
+    yaw: f64,
+    pitch: f64,
+    // Distance to look_at, which moves with the camera.
+    distance: f64,
+    // Units moved per second a key is held, so that a camera crosses the
+    // distance to what it looks at in two seconds.
+    speed: f64,
+}
+
+impl FlyCamera {
+    pub fn new(desc: CameraDesc) -> Self {
+        let position = vec3(desc.look_from);
+        let dir = vec3(desc.look_at) - position;
+        let distance = dir.abs();
+        FlyCamera {
+            yaw: dir.x.atan2(dir.z),
+            pitch: (dir.y / distance).asin().max(-MAX_PITCH).min(MAX_PITCH),
+            desc,
+            position,
+            distance,
+            speed: distance / 2.0,
+        }
+    }
+
+    // Returns whether the camera moved.
+    pub fn apply(&mut self, motion: &Motion, elapsed: Duration) -> bool {
+        if motion.is_still() {
+            return false;
+        }
+        let dt = elapsed.as_secs_f64();
+        self.yaw -= motion.turn_right * KEY_TURN * dt + motion.drag_x * DRAG_TURN;
+        self.pitch += motion.turn_up * KEY_TURN * dt - motion.drag_y * DRAG_TURN;
+        self.pitch = self.pitch.max(-MAX_PITCH).min(MAX_PITCH);
+        // Right is the direction of increasing x of images, which is the cross
+        // product of the direction and up.
+        let right = Vec3::new(-self.yaw.cos(), 0.0, self.yaw.sin());
+        let up = Vec3::new(0.0, 1.0, 0.0);
+        self.position = self.position
+            + (self.direction() * motion.forward + right * motion.right + up * motion.up)
+                * (self.speed * dt);
+        true
+    }
+
+    pub fn desc(&self) -> CameraDesc {
+        let look_at = self.position + self.direction() * self.distance;
+        CameraDesc {
+            look_from: [self.position.x, self.position.y, self.position.z],
+            look_at: [look_at.x, look_at.y, look_at.z],
+            ..self.desc.clone()
+        }
+    }
+
+    fn direction(&self) -> Vec3 {
+        Vec3::new(
+            self.pitch.cos() * self.yaw.sin(),
+            self.pitch.sin(),
+            self.pitch.cos() * self.yaw.cos(),
+        )
+    }
+}
+
+fn vec3(v: [f64; 3]) -> Vec3 {
+    Vec3::new(v[0], v[1], v[2])
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn camera_desc(look_from: [f64; 3], look_at: [f64; 3]) -> CameraDesc {
+        CameraDesc {
+            look_from,
+            look_at,
+            vfov: 40.0,
+            aperture: 0.0,
+            focus_dist: None,
+            time: [0.0, 0.0],
+        }
+    }
+
+    fn assert_near(got: [f64; 3], want: [f64; 3]) {
+        for (g, w) in got.iter().zip(want.iter()) {
+            assert!((g - w).abs() < 1e-9, "got {:?}, want {:?}", got, want);
+        }
+    }
+
+    #[test]
+    fn test_fly_camera() {
+        let mut camera = FlyCamera::new(camera_desc([1.0, 2.0, 3.0], [1.0, 2.0, 7.0]));
+        let desc = camera.desc();
+        assert_near(desc.look_from, [1.0, 2.0, 3.0]);
+        assert_near(desc.look_at, [1.0, 2.0, 7.0]);
+
+        // Looking toward +z, right is -x.
+        let step = Duration::from_secs(1);
+        let forward = Motion {
+            forward: 1.0,
+            ..Motion::default()
+        };
+        assert!(camera.apply(&forward, step));
+        assert_near(camera.desc().look_from, [1.0, 2.0, 5.0]);
+        let right = Motion {
+            right: 1.0,
+            ..Motion::default()
+        };
+        camera.apply(&right, step);
+        assert_near(camera.desc().look_from, [-1.0, 2.0, 5.0]);
+        assert!(!camera.apply(&Motion::default(), step));
+
+        let turn = Motion {
+            turn_right: PI / 2.0 / KEY_TURN,
+            ..Motion::default()
+        };
+        camera.apply(&turn, step);
+        assert_near(camera.desc().look_at, [-5.0, 2.0, 5.0]);
+    }
+}
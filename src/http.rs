@@ -0,0 +1,441 @@
+// Just enough HTTP/1.1 over std::net for the preview server, distributed
+// rendering and the render service, so that they need no web framework.
+// Connections serve a single request and are closed.
+
+use anyhow::{bail, Context, Result};
+use std::io::{self, BufRead, BufReader, Read, Write};
+use std::net::{TcpListener, TcpStream, ToSocketAddrs};
+use std::sync::{Arc, Condvar, Mutex};
+use std::thread;
+use std::time::Duration;
+
+// Bodies of responses are tiles, which are far smaller. Servers limit bodies of
+// requests by what they take.
+const MAX_BODY: usize = 1 << 28;
+// Clients sending or taking nothing for this long are gone.
+const TIMEOUT: Duration = Duration::from_secs(30);
+// Limits of the request line and headers, which are far larger than any of
+// ours.
+const MAX_LINE: usize = 8192;
+const MAX_HEADERS: usize = 64;
+// Connections served at once, each by a thread. More wait to be accepted.
+const MAX_CONNECTIONS: usize = 64;
+
+pub struct Request {
+    pub method: String,
+    // Path including the query string, e.g. /render?x=0.
+    pub path: String,
+    // Headers with names in lower case.
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+impl Request {
+    // Returns the value of the query parameter.
+    pub fn query(&self, name: &str) -> Option<&str> {
+        let (_, query) = self.path.split_once('?')?;
+        query
+            .split('&')
+            .filter_map(|pair| pair.split_once('='))
+            .find(|(key, _)| *key == name)
+            .map(|(_, value)| value)
+    }
+
+    // Returns the query parameters with escapes decoded, in order. Parameters
+    // without values, e.g. ?denoise, have empty values.
+    pub fn query_pairs(&self) -> Vec<(String, String)> {
+        let query = match self.path.split_once('?') {
+            Some((_, query)) => query,
+            None => return Vec::new(),
+        };
+        query
+            .split('&')
+            .filter(|pair| !pair.is_empty())
+            .map(|pair| {
+                let (key, value) = pair.split_once('=').unwrap_or((pair, ""));
+                (decode(key), decode(value))
+            })
+            .collect()
+    }
+
+    pub fn header(&self, name: &str) -> Option<&str> {
+        self.headers
+            .iter()
+            .find(|(key, _)| key.eq_ignore_ascii_case(name))
+            .map(|(_, value)| value.as_str())
+    }
+
+    // Returns the path without the query string.
+    pub fn route(&self) -> &str {
+        self.path.split('?').next().unwrap_or("/")
+    }
+}
+
+// Decodes %XX escapes and pluses of query strings. Invalid escapes are kept.
+fn decode(s: &str) -> String {
+    let bytes = s.as_bytes();
+    let mut out = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        let escaped = bytes
+            .get(i + 1..i + 3)
+            .and_then(|hex| std::str::from_utf8(hex).ok())
+            .and_then(|hex| u8::from_str_radix(hex, 16).ok());
+        match (bytes[i], escaped) {
+            (b'%', Some(byte)) => {
+                out.push(byte);
+                i += 3;
+                continue;
+            }
+            (b'+', _) => out.push(b' '),
+            (byte, _) => out.push(byte),
+        }
+        i += 1;
+    }
+    String::from_utf8_lossy(&out).into_owned()
+}
+
+// Accepts connections forever and handles each in a thread, up to
+// MAX_CONNECTIONS at once.
+pub fn serve(listener: TcpListener, handle: impl Fn(TcpStream) + Send + Sync + 'static) {
+    let handle = Arc::new(handle);
+    let active = Arc::new((Mutex::new(0), Condvar::new()));
+    for stream in listener.incoming() {
+        let stream = match stream {
+            Ok(stream) => stream,
+            Err(_) => continue,
+        };
+        {
+            let (count, released) = &*active;
+            let mut count = count.lock().unwrap();
+            while *count >= MAX_CONNECTIONS {
+                count = released.wait(count).unwrap();
+            }
+            *count += 1;
+        }
+        let handle = Arc::clone(&handle);
+        let slot = Slot(Arc::clone(&active));
+        thread::spawn(move || {
+            let _slot = slot;
+            handle(stream);
+        });
+    }
+}
+
+// Releases a connection counted by serve when dropped, even by a panic.
+struct Slot(Arc<(Mutex<usize>, Condvar)>);
+
+impl Drop for Slot {
+    fn drop(&mut self) {
+        let (count, released) = &*self.0;
+        *count.lock().unwrap() -= 1;
+        released.notify_one();
+    }
+}
+
+// Returns the secret in the environment variable, if set.
+pub fn env_secret(env: &str) -> Option<String> {
+    std::env::var(env).ok().filter(|secret| !secret.is_empty())
+}
+
+// Fails if the server would listen on other than loopback addresses, where
+// anyone on the network can reach it, without a secret from the environment
+// variable.
+pub fn check_listen(listen: &str, secret: Option<&str>, env: &str) -> Result<()> {
+    let loopback = listen
+        .to_socket_addrs()
+        .with_context(|| format!("Invalid address: {}", listen))?
+        .all(|addr| addr.ip().is_loopback());
+    if !loopback && secret.is_none() {
+        bail!(
+            "Servers listening on {} must have a secret in ${}",
+            listen,
+            env
+        );
+    }
+    Ok(())
+}
+
+// Returns whether the request carries the secret as a bearer token, or true if
+// no secret is set.
+pub fn authorized(request: &Request, secret: Option<&str>) -> bool {
+    let secret = match secret {
+        Some(secret) => secret,
+        None => return true,
+    };
+    let expected = format!("Bearer {}", secret);
+    let given = request.header("authorization").unwrap_or("");
+    // Compares every byte, so that the time taken does not tell how much of
+    // the secret was guessed right.
+    given.len() == expected.len()
+        && given
+            .bytes()
+            .zip(expected.bytes())
+            .fold(0, |diff, (a, b)| diff | (a ^ b))
+            == 0
+}
+
+// Reads a request of a body up to max_body bytes from an accepted connection,
+// answering larger ones with 413, and ones without the secret with 401 before
+// taking their bodies.
+pub fn read_request(
+    stream: &TcpStream,
+    max_body: usize,
+    secret: Option<&str>,
+) -> io::Result<Request> {
+    stream.set_read_timeout(Some(TIMEOUT))?;
+    stream.set_write_timeout(Some(TIMEOUT))?;
+    let mut reader = BufReader::new(stream.try_clone()?);
+    let line = read_line(&mut reader)?;
+    let mut fields = line.split_whitespace();
+    let method = fields.next().unwrap_or("GET").to_owned();
+    let path = fields.next().unwrap_or("/").to_owned();
+    let headers = read_headers(&mut reader)?;
+    let mut request = Request {
+        method,
+        path,
+        headers,
+        body: Vec::new(),
+    };
+    if !authorized(&request, secret) {
+        let mut stream = stream.try_clone()?;
+        respond(
+            &mut stream,
+            "401 Unauthorized",
+            "text/plain",
+            b"Missing or wrong bearer token\n",
+        )
+        .ok();
+        return Err(io::ErrorKind::PermissionDenied.into());
+    }
+    request.body = match content_length(&request.headers, max_body) {
+        Ok(length) => read_body(&mut reader, length)?,
+        Err(err) => {
+            let mut stream = stream.try_clone()?;
+            respond(
+                &mut stream,
+                "413 Payload Too Large",
+                "text/plain",
+                b"Too large\n",
+            )
+            .ok();
+            return Err(err);
+        }
+    };
+    Ok(request)
+}
+
+pub fn respond(
+    stream: &mut TcpStream,
+    status: &str,
+    content_type: &str,
+    body: &[u8],
+) -> io::Result<()> {
+    write!(
+        stream,
+        "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n",
+        status,
+        content_type,
+        body.len()
+    )?;
+    stream.write_all(body)?;
+    stream.flush()
+}
+
+// Error of a request the server answered, as opposed to one that failed on
+// the way.
+#[derive(Debug)]
+pub struct StatusError {
+    pub status: u16,
+    pub message: String,
+}
+
+impl std::fmt::Display for StatusError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "HTTP {}: {}", self.status, self.message.trim_end())
+    }
+}
+
+impl std::error::Error for StatusError {}
+
+// Sends a request to the address, e.g. 10.0.0.2:8080, with the extra headers,
+// and returns the body of a successful response. Other responses fail with
+// StatusError.
+pub fn request(
+    addr: &str,
+    method: &str,
+    path: &str,
+    headers: &[(&str, &str)],
+    body: &[u8],
+    timeout: Duration,
+) -> Result<Vec<u8>> {
+    let mut stream =
+        TcpStream::connect(addr).with_context(|| format!("Failed to connect to {}", addr))?;
+    stream.set_read_timeout(Some(timeout))?;
+    stream.set_write_timeout(Some(timeout))?;
+    write!(stream, "{} {} HTTP/1.1\r\nHost: {}\r\n", method, path, addr)?;
+    for (name, value) in headers {
+        write!(stream, "{}: {}\r\n", name, value)?;
+    }
+    write!(
+        stream,
+        "Content-Length: {}\r\nConnection: close\r\n\r\n",
+        body.len()
+    )?;
+    stream.write_all(body)?;
+    stream.flush()?;
+
+    let mut reader = BufReader::new(stream);
+    let line = read_line(&mut reader)?;
+    let status = match line.split_whitespace().nth(1).map(|s| s.parse::<u16>()) {
+        Some(Ok(status)) => status,
+        _ => bail!("Invalid response from {}: {:?}", addr, line),
+    };
+    let headers = read_headers(&mut reader)?;
+    let body = read_body(&mut reader, content_length(&headers, MAX_BODY)?)?;
+    if !(200..300).contains(&status) {
+        return Err(StatusError {
+            status,
+            message: String::from_utf8_lossy(&body).into_owned(),
+        }
+        .into());
+    }
+    Ok(body)
+}
+
+// Reads a line of up to MAX_LINE bytes, failing on longer ones.
+fn read_line(reader: &mut impl BufRead) -> io::Result<String> {
+    let mut line = String::new();
+    reader.by_ref().take(MAX_LINE as u64).read_line(&mut line)?;
+    if line.len() >= MAX_LINE && !line.ends_with('\n') {
+        return Err(io::Error::new(io::ErrorKind::InvalidData, "Line too long"));
+    }
+    Ok(line)
+}
+
+// Reads up to MAX_HEADERS headers up to the empty line.
+fn read_headers(reader: &mut impl BufRead) -> io::Result<Vec<(String, String)>> {
+    let mut headers = Vec::new();
+    loop {
+        let header = read_line(reader)?;
+        if header.trim().is_empty() {
+            return Ok(headers);
+        }
+        if headers.len() >= MAX_HEADERS {
+            return Err(io::Error::new(
+                io::ErrorKind::InvalidData,
+                "Too many headers",
+            ));
+        }
+        if let Some((name, value)) = header.split_once(':') {
+            headers.push((name.trim().to_ascii_lowercase(), value.trim().to_owned()));
+        }
+    }
+}
+
+fn content_length(headers: &[(String, String)], max_body: usize) -> io::Result<usize> {
+    match headers.iter().find(|(name, _)| name == "content-length") {
+        Some((_, value)) => value
+            .parse()
+            .ok()
+            .filter(|&length| length <= max_body)
+            .ok_or_else(|| io::Error::new(io::ErrorKind::InvalidData, "Invalid Content-Length")),
+        None => Ok(0),
+    }
+}
+
+// Reads the body as it arrives rather than allocating the length claimed up
+// front.
+fn read_body(reader: &mut impl Read, length: usize) -> io::Result<Vec<u8>> {
+    let mut body = Vec::new();
+    reader.take(length as u64).read_to_end(&mut body)?;
+    if body.len() < length {
+        return Err(io::ErrorKind::UnexpectedEof.into());
+    }
+    Ok(body)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_query_pairs() {
+        let request = Request {
+            method: "POST".to_owned(),
+            path: "/jobs?scene=book1%2Fimage12&background=1,1,1&denoise&tone+mapping=%zz"
+                .to_owned(),
+            headers: Vec::new(),
+            body: Vec::new(),
+        };
+        assert_eq!(request.route(), "/jobs");
+        assert_eq!(
+            request.query_pairs(),
+            vec![
+                ("scene".to_owned(), "book1/image12".to_owned()),
+                ("background".to_owned(), "1,1,1".to_owned()),
+                ("denoise".to_owned(), String::new()),
+                ("tone mapping".to_owned(), "%zz".to_owned()),
+            ]
+        );
+    }
+
+    // Sends the raw request to a server reading it with the secret, and
+    // returns the response and the result of reading.
+    fn exchange(raw: &[u8], secret: Option<&'static str>) -> (String, io::Result<Request>) {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move || {
+            let (stream, _) = listener.accept().unwrap();
+            let result = read_request(&stream, 100, secret);
+            if result.is_ok() {
+                respond(
+                    &mut stream.try_clone().unwrap(),
+                    "200 OK",
+                    "text/plain",
+                    b"",
+                )
+                .unwrap();
+            }
+            result
+        });
+        let mut stream = TcpStream::connect(addr).unwrap();
+        stream.write_all(raw).unwrap();
+        let mut response = String::new();
+        stream.read_to_string(&mut response).ok();
+        (response, server.join().unwrap())
+    }
+
+    #[test]
+    fn test_read_request() {
+        let (response, result) = exchange(b"GET /x HTTP/1.1\r\nA: b\r\n\r\n", None);
+        assert!(response.starts_with("HTTP/1.1 200"), "{}", response);
+        assert_eq!(result.unwrap().header("a"), Some("b"));
+
+        let long = format!("GET /{} HTTP/1.1\r\n\r\n", "x".repeat(MAX_LINE));
+        assert!(exchange(long.as_bytes(), None).1.is_err());
+        let many = format!(
+            "GET / HTTP/1.1\r\n{}\r\n",
+            "A: b\r\n".repeat(MAX_HEADERS + 1)
+        );
+        assert!(exchange(many.as_bytes(), None).1.is_err());
+
+        let (response, result) = exchange(b"POST / HTTP/1.1\r\nContent-Length: 1000\r\n\r\n", None);
+        assert!(response.starts_with("HTTP/1.1 413"), "{}", response);
+        assert!(result.is_err());
+
+        // Refused before the body, which never comes.
+        let (response, result) = exchange(
+            b"POST / HTTP/1.1\r\nAuthorization: Bearer wrong\r\nContent-Length: 10\r\n\r\n",
+            Some("secret"),
+        );
+        assert!(response.starts_with("HTTP/1.1 401"), "{}", response);
+        assert!(result.is_err());
+        let (response, result) = exchange(
+            b"POST / HTTP/1.1\r\nAuthorization: Bearer secret\r\nContent-Length: 2\r\n\r\nok",
+            Some("secret"),
+        );
+        assert!(response.starts_with("HTTP/1.1 200"), "{}", response);
+        assert_eq!(result.unwrap().body, b"ok");
+    }
+}
@@ -0,0 +1,48 @@
+// Logger printing records of the renderer and the engine to stderr. Key-values
+// of records follow the message as key=value, so that logs are easy both to
+// read and to parse.
+
+use log::kv::{Error, Key, Value, VisitSource};
+use log::{Level, LevelFilter, Log, Metadata, Record, SetLoggerError};
+use std::fmt::Write;
+
+struct StderrLogger;
+
+struct KeyValues<'a>(&'a mut String);
+
+impl<'kvs> VisitSource<'kvs> for KeyValues<'_> {
+    fn visit_pair(&mut self, key: Key<'kvs>, value: Value<'kvs>) -> Result<(), Error> {
+        write!(self.0, " {}={}", key, value).map_err(|_| Error::msg("formatting failed"))
+    }
+}
+
+impl Log for StderrLogger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        metadata.level() <= log::max_level()
+    }
+
+    fn log(&self, record: &Record) {
+        if !self.enabled(record.metadata()) {
+            return;
+        }
+        let mut line = match record.level() {
+            Level::Error => "ERROR: ".to_owned(),
+            Level::Warn => "WARNING: ".to_owned(),
+            Level::Info => String::new(),
+            Level::Debug => "DEBUG: ".to_owned(),
+            Level::Trace => "TRACE: ".to_owned(),
+        };
+        write!(line, "{}", record.args()).ok();
+        record.key_values().visit(&mut KeyValues(&mut line)).ok();
+        eprintln!("{}", line);
+    }
+
+    fn flush(&self) {}
+}
+
+// Fails if a logger is already installed.
+pub fn init(level: LevelFilter) -> Result<(), SetLoggerError> {
+    log::set_logger(&StderrLogger)?;
+    log::set_max_level(level);
+    Ok(())
+}
@@ -1,12 +1,42 @@
-use anyhow::Result;
+mod compare;
+mod distributed;
+mod fly;
+mod http;
+mod logger;
+mod metrics;
+mod preview;
+mod profile;
+mod service;
+mod timeline;
+mod window;
+
+use crate::compare::CompareOpts;
+use crate::distributed::{job_from_args, render_distributed, run_worker, secret, Job, WorkerOpts};
+use crate::fly::FlyCamera;
+use crate::preview::PreviewServer;
+use crate::profile::{CpuProfiler, HeapProfiler};
+use crate::service::{run_server, RenderJob, ServerOpts, Submission};
+use crate::timeline::Timeline;
+use crate::window::{PreviewWindow, WindowAction};
+use anyhow::{anyhow, bail, Context, Result};
 use clap::Clap;
-use engine::{render, RenderParams, Rng, Scene};
+use engine::{
+    denoise, load_checkpoint, parse_background, render, render_progressive, save_checkpoint,
+    scene_hash, trace_pixel, AcceleratorKind, Camera, CameraDesc, Color, DisplayParams, Frame,
+    IntegratorKind, PixelSampling, Progress, RenderParams, RenderStats, Rng, SceneFile,
+    SceneRegistry, ToneMapping, World,
+};
+use log::{info, warn, LevelFilter};
 use rand::SeedableRng;
 use rayon::ThreadPoolBuilder;
+use signal_hook::consts::SIGINT;
 use std::fs::File;
-use std::io::BufWriter;
-use std::path::PathBuf;
+use std::io::{BufReader, BufWriter, Write};
+use std::path::{Path, PathBuf};
 use std::str::FromStr;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
+use std::time::{Duration, Instant};
 
 #[derive(Clap)]
 struct Opts {
@@ -14,17 +44,486 @@ struct Opts {
     width: Option<u32>,
     #[clap(short, long, default_value = "out.png")]
     output: PathBuf,
+    // Built-in scene name, or path to a YAML or JSON scene file.
     #[clap(short, long, default_value = "book3/image12")]
     scene: String,
+    // Prints built-in scenes and exits.
+    #[clap(long)]
+    list_scenes: bool,
+    // Overrides the scene background: sky, black, daylight[:x,y,z], r,g,b or
+    // gradient:r,g,b:r,g,b.
+    #[clap(long)]
+    background: Option<String>,
+    // Writes the scene as a YAML scene file to this path instead of rendering.
+    #[clap(long)]
+    export_scene: Option<PathBuf>,
+    // Checks the scene file instead of rendering, failing if it has problems.
+    #[clap(long)]
+    check_scene: bool,
+    // Renders only the pixel at "x,y", counted from the top left, printing
+    // every bounce of its paths instead of writing the image.
+    #[clap(long)]
+    debug_pixel: Option<String>,
     #[clap(short, long)]
     samples: Option<usize>,
+    #[clap(long)]
+    max_depth: Option<usize>,
     #[clap(short, long, default_value = "1")]
     threads: usize,
+    #[clap(long)]
+    tile_size: Option<u32>,
+    #[clap(long)]
+    sampler: Option<String>,
+    #[clap(long)]
+    integrator: Option<String>,
+    #[clap(long)]
+    ao_distance: Option<f64>,
+    // Acceleration structure of meshes in scene files: bvh or kd_tree.
+    #[clap(long)]
+    accelerator: Option<String>,
+    // Integrators to render into extra images, e.g. albedo and normal.
+    #[clap(long)]
+    aov: Vec<String>,
+    // Renders tiles on workers at these addresses, e.g. 10.0.0.2:8642, which
+    // are started with the worker subcommand.
+    #[clap(long)]
+    worker: Vec<String>,
+    // Smooths noise in the output image, guided by albedo and normal AOVs.
+    #[clap(long)]
+    denoise: bool,
     #[clap(short, long)]
     importance_sampling: Option<bool>,
+    #[clap(long, default_value = "300")]
+    checkpoint_interval: u64,
+    // Renders the whole image a sample per pixel at a time, writing the image
+    // every preview interval, instead of finishing tiles one by one.
+    #[clap(long)]
+    progressive: bool,
+    // Renders progressively for at most this many seconds and writes the image
+    // of the samples so far. The first sample of every pixel is always
+    // rendered.
+    #[clap(long)]
+    max_time: Option<f64>,
+    // Renders progressively until the estimated relative RMSE of the image
+    // falls to this, e.g. 0.02, taking up to the number of samples.
+    #[clap(long)]
+    target_error: Option<f64>,
+    // Seconds between images written while rendering progressively or served.
+    #[clap(long, default_value = "2")]
+    preview_interval: f64,
+    // Serves the image being rendered over HTTP on this address, e.g.
+    // 0.0.0.0:8080, to be watched from a browser, along with metrics for
+    // Prometheus.
+    #[clap(long)]
+    serve: Option<String>,
+    // Shows the image in a window as tiles complete, where S saves a snapshot
+    // and Escape aborts. Needs the window feature.
+    #[clap(long)]
+    window: bool,
+    // Moves the camera in the window with WASD and the mouse, rendering again
+    // as it moves, and prints the camera when the window is closed. Needs the
+    // window feature.
+    #[clap(long)]
+    fly: bool,
+    #[clap(long)]
+    resume: bool,
+    // Keeps the checkpoint of a completed render, so that it can be resumed to
+    // write images with other display options.
+    #[clap(long)]
+    keep_checkpoint: bool,
+    // Exposure in EV stops.
+    #[clap(long)]
+    exposure: Option<f64>,
+    // White balance multipliers as "r,g,b".
+    #[clap(long)]
+    white_balance: Option<String>,
+    // Image format: png, ppm, jpeg or hdr. Defaults to the output extension.
+    #[clap(long)]
+    format: Option<String>,
+    // Tone mapping: clamp, reinhard, aces or exponential.
+    #[clap(long)]
+    tone_mapping: Option<String>,
+    // Encodes with a power curve of this gamma instead of sRGB.
+    #[clap(long)]
+    gamma: Option<f64>,
+    // Shows pixels with NaN samples in magenta.
+    #[clap(long)]
+    mark_nan: bool,
+    // Bits per channel of PNG outputs, 8 or 16.
+    #[clap(long, default_value = "8")]
+    bit_depth: u8,
+    #[clap(long, default_value = "90")]
+    jpeg_quality: u8,
+    // Logs details of rendering, e.g. the shapes sampled as lights.
+    #[clap(short, long)]
+    verbose: bool,
+    // Logs only warnings and errors.
+    #[clap(short, long)]
+    quiet: bool,
+    // Writes a Chrome trace of the stages and the tiles rendered by each
+    // thread, to be viewed in chrome://tracing or Perfetto.
+    #[clap(long)]
+    trace: Option<PathBuf>,
+    // Writes a CPU profile of rendering as a flame graph SVG. Needs the profile
+    // feature.
+    #[clap(long)]
+    cpu_profile: Option<PathBuf>,
+    // Writes a heap profile of the run for DHAT's viewer. Needs the
+    // heap-profile feature.
+    #[clap(long)]
+    mem_profile: Option<PathBuf>,
+    #[clap(subcommand)]
+    command: Option<Command>,
+}
+
+#[derive(Clap)]
+enum Command {
+    Compare(CompareOpts),
+    Server(ServerOpts),
+    #[clap(
+        about = "Renders tiles of renders run with --worker. Jobs can read any file the worker \
+                 can and use all its CPUs, so workers only listen on loopback addresses unless \
+                 RAYTRACING_WORKER_SECRET is set to a secret coordinators are run with too."
+    )]
+    Worker(WorkerOpts),
+}
+
+#[derive(Clone, Copy)]
+enum ImageFormat {
+    Png,
+    Ppm,
+    Jpeg,
+    Hdr,
+}
+
+impl FromStr for ImageFormat {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        Ok(match s {
+            "png" => ImageFormat::Png,
+            "ppm" => ImageFormat::Ppm,
+            "jpg" | "jpeg" => ImageFormat::Jpeg,
+            "hdr" => ImageFormat::Hdr,
+            _ => bail!("Unknown image format: {}", s),
+        })
+    }
+}
+
+fn format_duration(d: Duration) -> String {
+    let secs = d.as_secs();
+    format!("{}:{:02}:{:02}", secs / 3600, secs / 60 % 60, secs % 60)
+}
+
+// Returns the path of an AOV image, e.g. out.normal.png for out.png.
+fn aov_path(output: &Path, aov: IntegratorKind) -> PathBuf {
+    suffixed_path(output, &aov.to_string())
+}
+
+// Inserts the suffix before the extension, e.g. out.albedo.png.
+fn suffixed_path(output: &Path, suffix: &str) -> PathBuf {
+    let mut name = output.file_stem().unwrap_or_default().to_owned();
+    name.push(format!(".{}", suffix));
+    if let Some(ext) = output.extension() {
+        name.push(".");
+        name.push(ext);
+    }
+    output.with_file_name(name)
+}
+
+impl ImageFormat {
+    fn content_type(self) -> &'static str {
+        match self {
+            ImageFormat::Png => "image/png",
+            ImageFormat::Ppm => "image/x-portable-pixmap",
+            ImageFormat::Jpeg => "image/jpeg",
+            ImageFormat::Hdr => "image/vnd.radiance",
+        }
+    }
+}
+
+// Writes the image of the frame, or the AOV if specified.
+fn write_png(
+    writer: &mut impl Write,
+    frame: &Frame,
+    aov: Option<usize>,
+    display: &DisplayParams,
+    bit_depth: u8,
+) -> Result<()> {
+    let mut encoder = png::Encoder::new(writer, frame.width(), frame.height());
+    encoder.set_color(png::ColorType::RGB);
+    encoder.set_depth(if bit_depth == 16 {
+        png::BitDepth::Sixteen
+    } else {
+        png::BitDepth::Eight
+    });
+    let mut writer = encoder.write_header()?.into_stream_writer();
+    match (aov, bit_depth) {
+        (Some(aov), 16) => frame.write_aov_rgb16(aov, display, &mut writer)?,
+        (Some(aov), _) => frame.write_aov_rgb(aov, display, &mut writer)?,
+        (None, 16) => frame.write_rgb16(display, &mut writer)?,
+        (None, _) => frame.write_rgb(display, &mut writer)?,
+    }
+    Ok(())
+}
+
+fn write_ppm(
+    writer: &mut impl Write,
+    frame: &Frame,
+    aov: Option<usize>,
+    display: &DisplayParams,
+) -> Result<()> {
+    write!(writer, "P6\n{} {}\n255\n", frame.width(), frame.height())?;
+    match aov {
+        Some(aov) => frame.write_aov_rgb(aov, display, writer)?,
+        None => frame.write_rgb(display, writer)?,
+    }
+    Ok(())
+}
+
+fn encode_jpeg(
+    frame: &Frame,
+    aov: Option<usize>,
+    display: &DisplayParams,
+    quality: u8,
+) -> Result<Vec<u8>> {
+    if frame.width() > u16::MAX as u32 || frame.height() > u16::MAX as u32 {
+        bail!("Image too large for JPEG");
+    }
+    let mut data = Vec::new();
+    match aov {
+        Some(aov) => frame.write_aov_rgb(aov, display, &mut data)?,
+        None => frame.write_rgb(display, &mut data)?,
+    }
+    let mut jpeg = Vec::new();
+    let encoder = jpeg_encoder::Encoder::new(&mut jpeg, quality);
+    encoder.encode(
+        &data,
+        frame.width() as u16,
+        frame.height() as u16,
+        jpeg_encoder::ColorType::Rgb,
+    )?;
+    Ok(jpeg)
+}
+
+// Writes the frame in linear colors without clamping.
+fn write_hdr(writer: &mut impl Write, frame: &Frame, aov: Option<usize>) -> Result<()> {
+    match aov {
+        Some(aov) => frame.write_aov_hdr(aov, writer)?,
+        None => frame.write_hdr(writer)?,
+    }
+    Ok(())
+}
+
+fn encode_image(
+    writer: &mut impl Write,
+    frame: &Frame,
+    aov: Option<usize>,
+    format: ImageFormat,
+    display: &DisplayParams,
+    opts: &Opts,
+) -> Result<()> {
+    match format {
+        ImageFormat::Png => write_png(writer, frame, aov, display, opts.bit_depth),
+        ImageFormat::Ppm => write_ppm(writer, frame, aov, display),
+        ImageFormat::Jpeg => {
+            let jpeg = encode_jpeg(frame, aov, display, opts.jpeg_quality)?;
+            Ok(writer.write_all(&jpeg)?)
+        }
+        ImageFormat::Hdr => write_hdr(writer, frame, aov),
+    }
+}
+
+fn write_image(
+    path: &Path,
+    frame: &Frame,
+    aov: Option<usize>,
+    format: ImageFormat,
+    display: &DisplayParams,
+    opts: &Opts,
+) -> Result<()> {
+    let write = || -> Result<()> {
+        let mut writer = BufWriter::new(File::create(path)?);
+        encode_image(&mut writer, frame, aov, format, display, opts)?;
+        writer.flush()?;
+        Ok(())
+    };
+    write().with_context(|| format!("Failed to write {}", path.display()))
+}
+
+fn checkpoint_path(output: &Path) -> PathBuf {
+    let mut path = output.as_os_str().to_owned();
+    path.push(".ckpt");
+    PathBuf::from(path)
+}
+
+fn write_checkpoint(path: &Path, params: &RenderParams, scene: u64, frame: &Frame) -> Result<()> {
+    // Write to a temporary file first so that a crash does not corrupt the
+    // last good checkpoint.
+    let temp_path = path.with_extension("ckpt.tmp");
+    let mut writer = BufWriter::new(File::create(&temp_path)?);
+    save_checkpoint(&mut writer, params, scene, frame)?;
+    writer.into_inner()?.sync_all()?;
+    std::fs::rename(&temp_path, path)?;
+    Ok(())
+}
+
+fn publish_preview(server: &PreviewServer, frame: &Frame, display: &DisplayParams, opts: &Opts) {
+    match encode_jpeg(frame, None, display, opts.jpeg_quality) {
+        Ok(jpeg) => server.publish(jpeg),
+        Err(err) => warn!("Failed to encode preview: {:#}", err),
+    }
+}
+
+// Handles keys pressed in the window. Snapshots are numbered so that earlier
+// ones are kept.
+fn update_window(
+    window: &mut PreviewWindow,
+    frame: &Frame,
+    format: ImageFormat,
+    display: &DisplayParams,
+    opts: &Opts,
+    cancel: &AtomicBool,
+) {
+    match window.update(frame, display) {
+        Ok(Some(WindowAction::Snapshot)) => {
+            let path = (1..)
+                .map(|i| suffixed_path(&opts.output, &format!("snapshot{}", i)))
+                .find(|path| !path.exists())
+                .unwrap();
+            match write_image(&path, frame, None, format, display, opts) {
+                Ok(()) => info!(path:% = path.display(); "Saved snapshot"),
+                Err(err) => warn!("Failed to save snapshot: {:#}", err),
+            }
+        }
+        Ok(Some(WindowAction::Abort)) => cancel.store(true, Ordering::Relaxed),
+        Ok(None) => {}
+        Err(err) => warn!("Failed to update window: {:#}", err),
+    }
+}
+
+// Renders progressively from the camera moved in the window until it is
+// closed, starting over at a sample per pixel whenever the camera moves.
+// Returns the last camera.
+fn fly_through(
+    camera: &Camera,
+    world: &World,
+    params: &RenderParams,
+    window: &mut PreviewWindow,
+    format: ImageFormat,
+    display: &DisplayParams,
+    opts: &Opts,
+    cancel: &AtomicBool,
+) -> Result<CameraDesc> {
+    let aspect_ratio = params.width as f64 / params.height as f64;
+    let mut fly = FlyCamera::new(CameraDesc::from(camera));
+    let mut last_input = Instant::now();
+    // Returns whether the camera moved.
+    let mut poll = |window: &mut PreviewWindow, fly: &mut FlyCamera, frame: &Frame| {
+        update_window(window, frame, format, display, opts, cancel);
+        let moved = fly.apply(&window.motion(), last_input.elapsed());
+        last_input = Instant::now();
+        moved
+    };
+    let restart = AtomicBool::new(false);
+    while !cancel.load(Ordering::Relaxed) {
+        let camera = Camera::from_desc(&fly.desc(), aspect_ratio);
+        let mut frame = Frame::new(params.width, params.height);
+        restart.store(false, Ordering::Relaxed);
+        render_progressive(
+            &camera,
+            world,
+            params,
+            &mut frame,
+            &restart,
+            &mut |progress| {
+                if poll(window, &mut fly, progress.frame) || cancel.load(Ordering::Relaxed) {
+                    restart.store(true, Ordering::Relaxed);
+                }
+            },
+        )?;
+        // Keep showing the finished image until the camera moves.
+        while !restart.load(Ordering::Relaxed) && !cancel.load(Ordering::Relaxed) {
+            if poll(window, &mut fly, &frame) {
+                break;
+            }
+            std::thread::sleep(Duration::from_millis(10));
+        }
+    }
+    Ok(fly.desc())
+}
+
+// Prints the camera in the scene file format, rounded to be readable.
+fn print_camera(desc: &CameraDesc) {
+    let round = |x: f64| (x * 1e4).round() / 1e4;
+    let format_vec3 = |v: [f64; 3]| format!("[{}, {}, {}]", round(v[0]), round(v[1]), round(v[2]));
+    println!("camera:");
+    println!("  look_from: {}", format_vec3(desc.look_from));
+    println!("  look_at: {}", format_vec3(desc.look_at));
+    println!("  vfov: {}", round(desc.vfov));
+    if desc.aperture != 0.0 {
+        println!("  aperture: {}", round(desc.aperture));
+        if let Some(focus_dist) = desc.focus_dist {
+            println!("  focus_dist: {}", round(focus_dist));
+        }
+    }
+    if desc.time != [0.0, 0.0] {
+        println!("  time: [{}, {}]", desc.time[0], desc.time[1]);
+    }
+}
+
+// Writes the image through a temporary file, so that viewers never see it half
+// written.
+fn write_preview(
+    output: &Path,
+    frame: &Frame,
+    format: ImageFormat,
+    display: &DisplayParams,
+    opts: &Opts,
+) -> Result<()> {
+    let mut path = output.as_os_str().to_owned();
+    path.push(".tmp");
+    let path = PathBuf::from(path);
+    write_image(&path, frame, None, format, display, opts)?;
+    std::fs::rename(&path, output)?;
+    Ok(())
+}
+
+fn log_progress(progress: &Progress) {
+    info!(
+        tiles = progress.completed_tiles,
+        total_tiles = progress.total_tiles,
+        elapsed:% = format_duration(progress.elapsed),
+        eta:% = progress.eta().map_or("-".to_owned(), format_duration),
+        error:% = progress
+            .error
+            .map_or("-".to_owned(), |error| format!("{:.4}", error));
+        "Rendering"
+    );
+}
+
+fn log_stats(stats: &RenderStats, timeline: &Timeline) {
+    let render_time = timeline.stage_time("render");
+    info!(
+        rays = stats.rays,
+        rays_per_sec = (stats.rays as f64 / render_time.as_secs_f64().max(1e-6)) as u64,
+        average_depth:% = stats
+            .average_depth()
+            .map_or("-".to_owned(), |depth| format!("{:.2}", depth)),
+        node_visits = stats.nodes,
+        shape_tests = stats.shapes;
+        "Render stats"
+    );
+    info!(
+        load:? = timeline.stage_time("load"),
+        render:? = render_time,
+        denoise:? = timeline.stage_time("denoise"),
+        write:? = timeline.stage_time("write");
+        "Stage times"
+    );
 }
 
-fn apply_opts(params: &mut RenderParams, opts: &Opts) {
+fn apply_opts(params: &mut RenderParams, opts: &Opts) -> Result<()> {
     if let Some(override_width) = opts.width {
         let old_width = params.width;
         let old_height = params.height;
@@ -34,37 +533,571 @@ fn apply_opts(params: &mut RenderParams, opts: &Opts) {
     if let Some(samples) = opts.samples {
         params.samples_per_pixel = samples;
     }
+    if let Some(max_depth) = opts.max_depth {
+        params.max_depth = max_depth;
+    }
     if let Some(importance_sampling) = opts.importance_sampling {
         params.importance_sampling = importance_sampling;
     }
+    if let Some(tile_size) = opts.tile_size {
+        params.tile_size = tile_size;
+    }
+    if let Some(sampler) = &opts.sampler {
+        params.pixel_sampling = PixelSampling::from_str(sampler)?;
+    }
+    if let Some(integrator) = &opts.integrator {
+        params.integrator = IntegratorKind::from_str(integrator)?;
+    }
+    if let Some(ao_distance) = opts.ao_distance {
+        params.ao_distance = Some(ao_distance);
+    }
+    Ok(())
 }
 
-fn main() -> Result<()> {
+fn is_scene_file(path: &Path) -> bool {
+    matches!(
+        path.extension().and_then(|ext| ext.to_str()),
+        Some("yaml") | Some("yml") | Some("json")
+    )
+}
+
+// Identifies the scene of checkpoints, so that renders are not resumed with
+// other scenes: the contents of the scene file with the files it includes, or
+// the name of the built-in scene, along with the background and the camera.
+fn scene_fingerprint(opts: &Opts, camera: &Camera) -> Result<u64> {
+    let scene_path = Path::new(&opts.scene);
+    let scene = if is_scene_file(scene_path) {
+        SceneFile::read(scene_path)?.to_yaml()?
+    } else {
+        opts.scene.clone()
+    };
+    let data = format!("{}\n{:?}\n{:?}", scene, opts.background, camera);
+    Ok(scene_hash(data.as_bytes()))
+}
+
+// Loads the scene with the options applied, which is the uploaded scene file
+// if any. Scene files are told from built-in scene names by their extensions.
+fn load_scene(
+    opts: &Opts,
+    scenes: &SceneRegistry,
+    uploaded: Option<SceneFile>,
+) -> Result<(RenderParams, Camera, World)> {
     const BASE_SEED: u64 = 28;
 
+    let mut rng = Rng::seed_from_u64(BASE_SEED);
+    let scene_path = Path::new(&opts.scene);
+    let file = match uploaded {
+        Some(file) => Some(file),
+        None if is_scene_file(scene_path) => Some(SceneFile::read(scene_path)?),
+        None => None,
+    };
+    let (mut params, camera, mut world) = match file {
+        Some(mut file) => {
+            if let Some(accelerator) = &opts.accelerator {
+                file.params.get_or_insert_with(Default::default).accelerator =
+                    Some(AcceleratorKind::from_str(accelerator)?);
+            }
+            // Errors fail the load even without --check-scene, as the scene
+            // may not load without panicking.
+            let problems = file.validate();
+            let (errors, warnings): (Vec<_>, Vec<_>) = problems.iter().partition(|p| p.error);
+            for problem in warnings.iter() {
+                warn!("{}", problem);
+            }
+            if !errors.is_empty() {
+                let errors: Vec<_> = errors.iter().map(|p| p.message.as_str()).collect();
+                bail!("{} has errors: {}", scene_path.display(), errors.join("; "));
+            }
+            let loaded = file.load(&mut rng)?;
+            if opts.check_scene && !problems.is_empty() {
+                bail!("{} has {} problems", scene_path.display(), problems.len());
+            }
+            loaded
+        }
+        None => {
+            if opts.accelerator.is_some() {
+                bail!("--accelerator is only supported for scene files");
+            }
+            if opts.check_scene {
+                bail!("--check-scene is only supported for scene files");
+            }
+            if scenes.get(&opts.scene).is_none() {
+                bail!(
+                    "Unknown scene: {}; run with --list-scenes to see available scenes",
+                    opts.scene
+                );
+            }
+            scenes.load(&opts.scene, &mut rng)?
+        }
+    };
+
+    apply_opts(&mut params, opts)?;
+    if let Some(background) = &opts.background {
+        world.background = parse_background(background)?;
+    }
+    Ok((params, camera, world))
+}
+
+// Loads the scene of a job of distributed rendering, which is the command line
+// of the coordinator.
+fn load_job(job: &str) -> Result<Job> {
+    let args = std::iter::once("raytracing").chain(job.lines());
+    let opts = Opts::try_parse_from(args).map_err(|err| anyhow!("Invalid job: {}", err))?;
+    let (params, camera, world) = load_scene(&opts, &SceneRegistry::with_builtins(), None)?;
+    Ok(Job {
+        params,
+        camera,
+        world,
+        aovs: render_aovs(&opts)?,
+    })
+}
+
+// Loads a job submitted to the render service, whose scene is either uploaded
+// or built-in. Uploaded scenes read only files in the scene directory.
+fn load_submission(submission: &Submission) -> Result<RenderJob> {
+    let args = std::iter::once("raytracing").chain(submission.args.iter().map(String::as_str));
+    let opts = Opts::try_parse_from(args).map_err(|err| anyhow!("Invalid options: {}", err))?;
+    if let Some(background) = &opts.background {
+        if background.starts_with("hdri:") {
+            bail!("HDRI backgrounds must be given by environment backgrounds of scene files");
+        }
+    }
+    let format = image_format(&opts)?;
+    let display = display_params(&opts)?;
+    let scenes = SceneRegistry::with_builtins();
+    let uploaded = match &submission.scene {
+        Some(text) => Some(SceneFile::parse(text, &submission.scene_dir)?),
+        None if scenes.get(&opts.scene).is_none() => bail!("Unknown scene: {}", opts.scene),
+        None => None,
+    };
+    let (params, camera, world) = load_scene(&opts, &scenes, uploaded)?;
+    let aovs = render_aovs(&opts)?;
+    let denoise = opts.denoise;
+    Ok(RenderJob {
+        job: Job {
+            params,
+            camera,
+            world,
+            aovs,
+        },
+        denoise,
+        content_type: format.content_type(),
+        encode: Box::new(move |frame| {
+            let mut image = Vec::new();
+            encode_image(&mut image, frame, None, format, &display, &opts)?;
+            Ok(image)
+        }),
+    })
+}
+
+fn parse_aovs(opts: &Opts) -> Result<Vec<IntegratorKind>> {
+    Ok(opts
+        .aov
+        .iter()
+        .map(|aov| IntegratorKind::from_str(aov))
+        .collect::<Result<Vec<_>, _>>()?)
+}
+
+// Returns the AOVs to render, which include the denoiser guides even if they
+// are not written.
+fn render_aovs(opts: &Opts) -> Result<Vec<IntegratorKind>> {
+    let mut aovs = parse_aovs(opts)?;
+    if opts.denoise {
+        for guide in [IntegratorKind::Albedo, IntegratorKind::Normal].iter() {
+            if !aovs.contains(guide) {
+                aovs.push(*guide);
+            }
+        }
+    }
+    Ok(aovs)
+}
+
+// Returns the format of images written, checking the options of formats.
+fn image_format(opts: &Opts) -> Result<ImageFormat> {
+    if opts.bit_depth != 8 && opts.bit_depth != 16 {
+        bail!("Unsupported bit depth: {}", opts.bit_depth);
+    }
+    if opts.jpeg_quality < 1 || opts.jpeg_quality > 100 {
+        bail!("JPEG quality must be in 1..=100: {}", opts.jpeg_quality);
+    }
+    Ok(match &opts.format {
+        Some(format) => ImageFormat::from_str(format)?,
+        None => match opts.output.extension().and_then(|ext| ext.to_str()) {
+            Some(ext) => ImageFormat::from_str(&ext.to_lowercase())?,
+            None => ImageFormat::Png,
+        },
+    })
+}
+
+fn display_params(opts: &Opts) -> Result<DisplayParams> {
+    let mut display = DisplayParams::default();
+    if let Some(exposure) = opts.exposure {
+        display.exposure = exposure;
+    }
+    if let Some(white_balance) = &opts.white_balance {
+        let channels = white_balance
+            .split(',')
+            .map(|s| s.trim().parse::<f64>())
+            .collect::<Result<Vec<_>, _>>()?;
+        if channels.len() != 3 || channels.iter().any(|c| !(*c >= 0.0)) {
+            bail!("Invalid white balance: {}", white_balance);
+        }
+        display.white_balance = Color::new(channels[0], channels[1], channels[2]);
+    }
+    if let Some(tone_mapping) = &opts.tone_mapping {
+        display.tone_mapping = ToneMapping::from_str(tone_mapping)?;
+    }
+    if let Some(gamma) = opts.gamma {
+        if !(gamma > 0.0) {
+            bail!("Gamma must be positive: {}", gamma);
+        }
+        display.gamma = Some(gamma);
+    }
+    display.mark_nan = opts.mark_nan;
+    Ok(display)
+}
+
+fn main() -> Result<()> {
     let opts = Opts::parse();
+    if opts.verbose && opts.quiet {
+        bail!("--verbose and --quiet cannot be used together");
+    }
+    logger::init(if opts.verbose {
+        LevelFilter::Debug
+    } else if opts.quiet {
+        LevelFilter::Warn
+    } else {
+        LevelFilter::Info
+    })?;
+    match &opts.command {
+        Some(Command::Compare(compare_opts)) => return compare::run(compare_opts),
+        Some(Command::Server(server_opts)) => return run_server(server_opts, load_submission),
+        Some(Command::Worker(worker_opts)) => return run_worker(worker_opts, load_job),
+        None => {}
+    }
+    let scenes = SceneRegistry::with_builtins();
+    if opts.list_scenes {
+        let width = scenes.list().map(|(name, _)| name.len()).max().unwrap_or(0);
+        for (name, description) in scenes.list() {
+            println!("{:width$}  {}", name, description, width = width);
+        }
+        return Ok(());
+    }
+    let format = image_format(&opts)?;
+    let display = display_params(&opts)?;
 
     ThreadPoolBuilder::new()
         .num_threads(opts.threads)
-        .build_global()
-        .expect("Failed to initialize thread pool");
+        .build_global()?;
 
-    let scene = Scene::from_str(&opts.scene)?;
+    let _heap_profiler = match &opts.mem_profile {
+        Some(path) => Some(HeapProfiler::start(path)?),
+        None => None,
+    };
+    let mut timeline = Timeline::new(opts.trace.is_some());
+    let load_start = Instant::now();
+    let (params, camera, world) = load_scene(&opts, &scenes, None)?;
+    timeline.stage("load", load_start);
+    if opts.check_scene {
+        return Ok(());
+    }
 
-    let (mut params, camera, world) = scene.load(&mut Rng::seed_from_u64(BASE_SEED));
+    if let Some(path) = &opts.export_scene {
+        let file = SceneFile::from_scene(&params, &camera, &world)?;
+        std::fs::write(path, file.to_yaml()?)
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+        return Ok(());
+    }
 
-    apply_opts(&mut params, &opts);
+    if let Some(pixel) = &opts.debug_pixel {
+        let coords = pixel
+            .split(',')
+            .map(|s| s.trim().parse::<u32>())
+            .collect::<Result<Vec<_>, _>>()
+            .ok()
+            .filter(|coords| coords.len() == 2);
+        let (x, y) = match coords {
+            Some(coords) => (coords[0], coords[1]),
+            None => bail!("Invalid pixel: {}", pixel),
+        };
+        let color = trace_pixel(&camera, &world, &params, x, y, &mut |args| {
+            println!("{}", args)
+        })?;
+        println!("pixel ({}, {}): {:.4}", x, y, color);
+        return Ok(());
+    }
 
-    let file = File::create(opts.output)?;
-    let mut encoder = png::Encoder::new(BufWriter::new(file), params.width, params.height);
-    encoder.set_color(png::ColorType::RGB);
-    encoder.set_depth(png::BitDepth::Eight);
-    let mut writer = encoder.write_header()?.into_stream_writer();
+    // The first Ctrl-C stops rendering and saves the partial image, and the
+    // second one terminates the process immediately.
+    let cancel = Arc::new(AtomicBool::new(false));
+    signal_hook::flag::register_conditional_shutdown(SIGINT, 1, Arc::clone(&cancel))?;
+    signal_hook::flag::register(SIGINT, Arc::clone(&cancel))?;
+
+    if opts.fly {
+        let mut window = PreviewWindow::open(params.width, params.height)?;
+        let desc = fly_through(
+            &camera,
+            &world,
+            &params,
+            &mut window,
+            format,
+            &display,
+            &opts,
+            &cancel,
+        )?;
+        print_camera(&desc);
+        return Ok(());
+    }
+
+    let aovs = parse_aovs(&opts)?;
+    let render_aovs = render_aovs(&opts)?;
+
+    if let Some(max_time) = opts.max_time {
+        if !(max_time > 0.0) {
+            bail!("Max time must be positive: {}", max_time);
+        }
+    }
+    if let Some(target_error) = opts.target_error {
+        if !(target_error > 0.0) {
+            bail!("Target error must be positive: {}", target_error);
+        }
+    }
+    let progressive = opts.progressive || opts.max_time.is_some() || opts.target_error.is_some();
+    if progressive && !opts.worker.is_empty() {
+        bail!("Progressive rendering cannot be distributed to workers");
+    }
+    if progressive && opts.resume {
+        bail!("Progressive rendering cannot be resumed");
+    }
+    if !(opts.preview_interval >= 0.0) {
+        bail!(
+            "Preview interval must not be negative: {}",
+            opts.preview_interval
+        );
+    }
+
+    let checkpoint_path = checkpoint_path(&opts.output);
+    let scene = scene_fingerprint(&opts, &camera)?;
+    let mut frame = if opts.resume {
+        let mut reader =
+            BufReader::new(File::open(&checkpoint_path).with_context(|| {
+                format!("Failed to open checkpoint {}", checkpoint_path.display())
+            })?);
+        let frame = load_checkpoint(&mut reader, &params, scene)?;
+        if frame.aovs() != render_aovs.as_slice() {
+            bail!("Checkpoint was saved with different AOVs");
+        }
+        info!(
+            checkpoint:% = checkpoint_path.display(),
+            rendered_pixels = frame.rendered_pixels(),
+            total_pixels = frame.pixels().len();
+            "Resuming"
+        );
+        frame
+    } else {
+        Frame::with_aovs(params.width, params.height, render_aovs)
+    };
+
+    let server = match &opts.serve {
+        Some(addr) => Some(PreviewServer::start(addr)?),
+        None => None,
+    };
+    let mut window = if opts.window {
+        Some(PreviewWindow::open(params.width, params.height)?)
+    } else {
+        None
+    };
+    let preview_interval = Duration::from_secs_f64(opts.preview_interval);
+    let mut last_preview = Instant::now();
+    let mut stats = RenderStats::default();
+    let cpu_profiler = match &opts.cpu_profile {
+        Some(path) => Some(CpuProfiler::start(path)?),
+        None => None,
+    };
+    let render_start = Instant::now();
+    let max_time = opts.max_time.map(Duration::from_secs_f64);
+    let mut out_of_time = false;
+    let mut converged = None;
+    if progressive {
+        // Stops on interrupts, when out of time and when converged, which are
+        // not interrupts to keep the window open for.
+        let stop = AtomicBool::new(false);
+        render_progressive(
+            &camera,
+            &world,
+            &params,
+            &mut frame,
+            &stop,
+            &mut |progress| {
+                timeline.tile(render_start, &progress.tile);
+                stats = progress.stats;
+                if let Some(server) = &server {
+                    server.record(progress);
+                }
+                let frame = progress.frame;
+                if let Some(window) = &mut window {
+                    update_window(window, frame, format, &display, &opts, &cancel);
+                }
+                if let Some(max_time) = max_time {
+                    if frame.is_complete() && render_start.elapsed() >= max_time {
+                        out_of_time = true;
+                    }
+                }
+                if let (Some(target_error), Some(error)) = (opts.target_error, progress.error) {
+                    if error <= target_error {
+                        converged = Some(error);
+                    }
+                }
+                if out_of_time || converged.is_some() || cancel.load(Ordering::Relaxed) {
+                    stop.store(true, Ordering::Relaxed);
+                }
+                if !frame.is_complete() || last_preview.elapsed() < preview_interval {
+                    return;
+                }
+                log_progress(progress);
+                if let Err(err) = write_preview(&opts.output, frame, format, &display, &opts) {
+                    warn!("Failed to write preview: {:#}", err);
+                }
+                if let Some(server) = &server {
+                    publish_preview(server, frame, &display, &opts);
+                }
+                last_preview = Instant::now();
+            },
+        )?;
+        if cancel.load(Ordering::Relaxed) {
+            warn!("Interrupted; saving the image of the samples so far");
+        } else if let Some(error) = converged {
+            info!(error:% = format!("{:.4}", error); "Converged");
+        } else if out_of_time {
+            info!(
+                elapsed:? = render_start.elapsed();
+                "Out of time; saving the image of the samples so far"
+            );
+        }
+    } else {
+        let checkpoint_interval = Duration::from_secs(opts.checkpoint_interval);
+        let mut last_checkpoint = Instant::now();
+        let mut on_progress = |progress: &Progress| {
+            log_progress(progress);
+            timeline.tile(render_start, &progress.tile);
+            stats = progress.stats;
+            if let Some(server) = &server {
+                server.record(progress);
+            }
+            let frame = progress.frame;
+            if let Some(window) = &mut window {
+                update_window(window, frame, format, &display, &opts, &cancel);
+            }
+            if let Some(server) = &server {
+                if last_preview.elapsed() >= preview_interval {
+                    publish_preview(server, frame, &display, &opts);
+                    last_preview = Instant::now();
+                }
+            }
+            if frame.is_complete() || last_checkpoint.elapsed() < checkpoint_interval {
+                return;
+            }
+            if let Err(err) = write_checkpoint(&checkpoint_path, &params, scene, frame) {
+                warn!("Failed to save checkpoint: {:#}", err);
+            }
+            last_checkpoint = Instant::now();
+        };
+        if opts.worker.is_empty() {
+            render(
+                &camera,
+                &world,
+                &params,
+                &mut frame,
+                &cancel,
+                &mut on_progress,
+            )?;
+        } else {
+            render_distributed(
+                &opts.worker,
+                secret().as_deref(),
+                &job_from_args()?,
+                &params,
+                &mut frame,
+                &cancel,
+                &mut on_progress,
+            )?;
+        }
+
+        if frame.is_complete() {
+            if opts.keep_checkpoint {
+                write_checkpoint(&checkpoint_path, &params, scene, &frame).with_context(|| {
+                    format!("Failed to save checkpoint {}", checkpoint_path.display())
+                })?;
+            } else if checkpoint_path.exists() {
+                std::fs::remove_file(&checkpoint_path)?;
+            }
+        } else {
+            warn!(
+                rendered_pixels = frame.rendered_pixels(),
+                total_pixels = frame.pixels().len();
+                "Interrupted; saving the partial image and checkpoint"
+            );
+            write_checkpoint(&checkpoint_path, &params, scene, &frame).with_context(|| {
+                format!("Failed to save checkpoint {}", checkpoint_path.display())
+            })?;
+        }
+    }
+
+    timeline.stage("render", render_start);
+    if let Some(cpu_profiler) = cpu_profiler {
+        cpu_profiler
+            .finish()
+            .context("Failed to write the CPU profile")?;
+    }
+
+    let nan_pixels = frame.pixels().iter().filter(|c| c.is_nan()).count();
+    if nan_pixels > 0 {
+        warn!(pixels = nan_pixels; "Pixels have NaN samples");
+    }
 
-    let mut rngs: Vec<Rng> = (0..params.samples_per_pixel)
-        .map(|i| Rng::seed_from_u64(BASE_SEED + i as u64))
-        .collect();
-    render(&mut writer, &camera, &world, &params, &mut rngs)?;
+    if opts.denoise {
+        let denoise_start = Instant::now();
+        denoise(&mut frame);
+        timeline.stage("denoise", denoise_start);
+    }
+
+    let write_start = Instant::now();
+    write_image(&opts.output, &frame, None, format, &display, &opts)?;
+    if let Some(server) = &server {
+        publish_preview(server, &frame, &display, &opts);
+    }
+    for (index, aov) in frame.aovs().iter().enumerate() {
+        if !aovs.contains(aov) {
+            continue;
+        }
+        write_image(
+            &aov_path(&opts.output, *aov),
+            &frame,
+            Some(index),
+            format,
+            &display,
+            &opts,
+        )?;
+    }
+    timeline.stage("write", write_start);
+
+    log_stats(&stats, &timeline);
+    if let Some(path) = &opts.trace {
+        timeline
+            .write_trace(path)
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+    }
+
+    // Keep showing the final image until the window is closed.
+    if let Some(window) = &mut window {
+        if !cancel.load(Ordering::Relaxed) {
+            info!("Done; close the window to exit");
+        }
+        while !cancel.load(Ordering::Relaxed) {
+            update_window(window, &frame, format, &display, &opts, &cancel);
+            std::thread::sleep(Duration::from_millis(10));
+        }
+    }
 
     Ok(())
 }
@@ -0,0 +1,248 @@
+// Metrics of the render in the text format of Prometheus, so that long renders
+// on farms can be monitored with the dashboards of other services.
+
+use engine::{Progress, RenderStats};
+use std::fmt::Write;
+use std::time::Duration;
+
+// Content type of the text format.
+pub const CONTENT_TYPE: &str = "text/plain; version=0.0.4";
+
+// Upper bounds of the buckets of tile render times, in seconds.
+const TILE_BUCKETS: [f64; 13] = [
+    0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0,
+];
+
+#[derive(Default)]
+pub struct Metrics {
+    completed_tiles: usize,
+    total_tiles: usize,
+    elapsed: Duration,
+    eta: Option<Duration>,
+    stats: RenderStats,
+    // Tiles rendered in each bucket, and in none of them at the end.
+    tile_counts: [u64; TILE_BUCKETS.len() + 1],
+    tile_seconds: f64,
+}
+
+impl Metrics {
+    // Updates metrics with the progress of a render.
+    pub fn record(&mut self, progress: &Progress) {
+        self.completed_tiles = progress.completed_tiles;
+        self.total_tiles = progress.total_tiles;
+        self.elapsed = progress.elapsed;
+        self.eta = progress.eta();
+        self.stats = progress.stats;
+        self.record_duration(progress.tile.end - progress.tile.start);
+    }
+
+    // Adds a tile rendered alone, as workers do, which is not part of a render
+    // known to the process.
+    pub fn record_tile(&mut self, duration: Duration, stats: &RenderStats) {
+        self.completed_tiles += 1;
+        self.elapsed += duration;
+        self.stats = self.stats + *stats;
+        self.record_duration(duration);
+    }
+
+    fn record_duration(&mut self, duration: Duration) {
+        let seconds = duration.as_secs_f64();
+        let bucket = TILE_BUCKETS
+            .iter()
+            .position(|&bound| seconds <= bound)
+            .unwrap_or(TILE_BUCKETS.len());
+        self.tile_counts[bucket] += 1;
+        self.tile_seconds += seconds;
+    }
+
+    pub fn encode(&self) -> String {
+        let mut out = String::new();
+        let progress = if self.total_tiles == 0 {
+            0.0
+        } else {
+            self.completed_tiles as f64 / self.total_tiles as f64
+        };
+        let elapsed = self.elapsed.as_secs_f64();
+        let rays_per_second = if elapsed > 0.0 {
+            self.stats.rays as f64 / elapsed
+        } else {
+            0.0
+        };
+        for (name, kind, help, value) in [
+            (
+                "raytracing_tiles_rendered_total",
+                "counter",
+                "Tiles rendered.",
+                self.completed_tiles as f64,
+            ),
+            (
+                "raytracing_tiles",
+                "gauge",
+                "Tiles to render, counting a tile once per pass.",
+                self.total_tiles as f64,
+            ),
+            (
+                "raytracing_progress_ratio",
+                "gauge",
+                "Fraction of tiles rendered.",
+                progress,
+            ),
+            (
+                "raytracing_elapsed_seconds",
+                "gauge",
+                "Time spent rendering.",
+                elapsed,
+            ),
+            (
+                "raytracing_rays_total",
+                "counter",
+                "Rays traced into the world.",
+                self.stats.rays as f64,
+            ),
+            (
+                "raytracing_paths_total",
+                "counter",
+                "Paths traced from the camera.",
+                self.stats.paths as f64,
+            ),
+            (
+                "raytracing_rays_per_second",
+                "gauge",
+                "Rays traced per second of rendering.",
+                rays_per_second,
+            ),
+        ]
+        .iter()
+        {
+            write_metric(&mut out, name, kind, help, *value);
+        }
+        if let Some(eta) = self.eta {
+            write_metric(
+                &mut out,
+                "raytracing_eta_seconds",
+                "gauge",
+                "Estimated time left to render.",
+                eta.as_secs_f64(),
+            );
+        }
+        if let Some(bytes) = resident_memory() {
+            write_metric(
+                &mut out,
+                "process_resident_memory_bytes",
+                "gauge",
+                "Resident memory size in bytes.",
+                bytes as f64,
+            );
+        }
+
+        let name = "raytracing_tile_duration_seconds";
+        writeln!(out, "# HELP {} Time taken to render a tile.", name).unwrap();
+        writeln!(out, "# TYPE {} histogram", name).unwrap();
+        // Buckets of the histogram are cumulative.
+        let mut count = 0;
+        for (bound, n) in TILE_BUCKETS.iter().zip(self.tile_counts.iter()) {
+            count += n;
+            writeln!(out, "{}_bucket{{le=\"{}\"}} {}", name, bound, count).unwrap();
+        }
+        count += self.tile_counts[TILE_BUCKETS.len()];
+        writeln!(out, "{}_bucket{{le=\"+Inf\"}} {}", name, count).unwrap();
+        writeln!(out, "{}_sum {}", name, self.tile_seconds).unwrap();
+        writeln!(out, "{}_count {}", name, count).unwrap();
+        out
+    }
+}
+
+fn write_metric(out: &mut String, name: &str, kind: &str, help: &str, value: f64) {
+    writeln!(out, "# HELP {} {}", name, help).unwrap();
+    writeln!(out, "# TYPE {} {}", name, kind).unwrap();
+    writeln!(out, "{} {}", name, value).unwrap();
+}
+
+// Reads the resident set size, which is only known on Linux.
+fn resident_memory() -> Option<u64> {
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+    let line = status.lines().find(|line| line.starts_with("VmRSS:"))?;
+    let kb: u64 = line.split_whitespace().nth(1)?.parse().ok()?;
+    Some(kb * 1024)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use engine::{Frame, TileSpan};
+
+    #[test]
+    fn test_encode() {
+        let frame = Frame::new(2, 2);
+        let mut metrics = Metrics::default();
+        for &(completed_tiles, millis) in &[(1, 3), (2, 40), (3, 20_000)] {
+            metrics.record(&Progress {
+                frame: &frame,
+                completed_tiles,
+                total_tiles: 4,
+                elapsed: Duration::from_secs(2),
+                tile: TileSpan {
+                    x: 0,
+                    y: 0,
+                    width: 1,
+                    height: 1,
+                    thread: 0,
+                    start: Duration::ZERO,
+                    end: Duration::from_millis(millis),
+                },
+                stats: RenderStats {
+                    rays: 1000,
+                    ..RenderStats::default()
+                },
+                error: None,
+            });
+        }
+        let text = metrics.encode();
+        for line in &[
+            "raytracing_tiles_rendered_total 3",
+            "raytracing_progress_ratio 0.75",
+            "raytracing_rays_per_second 500",
+            "raytracing_tile_duration_seconds_bucket{le=\"0.0025\"} 0",
+            "raytracing_tile_duration_seconds_bucket{le=\"0.005\"} 1",
+            "raytracing_tile_duration_seconds_bucket{le=\"0.05\"} 2",
+            "raytracing_tile_duration_seconds_bucket{le=\"10\"} 2",
+            "raytracing_tile_duration_seconds_bucket{le=\"+Inf\"} 3",
+            "raytracing_tile_duration_seconds_count 3",
+        ] {
+            assert!(
+                text.lines().any(|l| l == *line),
+                "{} not in:\n{}",
+                line,
+                text
+            );
+        }
+    }
+
+    #[test]
+    fn test_record_tile() {
+        let mut metrics = Metrics::default();
+        for &millis in &[3, 40] {
+            metrics.record_tile(
+                Duration::from_millis(millis),
+                &RenderStats {
+                    rays: 100,
+                    ..RenderStats::default()
+                },
+            );
+        }
+        let text = metrics.encode();
+        for line in &[
+            "raytracing_tiles_rendered_total 2",
+            "raytracing_rays_total 200",
+            "raytracing_tile_duration_seconds_bucket{le=\"0.005\"} 1",
+            "raytracing_tile_duration_seconds_count 2",
+        ] {
+            assert!(
+                text.lines().any(|l| l == *line),
+                "{} not in:\n{}",
+                line,
+                text
+            );
+        }
+    }
+}
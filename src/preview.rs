@@ -0,0 +1,133 @@
+// HTTP server of the image being rendered, so that renders on remote or
+// headless machines can be watched from a browser. The page shows a Motion JPEG
+// stream, which browsers display as an image replaced by every new frame.
+// Metrics of the render are served for Prometheus at /metrics.
+
+use crate::http::{read_request, respond, serve};
+use crate::metrics::{self, Metrics};
+use anyhow::{Context, Result};
+use engine::Progress;
+use log::info;
+use std::io::{self, Write};
+use std::net::{TcpListener, TcpStream};
+use std::sync::{Arc, Condvar, Mutex};
+use std::thread;
+
+const BOUNDARY: &str = "raytracing-preview";
+
+const PAGE: &str = r#"<!DOCTYPE html>
+<title>raytracing</title>
+<style>
+  body { margin: 0; background: #222; display: flex; align-items: center; justify-content: center; height: 100vh; }
+  img { max-width: 100%; max-height: 100vh; }
+</style>
+<img src="/stream" alt="Waiting for the first image">
+"#;
+
+#[derive(Default)]
+struct State {
+    // The latest JPEG image and its version, which is 0 before the first one.
+    latest: Mutex<(u64, Arc<Vec<u8>>)>,
+    updated: Condvar,
+    metrics: Mutex<Metrics>,
+}
+
+pub struct PreviewServer {
+    state: Arc<State>,
+}
+
+impl PreviewServer {
+    // Starts serving on the address, e.g. 0.0.0.0:8080, in background threads,
+    // which run until the process exits.
+    pub fn start(addr: &str) -> Result<Self> {
+        let listener =
+            TcpListener::bind(addr).with_context(|| format!("Failed to listen on {}", addr))?;
+        info!(url:% = format!("http://{}/", listener.local_addr()?); "Serving previews");
+        let state = Arc::new(State::default());
+        let server_state = Arc::clone(&state);
+        // Errors are of clients going away, which are not worth reporting.
+        thread::spawn(move || {
+            serve(listener, move |stream| {
+                handle(stream, &server_state).ok();
+            })
+        });
+        Ok(PreviewServer { state })
+    }
+
+    pub fn publish(&self, jpeg: Vec<u8>) {
+        let mut latest = self.state.latest.lock().unwrap();
+        *latest = (latest.0 + 1, Arc::new(jpeg));
+        self.state.updated.notify_all();
+    }
+
+    // Updates metrics with the tile just rendered.
+    pub fn record(&self, progress: &Progress) {
+        self.state.metrics.lock().unwrap().record(progress);
+    }
+}
+
+fn handle(mut stream: TcpStream, state: &State) -> io::Result<()> {
+    let request = read_request(&stream, 0, None)?;
+    match request.route() {
+        "/" => respond(
+            &mut stream,
+            "200 OK",
+            "text/html; charset=utf-8",
+            PAGE.as_bytes(),
+        ),
+        "/image.jpg" => {
+            let (version, image) = state.latest.lock().unwrap().clone();
+            if version == 0 {
+                respond(
+                    &mut stream,
+                    "503 Service Unavailable",
+                    "text/plain",
+                    b"No image yet\n",
+                )
+            } else {
+                respond(&mut stream, "200 OK", "image/jpeg", &image)
+            }
+        }
+        "/stream" => stream_images(&mut stream, state),
+        "/metrics" => {
+            let metrics = state.metrics.lock().unwrap().encode();
+            respond(
+                &mut stream,
+                "200 OK",
+                metrics::CONTENT_TYPE,
+                metrics.as_bytes(),
+            )
+        }
+        _ => respond(&mut stream, "404 Not Found", "text/plain", b"Not found\n"),
+    }
+}
+
+// Sends images as parts of a multipart response as they are published, until
+// the client goes away. Slow clients skip images published in the meantime.
+fn stream_images(stream: &mut TcpStream, state: &State) -> io::Result<()> {
+    write!(
+        stream,
+        "HTTP/1.1 200 OK\r\nContent-Type: multipart/x-mixed-replace; boundary={}\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n",
+        BOUNDARY
+    )?;
+    let mut version = 0;
+    loop {
+        let image = {
+            let mut latest = state.latest.lock().unwrap();
+            while latest.0 == version {
+                latest = state.updated.wait(latest).unwrap();
+            }
+            version = latest.0;
+            Arc::clone(&latest.1)
+        };
+        write!(
+            stream,
+            "--{}\r\nContent-Type: image/jpeg\r\nContent-Length: {}\r\n\r\n",
+            BOUNDARY,
+            image.len()
+        )?;
+        stream.write_all(&image)?;
+        stream.write_all(b"\r\n")?;
+        stream.flush()?;
+    }
+}
@@ -0,0 +1,73 @@
+// CPU profiler of rendering, built with the profile feature, and heap profiler
+// of the whole run, built with the heap-profile feature. The heap profiler
+// replaces the global allocator, which slows allocations even when it is not
+// started, so it has a feature of its own.
+
+use anyhow::Result;
+use std::path::Path;
+
+#[cfg(feature = "profile")]
+pub struct CpuProfiler {
+    guard: pprof::ProfilerGuard<'static>,
+    path: std::path::PathBuf,
+}
+
+#[cfg(feature = "profile")]
+impl CpuProfiler {
+    pub fn start(path: &Path) -> Result<Self> {
+        Ok(CpuProfiler {
+            guard: pprof::ProfilerGuard::new(1000)?,
+            path: path.to_owned(),
+        })
+    }
+
+    // Writes the samples so far as a flame graph.
+    pub fn finish(self) -> Result<()> {
+        let report = self.guard.report().build()?;
+        report.flamegraph(std::fs::File::create(&self.path)?)?;
+        Ok(())
+    }
+}
+
+#[cfg(not(feature = "profile"))]
+pub struct CpuProfiler;
+
+#[cfg(not(feature = "profile"))]
+impl CpuProfiler {
+    pub fn start(_path: &Path) -> Result<Self> {
+        anyhow::bail!("CPU profiler is not available; build with --features=profile")
+    }
+
+    pub fn finish(self) -> Result<()> {
+        Ok(())
+    }
+}
+
+#[cfg(feature = "heap-profile")]
+#[global_allocator]
+static ALLOCATOR: dhat::Alloc = dhat::Alloc;
+
+// Writes the profile for DHAT's viewer when dropped.
+#[cfg(feature = "heap-profile")]
+pub struct HeapProfiler {
+    _profiler: dhat::Profiler,
+}
+
+#[cfg(feature = "heap-profile")]
+impl HeapProfiler {
+    pub fn start(path: &Path) -> Result<Self> {
+        Ok(HeapProfiler {
+            _profiler: dhat::Profiler::builder().file_name(path).build(),
+        })
+    }
+}
+
+#[cfg(not(feature = "heap-profile"))]
+pub struct HeapProfiler;
+
+#[cfg(not(feature = "heap-profile"))]
+impl HeapProfiler {
+    pub fn start(_path: &Path) -> Result<Self> {
+        anyhow::bail!("Heap profiler is not available; build with --features=heap-profile")
+    }
+}
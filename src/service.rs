@@ -0,0 +1,632 @@
+// Rendering as a service over HTTP, so that web apps and pipelines can render
+// without running the command. Jobs are scene files with options, rendered one
+// at a time in the order submitted, whose status is polled until their images
+// are ready:
+//
+//   POST   /jobs?samples=64&format=jpeg  Submits the scene file in the body, or
+//                                        a built-in scene by ?scene=book1/image12.
+//   GET    /jobs                         Lists the status of jobs.
+//   GET    /jobs/ID                      Returns the status of the job.
+//   GET    /jobs/ID/image                Returns the image of the finished job.
+//   DELETE /jobs/ID                      Cancels the job and forgets it.
+//   GET    /metrics                      Returns metrics of renders for Prometheus.
+//
+// Options are the ones of the command that change the image, without dashes,
+// and flags take no values, e.g. ?denoise. Statuses are JSON objects like
+// {"id":1,"state":"rendering","progress":0.5,"elapsed":1.2,"eta":1.2,"error":null}
+// in the states queued, rendering, done and failed.
+//
+// The service renders for anyone who can reach it, so it listens on localhost
+// by default, and on other addresses only with a secret in
+// RAYTRACING_SERVICE_SECRET, which requests must have as bearer tokens, e.g.
+// Authorization: Bearer SECRET. Uploaded scene files read no files but the
+// ones in the scene directory, jobs are loaded one at a time by the thread
+// rendering them, and their images, samples and queue are limited.
+
+use crate::distributed::Job;
+use crate::http::{check_listen, env_secret, read_request, respond, serve, Request};
+use crate::metrics::{self, Metrics};
+use anyhow::{bail, Context, Result};
+use clap::Clap;
+use engine::{denoise, render, Frame, Progress, RenderParams};
+use log::{info, warn};
+use rayon::ThreadPoolBuilder;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::net::{SocketAddr, TcpListener, TcpStream};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Condvar, Mutex};
+use std::thread;
+use std::time::Duration;
+
+// Options of submissions. Others, e.g. output and threads, are up to the
+// server.
+const OPTIONS: [&str; 20] = [
+    "scene",
+    "width",
+    "samples",
+    "max-depth",
+    "tile-size",
+    "sampler",
+    "integrator",
+    "ao-distance",
+    "accelerator",
+    "background",
+    "denoise",
+    "importance-sampling",
+    "exposure",
+    "white-balance",
+    "format",
+    "tone-mapping",
+    "gamma",
+    "mark-nan",
+    "bit-depth",
+    "jpeg-quality",
+];
+
+// Options of submissions which are flags, taking no values.
+const FLAGS: [&str; 2] = ["denoise", "mark-nan"];
+
+// Finished jobs kept for their images, forgetting the oldest ones first.
+const MAX_FINISHED: usize = 100;
+// Scene files with inline meshes can be large, but not as large as this.
+const MAX_SCENE: usize = 1 << 24;
+// Jobs waiting to be rendered, beyond which submissions are refused.
+const MAX_QUEUED: usize = 16;
+// Limits of jobs: pixels of 4096x4096 images, samples per pixel and bounces.
+const MAX_PIXELS: usize = 1 << 24;
+const MAX_SAMPLES: usize = 1 << 14;
+const MAX_DEPTH: usize = 1 << 10;
+const SECRET_ENV: &str = "RAYTRACING_SERVICE_SECRET";
+
+// Serves rendering jobs submitted over HTTP.
+#[derive(Clap)]
+pub struct ServerOpts {
+    #[clap(long, default_value = "127.0.0.1:8080")]
+    listen: String,
+    // Directory that paths in uploaded scene files are relative to.
+    #[clap(long, default_value = ".")]
+    scene_dir: PathBuf,
+    // Threads to render with, the number of CPUs by default.
+    #[clap(long)]
+    threads: Option<usize>,
+}
+
+// A submitted job before it is loaded.
+pub struct Submission {
+    // Options as command line arguments, e.g. ["--samples=64", "--denoise"].
+    pub args: Vec<String>,
+    // Text of the uploaded scene file.
+    pub scene: Option<String>,
+    pub scene_dir: PathBuf,
+}
+
+// What the service renders, loaded from a submission.
+pub struct RenderJob {
+    pub job: Job,
+    pub denoise: bool,
+    pub content_type: &'static str,
+    // Encodes the rendered frame into the image served.
+    pub encode: Box<dyn Fn(&Frame) -> Result<Vec<u8>> + Send>,
+}
+
+type Loader = dyn Fn(&Submission) -> Result<RenderJob> + Send + Sync;
+
+enum JobState {
+    // Holds the job until it is loaded and rendered.
+    Queued(Submission),
+    Rendering,
+    Done {
+        content_type: &'static str,
+        image: Arc<Vec<u8>>,
+    },
+    Failed(String),
+}
+
+struct Entry {
+    state: JobState,
+    cancel: Arc<AtomicBool>,
+    progress: f64,
+    elapsed: Duration,
+    eta: Option<Duration>,
+}
+
+impl Entry {
+    fn is_finished(&self) -> bool {
+        matches!(self.state, JobState::Done { .. } | JobState::Failed(_))
+    }
+
+    fn to_json(&self, id: u64) -> String {
+        let (state, error) = match &self.state {
+            JobState::Queued(_) => ("queued", None),
+            JobState::Rendering => ("rendering", None),
+            JobState::Done { .. } => ("done", None),
+            JobState::Failed(error) => ("failed", Some(error)),
+        };
+        let mut json = String::new();
+        write!(
+            json,
+            "{{\"id\":{},\"state\":\"{}\",\"progress\":{},\"elapsed\":{},\"eta\":",
+            id,
+            state,
+            self.progress,
+            self.elapsed.as_secs_f64()
+        )
+        .unwrap();
+        match self.eta {
+            Some(eta) => write!(json, "{}", eta.as_secs_f64()).unwrap(),
+            None => json.push_str("null"),
+        }
+        json.push_str(",\"error\":");
+        match error {
+            Some(error) => json.push_str(&json_string(error)),
+            None => json.push_str("null"),
+        }
+        json.push('}');
+        json
+    }
+}
+
+#[derive(Default)]
+struct Jobs {
+    next_id: u64,
+    entries: BTreeMap<u64, Entry>,
+}
+
+struct ServiceState {
+    secret: Option<String>,
+    load: Box<Loader>,
+    scene_dir: PathBuf,
+    jobs: Mutex<Jobs>,
+    submitted: Condvar,
+    // Metrics of the job rendering, and tile times of all jobs.
+    metrics: Mutex<Metrics>,
+}
+
+pub struct Service {
+    addr: SocketAddr,
+}
+
+impl Service {
+    // Starts serving on the address in background threads, which run until
+    // the process exits. Requests must have the secret if any. load turns
+    // submissions into jobs.
+    pub fn start(
+        addr: &str,
+        scene_dir: &Path,
+        secret: Option<String>,
+        load: impl Fn(&Submission) -> Result<RenderJob> + Send + Sync + 'static,
+    ) -> Result<Self> {
+        let listener =
+            TcpListener::bind(addr).with_context(|| format!("Failed to listen on {}", addr))?;
+        let addr = listener.local_addr()?;
+        let state = Arc::new(ServiceState {
+            secret,
+            load: Box::new(load),
+            scene_dir: scene_dir.to_owned(),
+            jobs: Mutex::new(Jobs::default()),
+            submitted: Condvar::new(),
+            metrics: Mutex::new(Metrics::default()),
+        });
+        let render_state = Arc::clone(&state);
+        thread::spawn(move || render_jobs(&render_state));
+        // Clients poll again after failed requests.
+        thread::spawn(move || {
+            serve(listener, move |stream| {
+                handle(stream, &state).ok();
+            })
+        });
+        Ok(Service { addr })
+    }
+
+    pub fn addr(&self) -> SocketAddr {
+        self.addr
+    }
+}
+
+pub fn run_server(
+    opts: &ServerOpts,
+    load: impl Fn(&Submission) -> Result<RenderJob> + Send + Sync + 'static,
+) -> Result<()> {
+    if opts.threads == Some(0) {
+        bail!("Threads must be positive");
+    }
+    let secret = env_secret(SECRET_ENV);
+    check_listen(&opts.listen, secret.as_deref(), SECRET_ENV)?;
+    let mut pool = ThreadPoolBuilder::new();
+    if let Some(threads) = opts.threads {
+        pool = pool.num_threads(threads);
+    }
+    pool.build_global()?;
+    let service = Service::start(&opts.listen, &opts.scene_dir, secret, load)?;
+    info!(url:% = format!("http://{}/jobs", service.addr()); "Waiting for jobs");
+    loop {
+        thread::park();
+    }
+}
+
+fn handle(mut stream: TcpStream, state: &ServiceState) -> std::io::Result<()> {
+    let request = read_request(&stream, MAX_SCENE, state.secret.as_deref())?;
+    let route = request.route().trim_matches('/').to_owned();
+    let segments: Vec<&str> = route.split('/').collect();
+    let id = segments.get(1).map(|id| id.parse::<u64>());
+    match (request.method.as_str(), segments.as_slice(), id) {
+        ("GET", ["jobs"], _) => {
+            let jobs = state.jobs.lock().unwrap();
+            let statuses: Vec<String> = jobs
+                .entries
+                .iter()
+                .map(|(id, entry)| entry.to_json(*id))
+                .collect();
+            respond_json(&mut stream, "200 OK", &format!("[{}]", statuses.join(",")))
+        }
+        ("POST", ["jobs"], _) => match submit(&request, state) {
+            Ok(json) => respond_json(&mut stream, "201 Created", &json),
+            Err((status, message)) => respond_error(&mut stream, status, &message),
+        },
+        ("GET", ["jobs", _], Some(Ok(id))) => {
+            let jobs = state.jobs.lock().unwrap();
+            match jobs.entries.get(&id) {
+                Some(entry) => respond_json(&mut stream, "200 OK", &entry.to_json(id)),
+                None => respond_error(&mut stream, "404 Not Found", "No such job"),
+            }
+        }
+        ("GET", ["jobs", _, "image"], Some(Ok(id))) => {
+            let image = match state.jobs.lock().unwrap().entries.get(&id) {
+                Some(Entry {
+                    state:
+                        JobState::Done {
+                            content_type,
+                            image,
+                        },
+                    ..
+                }) => Ok((*content_type, Arc::clone(image))),
+                Some(_) => Err(("409 Conflict", "Job is not done")),
+                None => Err(("404 Not Found", "No such job")),
+            };
+            match image {
+                Ok((content_type, image)) => respond(&mut stream, "200 OK", content_type, &image),
+                Err((status, message)) => respond_error(&mut stream, status, message),
+            }
+        }
+        ("DELETE", ["jobs", _], Some(Ok(id))) => {
+            match state.jobs.lock().unwrap().entries.remove(&id) {
+                Some(entry) => {
+                    entry.cancel.store(true, Ordering::Relaxed);
+                    info!(job = id; "Canceled job");
+                    respond_json(&mut stream, "200 OK", &entry.to_json(id))
+                }
+                None => respond_error(&mut stream, "404 Not Found", "No such job"),
+            }
+        }
+        ("GET", ["metrics"], _) => {
+            let metrics = state.metrics.lock().unwrap().encode();
+            respond(
+                &mut stream,
+                "200 OK",
+                metrics::CONTENT_TYPE,
+                metrics.as_bytes(),
+            )
+        }
+        _ => respond_error(&mut stream, "404 Not Found", "Not found"),
+    }
+}
+
+// Queues the job of the request, returning its status, or the status and
+// message of the response if refused.
+fn submit(request: &Request, state: &ServiceState) -> Result<String, (&'static str, String)> {
+    let submission =
+        submission(request, state).map_err(|err| ("400 Bad Request", format!("{:#}", err)))?;
+    let mut jobs = state.jobs.lock().unwrap();
+    let queued = jobs
+        .entries
+        .values()
+        .filter(|entry| matches!(entry.state, JobState::Queued(_)))
+        .count();
+    if queued >= MAX_QUEUED {
+        let message = format!("{} jobs are queued already", queued);
+        return Err(("503 Service Unavailable", message));
+    }
+    jobs.next_id += 1;
+    let id = jobs.next_id;
+    let entry = Entry {
+        state: JobState::Queued(submission),
+        cancel: Arc::new(AtomicBool::new(false)),
+        progress: 0.0,
+        elapsed: Duration::ZERO,
+        eta: None,
+    };
+    let json = entry.to_json(id);
+    jobs.entries.insert(id, entry);
+    state.submitted.notify_one();
+    info!(job = id; "Queued job");
+    Ok(json)
+}
+
+fn submission(request: &Request, state: &ServiceState) -> Result<Submission> {
+    let mut args = Vec::new();
+    for (name, value) in request.query_pairs() {
+        let name = name.replace('_', "-");
+        if !OPTIONS.contains(&name.as_str()) {
+            bail!("Unknown option: {}", name);
+        }
+        // Values are kept in the arguments of their options, so that they
+        // can't be taken for options themselves.
+        match (FLAGS.contains(&name.as_str()), value.is_empty()) {
+            (true, true) => args.push(format!("--{}", name)),
+            (true, false) => bail!("{} takes no value", name),
+            (false, true) => bail!("{} needs a value", name),
+            (false, false) => args.push(format!("--{}={}", name, value)),
+        }
+    }
+    let scene = if request.body.is_empty() {
+        None
+    } else {
+        let text = std::str::from_utf8(&request.body).context("Scene file is not UTF-8")?;
+        Some(text.to_owned())
+    };
+    let named = args.iter().any(|arg| arg.starts_with("--scene="));
+    match (&scene, named) {
+        (Some(_), true) => bail!("Submit either a scene file or a built-in scene"),
+        (None, false) => bail!("Submit a scene file, or a built-in scene by ?scene="),
+        _ => {}
+    }
+    Ok(Submission {
+        args,
+        scene,
+        scene_dir: state.scene_dir.clone(),
+    })
+}
+
+// Renders queued jobs in the order submitted, forever.
+fn render_jobs(state: &ServiceState) {
+    loop {
+        let (id, submission, cancel) = {
+            let mut jobs = state.jobs.lock().unwrap();
+            loop {
+                let queued = jobs
+                    .entries
+                    .iter_mut()
+                    .find(|(_, entry)| matches!(entry.state, JobState::Queued(_)));
+                if let Some((&id, entry)) = queued {
+                    let submission = match std::mem::replace(&mut entry.state, JobState::Rendering)
+                    {
+                        JobState::Queued(submission) => submission,
+                        _ => unreachable!(),
+                    };
+                    break (id, submission, Arc::clone(&entry.cancel));
+                }
+                jobs = state.submitted.wait(jobs).unwrap();
+            }
+        };
+
+        info!(job = id; "Rendering job");
+        let result = (state.load)(&submission).and_then(|job| {
+            let image = render_job(&job, &cancel, &mut |progress| {
+                state.metrics.lock().unwrap().record(progress);
+                if let Some(entry) = state.jobs.lock().unwrap().entries.get_mut(&id) {
+                    entry.progress = progress.completed_tiles as f64 / progress.total_tiles as f64;
+                    entry.elapsed = progress.elapsed;
+                    entry.eta = progress.eta();
+                }
+            })?;
+            Ok((job.content_type, image))
+        });
+
+        // Canceled jobs are gone already.
+        let mut jobs = state.jobs.lock().unwrap();
+        let entry = match jobs.entries.get_mut(&id) {
+            Some(entry) => entry,
+            None => continue,
+        };
+        entry.eta = None;
+        entry.state = match result {
+            Ok((content_type, image)) => {
+                info!(job = id, elapsed:? = entry.elapsed; "Finished job");
+                entry.progress = 1.0;
+                JobState::Done {
+                    content_type,
+                    image: Arc::new(image),
+                }
+            }
+            Err(err) => {
+                warn!(job = id, error:% = format!("{:#}", err); "Job failed");
+                JobState::Failed(format!("{:#}", err))
+            }
+        };
+        let finished: Vec<u64> = jobs
+            .entries
+            .iter()
+            .filter(|(_, entry)| entry.is_finished())
+            .map(|(id, _)| *id)
+            .collect();
+        for id in finished
+            .iter()
+            .take(finished.len().saturating_sub(MAX_FINISHED))
+        {
+            jobs.entries.remove(id);
+        }
+    }
+}
+
+fn render_job(
+    job: &RenderJob,
+    cancel: &AtomicBool,
+    progress: &mut dyn FnMut(&Progress),
+) -> Result<Vec<u8>> {
+    let Job {
+        params,
+        camera,
+        world,
+        aovs,
+    } = &job.job;
+    check_limits(params)?;
+    let mut frame = Frame::with_aovs(params.width, params.height, aovs.clone());
+    render(camera, world, params, &mut frame, cancel, progress)?;
+    if !frame.is_complete() {
+        bail!("Canceled");
+    }
+    if job.denoise {
+        denoise(&mut frame);
+    }
+    (job.encode)(&frame)
+}
+
+fn check_limits(params: &RenderParams) -> Result<()> {
+    let pixels = params.width as usize * params.height as usize;
+    if pixels > MAX_PIXELS {
+        bail!("Images must have at most {} pixels: {}", MAX_PIXELS, pixels);
+    }
+    if params.samples_per_pixel > MAX_SAMPLES {
+        bail!(
+            "Pixels must have at most {} samples: {}",
+            MAX_SAMPLES,
+            params.samples_per_pixel
+        );
+    }
+    if params.max_depth > MAX_DEPTH {
+        bail!("Depth must be at most {}: {}", MAX_DEPTH, params.max_depth);
+    }
+    Ok(())
+}
+
+fn respond_json(stream: &mut TcpStream, status: &str, json: &str) -> std::io::Result<()> {
+    let body = format!("{}\n", json);
+    respond(stream, status, "application/json", body.as_bytes())
+}
+
+fn respond_error(stream: &mut TcpStream, status: &str, message: &str) -> std::io::Result<()> {
+    respond_json(
+        stream,
+        status,
+        &format!("{{\"error\":{}}}", json_string(message)),
+    )
+}
+
+fn json_string(s: &str) -> String {
+    let mut json = String::from("\"");
+    for c in s.chars() {
+        match c {
+            '"' => json.push_str("\\\""),
+            '\\' => json.push_str("\\\\"),
+            '\n' => json.push_str("\\n"),
+            c if (c as u32) < 0x20 => write!(json, "\\u{:04x}", c as u32).unwrap(),
+            c => json.push(c),
+        }
+    }
+    json.push('"');
+    json
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::http::{request, StatusError};
+    use engine::{IntegratorKind, RenderParams, Rng, SceneRegistry};
+    use rand::SeedableRng;
+    use std::time::Instant;
+
+    const TIMEOUT: Duration = Duration::from_secs(10);
+
+    // Loads built-in scenes small, and encodes the number of pixels rendered.
+    fn load(submission: &Submission) -> Result<RenderJob> {
+        let name = match submission.args.as_slice() {
+            [option] if option.starts_with("--scene=") => &option["--scene=".len()..],
+            _ => bail!("Unsupported options: {:?}", submission.args),
+        };
+        let (params, camera, world) =
+            SceneRegistry::with_builtins().load(name, &mut Rng::seed_from_u64(28))?;
+        Ok(RenderJob {
+            job: Job {
+                params: RenderParams {
+                    width: 24,
+                    height: 16,
+                    samples_per_pixel: 2,
+                    tile_size: 8,
+                    ..params
+                },
+                camera,
+                world,
+                aovs: vec![IntegratorKind::Albedo, IntegratorKind::Normal],
+            },
+            denoise: true,
+            content_type: "text/plain",
+            encode: Box::new(|frame| Ok(frame.rendered_pixels().to_string().into_bytes())),
+        })
+    }
+
+    fn status(err: anyhow::Error) -> u16 {
+        err.downcast_ref::<StatusError>().unwrap().status
+    }
+
+    #[test]
+    fn test_service() {
+        let service = Service::start(
+            "127.0.0.1:0",
+            Path::new("."),
+            Some("secret".to_owned()),
+            load,
+        )
+        .unwrap();
+        let addr = service.addr().to_string();
+        let call = |method: &str, path: &str| {
+            let auth = [("Authorization", "Bearer secret")];
+            request(&addr, method, path, &auth, &[], TIMEOUT)
+                .map(|body| String::from_utf8(body).unwrap())
+        };
+
+        let unauthorized = request(&addr, "GET", "/jobs", &[], &[], TIMEOUT).unwrap_err();
+        assert_eq!(status(unauthorized), 401);
+
+        let submitted = call("POST", "/jobs?scene=book1%2Fimage12").unwrap();
+        assert!(submitted.starts_with("{\"id\":1,"), "{}", submitted);
+        let start = Instant::now();
+        while !call("GET", "/jobs/1")
+            .unwrap()
+            .contains("\"state\":\"done\"")
+        {
+            assert!(start.elapsed() < TIMEOUT, "Job did not finish");
+            thread::sleep(Duration::from_millis(10));
+        }
+        assert_eq!(call("GET", "/jobs/1/image").unwrap(), "384");
+        assert!(call("GET", "/jobs").unwrap().starts_with("[{\"id\":1,"));
+        let metrics = call("GET", "/metrics").unwrap();
+        assert!(
+            metrics
+                .lines()
+                .any(|line| line == "raytracing_tile_duration_seconds_count 6"),
+            "{}",
+            metrics
+        );
+
+        // Jobs failing to load fail like ones failing to render.
+        let submitted = call("POST", "/jobs?scene=book1%2Fimage12&samples=64").unwrap();
+        assert!(submitted.starts_with("{\"id\":2,"), "{}", submitted);
+        let start = Instant::now();
+        loop {
+            let status = call("GET", "/jobs/2").unwrap();
+            if status.contains("\"state\":\"failed\"") {
+                assert!(status.contains("Unsupported options"), "{}", status);
+                break;
+            }
+            assert!(start.elapsed() < TIMEOUT, "Job did not fail");
+            thread::sleep(Duration::from_millis(10));
+        }
+
+        // Bad submissions are rejected before they are queued.
+        for path in &[
+            "/jobs",
+            "/jobs?scene=book1%2Fimage12&output=%2Fetc%2Fpasswd",
+            "/jobs?scene=book1%2Fimage12&denoise=--output%3D%2Fx",
+            "/jobs?scene=book1%2Fimage12&samples",
+        ] {
+            assert_eq!(status(call("POST", path).unwrap_err()), 400, "{}", path);
+        }
+
+        call("DELETE", "/jobs/1").unwrap();
+        assert_eq!(status(call("GET", "/jobs/1").unwrap_err()), 404);
+        assert_eq!(status(call("GET", "/jobs/2/image").unwrap_err()), 409);
+        assert_eq!(status(call("GET", "/jobs/3/image").unwrap_err()), 404);
+    }
+}
@@ -0,0 +1,87 @@
+// Times of the stages of a run, reported at the end, and of the tiles rendered,
+// which can be written as a Chrome trace to be viewed as a timeline per thread
+// in chrome://tracing or Perfetto.
+
+use anyhow::Result;
+use engine::TileSpan;
+use std::fs::File;
+use std::io::{BufWriter, Write};
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+struct Span {
+    name: &'static str,
+    // 0 for the main thread, and 1 + index for threads of the pool.
+    thread: usize,
+    start: Duration,
+    end: Duration,
+}
+
+pub struct Timeline {
+    origin: Instant,
+    spans: Vec<Span>,
+    // Tiles are only kept for traces, as renders may have millions of them.
+    keep_tiles: bool,
+}
+
+impl Timeline {
+    pub fn new(keep_tiles: bool) -> Self {
+        Timeline {
+            origin: Instant::now(),
+            spans: Vec::new(),
+            keep_tiles,
+        }
+    }
+
+    // Records the stage from start until now.
+    pub fn stage(&mut self, name: &'static str, start: Instant) {
+        self.spans.push(Span {
+            name,
+            thread: 0,
+            start: start - self.origin,
+            end: self.origin.elapsed(),
+        });
+    }
+
+    pub fn tile(&mut self, render_start: Instant, tile: &TileSpan) {
+        if !self.keep_tiles {
+            return;
+        }
+        let offset = render_start - self.origin;
+        self.spans.push(Span {
+            name: "tile",
+            thread: 1 + tile.thread,
+            start: offset + tile.start,
+            end: offset + tile.end,
+        });
+    }
+
+    // Returns the total time of the stage.
+    pub fn stage_time(&self, name: &str) -> Duration {
+        self.spans
+            .iter()
+            .filter(|span| span.thread == 0 && span.name == name)
+            .map(|span| span.end - span.start)
+            .sum()
+    }
+
+    // Writes spans as complete events of the Trace Event Format.
+    pub fn write_trace(&self, path: &Path) -> Result<()> {
+        let mut writer = BufWriter::new(File::create(path)?);
+        writeln!(writer, "{{\"traceEvents\": [")?;
+        for (i, span) in self.spans.iter().enumerate() {
+            writeln!(
+                writer,
+                "  {{\"name\": \"{}\", \"ph\": \"X\", \"pid\": 1, \"tid\": {}, \"ts\": {}, \"dur\": {}}}{}",
+                span.name,
+                span.thread,
+                span.start.as_micros(),
+                (span.end - span.start).as_micros(),
+                if i + 1 < self.spans.len() { "," } else { "" }
+            )?;
+        }
+        writeln!(writer, "]}}")?;
+        writer.flush()?;
+        Ok(())
+    }
+}
@@ -0,0 +1,164 @@
+// Window showing the image as tiles complete, built with the window feature.
+// Keys: P saves a snapshot of the image so far, and Escape aborts like Ctrl-C.
+// In fly-through mode, WASD moves the camera, E and Q move it up and down, and
+// dragging the mouse or the arrow keys turn it.
+
+use anyhow::Result;
+use engine::{DisplayParams, Frame};
+
+// Only the window feature has keys to report.
+#[cfg_attr(not(feature = "window"), allow(dead_code))]
+pub enum WindowAction {
+    Snapshot,
+    Abort,
+}
+
+// Camera motion requested by input: axes of held keys in -1..=1, and the
+// distance in pixels the mouse was dragged since the last call.
+#[derive(Clone, Copy, Debug, Default)]
+pub struct Motion {
+    pub forward: f64,
+    pub right: f64,
+    pub up: f64,
+    pub turn_right: f64,
+    pub turn_up: f64,
+    pub drag_x: f64,
+    pub drag_y: f64,
+}
+
+impl Motion {
+    pub fn is_still(&self) -> bool {
+        self.forward == 0.0
+            && self.right == 0.0
+            && self.up == 0.0
+            && self.turn_right == 0.0
+            && self.turn_up == 0.0
+            && self.drag_x == 0.0
+            && self.drag_y == 0.0
+    }
+}
+
+#[cfg(feature = "window")]
+pub struct PreviewWindow {
+    window: minifb::Window,
+    buffer: Vec<u32>,
+    width: usize,
+    height: usize,
+    last_redraw: Option<std::time::Instant>,
+    last_mouse: Option<(f32, f32)>,
+}
+
+#[cfg(feature = "window")]
+impl PreviewWindow {
+    pub fn open(width: u32, height: u32) -> Result<Self> {
+        use minifb::{ScaleMode, Window, WindowOptions};
+
+        let width = width as usize;
+        let height = height as usize;
+        let window = Window::new(
+            "raytracing",
+            width,
+            height,
+            WindowOptions {
+                resize: true,
+                scale_mode: ScaleMode::AspectRatioStretch,
+                ..WindowOptions::default()
+            },
+        )?;
+        Ok(PreviewWindow {
+            window,
+            buffer: vec![0; width * height],
+            width,
+            height,
+            last_redraw: None,
+            last_mouse: None,
+        })
+    }
+
+    // Shows the frame and returns the key pressed since the last update, if
+    // any. Redraws are limited to 30 per second since converting large images
+    // takes time.
+    pub fn update(
+        &mut self,
+        frame: &Frame,
+        display: &DisplayParams,
+    ) -> Result<Option<WindowAction>> {
+        use minifb::{Key, KeyRepeat};
+        use std::time::{Duration, Instant};
+
+        let redraw = self
+            .last_redraw
+            .map_or(true, |t| t.elapsed() >= Duration::from_millis(33));
+        if redraw {
+            let mut rgb = Vec::with_capacity(self.buffer.len() * 3);
+            frame.write_rgb(display, &mut rgb)?;
+            for (pixel, c) in self.buffer.iter_mut().zip(rgb.chunks_exact(3)) {
+                *pixel = (c[0] as u32) << 16 | (c[1] as u32) << 8 | c[2] as u32;
+            }
+            self.window
+                .update_with_buffer(&self.buffer, self.width, self.height)?;
+            self.last_redraw = Some(Instant::now());
+        } else {
+            self.window.update();
+        }
+
+        if !self.window.is_open() || self.window.is_key_pressed(Key::Escape, KeyRepeat::No) {
+            return Ok(Some(WindowAction::Abort));
+        }
+        if self.window.is_key_pressed(Key::P, KeyRepeat::No) {
+            return Ok(Some(WindowAction::Snapshot));
+        }
+        Ok(None)
+    }
+
+    // Reads input as of the last update.
+    pub fn motion(&mut self) -> Motion {
+        use minifb::{Key, MouseButton, MouseMode};
+
+        let axis = |plus: Key, minus: Key| {
+            self.window.is_key_down(plus) as i32 as f64
+                - self.window.is_key_down(minus) as i32 as f64
+        };
+        let mut motion = Motion {
+            forward: axis(Key::W, Key::S),
+            right: axis(Key::D, Key::A),
+            up: axis(Key::E, Key::Q),
+            turn_right: axis(Key::Right, Key::Left),
+            turn_up: axis(Key::Up, Key::Down),
+            ..Motion::default()
+        };
+        let mouse = if self.window.get_mouse_down(MouseButton::Left) {
+            self.window.get_mouse_pos(MouseMode::Pass)
+        } else {
+            None
+        };
+        if let (Some((x, y)), Some((last_x, last_y))) = (mouse, self.last_mouse) {
+            motion.drag_x = (x - last_x) as f64;
+            motion.drag_y = (y - last_y) as f64;
+        }
+        self.last_mouse = mouse;
+        motion
+    }
+}
+
+#[cfg(not(feature = "window"))]
+pub struct PreviewWindow;
+
+#[cfg(not(feature = "window"))]
+impl PreviewWindow {
+    pub fn open(_width: u32, _height: u32) -> Result<Self> {
+        anyhow::bail!("Preview window is not available; build with --features=window")
+    }
+
+    pub fn update(
+        &mut self,
+        _frame: &Frame,
+        _display: &DisplayParams,
+    ) -> Result<Option<WindowAction>> {
+        Ok(None)
+    }
+
+    pub fn motion(&mut self) -> Motion {
+        Motion::default()
+    }
+}